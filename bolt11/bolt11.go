@@ -0,0 +1,189 @@
+// Package bolt11 decodes the parts of a BOLT11 lightning invoice needed to
+// validate notifications: the amount, creation timestamp and expiry.
+package bolt11
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+	checksumLength  = 6
+	signatureLength = 104
+	timestampLength = 7
+
+	expiryField   = 6
+	defaultExpiry = time.Hour
+)
+
+var (
+	ErrInvalidInvoice = errors.New("invalid bolt11 invoice")
+)
+
+type Invoice struct {
+	// AmountMsat is nil for invoices without an amount.
+	AmountMsat *uint64
+	Timestamp  time.Time
+	Expiry     time.Duration
+}
+
+// ExpiresAt returns the time after which the invoice can't be paid.
+func (i *Invoice) ExpiresAt() time.Time {
+	return i.Timestamp.Add(i.Expiry)
+}
+
+// Decode parses a BOLT11 invoice, verifying its bech32 checksum. The
+// signature is not verified.
+func Decode(invoice string) (*Invoice, error) {
+	hrp, data, err := decodeBech32(strings.TrimPrefix(strings.ToLower(invoice), "lightning:"))
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(hrp, "ln") {
+		return nil, fmt.Errorf("%w: unexpected prefix %v", ErrInvalidInvoice, hrp)
+	}
+	if len(data) < timestampLength+signatureLength {
+		return nil, fmt.Errorf("%w: too short", ErrInvalidInvoice)
+	}
+
+	amount, err := parseAmount(hrp[2:])
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Invoice{
+		AmountMsat: amount,
+		Timestamp:  time.Unix(int64(toUint(data[:timestampLength])), 0),
+		Expiry:     defaultExpiry,
+	}
+
+	fields := data[timestampLength : len(data)-signatureLength]
+	for len(fields) >= 3 {
+		fieldType := fields[0]
+		length := int(fields[1])*32 + int(fields[2])
+		if len(fields) < 3+length {
+			return nil, fmt.Errorf("%w: truncated field", ErrInvalidInvoice)
+		}
+		if fieldType == expiryField {
+			result.Expiry = time.Duration(toUint(fields[3:3+length])) * time.Second
+		}
+		fields = fields[3+length:]
+	}
+
+	return result, nil
+}
+
+// parseAmount parses the amount of the human readable part, following the
+// currency prefix, into millisatoshis.
+func parseAmount(hrp string) (*uint64, error) {
+	start := strings.IndexAny(hrp, "0123456789")
+	if start < 0 {
+		return nil, nil
+	}
+	amount := hrp[start:]
+
+	multiplier := amount[len(amount)-1]
+	digits := amount
+	if multiplier >= '0' && multiplier <= '9' {
+		multiplier = 0
+	} else {
+		digits = amount[:len(amount)-1]
+	}
+
+	value, err := strconv.ParseUint(digits, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid amount %v", ErrInvalidInvoice, amount)
+	}
+
+	var msatPerUnit uint64
+	switch multiplier {
+	case 0:
+		msatPerUnit = 100_000_000_000
+	case 'm':
+		msatPerUnit = 100_000_000
+	case 'u':
+		msatPerUnit = 100_000
+	case 'n':
+		msatPerUnit = 100
+	case 'p':
+		if value%10 != 0 {
+			return nil, fmt.Errorf("%w: sub millisatoshi amount %v", ErrInvalidInvoice, amount)
+		}
+		msat := value / 10
+		return &msat, nil
+	default:
+		return nil, fmt.Errorf("%w: invalid amount multiplier %v", ErrInvalidInvoice, amount)
+	}
+	// A wrapped amount could match the one expected by the caller.
+	if value > math.MaxUint64/msatPerUnit {
+		return nil, fmt.Errorf("%w: amount %v overflows", ErrInvalidInvoice, amount)
+	}
+	msat := value * msatPerUnit
+	return &msat, nil
+}
+
+// decodeBech32 returns the human readable part and the 5 bit groups of the
+// data part, without the checksum.
+func decodeBech32(s string) (string, []byte, error) {
+	separator := strings.LastIndexByte(s, '1')
+	if separator < 1 || separator+checksumLength+1 > len(s) {
+		return "", nil, fmt.Errorf("%w: invalid bech32 string", ErrInvalidInvoice)
+	}
+
+	hrp := s[:separator]
+	data := make([]byte, 0, len(s)-separator-1)
+	for _, c := range s[separator+1:] {
+		value := strings.IndexRune(charset, c)
+		if value < 0 {
+			return "", nil, fmt.Errorf("%w: invalid bech32 character %q", ErrInvalidInvoice, c)
+		}
+		data = append(data, byte(value))
+	}
+
+	if polymod(append(expandHRP(hrp), data...)) != 1 {
+		return "", nil, fmt.Errorf("%w: invalid checksum", ErrInvalidInvoice)
+	}
+	return hrp, data[:len(data)-checksumLength], nil
+}
+
+func expandHRP(hrp string) []byte {
+	expanded := make([]byte, 0, len(hrp)*2+1)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]>>5)
+	}
+	expanded = append(expanded, 0)
+	for i := 0; i < len(hrp); i++ {
+		expanded = append(expanded, hrp[i]&31)
+	}
+	return expanded
+}
+
+func polymod(values []byte) uint32 {
+	generator := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (top>>i)&1 == 1 {
+				chk ^= generator[i]
+			}
+		}
+	}
+	return chk
+}
+
+// toUint reads 5 bit groups as a big endian number.
+func toUint(groups []byte) uint64 {
+	var value uint64
+	for _, g := range groups {
+		value = value<<5 | uint64(g)
+	}
+	return value
+}
@@ -0,0 +1,44 @@
+package bolt11
+
+import (
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+)
+
+func TestDecodeWithAmountAndExpiry(t *testing.T) {
+	invoice, err := Decode("lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rh")
+	assert.NilError(t, err)
+	assert.Equal(t, *invoice.AmountMsat, uint64(250_000_000))
+	assert.Equal(t, invoice.Timestamp, time.Unix(1496314658, 0))
+	assert.Equal(t, invoice.Expiry, time.Minute)
+}
+
+func TestDecodeWithoutAmount(t *testing.T) {
+	invoice, err := Decode("lnbc1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdpl2pkx2ctnv5sxxmmwwd5kgetjypeh2ursdae8g6twvus8g6rfwvs8qun0dfjkxaq9qrsgq357wnc5r2ueh7ck6q93dj32dlqnls087fxdwk8qakdyafkq3yap9us6v52vjjsrvywa6rt52cm9r9zqt8r2t7mlcwspyetp5h2tztugp9lfyql")
+	assert.NilError(t, err)
+	assert.Assert(t, invoice.AmountMsat == nil)
+	assert.Equal(t, invoice.Expiry, time.Hour)
+}
+
+func TestDecodeInvalidChecksum(t *testing.T) {
+	_, err := Decode("lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rq")
+	assert.ErrorIs(t, err, ErrInvalidInvoice)
+}
+
+func TestParseAmountOverflow(t *testing.T) {
+	amount, err := parseAmount("bc2500u")
+	assert.NilError(t, err)
+	assert.Equal(t, *amount, uint64(250_000_000))
+
+	// 4611686018429887904 * 100 wraps to 250_000_000 msat.
+	_, err = parseAmount("bc4611686018429887904n")
+	assert.ErrorIs(t, err, ErrInvalidInvoice)
+	_, err = parseAmount("bc184467441")
+	assert.ErrorIs(t, err, ErrInvalidInvoice)
+
+	amount, err = parseAmount("bc184467440")
+	assert.NilError(t, err)
+	assert.Equal(t, *amount, uint64(18_446_744_000_000_000_000))
+}
@@ -2,26 +2,40 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
-	firebase "firebase.google.com/go"
-	"github.com/Netflix/go-env"
 	"github.com/joho/godotenv"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/option"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/exp/slog"
 
 	"github.com/breez/notify/breezsdk"
 	"github.com/breez/notify/channel"
 	"github.com/breez/notify/config"
+	"github.com/breez/notify/grpc"
 	"github.com/breez/notify/http"
+	"github.com/breez/notify/notify"
+	"github.com/breez/notify/tracing"
 )
 
+// version is set at build time with -ldflags "-X main.version=<version>".
+var version = "dev"
+
 func main() {
 	var err error
-	var firebaseApp *firebase.App
 	ctx := context.Background()
 
+	profile := flag.String("profile", os.Getenv("NOTIFY_PROFILE"), "name of the config profile to load")
+	profilesFile := flag.String("profiles-file", "profiles.json", "json file holding the config profiles")
+	configFile := flag.String("config-file", os.Getenv("NOTIFY_CONFIG_FILE"), "env file overriding the environment, read again on SIGHUP")
+	flag.Parse()
+
 	environment := os.Getenv("NOTIFIER_ENV")
 	// Read environment variables from breezsdk/cmd/config.env (if the file is available) on Dev environment.
 	if environment == "development" {
@@ -30,45 +44,170 @@ func main() {
 		}
 	}
 
-	var config config.Config
-	if _, err = env.UnmarshalFromEnviron(&config); err != nil {
+	// Profile values only fill in variables that are not already set, so the environment can still override them.
+	if *profile != "" {
+		if err = config.ApplyProfile(*profilesFile, *profile); err != nil {
+			log.Fatalf("failed to load config profile %v", err)
+		}
+	}
+
+	loaded, err := config.Load(*configFile)
+	if err != nil {
 		log.Fatalf("failed to load config %v", err)
 	}
+	config := *loaded
+
+	// The logs of the log package and of the services go through the default logger too.
+	logger := newLogger(&config)
+	slog.SetDefault(logger)
 
-	if err = config.Validate(); err != nil {
-		log.Fatalf("failed to validate config %v", err)
+	shutdownTracing, err := tracing.Setup(ctx, &config.TracingConfig, version)
+	if err != nil {
+		log.Fatalf("failed to set up tracing %v", err)
 	}
 
-	if _, f := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS_JSON"); f {
-		creds, err := google.CredentialsFromJSON(context.Background(), []byte(os.Getenv("GOOGLE_APPLICATION_CREDENTIALS_JSON")), "https://www.googleapis.com/auth/firebase.messaging")
+	// Each app is delivered through its own firebase project, none being needed when notifications are captured by the sink.
+	userAgent := fmt.Sprintf("%s/%s", config.UserAgent, version)
+	notifier, err := breezsdk.NewNotifierFromConfig(ctx, &config, userAgent)
+	if err != nil {
+		log.Fatalf("failed to create breezsdk notifier %v", err)
+	}
+	if config.DeviceRegistry && config.DeviceStoreFile != "" {
+		devices, err := notify.NewFileDeviceStore(config.DeviceStoreFile)
 		if err != nil {
-			log.Fatalf("failed to get google credentials %v", err)
+			log.Fatalf("failed to open device store %v", err)
 		}
-		firebaseApp, err = firebase.NewApp(context.Background(), nil, option.WithCredentials(creds))
+		notifier.UseDeviceStore(devices)
+	}
+	// The encryption keys outlive the instance, the notifications of a target having one are never sent in clear.
+	if config.EncryptionKeyRegistry && config.DeliveryQueueRedisURL == "" {
+		keys, err := notify.NewFileEncryptionKeys(config.EncryptionKeyFile)
+		if err != nil {
+			log.Fatalf("failed to open encryption keys %v", err)
+		}
+		notifier.UseEncryptionKeyRegistry(keys)
+	}
+	// The webhook exposes no metrics endpoint without a registry.
+	var registry *prometheus.Registry
+	if config.Metrics {
+		registry = prometheus.NewRegistry()
+		registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+		notifier.UseMetrics(notify.NewMetrics(registry))
+	}
+	notifier.UseLogger(logger)
+	// Failed notifications are retried until the service stops, and after it restarts.
+	serveCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if config.RetryQueueDir != "" {
+		retryStore, err := notify.NewBoltRetryStore(config.RetryQueueDir)
+		if err != nil {
+			log.Fatalf("failed to open retry queue %v", err)
+		}
+		defer retryStore.Close()
+		notifier.UseRetryQueue(retryStore)
+		go notifier.RunRetryQueue(serveCtx, config.RetryQueueInterval)
+	}
+	// The notifications nobody waits for are delivered by the workers of any instance sharing the delivery queue.
+	if config.DeliveryQueueRedisURL != "" {
+		options, err := redis.ParseURL(config.DeliveryQueueRedisURL)
 		if err != nil {
-			log.Fatalf("failed to create firebase application %v", err)
+			log.Fatalf("invalid delivery queue redis url %v", err)
 		}
-	} else {
-		projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
-		firebaseApp, err = firebase.NewApp(ctx, &firebase.Config{ProjectID: projectID})
+		client := redis.NewClient(options)
+		defer client.Close()
+		notifier.UseDeliveryQueue(notify.NewRedisDeliveryQueue(client, config.DeliveryQueueKey, config.DeliveryQueueVisibility))
+		// The instances delivering the notifications share the encryption keys of the targets.
+		if config.EncryptionKeyRegistry {
+			notifier.UseEncryptionKeyRegistry(notify.NewRedisEncryptionKeys(client, config.EncryptionKeyRedisKey))
+		}
+		go notifier.RunDeliveryQueue(serveCtx)
+	}
+	// Scheduled and held back notifications are kept in the schedule directory, and sent once due after a restart too.
+	if config.HoldsNotifications() {
+		schedule, err := notify.NewFileScheduleStore(config.ScheduleDir)
 		if err != nil {
-			log.Fatalf("failed to create firebase application %v", err)
+			log.Fatalf("failed to open schedule %v", err)
 		}
+		notifier.UseScheduleStore(schedule)
+		go notifier.RunScheduler(serveCtx, config.ScheduleInterval)
+	}
+	// The providers are checked at startup and periodically, a misconfigured credential failing the readiness probe.
+	go notifier.RunProviderChecks(serveCtx)
+	callbackChannel := channel.NewHttpCallbackChannel(config.ExternalURL)
+	callbackChannel.SetCallbackTimeout(config.CallbackTimeout)
+	if len(config.HTTPConfig.RelayReplyTemplates) > 0 {
+		callbackChannel.UseReplyClient(channel.NewHTTPReplyClient(config.ReplyTimeout))
+	}
+	// The senders are told about the tokens the providers unregistered, to clean up their stores.
+	if config.TokenInvalidatedURL != "" {
+		notifier.OnTokenInvalidated(channel.TokenInvalidationHook(config.TokenInvalidatedURL, channel.NewHTTPReplyClient(config.ReplyTimeout), notifier.Logger))
 	}
 
-	fcmMessaging, err := firebaseApp.Messaging(ctx)
-	if err != nil {
-		log.Fatalf("failed to create firebase messaging %v", err)
+	// The gRPC service runs along with the webhook, until the same signal.
+	if config.GRPCConfig.Address != "" {
+		logger.Info("starting grpc server", "address", config.GRPCConfig.Address)
+		go func() {
+			if err := grpc.Run(serveCtx, notifier, callbackChannel, &config); err != nil {
+				logger.Error("grpc server has exited with error", "error", err)
+			}
+		}()
 	}
-	notifier, err := breezsdk.NewNotifier(&config, fcmMessaging)
-	if err != nil {
-		log.Fatalf("failed to create breezsdk notifier %v", err)
+
+	logger.Info("initialization successful, starting web server", "address", config.HTTPConfig.Address)
+
+	// The server drains the in-flight requests once a termination signal is received.
+	handler := http.NewHandler(notifier, callbackChannel, &config.HTTPConfig, registry)
+	go reloadOnHangup(serveCtx, *configFile, notifier, handler)
+	if err = http.Run(serveCtx, handler, &config.HTTPConfig); err != nil {
+		logger.Error("web server has exited with error", "error", err)
 	}
-	channel := channel.NewHttpCallbackChannel(config.ExternalURL)
 
-	log.Printf("Initialization successful. Starting web server on %s", config.HTTPConfig.Address)
+	drainCtx, cancel := context.WithTimeout(ctx, config.HTTPConfig.DrainTimeout)
+	defer cancel()
+	if err = notifier.Shutdown(drainCtx); err != nil {
+		logger.Error("failed to deliver the queued notifications", "error", err)
+	}
+	// The spans of the last deliveries are flushed once they are done.
+	if err = shutdownTracing(drainCtx); err != nil {
+		logger.Error("failed to export the remaining spans", "error", err)
+	}
+}
+
+// reloadOnHangup reloads the config on SIGHUP until ctx is done, applying its
+// log level, message templates and webhook routes, with their secrets, filters
+// and rate limits. The listeners and the provider clients keep running with
+// the config they were started with, and an invalid config is not applied.
+func reloadOnHangup(ctx context.Context, configFile string, notifier *notify.Notifier, handler *http.Handler) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-hangup:
+		case <-ctx.Done():
+			return
+		}
+		reloaded, err := config.Load(configFile)
+		if err != nil {
+			slog.Error("failed to reload config, keeping the current one", "error", err)
+			continue
+		}
+		logLevel.Set(slog.Level(reloaded.LogLevel))
+		notifier.ReloadMessageTemplates(reloaded.MessageTemplates)
+		handler.Reload(&reloaded.HTTPConfig)
+		slog.Info("config reloaded")
+	}
+}
+
+// logLevel is the level of the logger, changed when the config is reloaded.
+var logLevel = new(slog.LevelVar)
 
-	if err = http.Run(notifier, channel, &config.HTTPConfig); err != nil {
-		log.Printf("web server has exited with error: %v", err)
+// newLogger returns the logger of the configured level and format.
+func newLogger(config *config.Config) *slog.Logger {
+	logLevel.Set(slog.Level(config.LogLevel))
+	options := slog.HandlerOptions{Level: logLevel}
+	if config.LogFormat == "text" {
+		return slog.New(options.NewTextHandler(os.Stderr))
 	}
+	return slog.New(options.NewJSONHandler(os.Stderr))
 }
@@ -0,0 +1,273 @@
+// Command notifycli validates the config of the notifier, sends test
+// notifications with it and replays saved webhook bodies against a running
+// instance.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/breez/notify/breezsdk"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+)
+
+const usage = `usage: notifycli <command> [flags]
+
+commands:
+  validate  validate the config, and the provider credentials with -providers
+  send      send a test notification of a template to a token
+  replay    post a saved webhook body to a running instance
+
+Run notifycli <command> -h for the flags of a command.
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	var err error
+	switch os.Args[1] {
+	case "validate":
+		err = validate(os.Args[2:])
+	case "send":
+		err = send(os.Args[2:])
+	case "replay":
+		err = replay(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// configFlags are the flags selecting the config, like those of the service.
+type configFlags struct {
+	configFile   *string
+	profile      *string
+	profilesFile *string
+}
+
+func addConfigFlags(flags *flag.FlagSet) *configFlags {
+	return &configFlags{
+		configFile:   flags.String("config-file", os.Getenv("NOTIFY_CONFIG_FILE"), "env file overriding the environment"),
+		profile:      flags.String("profile", os.Getenv("NOTIFY_PROFILE"), "name of the config profile to load"),
+		profilesFile: flags.String("profiles-file", "profiles.json", "json file holding the config profiles"),
+	}
+}
+
+// load loads the config the way the service does.
+func (f *configFlags) load() (*config.Config, error) {
+	if *f.profile != "" {
+		if err := config.ApplyProfile(*f.profilesFile, *f.profile); err != nil {
+			return nil, err
+		}
+	}
+	return config.Load(*f.configFile)
+}
+
+// validate loads the config, and checks the credentials and the connectivity
+// of the providers of every platform when asked to.
+func validate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	providers := flags.Bool("providers", false, "check the credentials and the connectivity of the push providers")
+	flags.Parse(args)
+
+	c, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+	fmt.Println("config is valid")
+	if !*providers {
+		return nil
+	}
+
+	ctx := context.Background()
+	notifier, err := breezsdk.NewNotifierFromConfig(ctx, c, c.UserAgent+"/notifycli")
+	if err != nil {
+		return err
+	}
+	failures := notifier.CheckProviders(ctx)
+	if len(failures) == 0 {
+		fmt.Println("providers are reachable")
+		return nil
+	}
+	platforms := make([]string, 0, len(failures))
+	for platform := range failures {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	for _, platform := range platforms {
+		fmt.Printf("%v: %v\n", platform, failures[platform])
+	}
+	return fmt.Errorf("%v providers failed their check", len(failures))
+}
+
+// send sends a notification of the template directly through the services of
+// the config, waiting for its delivery.
+func send(args []string) error {
+	flags := flag.NewFlagSet("send", flag.ExitOnError)
+	configFlags := addConfigFlags(flags)
+	platform := flags.String("platform", "android", "platform of the token, e.g. android or ios")
+	token := flags.String("token", "", "token of the device to notify")
+	app := flags.String("app", "", "app of the token, the default one when empty")
+	template := flags.String("template", notify.NOTIFICATION_PAYMENT_RECEIVED, "template of the notification")
+	message := flags.String("message", "Test notification", "display message of the notification")
+	data := flags.String("data", "{}", "json data of the notification")
+	timeout := flags.Duration("timeout", 30*time.Second, "time to wait for the delivery")
+	flags.Parse(args)
+
+	if *token == "" {
+		return fmt.Errorf("-token is required")
+	}
+	var notificationData map[string]interface{}
+	if err := json.Unmarshal([]byte(*data), &notificationData); err != nil {
+		return fmt.Errorf("invalid -data: %w", err)
+	}
+	c, err := configFlags.load()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	notifier, err := breezsdk.NewNotifierFromConfig(ctx, c, c.UserAgent+"/notifycli")
+	if err != nil {
+		return err
+	}
+	defer notifier.Shutdown(ctx)
+	result, err := notifier.NotifyAndWait(ctx, &notify.Notification{
+		Template:         *template,
+		DisplayMessage:   *message,
+		Type:             *platform,
+		TargetIdentifier: *token,
+		App:              *app,
+		Data:             notificationData,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to send notification, reason: %v: %w", notify.Reason(err), err)
+	}
+	if result.Deferred {
+		fmt.Printf("deferred by %v\n", result.Platform)
+		return nil
+	}
+	fmt.Printf("sent through %v\n", result.Platform)
+	if result.MessageID != "" {
+		fmt.Printf("message id: %v\n", result.MessageID)
+	}
+	if result.MigratedToken != "" {
+		fmt.Printf("the token was replaced by %v\n", result.MigratedToken)
+	}
+	return nil
+}
+
+// Headers of the replay protection of the webhook.
+const (
+	timestampHeader = "X-Notify-Timestamp"
+	nonceHeader     = "X-Notify-Nonce"
+)
+
+// replay posts a saved webhook body to the notify endpoint of a running
+// instance, printing its response. The body is signed like a swap provider
+// would, and carries a fresh timestamp and nonce, when asked to.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	address := flags.String("url", "http://localhost:8080/api/v1/notify", "url of the webhook endpoint")
+	bodyFile := flags.String("body", "", "file holding the webhook body, - for the standard input")
+	platform := flags.String("platform", "android", "platform of the token")
+	token := flags.String("token", "", "token of the device to notify")
+	app := flags.String("app", "", "app of the token, the default one when empty")
+	secret := flags.String("secret", os.Getenv("NOTIFY_HTTP_WEBHOOK_SECRET"), "bearer token of the webhook")
+	signSecret := flags.String("sign-secret", "", "secret of the signature provider to sign the body with")
+	signHeader := flags.String("sign-header", "X-Hook-Signature", "header of the signature of the provider")
+	signTimestamp := flags.Bool("sign-timestamp", false, "sign <timestamp>.<nonce>.<body> like a provider with signs_timestamp, implies -fresh")
+	fresh := flags.Bool("fresh", false, "set a fresh X-Notify-Timestamp and X-Notify-Nonce for the replay protection")
+	timeout := flags.Duration("timeout", 30*time.Second, "time to wait for the response")
+	flags.Parse(args)
+
+	if *bodyFile == "" || *token == "" {
+		return fmt.Errorf("-body and -token are required")
+	}
+	var body []byte
+	var err error
+	if *bodyFile == "-" {
+		body, err = io.ReadAll(os.Stdin)
+	} else {
+		body, err = os.ReadFile(*bodyFile)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read body %w", err)
+	}
+
+	endpoint, err := url.Parse(*address)
+	if err != nil {
+		return fmt.Errorf("invalid -url: %w", err)
+	}
+	query := endpoint.Query()
+	query.Set("platform", *platform)
+	query.Set("token", *token)
+	if *app != "" {
+		query.Set("app", *app)
+	}
+	endpoint.RawQuery = query.Encode()
+
+	request, err := http.NewRequest(http.MethodPost, endpoint.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if *secret != "" {
+		request.Header.Set("Authorization", "Bearer "+*secret)
+	}
+	if *fresh || *signTimestamp {
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		request.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		request.Header.Set(nonceHeader, hex.EncodeToString(nonce))
+	}
+	if *signSecret != "" {
+		message := body
+		if *signTimestamp {
+			prefix := request.Header.Get(timestampHeader) + "." + request.Header.Get(nonceHeader) + "."
+			message = append([]byte(prefix), body...)
+		}
+		mac := hmac.New(sha256.New, []byte(*signSecret))
+		mac.Write(message)
+		request.Header.Set(*signHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+	res, err := (&http.Client{Timeout: *timeout}).Do(request)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	response, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%v\n%s\n", res.Status, response)
+	if res.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("the webhook responded with %v", res.Status)
+	}
+	return nil
+}
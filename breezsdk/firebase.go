@@ -0,0 +1,116 @@
+package breezsdk
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/messaging"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"github.com/breez/notify/notify/services"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+	htransport "google.golang.org/api/transport/http"
+)
+
+var messagingScopes = []string{
+	"https://www.googleapis.com/auth/cloud-platform",
+	"https://www.googleapis.com/auth/firebase.messaging",
+}
+
+// NewNotifierFromConfig creates the notifier of the config along with the
+// services of its apps, each of them delivering through its own firebase
+// project. No firebase project is created when notifications are captured by
+// the sink. The push requests are sent with the user agent.
+func NewNotifierFromConfig(ctx context.Context, c *config.Config, userAgent string) (*notify.Notifier, error) {
+	var fcmMessaging, secondaryMessaging *messaging.Client
+	if c.Sink == "" {
+		firebaseApp, err := newFirebaseApp(ctx, c.Credentials, "GOOGLE_APPLICATION_CREDENTIALS_JSON", "GOOGLE_CLOUD_PROJECT", c.FCMEndpoint, userAgent)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create firebase application %w", err)
+		}
+		if fcmMessaging, err = firebaseApp.Messaging(ctx); err != nil {
+			return nil, fmt.Errorf("failed to create firebase messaging %w", err)
+		}
+
+		// A secondary firebase project is optional and only used for failover.
+		_, hasSecondaryCreds := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS_JSON_SECONDARY")
+		_, hasSecondaryProject := os.LookupEnv("GOOGLE_CLOUD_PROJECT_SECONDARY")
+		if c.SecondaryCredentials != "" || hasSecondaryCreds || hasSecondaryProject {
+			secondaryApp, err := newFirebaseApp(ctx, c.SecondaryCredentials, "GOOGLE_APPLICATION_CREDENTIALS_JSON_SECONDARY", "GOOGLE_CLOUD_PROJECT_SECONDARY", c.FCMEndpoint, userAgent)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create secondary firebase application %w", err)
+			}
+			if secondaryMessaging, err = secondaryApp.Messaging(ctx); err != nil {
+				return nil, fmt.Errorf("failed to create secondary firebase messaging %w", err)
+			}
+		}
+	}
+
+	notifier, err := NewNotifier(c, fcmMessaging, secondaryMessaging)
+	if err != nil {
+		return nil, err
+	}
+	for name, app := range c.Apps {
+		var appMessaging *messaging.Client
+		if c.Sink == "" {
+			appFirebase, err := newFirebaseApp(ctx, app.Credentials, "", "", c.FCMEndpoint, userAgent)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create firebase application of app %v %w", name, err)
+			}
+			if appMessaging, err = appFirebase.Messaging(ctx); err != nil {
+				return nil, fmt.Errorf("failed to create firebase messaging of app %v %w", name, err)
+			}
+		}
+		appServices, err := NewAppServices(c, app, appMessaging)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the services of app %v %w", name, err)
+		}
+		notifier.UseApp(name, appServices)
+	}
+	return notifier, nil
+}
+
+// newFirebaseApp creates a firebase application from the credentials
+// referenced by credsRef, or the json credentials in credsEnv when set,
+// falling back to the default credentials of the project in projectEnv. Push
+// requests are sent to endpoint with the given user agent.
+func newFirebaseApp(ctx context.Context, credsRef string, credsEnv string, projectEnv string, endpoint string, userAgent string) (*firebase.App, error) {
+	var credsJSON []byte
+	if credsRef != "" {
+		secret, err := config.ResolveSecret(ctx, credsRef)
+		if err != nil {
+			return nil, err
+		}
+		credsJSON = secret
+	} else if value, f := os.LookupEnv(credsEnv); f {
+		credsJSON = []byte(value)
+	}
+
+	var firebaseConfig *firebase.Config
+	opts := []option.ClientOption{option.WithScopes(messagingScopes...), option.WithUserAgent(userAgent)}
+	if credsJSON != nil {
+		creds, err := google.CredentialsFromJSON(ctx, credsJSON, messagingScopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get google credentials %v", err)
+		}
+		opts = append(opts, option.WithCredentials(creds))
+	} else {
+		firebaseConfig = &firebase.Config{ProjectID: os.Getenv(projectEnv)}
+	}
+
+	// The firebase sdk has no endpoint option, so requests are redirected by
+	// the transport of an authenticated client.
+	client, _, err := htransport.NewClient(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create firebase http client %v", err)
+	}
+	transport, err := services.NewEndpointTransport(endpoint, client.Transport)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = transport
+	return firebase.NewApp(ctx, firebaseConfig, append(opts, option.WithHTTPClient(client))...)
+}
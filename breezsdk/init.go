@@ -1,9 +1,13 @@
 package breezsdk
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"strconv"
+	"time"
 
 	"firebase.google.com/go/messaging"
 	"github.com/breez/notify/config"
@@ -11,36 +15,202 @@ import (
 	"github.com/breez/notify/notify/services"
 )
 
-func NewNotifier(c *config.Config, fcmClient *messaging.Client) (*notify.Notifier, error) {
-	fcm := services.NewFCM(createMessageFactory(), fcmClient)
-	return notify.NewNotifier(c, map[string]notify.Service{
+// actionCategory is the iOS notification category the apps register to show
+// the action button of a notification.
+const actionCategory = "NOTIFICATION_ACTION"
+
+// apnsMaxCollapseIDLength is the maximum length in bytes of the apns-collapse-id
+// header.
+const apnsMaxCollapseIDLength = 64
+
+// NewNotifier creates the notifier delivering through fcmClient. When
+// secondaryClient is not nil new sends fail over to it while the primary
+// project is failing. When a sink is configured notifications are captured by
+// the sink instead and the clients are not used.
+func NewNotifier(c *config.Config, fcmClient *messaging.Client, secondaryClient *messaging.Client) (*notify.Notifier, error) {
+	platforms, err := newAppServices(c, c.DefaultApp(), fcmClient, secondaryClient)
+	if err != nil {
+		return nil, err
+	}
+	if c.VAPIDPublicKey != "" {
+		platforms["web"] = services.NewWebPush(c.VAPIDSubscriber, c.VAPIDPublicKey, c.VAPIDPrivateKey)
+	}
+	if c.UnifiedPush {
+		unifiedPush, err := services.NewUnifiedPush(c.UnifiedPushServer, c.UnifiedPushToken)
+		if err != nil {
+			return nil, err
+		}
+		platforms["unifiedpush"] = unifiedPush
+	}
+	return notify.NewNotifier(c, platforms), nil
+}
+
+// NewAppServices creates the services delivering the notifications of an app
+// through its fcm client and apns credentials, to be served with
+// notifier.UseApp. When a sink is configured notifications are captured by
+// the sink instead.
+func NewAppServices(c *config.Config, app config.AppCredentials, fcmClient *messaging.Client) (map[string]notify.Service, error) {
+	return newAppServices(c, app, fcmClient, nil)
+}
+
+func newAppServices(c *config.Config, app config.AppCredentials, fcmClient *messaging.Client, secondaryClient *messaging.Client) (map[string]notify.Service, error) {
+	var fcm notify.Service = services.NewFCM(createMessageFactory(c), fcmClient)
+	if c.Sink != "" {
+		fcm = services.NewSink(c.Sink, services.NewFCM(createMessageFactory(c), nil))
+	} else if secondaryClient != nil {
+		secondary := services.NewFCM(createMessageFactory(c), secondaryClient)
+		fcm = services.NewFailover(fcm, secondary, c.FailoverThreshold, c.FailoverRecovery)
+	}
+	platforms := map[string]notify.Service{
 		"ios":     fcm,
 		"android": fcm,
-	}), nil
+	}
+	if app.APNSKeyFile != "" || app.APNSCertFile != "" {
+		apns, err := newAPNS(c, app)
+		if err != nil {
+			return nil, err
+		}
+		platforms["apns"] = apns
+	}
+	return platforms, nil
 }
 
-func createMessageFactory() services.FCMMessageBuilder {
-	return func(notification *notify.Notification) (*messaging.Message, error) {
+// newAPNS creates the service delivering to APNS directly, with the p8 key
+// when configured and with the certificate otherwise.
+func newAPNS(c *config.Config, app config.AppCredentials) (notify.Service, error) {
+	bundles := services.APNSBundles{Default: app.APNSBundleID, Apps: app.APNSBundles}
+	if app.APNSKeyFile != "" {
+		key, err := os.ReadFile(app.APNSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the apns key: %w", err)
+		}
+		return services.NewAPNSWithKey(createMessageFactory(c), c.APNSEndpoint, bundles, key, app.APNSKeyID, app.APNSTeamID)
+	}
+	cert, err := tls.LoadX509KeyPair(app.APNSCertFile, app.APNSCertKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the apns certificate: %w", err)
+	}
+	return services.NewAPNSWithCertificate(createMessageFactory(c), c.APNSEndpoint, bundles, cert), nil
+}
 
-		switch notification.Template {
-		case notify.NOTIFICATION_PAYMENT_RECEIVED,
-			notify.NOTIFICATION_TX_CONFIRMED,
-			notify.NOTIFICATION_ADDRESS_TXS_CONFIRMED,
-			notify.NOTIFICATION_LNURLPAY_INFO,
-			notify.NOTIFICATION_LNURLPAY_INVOICE,
-			notify.NOTIFICATION_LNURLPAY_VERIFY,
-			notify.NOTIFICATION_SWAP_UPDATED,
-			notify.NOTIFICATION_INVOICE_REQUEST:
-
-			if os.Getenv("IOS_HIGH_PRIORITY") == "true" {
-				return createPush(notification)
-			} else {
-				return createBackgroundPush(notification)
+// createMessageFactory builds the push messages of the templates. With
+// APNSCustomKeys the notification data is also set as top level keys of the
+// APNS payload, for the notification service extension to read.
+func createMessageFactory(c *config.Config) services.FCMMessageBuilder {
+	return func(notification *notify.Notification) (*messaging.Message, error) {
+		message, err := createTemplateMessage(notification)
+		if err != nil || message == nil {
+			return message, err
+		}
+		if c.HighPriorityAmountMsat > 0 && paymentTemplates[notification.Template] {
+			if amount, ok := amountMsat(notification.Data); ok && amount >= c.HighPriorityAmountMsat {
+				elevatePriority(message)
 			}
 		}
+		if c.APNSCustomKeys {
+			if err := setAPNSCustomData(message, notification.Data); err != nil {
+				return nil, err
+			}
+		}
+		return message, nil
+	}
+}
+
+// paymentTemplates are the templates of bitcoin payments whose amount may
+// elevate their priority, the amount of the other templates, e.g. of the
+// liquid assets, being in other units.
+var paymentTemplates = map[string]bool{
+	notify.NOTIFICATION_PAYMENT_RECEIVED: true,
+	notify.NOTIFICATION_TX_CONFIRMED:     true,
+	notify.NOTIFICATION_LNURLPAY_INVOICE: true,
+	notify.NOTIFICATION_INVOICE_REQUEST:  true,
+	notify.NOTIFICATION_SWAP_UPDATED:     true,
+	notify.NOTIFICATION_SWAP_REFUNDED:    true,
+	notify.NOTIFICATION_PEGIN_CONFIRMED:  true,
+	notify.NOTIFICATION_PEGOUT_CONFIRMED: true,
+}
+
+// amountMsat reads the amount of a payment from the notification data, either
+// amount_msat, amount in millisatoshi as in lnurl-pay, or amount_sat.
+func amountMsat(data map[string]interface{}) (uint64, bool) {
+	fields := []struct {
+		key        string
+		multiplier uint64
+	}{{"amount_msat", 1}, {"amount", 1}, {"amount_sat", 1000}}
+	for _, field := range fields {
+		value, ok := data[field.key]
+		if !ok {
+			continue
+		}
+		switch amount := value.(type) {
+		case uint64:
+			return amount * field.multiplier, true
+		case int:
+			return uint64(amount) * field.multiplier, amount >= 0
+		case float64:
+			return uint64(amount) * field.multiplier, amount >= 0
+		}
+	}
+	return 0, false
+}
+
+// elevatePriority lets a visible notification break through the focus modes
+// of iOS. The apps read the same hint from the data on Android.
+func elevatePriority(message *messaging.Message) {
+	aps := message.APNS.Payload.Aps
+	if aps.Alert == nil {
+		return
+	}
+	if aps.CustomData == nil {
+		aps.CustomData = make(map[string]interface{})
+	}
+	aps.CustomData["interruption-level"] = "time-sensitive"
+	message.Data["interruption_level"] = "time-sensitive"
+}
+
+func createTemplateMessage(notification *notify.Notification) (*messaging.Message, error) {
+	switch notification.Template {
+	case notify.NOTIFICATION_PAYMENT_RECEIVED,
+		notify.NOTIFICATION_TX_CONFIRMED,
+		notify.NOTIFICATION_ADDRESS_TXS_CONFIRMED,
+		notify.NOTIFICATION_LNURLPAY_INFO,
+		notify.NOTIFICATION_LNURLPAY_INVOICE,
+		notify.NOTIFICATION_LNURLPAY_VERIFY,
+		notify.NOTIFICATION_LNURL_WITHDRAW,
+		notify.NOTIFICATION_SWAP_UPDATED,
+		notify.NOTIFICATION_SWAP_REFUNDED,
+		notify.NOTIFICATION_INVOICE_REQUEST,
+		notify.NOTIFICATION_DAILY_SUMMARY,
+		notify.NOTIFICATION_LIQUID_ASSET_RECEIVED,
+		notify.NOTIFICATION_PEGIN_CONFIRMED,
+		notify.NOTIFICATION_PEGOUT_CONFIRMED,
+		notify.NOTIFICATION_BOLT12_OFFER_INVOICE_REQUEST:
 
-		return nil, nil
+		silent := os.Getenv("IOS_HIGH_PRIORITY") != "true"
+		if notification.Silent != nil {
+			silent = *notification.Silent
+		}
+		if silent {
+			return createBackgroundPush(notification)
+		}
+		return createPush(notification)
+	}
+
+	return nil, nil
+}
+
+// setAPNSCustomData sets the data as custom keys of the APNS payload, next to
+// the reserved aps dictionary.
+func setAPNSCustomData(message *messaging.Message, data map[string]interface{}) error {
+	if _, ok := data["aps"]; ok {
+		return errors.New("notification data key aps is reserved by APNS")
 	}
+	customData := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		customData[key] = value
+	}
+	message.APNS.Payload.CustomData = customData
+	return nil
 }
 
 func createPush(notification *notify.Notification) (*messaging.Message, error) {
@@ -50,13 +220,28 @@ func createPush(notification *notify.Notification) (*messaging.Message, error) {
 	if notification.AppData != nil {
 		data["app_data"] = *notification.AppData
 	}
+	category := notification.Category
+	if notification.Action != nil {
+		data["action_label"] = notification.Action.Label
+		data["action_link"] = notification.Action.Link
+		if category == "" {
+			category = actionCategory
+		}
+	}
+	if notification.Body != "" {
+		data["body"] = notification.Body
+	}
+	// Android has no categories, the app picks the action set from the data.
+	if category != "" {
+		data["category"] = category
+	}
 	payload, err := json.Marshal(notification.Data)
 	if err != nil {
 		return nil, fmt.Errorf("failed to marshal notification data %v", err)
 	}
 	data["notification_payload"] = string(payload)
 
-	return &messaging.Message{
+	message := &messaging.Message{
 		Token: notification.TargetIdentifier,
 		Data:  data,
 		Android: &messaging.AndroidConfig{
@@ -70,13 +255,19 @@ func createPush(notification *notify.Notification) (*messaging.Message, error) {
 				Aps: &messaging.Aps{
 					Alert: &messaging.ApsAlert{
 						Title: notification.DisplayMessage,
+						Body:  notification.Body,
 					},
 					ContentAvailable: false,
-					MutableContent:   true,
+					MutableContent:   notification.Encrypted || notification.Capabilities.Supports(notify.CapabilityRichMedia),
+					Category:         category,
 				},
 			},
 		},
-	}, nil
+	}
+	setExpiry(message, notification.TTL)
+	setPriority(message, notification.Priority)
+	setCollapseKey(message, notification.CollapseKey)
+	return message, nil
 }
 
 func createBackgroundPush(notification *notify.Notification) (*messaging.Message, error) {
@@ -91,7 +282,7 @@ func createBackgroundPush(notification *notify.Notification) (*messaging.Message
 	}
 	data["notification_payload"] = string(payload)
 
-	return &messaging.Message{
+	message := &messaging.Message{
 		Token: notification.TargetIdentifier,
 		Data:  data,
 		Android: &messaging.AndroidConfig{
@@ -108,5 +299,40 @@ func createBackgroundPush(notification *notify.Notification) (*messaging.Message
 				},
 			},
 		},
-	}, nil
+	}
+	setExpiry(message, notification.TTL)
+	setPriority(message, notification.Priority)
+	setCollapseKey(message, notification.CollapseKey)
+	return message, nil
+}
+
+// setPriority lowers the priority of the normal priority notifications, so the
+// devices can batch their delivery. Background pushes always have the normal
+// APNS priority.
+func setPriority(message *messaging.Message, priority string) {
+	if priority != notify.PriorityNormal {
+		return
+	}
+	message.Android.Priority = "normal"
+	message.APNS.Headers["apns-priority"] = "5"
+}
+
+// setCollapseKey lets the providers replace the undelivered notifications
+// having the same collapse key. APNS ignores the keys longer than 64 bytes.
+func setCollapseKey(message *messaging.Message, collapseKey string) {
+	if collapseKey == "" {
+		return
+	}
+	message.Android.CollapseKey = collapseKey
+	if len(collapseKey) <= apnsMaxCollapseIDLength {
+		message.APNS.Headers["apns-collapse-id"] = collapseKey
+	}
+}
+
+func setExpiry(message *messaging.Message, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	message.Android.TTL = &ttl
+	message.APNS.Headers["apns-expiration"] = strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
 }
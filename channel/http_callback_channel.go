@@ -5,17 +5,24 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
-	"net/http"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/breez/notify/notify"
-	"github.com/google/martian/v3/log"
 )
 
 const (
-	callbackTimeout = 60 * time.Second
+	defaultCallbackTimeout = 60 * time.Second
+)
+
+var (
+	// ErrCallbackTimeout is returned when the app doesn't reply within the
+	// callback timeout.
+	ErrCallbackTimeout = errors.New("timeout")
+	// ErrReplyRelayFailed is returned when the reply of the app could not be
+	// posted to the reply url of the sender.
+	ErrReplyRelayFailed = errors.New("failed to relay the reply")
 )
 
 type PendingRequest struct {
@@ -25,7 +32,9 @@ type PendingRequest struct {
 
 type HttpCallbackChannel struct {
 	sync.Mutex
-	httpClient      *http.Client
+	// replyClient is nil when the replies are not relayed to the senders.
+	replyClient     ReplyClient
+	callbackTimeout time.Duration
 	callbackBaseURL string
 	random          *rand.Rand
 	pendingRequests map[uint64]*PendingRequest
@@ -33,7 +42,7 @@ type HttpCallbackChannel struct {
 
 func NewHttpCallbackChannel(callbackBaseURL string) *HttpCallbackChannel {
 	channel := &HttpCallbackChannel{
-		httpClient:      http.DefaultClient,
+		callbackTimeout: defaultCallbackTimeout,
 		callbackBaseURL: strings.TrimRight(callbackBaseURL, "/"),
 		random:          rand.New(rand.NewSource(time.Now().UnixNano())),
 		pendingRequests: make(map[uint64]*PendingRequest),
@@ -42,44 +51,121 @@ func NewHttpCallbackChannel(callbackBaseURL string) *HttpCallbackChannel {
 	return channel
 }
 
+// UseReplyClient relays the replies of the apps to the reply_url of the
+// requests with the client, besides returning them. It must be set before
+// sending notifications.
+func (p *HttpCallbackChannel) UseReplyClient(client ReplyClient) {
+	p.replyClient = client
+}
+
+// SetCallbackTimeout sets how long the apps have to reply. It must be set
+// before sending notifications.
+func (p *HttpCallbackChannel) SetCallbackTimeout(timeout time.Duration) {
+	p.callbackTimeout = timeout
+}
+
+// Notify sends the notification with a reply_url of the channel and returns
+// the reply of the app, relayed to the former reply_url of the notification
+// when a reply client is set.
 func (p *HttpCallbackChannel) Notify(c context.Context, notifier *notify.Notifier, basePath string, request *notify.Notification) (string, error) {
-	reqID := p.random.Uint64()
-	trimmedBasePath := strings.Trim(basePath, "/")
-	callbackURL := fmt.Sprintf("%s/%s/response/%d", p.callbackBaseURL, trimmedBasePath, reqID)
+	pendingRequest := p.newPendingRequest()
+	callbackURL := p.callbackURL(basePath, pendingRequest.id)
+	replyURL, _ := request.Data["reply_url"].(string)
 	request.Data["reply_url"] = callbackURL
 
-	pendingRequest := &PendingRequest{
-		id:     reqID,
-		result: make(chan string, 1),
-	}
-	p.Lock()
-	p.pendingRequests[reqID] = pendingRequest
-	p.Unlock()
-
 	// We only delete the request from the map and close the channel only if it was not deleted before.
-	defer func() {
-		p.Lock()
-		req, ok := p.pendingRequests[reqID]
-		if ok {
-			p.deleteRequestAndClose(req)
-		}
-		p.Unlock()
-	}()
+	defer p.removeRequest(pendingRequest.id)
 
-	log.Debugf("waiting for response: %v", callbackURL)
+	logger := notifier.Logger().With("request_id", request.RequestID, "template", request.Template)
+	logger.Debug("waiting for response", "callback_url", callbackURL)
 
 	if err := notifier.Notify(c, request); err != nil {
-		log.Debugf("failed to notify, request: %v, error: %v", request, err)
+		logger.Debug("failed to notify", "error", err)
 		return "", err
 	}
 
+	var reply string
 	select {
-	case result := <-pendingRequest.result:
-		return result, nil
+	case reply = <-pendingRequest.result:
 	case <-c.Done():
 		return "", errors.New("canceled")
-	case <-time.After(callbackTimeout):
-		return "", errors.New("timeout")
+	case <-time.After(p.callbackTimeout):
+		return "", ErrCallbackTimeout
+	}
+
+	if p.replyClient != nil && replyURL != "" {
+		if err := p.replyClient.PostReply(c, replyURL, reply); err != nil {
+			logger.Error("failed to relay the reply", "reply_url", replyURL, "error", err)
+			return "", fmt.Errorf("%w: %v", ErrReplyRelayFailed, err)
+		}
+	}
+	return reply, nil
+}
+
+// WakeWithFallback sends the notification as a silent push carrying an
+// ack_url, and sends it again as a visible alert if the app doesn't post to
+// the ack url within the window. It returns once the silent push is queued.
+func (p *HttpCallbackChannel) WakeWithFallback(c context.Context, notifier *notify.Notifier, basePath string, request *notify.Notification, window time.Duration) error {
+	pendingRequest := p.newPendingRequest()
+	ackURL := p.callbackURL(basePath, pendingRequest.id)
+
+	silent := true
+	wake := *request
+	wake.Silent = &silent
+	wake.Data = make(map[string]interface{}, len(request.Data)+1)
+	for key, value := range request.Data {
+		wake.Data[key] = value
+	}
+	wake.Data["ack_url"] = ackURL
+
+	if err := notifier.Notify(c, &wake); err != nil {
+		p.removeRequest(pendingRequest.id)
+		return err
+	}
+
+	logger := notifier.Logger().With("request_id", request.RequestID, "template", request.Template)
+	go func() {
+		defer p.removeRequest(pendingRequest.id)
+		select {
+		case <-pendingRequest.result:
+			logger.Debug("notification acknowledged", "ack_url", ackURL)
+		case <-time.After(window):
+			logger.Debug("notification not acknowledged, sending alert", "window", window)
+			visible := false
+			alert := *request
+			alert.Silent = &visible
+			// The request context is likely gone by now.
+			if err := notifier.Notify(context.Background(), &alert); err != nil {
+				logger.Error("failed to send fallback alert", "error", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *HttpCallbackChannel) newPendingRequest() *PendingRequest {
+	p.Lock()
+	defer p.Unlock()
+	pendingRequest := &PendingRequest{
+		id:     p.random.Uint64(),
+		result: make(chan string, 1),
+	}
+	p.pendingRequests[pendingRequest.id] = pendingRequest
+	return pendingRequest
+}
+
+func (p *HttpCallbackChannel) callbackURL(basePath string, reqID uint64) string {
+	trimmedBasePath := strings.Trim(basePath, "/")
+	return fmt.Sprintf("%s/%s/response/%d", p.callbackBaseURL, trimmedBasePath, reqID)
+}
+
+// removeRequest deletes the request from the map and closes its channel, only
+// if it was not deleted before.
+func (p *HttpCallbackChannel) removeRequest(reqID uint64) {
+	p.Lock()
+	defer p.Unlock()
+	if req, ok := p.pendingRequests[reqID]; ok {
+		p.deleteRequestAndClose(req)
 	}
 }
 
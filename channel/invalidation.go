@@ -0,0 +1,28 @@
+package channel
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/breez/notify/notify"
+	"golang.org/x/exp/slog"
+)
+
+// TokenInvalidationHook returns the hook posting the invalidated tokens to
+// the url as json with the client, for notifier.OnTokenInvalidated. The
+// tokens are posted in the background so the delivery is not slowed down.
+func TokenInvalidationHook(url string, client ReplyClient, logger func() *slog.Logger) func(invalidation notify.TokenInvalidation) {
+	return func(invalidation notify.TokenInvalidation) {
+		body, err := json.Marshal(invalidation)
+		if err != nil {
+			logger().Error("failed to marshal the token invalidation", "error", err)
+			return
+		}
+		go func() {
+			if err := client.PostReply(context.Background(), url, string(body)); err != nil {
+				logger().Error("failed to post the token invalidation", "platform", invalidation.Platform,
+					"token", notify.MaskToken(invalidation.Token), "error", err)
+			}
+		}()
+	}
+}
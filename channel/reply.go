@@ -0,0 +1,47 @@
+package channel
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// ReplyClient posts the replies of the apps to the reply url of the senders.
+type ReplyClient interface {
+	PostReply(ctx context.Context, replyURL string, reply string) error
+}
+
+// httpReplyClient posts the replies as json, failing on non 2xx statuses.
+type httpReplyClient struct {
+	client  *http.Client
+	timeout time.Duration
+}
+
+// NewHTTPReplyClient returns a ReplyClient giving up on the replies not
+// posted within the timeout.
+func NewHTTPReplyClient(timeout time.Duration) ReplyClient {
+	return &httpReplyClient{client: http.DefaultClient, timeout: timeout}
+}
+
+func (h *httpReplyClient) PostReply(ctx context.Context, replyURL string, reply string) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, replyURL, bytes.NewBufferString(reply))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		return fmt.Errorf("reply url responded with status %v", res.StatusCode)
+	}
+	return nil
+}
@@ -1,23 +1,838 @@
 package config
 
 import (
+	"encoding/json"
 	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/exp/slog"
 )
 
 type HTTPConfig struct {
 	Address string `env:"NOTIFY_HTTP_ADDRESS"`
+	// DebugResponses allows senders to request the resolved notification and
+	// provider payload in the response using the X-Notify-Debug header.
+	// It should stay disabled in production.
+	DebugResponses bool `env:"NOTIFY_HTTP_DEBUG_RESPONSES"`
+	// DefaultAppData is used as the app_data of requests that don't provide one.
+	DefaultAppData string `env:"NOTIFY_HTTP_DEFAULT_APP_DATA"`
+	// MaxAppDataLength is the maximum length in bytes of the app_data provided
+	// by senders, keeping the pushes within the payload limits of the
+	// providers. Zero disables the limit.
+	MaxAppDataLength int `env:"NOTIFY_HTTP_MAX_APP_DATA_LENGTH,default=2048"`
+	// AppDataJSON rejects the app_data that is not valid json.
+	AppDataJSON bool `env:"NOTIFY_HTTP_APP_DATA_JSON"`
+	// Messages overrides the translations of the display messages, adding
+	// languages or replacing messages, English ones included.
+	Messages LanguageMessages `env:"NOTIFY_HTTP_MESSAGES"`
+	// SwapStatusMessages maps swap statuses to the message displayed to the
+	// user, e.g. {"transaction.mempool":"Swap transaction seen"}. When set,
+	// unmapped statuses are displayed as is.
+	SwapStatusMessages StringMap `env:"NOTIFY_HTTP_SWAP_STATUS_MESSAGES"`
+	// SwapStatusAllow forwards only the swap updates of the listed statuses
+	// when set, e.g. invoice.set,transaction.claimed,swap.expired, and
+	// SwapStatusDeny drops those of the listed statuses. Dropped updates are
+	// acknowledged without waking the device.
+	SwapStatusAllow StringList `env:"NOTIFY_HTTP_SWAP_STATUS_ALLOW"`
+	SwapStatusDeny  StringList `env:"NOTIFY_HTTP_SWAP_STATUS_DENY"`
+	// AppSwapStatusFilters replaces the swap status filter of the apps, e.g.
+	// {"satsails":{"allow":["invoice.set","transaction.claimed"]}}.
+	AppSwapStatusFilters AppStatusFilters `env:"NOTIFY_HTTP_APP_SWAP_STATUS_FILTERS"`
+	// DisplayMessageFallback is displayed instead of the messages referencing
+	// data the notification is missing, e.g. "Received {amount_sat} sats"
+	// without amount_sat. The default message of the template is displayed
+	// when empty.
+	DisplayMessageFallback string `env:"NOTIFY_HTTP_DISPLAY_MESSAGE_FALLBACK"`
+	// MaxDisplayMessageLength is the maximum length in characters of the
+	// display_message provided by senders.
+	MaxDisplayMessageLength int `env:"NOTIFY_HTTP_MAX_DISPLAY_MESSAGE_LENGTH,default=200"`
+	// DisplayMessageTruncation truncates the displayed messages longer than
+	// the given number of characters with an ellipsis. Zero disables it.
+	DisplayMessageTruncation int `env:"NOTIFY_HTTP_DISPLAY_MESSAGE_TRUNCATION"`
+	// WakeFallback sends the templates as a silent push first, followed by a
+	// visible alert if the app doesn't acknowledge the push within the window,
+	// e.g. {"lnurlpay_info":"5s"}.
+	WakeFallback TemplateDurations `env:"NOTIFY_HTTP_WAKE_FALLBACK"`
+	// DeliveryQuorum is the number of devices the notifications of a template
+	// sent to several devices, those of a client or of a batch, must be sent
+	// to for the request to succeed, e.g. {"payment_received":2}.
+	DeliveryQuorum TemplateLimits `env:"NOTIFY_HTTP_DELIVERY_QUORUM"`
+	// TemplateMaxDataSize is the maximum size in bytes of the serialized
+	// notification data per template.
+	TemplateMaxDataSize TemplateLimits `env:"NOTIFY_HTTP_TEMPLATE_MAX_DATA_SIZE"`
+	// BodyLogSampleRate is the fraction, between 0 and 1, of the requests
+	// logged along with their request and response bodies, their tokens and
+	// keys masked.
+	BodyLogSampleRate float64 `env:"NOTIFY_HTTP_BODY_LOG_SAMPLE_RATE"`
+	// ReplayProtection requires webhook requests to carry a timestamp within
+	// ReplayWindow and a nonce that was not used within that window.
+	// ReplayClockSkew is the allowed drift of the sender clock, accepting
+	// timestamps up to the skew in the future or past the window. It must be
+	// shorter than the window.
+	ReplayProtection bool          `env:"NOTIFY_HTTP_REPLAY_PROTECTION"`
+	ReplayWindow     time.Duration `env:"NOTIFY_HTTP_REPLAY_WINDOW,default=5m"`
+	ReplayClockSkew  time.Duration `env:"NOTIFY_HTTP_REPLAY_CLOCK_SKEW,default=30s"`
+	// IdempotencyWindow suppresses the notifications sent again within the
+	// window, identified by their Idempotency-Key header or their content.
+	// Zero disables the deduplication.
+	IdempotencyWindow time.Duration `env:"NOTIFY_HTTP_IDEMPOTENCY_WINDOW"`
+	// IdempotencyMaxKeys bounds the keys remembered within the window, the
+	// least recently sent notifications being forgotten first. Zero keeps
+	// them all.
+	IdempotencyMaxKeys int `env:"NOTIFY_HTTP_IDEMPOTENCY_MAX_KEYS,default=100000"`
+	// AllowForce lets the senders bypass the deduplication of a notification
+	// with the X-Notify-Force header, e.g. when the user asked for it again.
+	AllowForce bool `env:"NOTIFY_HTTP_ALLOW_FORCE"`
+	// TokenRateLimit is the number of notifications per minute accepted for a
+	// device token, with bursts of up to TokenRateBurst notifications, the
+	// rate when zero. Zero disables the limit.
+	TokenRateLimit int `env:"NOTIFY_HTTP_TOKEN_RATE_LIMIT"`
+	TokenRateBurst int `env:"NOTIFY_HTTP_TOKEN_RATE_BURST"`
+	// BatchMaxItems is the maximum number of notifications of a batch
+	// request, sent by up to BatchConcurrency workers at the same time.
+	BatchMaxItems    int `env:"NOTIFY_HTTP_BATCH_MAX_ITEMS,default=100"`
+	BatchConcurrency int `env:"NOTIFY_HTTP_BATCH_CONCURRENCY,default=10"`
+	// Platforms are the platforms accepted by the webhook, ios, android, web,
+	// unifiedpush and apns when empty.
+	Platforms StringList `env:"NOTIFY_HTTP_PLATFORMS"`
+	// WebhookSecret is required as a bearer token by the webhook endpoints
+	// when set.
+	WebhookSecret string `env:"NOTIFY_HTTP_WEBHOOK_SECRET"`
+	// RelayReplyTemplates are the templates the apps reply to through the
+	// service rather than to the reply_url of the sender directly, e.g.
+	// ["lnurlpay_info","lnurlpay_invoice"]. The replies are relayed to the
+	// reply_url and returned in the webhook response.
+	RelayReplyTemplates StringList `env:"NOTIFY_HTTP_RELAY_REPLY_TEMPLATES"`
+	// SignatureProviders requires the payloads of the providers to be signed
+	// with their secret, and all the payloads when a provider has none.
+	// Signatures are not checked when empty.
+	SignatureProviders SignatureProviders `env:"NOTIFY_HTTP_SIGNATURE_PROVIDERS"`
+	// AdminToken is the bearer token of the admin endpoints, which are
+	// disabled when empty.
+	AdminToken string `env:"NOTIFY_HTTP_ADMIN_TOKEN"`
+	// BroadcastRate is the number of notifications per second the admin
+	// broadcasts send to the devices of a platform.
+	BroadcastRate int `env:"NOTIFY_HTTP_BROADCAST_RATE,default=20"`
+	// MaxConnections limits the connections open at the same time, those
+	// beyond it are closed right away. Zero means no limit.
+	MaxConnections int `env:"NOTIFY_HTTP_MAX_CONNECTIONS"`
+	// NotifyTimeout is how long a webhook request waits for its notification
+	// to be sent, zero meaning as long as the request lasts.
+	NotifyTimeout time.Duration `env:"NOTIFY_HTTP_NOTIFY_TIMEOUT,default=30s"`
+	// AsyncDelivery responds to the webhook requests with a 202 once their
+	// notification is queued, rather than once it is sent. The requests
+	// awaiting a reply still wait for it.
+	AsyncDelivery bool `env:"NOTIFY_HTTP_ASYNC_DELIVERY"`
+	// TLSCertFile and TLSKeyFile serve the webhook over TLS when set, they
+	// must be set together.
+	TLSCertFile string `env:"NOTIFY_HTTP_TLS_CERT_FILE"`
+	TLSKeyFile  string `env:"NOTIFY_HTTP_TLS_KEY_FILE"`
+	// TLSClientCAFile requires the clients to present a certificate signed
+	// by one of the CAs of the pem file, it needs TLSCertFile and TLSKeyFile.
+	TLSClientCAFile string `env:"NOTIFY_HTTP_TLS_CLIENT_CA_FILE"`
+	// ReadTimeout bounds reading a request, body included, WriteTimeout
+	// writing its response and IdleTimeout how long idle connections are
+	// kept open. Zero means no timeout, the WriteTimeout should exceed the
+	// NotifyTimeout and the callback timeout.
+	ReadTimeout  time.Duration `env:"NOTIFY_HTTP_READ_TIMEOUT,default=30s"`
+	WriteTimeout time.Duration `env:"NOTIFY_HTTP_WRITE_TIMEOUT"`
+	IdleTimeout  time.Duration `env:"NOTIFY_HTTP_IDLE_TIMEOUT,default=2m"`
+	// DrainTimeout is how long in-flight requests are waited for on shutdown.
+	DrainTimeout time.Duration `env:"NOTIFY_HTTP_DRAIN_TIMEOUT,default=30s"`
+	// MaxTTL bounds the TTL a sender can request with the X-Notify-TTL header.
+	MaxTTL time.Duration `env:"NOTIFY_HTTP_MAX_TTL,default=24h"`
+}
+
+// SwapStatusFilter returns the swap status filter of the app, the global one
+// unless the app has its own.
+func (c *HTTPConfig) SwapStatusFilter(app string) StatusFilter {
+	if filter, ok := c.AppSwapStatusFilters[app]; ok {
+		return filter
+	}
+	return StatusFilter{Allow: c.SwapStatusAllow, Deny: c.SwapStatusDeny}
+}
+
+// GRPCConfig serves the NotifyService, sending the notifications like the
+// webhook, along with it.
+type GRPCConfig struct {
+	// Address is the address the service listens on, the service being
+	// disabled when empty. The service requires the WebhookSecret of the
+	// HTTPConfig.
+	Address string `env:"NOTIFY_GRPC_ADDRESS"`
+	// TLSCertFile and TLSKeyFile serve the service over TLS when set, they
+	// must be set together. TLSClientCAFile requires the clients to present a
+	// certificate signed by one of its CAs.
+	TLSCertFile     string `env:"NOTIFY_GRPC_TLS_CERT_FILE"`
+	TLSKeyFile      string `env:"NOTIFY_GRPC_TLS_KEY_FILE"`
+	TLSClientCAFile string `env:"NOTIFY_GRPC_TLS_CLIENT_CA_FILE"`
+}
+
+// TracingConfig exports the traces of the webhook requests and of the push
+// deliveries with OTLP over http.
+type TracingConfig struct {
+	// Endpoint is the url of the OTLP collector, e.g. http://collector:4318,
+	// tracing being disabled when empty.
+	Endpoint string `env:"NOTIFY_TRACING_ENDPOINT"`
+	// Headers are sent along with the exported spans, e.g. to authenticate.
+	Headers StringMap `env:"NOTIFY_TRACING_HEADERS"`
+	// SampleRate is the fraction, between 0 and 1, of the traces started by
+	// the service that are sampled. The traces started upstream, e.g. by a
+	// proxy, follow the sampling decision of their parent.
+	SampleRate  float64 `env:"NOTIFY_TRACING_SAMPLE_RATE,default=1"`
+	ServiceName string  `env:"NOTIFY_TRACING_SERVICE_NAME,default=notify"`
+}
+
+// StringList is a comma separated list of strings.
+type StringList []string
+
+func (s *StringList) UnmarshalEnvironmentValue(data string) error {
+	var list StringList
+	for _, item := range strings.Split(data, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*s = list
+	return nil
+}
+
+// StringMap is a json object of strings, e.g. {"key":"value"}.
+type StringMap map[string]string
+
+func (s *StringMap) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), s)
+}
+
+// StatusFilter forwards the statuses of Allow, all of them when empty, except
+// those of Deny.
+type StatusFilter struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Forwards reports whether the notifications of the status are forwarded.
+func (f StatusFilter) Forwards(status string) bool {
+	for _, denied := range f.Deny {
+		if denied == status {
+			return false
+		}
+	}
+	if len(f.Allow) == 0 {
+		return true
+	}
+	for _, allowed := range f.Allow {
+		if allowed == status {
+			return true
+		}
+	}
+	return false
+}
+
+// AppStatusFilters maps the name of an app to its status filter.
+type AppStatusFilters map[string]StatusFilter
+
+func (a *AppStatusFilters) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), a)
+}
+
+// FieldRenames maps a template name to the Data keys that should be renamed
+// before the notification is delivered, e.g. {"tx_confirmed":{"tx_id":"txid"}}.
+type FieldRenames map[string]map[string]string
+
+func (f *FieldRenames) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), f)
+}
+
+// TemplateHours maps a template name to a local hour of the day (0-23),
+// e.g. {"tx_confirmed":9}.
+type TemplateHours map[string]int
+
+func (t *TemplateHours) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), t)
+}
+
+// TemplateDurations maps a template name to a duration, e.g.
+// {"lnurlpay_invoice":"30s"}.
+type TemplateDurations map[string]time.Duration
+
+func (t *TemplateDurations) UnmarshalEnvironmentValue(data string) error {
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return err
+	}
+	durations := make(TemplateDurations, len(raw))
+	for template, value := range raw {
+		duration, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration for %v: %w", template, err)
+		}
+		durations[template] = duration
+	}
+	*t = durations
+	return nil
+}
+
+// TemplateLimits maps a template name to a limit, e.g. {"swap_updated":2}.
+type TemplateLimits map[string]int
+
+func (t *TemplateLimits) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), t)
+}
+
+// TemplateLists maps a template name to a list of values, e.g.
+// {"swap_updated":["throttled","timeout"]}.
+type TemplateLists map[string][]string
+
+func (t *TemplateLists) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), t)
+}
+
+// TemplateValues maps a template name to a value, e.g.
+// {"lnurlpay_info":"background"}.
+type TemplateValues map[string]string
+
+func (t *TemplateValues) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), t)
+}
+
+// TemplatePlatformValues maps a template name to a value per platform, e.g.
+// {"lnurlpay_info":{"ios":"LNURL_PAY"}}.
+type TemplatePlatformValues map[string]map[string]string
+
+func (t *TemplatePlatformValues) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), t)
+}
+
+// MessageTemplate renders the title and body displayed by a notification
+// with Go text/template, executed with the notification, e.g.
+// "Receiving {{.Data.amount_sat}} sats". Empty ones are not rendered.
+type MessageTemplate struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// MessageTemplates maps a template name to its message template per platform,
+// "*" matching the platforms without one, e.g.
+// {"lnurlpay_invoice":{"*":{"body":"Receiving {{.Data.amount_sat}} sats"}}}.
+type MessageTemplates map[string]map[string]MessageTemplate
+
+func (m *MessageTemplates) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), m)
+}
+
+// LanguageMessages maps a language to the display messages of its templates,
+// e.g. {"pt":{"payment_received":"Pagamento recebido"}}.
+type LanguageMessages map[string]map[string]string
+
+func (l *LanguageMessages) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), l)
+}
+
+// SignatureProvider is a sender signing the body of its webhook requests with
+// an HMAC-SHA256 of a shared secret, sent in the Header, X-Hook-Signature
+// when empty. Payloads are the templates and events only accepted from it,
+// a provider without payloads signs all the other ones. Secrets are the
+// secrets also accepted while the secret is rotated. A provider with
+// SignsTimestamp signs "timestamp.nonce.body", the values of the replay
+// protection headers, so that its requests can't be replayed with other
+// ones.
+type SignatureProvider struct {
+	Header         string   `json:"header"`
+	Secret         string   `json:"secret"`
+	Secrets        []string `json:"secrets"`
+	Payloads       []string `json:"payloads"`
+	SignsTimestamp bool     `json:"signs_timestamp"`
+}
+
+// ActiveSecrets returns the secrets the signatures of the provider are
+// accepted with.
+func (p SignatureProvider) ActiveSecrets() []string {
+	var secrets []string
+	if p.Secret != "" {
+		secrets = append(secrets, p.Secret)
+	}
+	for _, secret := range p.Secrets {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return secrets
+}
+
+// SignatureProviders maps a provider name to its signature, e.g.
+// {"boltz":{"secret":"...","payloads":["swap.update"]}}.
+type SignatureProviders map[string]SignatureProvider
+
+func (s *SignatureProviders) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), s)
+}
+
+// AppCredentials are the push credentials of an app served along with the
+// default one. Credentials references the firebase service account json of
+// its project through a secret provider, the APNS fields are those of the
+// apns platform of the app.
+type AppCredentials struct {
+	Credentials     string            `json:"credentials"`
+	APNSKeyFile     string            `json:"apns_key_file"`
+	APNSKeyID       string            `json:"apns_key_id"`
+	APNSTeamID      string            `json:"apns_team_id"`
+	APNSCertFile    string            `json:"apns_cert_file"`
+	APNSCertKeyFile string            `json:"apns_cert_key_file"`
+	APNSBundleID    string            `json:"apns_bundle_id"`
+	APNSBundles     map[string]string `json:"apns_bundles"`
+}
+
+// validateAPNS checks the APNS credentials of the app.
+func (a *AppCredentials) validateAPNS() error {
+	if a.APNSKeyFile != "" && (a.APNSKeyID == "" || a.APNSTeamID == "") {
+		return fmt.Errorf("APNSKeyFile requires APNSKeyID and APNSTeamID")
+	}
+	if (a.APNSCertFile == "") != (a.APNSCertKeyFile == "") {
+		return fmt.Errorf("APNSCertFile and APNSCertKeyFile must be set together")
+	}
+	if a.APNSKeyFile != "" && a.APNSCertFile != "" {
+		return fmt.Errorf("APNSKeyFile and APNSCertFile are exclusive")
+	}
+	if (a.APNSKeyFile != "" || a.APNSCertFile != "") && a.APNSBundleID == "" && len(a.APNSBundles) == 0 {
+		return fmt.Errorf("APNSBundleID or APNSBundles is required along with the apns credentials")
+	}
+	return nil
+}
+
+// Apps maps the name of an app to its push credentials, e.g.
+// {"satsails":{"credentials":"file:/run/secrets/satsails-fcm.json"}}.
+type Apps map[string]AppCredentials
+
+func (a *Apps) UnmarshalEnvironmentValue(data string) error {
+	return json.Unmarshal([]byte(data), a)
+}
+
+// LogLevel is the minimum level of the logs: debug, info, warn or error.
+type LogLevel slog.Level
+
+func (l *LogLevel) UnmarshalEnvironmentValue(data string) error {
+	return (*slog.Level)(l).UnmarshalText([]byte(data))
 }
 
 type Config struct {
-	WorkersNum  int `env:"NOTIFY_WORKERS_NUM"`
+	WorkersNum int `env:"NOTIFY_WORKERS_NUM"`
+	// QueueSize bounds the notifications waiting for a worker, those beyond
+	// it failing with ErrQueueFull. Zero keeps the default of the queue.
+	QueueSize   int    `env:"NOTIFY_QUEUE_SIZE,default=4096"`
 	ExternalURL string `env:"NOTIFY_EXTERNAL_URL"`
-	HTTPConfig  HTTPConfig
+	// Sink captures notifications in a file or posts them to an http(s) url
+	// instead of delivering them to devices, for integration environments.
+	Sink         string       `env:"NOTIFY_SINK"`
+	FieldRenames FieldRenames `env:"NOTIFY_FIELD_RENAMES"`
+	// Metrics measures the notifications and exposes the metrics on the
+	// /metrics endpoint of the webhook. It is off by default, the endpoint
+	// being unauthenticated unless an admin token is set.
+	Metrics bool `env:"NOTIFY_METRICS"`
+	// LogLevel is the minimum level of the logs, the raw request bodies
+	// are only logged at the debug level.
+	LogLevel LogLevel `env:"NOTIFY_LOG_LEVEL,default=info"`
+	// LogFormat is the format of the logs, json or text.
+	LogFormat string `env:"NOTIFY_LOG_FORMAT,default=json"`
+	// DeliverAtLocalHour delays non urgent templates to the given hour in the
+	// device timezone, holding them in the schedule meanwhile.
+	DeliverAtLocalHour TemplateHours `env:"NOTIFY_DELIVER_AT_LOCAL_HOUR"`
+	// TemplateTTL sets how long the push provider keeps trying to deliver
+	// each template.
+	TemplateTTL TemplateDurations `env:"NOTIFY_TEMPLATE_TTL"`
+	// TemplatePushTypes delivers the templates as background data only
+	// pushes or as alerts by default, e.g. {"lnurlpay_info":"background"}.
+	TemplatePushTypes TemplateValues `env:"NOTIFY_TEMPLATE_PUSH_TYPES"`
+	// TemplateCategories is the default notification category per template
+	// and platform, registered by the apps to show the notification actions.
+	TemplateCategories TemplatePlatformValues `env:"NOTIFY_TEMPLATE_CATEGORIES"`
+	// MessageTemplates overrides the title and body of the notifications per
+	// template and platform, rendered when they are sent.
+	MessageTemplates MessageTemplates `env:"NOTIFY_MESSAGE_TEMPLATES"`
+	// TemplateDeadline drops notifications of a template that could not be
+	// sent within the deadline once queued, rather than delivering them late.
+	TemplateDeadline TemplateDurations `env:"NOTIFY_TEMPLATE_DEADLINE"`
+	// SummaryTemplates are the non urgent templates aggregated in a daily
+	// summary, sent at SummaryHour of the device timezone, for the targets
+	// opted in.
+	SummaryTemplates StringList `env:"NOTIFY_SUMMARY_TEMPLATES"`
+	SummaryHour      int        `env:"NOTIFY_SUMMARY_HOUR,default=20"`
+	// TemplateConcurrency limits how many notifications of a template are
+	// delivered concurrently, within the WorkersNum global limit.
+	TemplateConcurrency TemplateLimits `env:"NOTIFY_TEMPLATE_CONCURRENCY"`
+	// PlatformRates limits the notifications sent per second to each platform,
+	// e.g. {"ios":100}. Notifications beyond the rate wait for their turn, up
+	// to ThrottleQueueSize waiting notifications per platform. PlatformBursts
+	// lets bursts of up to that many notifications through right away, e.g.
+	// {"ios":500}, one when not set.
+	PlatformRates     TemplateLimits `env:"NOTIFY_PLATFORM_RATES"`
+	PlatformBursts    TemplateLimits `env:"NOTIFY_PLATFORM_BURSTS"`
+	ThrottleQueueSize int            `env:"NOTIFY_THROTTLE_QUEUE_SIZE,default=1000"`
+	// RetryAttempts is the number of attempts to send a notification, one
+	// meaning no retries. TemplateRetryAttempts overrides it per template.
+	// The delay between attempts starts at RetryDelay and doubles after each
+	// attempt, up to RetryMaxDelay.
+	RetryAttempts         int            `env:"NOTIFY_RETRY_ATTEMPTS,default=1"`
+	TemplateRetryAttempts TemplateLimits `env:"NOTIFY_TEMPLATE_RETRY_ATTEMPTS"`
+	RetryDelay            time.Duration  `env:"NOTIFY_RETRY_DELAY,default=1s"`
+	RetryMaxDelay         time.Duration  `env:"NOTIFY_RETRY_MAX_DELAY,default=30s"`
+	// RetryQueueDir persists the notifications that failed with a retryable
+	// reason in a bbolt database of the directory, to be retried across
+	// restarts. They are
+	// retried after RetryQueueDelay, doubling after each attempt up to
+	// RetryQueueMaxDelay, and dropped once failing for RetryQueueMaxAge. The
+	// queue is checked every RetryQueueInterval. Failed notifications are not
+	// persisted when empty.
+	RetryQueueDir      string        `env:"NOTIFY_RETRY_QUEUE_DIR"`
+	RetryQueueDelay    time.Duration `env:"NOTIFY_RETRY_QUEUE_DELAY,default=1m"`
+	RetryQueueMaxDelay time.Duration `env:"NOTIFY_RETRY_QUEUE_MAX_DELAY,default=1h"`
+	RetryQueueMaxAge   time.Duration `env:"NOTIFY_RETRY_QUEUE_MAX_AGE,default=24h"`
+	RetryQueueInterval time.Duration `env:"NOTIFY_RETRY_QUEUE_INTERVAL,default=10s"`
+	// TemplateRetryOn overrides per template the failure reasons that are
+	// retried, e.g. {"payment_received":["throttled","timeout","unknown"]}.
+	TemplateRetryOn TemplateLists `env:"NOTIFY_TEMPLATE_RETRY_ON"`
+	// CollapseWindow holds notifications having a collapse key, delivering
+	// only the latest one per key and device arriving within the window.
+	CollapseWindow time.Duration `env:"NOTIFY_COLLAPSE_WINDOW"`
+	// CoalesceWindow holds the notifications of a template per target for
+	// the window, e.g. {"payment_received":"1m"}, sending a single
+	// notification for those arrived within it. Its body counts them, with
+	// CoalesceMessages per template, e.g.
+	// {"payment_received":"{count} incoming payments"}, and its data carries
+	// the data of all of them.
+	CoalesceWindow   TemplateDurations `env:"NOTIFY_COALESCE_WINDOW"`
+	CoalesceMessages TemplateValues    `env:"NOTIFY_COALESCE_MESSAGES"`
+	// CapabilityRegistry enables registering the capabilities of the devices,
+	// e.g. no support of silent pushes, to tailor their notifications.
+	CapabilityRegistry bool `env:"NOTIFY_CAPABILITY_REGISTRY"`
+	// EncryptionKeyRegistry enables registering an X25519 public key per
+	// device, the content of its notifications being encrypted to it so the
+	// push providers can't read it. EncryptedMessage is displayed until the
+	// app decrypts the notification, "New notification" when empty. The keys
+	// are kept in Redis under EncryptionKeyRedisKey along with the delivery
+	// queue when it is shared, and in EncryptionKeyFile otherwise, so that
+	// they outlive the instance.
+	EncryptionKeyRegistry bool   `env:"NOTIFY_ENCRYPTION_KEY_REGISTRY"`
+	EncryptedMessage      string `env:"NOTIFY_ENCRYPTED_MESSAGE"`
+	EncryptionKeyFile     string `env:"NOTIFY_ENCRYPTION_KEY_FILE"`
+	EncryptionKeyRedisKey string `env:"NOTIFY_ENCRYPTION_KEY_REDIS_KEY,default=notify:encryption_keys"`
+	// Scheduling lets the senders schedule notifications up to
+	// ScheduleMaxDelay in the future, zero not limiting the delay. They are
+	// kept in ScheduleDir, surviving restarts, along with the notifications
+	// held back by the notifier, which is required as soon as notifications
+	// are scheduled or held back. The schedule is checked every
+	// ScheduleInterval.
+	Scheduling       bool          `env:"NOTIFY_SCHEDULING"`
+	ScheduleDir      string        `env:"NOTIFY_SCHEDULE_DIR"`
+	ScheduleMaxDelay time.Duration `env:"NOTIFY_SCHEDULE_MAX_DELAY,default=720h"`
+	ScheduleInterval time.Duration `env:"NOTIFY_SCHEDULE_INTERVAL,default=5s"`
+	// DeliveryQueueRedisURL shares the delivery of the notifications nobody
+	// waits for between the instances through a queue kept in Redis under
+	// DeliveryQueueKey, e.g. redis://localhost:6379/0. The notifications not
+	// acknowledged within DeliveryQueueVisibility, e.g. because their instance
+	// stopped, are delivered again.
+	DeliveryQueueRedisURL   string        `env:"NOTIFY_DELIVERY_QUEUE_REDIS_URL"`
+	DeliveryQueueKey        string        `env:"NOTIFY_DELIVERY_QUEUE_KEY,default=notify:delivery"`
+	DeliveryQueueVisibility time.Duration `env:"NOTIFY_DELIVERY_QUEUE_VISIBILITY,default=5m"`
+	// ProviderCheckInterval is how often the credentials and the connectivity
+	// of the push providers are checked, the platforms failing their last
+	// check being reported as not ready. Zero disables the checks.
+	ProviderCheckInterval time.Duration `env:"NOTIFY_PROVIDER_CHECK_INTERVAL,default=5m"`
+	// DeviceRegistry enables registering the devices of the clients, so
+	// senders can notify a client by its id. The devices are kept in
+	// DeviceStoreFile when set, and only in memory otherwise.
+	DeviceRegistry  bool   `env:"NOTIFY_DEVICE_REGISTRY"`
+	DeviceStoreFile string `env:"NOTIFY_DEVICE_STORE_FILE"`
+	// DeliveryStatus keeps the delivery status of the notifications, queried
+	// by their id, up to DeliveryStatusMaxEntries of the most recent ones.
+	// Zero keeps them all.
+	DeliveryStatus           bool `env:"NOTIFY_DELIVERY_STATUS"`
+	DeliveryStatusMaxEntries int  `env:"NOTIFY_DELIVERY_STATUS_MAX_ENTRIES,default=10000"`
+	// LiveSubscriptions streams the notifications to the clients subscribed
+	// to their target over a websocket, along with their push. Notifications
+	// of the websocket type are only streamed.
+	LiveSubscriptions bool `env:"NOTIFY_LIVE_SUBSCRIPTIONS"`
+	// InvalidTokenTTL is how long the tokens the providers reported as
+	// unregistered are remembered, their notifications failing right away
+	// rather than being sent or retried. Zero disables it.
+	// TokenInvalidatedURL is posted the invalidated tokens when set, for the
+	// senders to remove them from their stores.
+	InvalidTokenTTL     time.Duration `env:"NOTIFY_INVALID_TOKEN_TTL,default=720h"`
+	TokenInvalidatedURL string        `env:"NOTIFY_TOKEN_INVALIDATED_URL"`
+	// MinTargetInterval is the minimum interval between two notifications to
+	// the same device. Notifications arriving too soon are delayed, or dropped
+	// when DropTooFrequent is set.
+	MinTargetInterval time.Duration `env:"NOTIFY_MIN_TARGET_INTERVAL"`
+	DropTooFrequent   bool          `env:"NOTIFY_DROP_TOO_FREQUENT"`
+	// ReportWindow is the period the delivery report covers, zero disabling
+	// the report.
+	ReportWindow time.Duration `env:"NOTIFY_REPORT_WINDOW,default=24h"`
+	// BreakerThreshold is the number of consecutive failures of a service
+	// opening its circuit, failing its sends fast for BreakerCooldown before
+	// probing it again. Zero disables the circuit breakers.
+	BreakerThreshold int           `env:"NOTIFY_BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration `env:"NOTIFY_BREAKER_COOLDOWN,default=30s"`
+	// FailoverThreshold is the number of consecutive failures of the primary
+	// push project, unavailable, rejecting the credentials or out of quota,
+	// before new sends fail over to the secondary one. A failed check of the
+	// primary fails over right away.
+	FailoverThreshold int `env:"NOTIFY_FAILOVER_THRESHOLD,default=3"`
+	// FailoverRecovery is how long to wait before trying the primary push
+	// project again.
+	FailoverRecovery time.Duration `env:"NOTIFY_FAILOVER_RECOVERY,default=1m"`
+	// Credentials references the firebase service account json through a
+	// secret provider, e.g. "file:/run/secrets/fcm.json" or "env:FCM_JSON".
+	// SecondaryCredentials is the one of the failover project.
+	Credentials          string `env:"NOTIFY_CREDENTIALS"`
+	SecondaryCredentials string `env:"NOTIFY_CREDENTIALS_SECONDARY"`
+	// HighPriorityAmountMsat elevates the interruption level of visible
+	// payment notifications of at least this amount, zero disabling it. Only
+	// the templates of bitcoin payments are elevated.
+	HighPriorityAmountMsat uint64 `env:"NOTIFY_HIGH_PRIORITY_AMOUNT_MSAT"`
+	// APNSCustomKeys also sets the notification data as top level custom keys
+	// of the APNS payload, next to aps.
+	APNSCustomKeys bool `env:"NOTIFY_APNS_CUSTOM_KEYS"`
+	// APNSKeyFile is the p8 key of APNSKeyID, of the APNSTeamID team, signing
+	// the provider tokens of the apns platform, which delivers to the APNS
+	// device tokens of iOS apps directly rather than through FCM.
+	// APNSCertFile and APNSCertKeyFile authenticate with the certificate of
+	// the app instead. The apns platform is disabled when neither is set.
+	APNSKeyFile     string `env:"NOTIFY_APNS_KEY_FILE"`
+	APNSKeyID       string `env:"NOTIFY_APNS_KEY_ID"`
+	APNSTeamID      string `env:"NOTIFY_APNS_TEAM_ID"`
+	APNSCertFile    string `env:"NOTIFY_APNS_CERT_FILE"`
+	APNSCertKeyFile string `env:"NOTIFY_APNS_CERT_KEY_FILE"`
+	// APNSBundleID is the bundle id of the notifications without an app_id,
+	// APNSBundles maps the app_id of the webhook query to the bundle id of
+	// the app, e.g. {"mainnet":"com.breez.app","testnet":"com.breez.app.testnet"}.
+	APNSBundleID string    `env:"NOTIFY_APNS_BUNDLE_ID"`
+	APNSBundles  StringMap `env:"NOTIFY_APNS_BUNDLES"`
+	// APNSEndpoint is the APNS server, the sandbox one being
+	// https://api.sandbox.push.apple.com.
+	APNSEndpoint string `env:"NOTIFY_APNS_ENDPOINT,default=https://api.push.apple.com"`
+	// VAPIDPublicKey and VAPIDPrivateKey enable the web platform, delivering
+	// to browsers with Web Push. VAPIDSubscriber is the contact of the sender
+	// for the push services, a mailto: or https: url.
+	VAPIDPublicKey  string `env:"NOTIFY_VAPID_PUBLIC_KEY"`
+	VAPIDPrivateKey string `env:"NOTIFY_VAPID_PRIVATE_KEY"`
+	VAPIDSubscriber string `env:"NOTIFY_VAPID_SUBSCRIBER"`
+	// UnifiedPush enables the unifiedpush platform, delivering to the
+	// UnifiedPush distributors of de-googled devices. The targets are push
+	// endpoints, or ntfy topics of UnifiedPushServer. UnifiedPushToken
+	// authenticates the requests to that server.
+	UnifiedPush       bool   `env:"NOTIFY_UNIFIEDPUSH"`
+	UnifiedPushServer string `env:"NOTIFY_UNIFIEDPUSH_SERVER,default=https://ntfy.sh"`
+	UnifiedPushToken  string `env:"NOTIFY_UNIFIEDPUSH_TOKEN"`
+	// FCMEndpoint is the base url push requests are sent to, overridden to
+	// target a mock server or a regional endpoint. APNS is reached through
+	// FCM so it is covered as well.
+	FCMEndpoint string `env:"NOTIFY_FCM_ENDPOINT,default=https://fcm.googleapis.com"`
+	// CallbackTimeout is how long the apps have to reply to the notifications
+	// awaiting a reply. The replies relayed to the reply_url of the senders
+	// are posted within ReplyTimeout.
+	CallbackTimeout time.Duration `env:"NOTIFY_CALLBACK_TIMEOUT,default=60s"`
+	ReplyTimeout    time.Duration `env:"NOTIFY_REPLY_TIMEOUT,default=10s"`
+	// UserAgent names the service in the User-Agent of push requests, followed
+	// by the build version.
+	UserAgent string `env:"NOTIFY_USER_AGENT,default=breez-notify"`
+	// Apps are the apps served along with the default one, each with its own
+	// push credentials, selected by the app query of the webhook. Only the
+	// configured apps are accepted.
+	Apps          Apps `env:"NOTIFY_APPS"`
+	HTTPConfig    HTTPConfig
+	GRPCConfig    GRPCConfig
+	TracingConfig TracingConfig
+}
+
+// DefaultApp returns the push credentials of the default app.
+func (c *Config) DefaultApp() AppCredentials {
+	return AppCredentials{
+		Credentials:     c.Credentials,
+		APNSKeyFile:     c.APNSKeyFile,
+		APNSKeyID:       c.APNSKeyID,
+		APNSTeamID:      c.APNSTeamID,
+		APNSCertFile:    c.APNSCertFile,
+		APNSCertKeyFile: c.APNSCertKeyFile,
+		APNSBundleID:    c.APNSBundleID,
+		APNSBundles:     c.APNSBundles,
+	}
+}
+
+// HoldsNotifications reports whether notifications may be held back in the
+// schedule to be sent later, scheduled by the senders, collapsed, coalesced,
+// summarized or delayed for the local delivery hour or the minimum interval
+// of their target.
+func (c *Config) HoldsNotifications() bool {
+	return c.Scheduling || c.CollapseWindow > 0 || len(c.CoalesceWindow) > 0 || len(c.SummaryTemplates) > 0 ||
+		len(c.DeliverAtLocalHour) > 0 || (c.MinTargetInterval > 0 && !c.DropTooFrequent)
 }
 
 func (c *Config) Validate() error {
+	if c.QueueSize < 0 {
+		return fmt.Errorf("QueueSize must not be negative")
+	}
 	if c.WorkersNum < 1 {
 		return fmt.Errorf("WorkersNum must be greater than zero")
 	}
+	if c.LogFormat != "" && c.LogFormat != "json" && c.LogFormat != "text" {
+		return fmt.Errorf("LogFormat must be json or text")
+	}
+	if c.HTTPConfig.BodyLogSampleRate < 0 || c.HTTPConfig.BodyLogSampleRate > 1 {
+		return fmt.Errorf("BodyLogSampleRate must be between 0 and 1")
+	}
+	if c.HTTPConfig.ReplayProtection && (c.HTTPConfig.ReplayClockSkew < 0 || c.HTTPConfig.ReplayClockSkew >= c.HTTPConfig.ReplayWindow) {
+		return fmt.Errorf("ReplayClockSkew must be between zero and ReplayWindow")
+	}
+	if c.HTTPConfig.TokenRateLimit < 0 || c.HTTPConfig.TokenRateBurst < 0 {
+		return fmt.Errorf("TokenRateLimit and TokenRateBurst must not be negative")
+	}
+	for template, quorum := range c.HTTPConfig.DeliveryQuorum {
+		if quorum < 1 {
+			return fmt.Errorf("DeliveryQuorum of %v must be greater than zero", template)
+		}
+	}
+	if c.HTTPConfig.BroadcastRate < 1 {
+		return fmt.Errorf("BroadcastRate must be greater than zero")
+	}
+	if c.HTTPConfig.BatchMaxItems < 1 || c.HTTPConfig.BatchConcurrency < 1 {
+		return fmt.Errorf("BatchMaxItems and BatchConcurrency must be greater than zero")
+	}
+	if (c.HTTPConfig.TLSCertFile == "") != (c.HTTPConfig.TLSKeyFile == "") {
+		return fmt.Errorf("TLSCertFile and TLSKeyFile must be set together")
+	}
+	if c.HTTPConfig.TLSClientCAFile != "" && c.HTTPConfig.TLSCertFile == "" {
+		return fmt.Errorf("TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+	if c.GRPCConfig.Address != "" && c.HTTPConfig.WebhookSecret == "" {
+		return fmt.Errorf("GRPCConfig Address requires the WebhookSecret of HTTPConfig")
+	}
+	if (c.GRPCConfig.TLSCertFile == "") != (c.GRPCConfig.TLSKeyFile == "") {
+		return fmt.Errorf("GRPCConfig TLSCertFile and TLSKeyFile must be set together")
+	}
+	if c.GRPCConfig.TLSClientCAFile != "" && c.GRPCConfig.TLSCertFile == "" {
+		return fmt.Errorf("GRPCConfig TLSClientCAFile requires TLSCertFile and TLSKeyFile")
+	}
+	if c.TracingConfig.SampleRate < 0 || c.TracingConfig.SampleRate > 1 {
+		return fmt.Errorf("TracingConfig SampleRate must be between 0 and 1")
+	}
+	if c.TracingConfig.Endpoint != "" {
+		if u, err := url.Parse(c.TracingConfig.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("TracingConfig Endpoint must be an http or https url")
+		}
+	}
+	if c.HTTPConfig.ReadTimeout < 0 || c.HTTPConfig.WriteTimeout < 0 || c.HTTPConfig.IdleTimeout < 0 {
+		return fmt.Errorf("ReadTimeout, WriteTimeout and IdleTimeout must not be negative")
+	}
+	for name, provider := range c.HTTPConfig.SignatureProviders {
+		if len(provider.ActiveSecrets()) == 0 {
+			return fmt.Errorf("signature provider %v must have a secret", name)
+		}
+		if provider.SignsTimestamp && !c.HTTPConfig.ReplayProtection {
+			return fmt.Errorf("signature provider %v signs the timestamp, which requires ReplayProtection", name)
+		}
+	}
+	for name, platforms := range c.MessageTemplates {
+		for platform, message := range platforms {
+			for _, text := range []string{message.Title, message.Body} {
+				if _, err := template.New(name).Parse(text); err != nil {
+					return fmt.Errorf("invalid message template of %v for %v: %w", name, platform, err)
+				}
+			}
+		}
+	}
+	defaultApp := c.DefaultApp()
+	if err := defaultApp.validateAPNS(); err != nil {
+		return err
+	}
+	for name, app := range c.Apps {
+		if name == "" {
+			return fmt.Errorf("app names must not be empty")
+		}
+		if app.Credentials == "" && c.Sink == "" {
+			return fmt.Errorf("app %v must have credentials", name)
+		}
+		if err := app.validateAPNS(); err != nil {
+			return fmt.Errorf("app %v: %w", name, err)
+		}
+	}
+	for name := range c.HTTPConfig.AppSwapStatusFilters {
+		if _, ok := c.Apps[name]; !ok {
+			return fmt.Errorf("AppSwapStatusFilters references unknown app %v", name)
+		}
+	}
+	if c.InvalidTokenTTL < 0 {
+		return fmt.Errorf("InvalidTokenTTL must not be negative")
+	}
+	if c.BreakerThreshold < 0 || (c.BreakerThreshold > 0 && c.BreakerCooldown <= 0) {
+		return fmt.Errorf("BreakerThreshold must not be negative and BreakerCooldown must be greater than zero")
+	}
+	if c.FailoverThreshold < 1 {
+		return fmt.Errorf("FailoverThreshold must be greater than zero")
+	}
+	if c.ProviderCheckInterval < 0 {
+		return fmt.Errorf("ProviderCheckInterval must not be negative")
+	}
+	if c.Scheduling && (c.ScheduleInterval <= 0 || c.ScheduleMaxDelay < 0) {
+		return fmt.Errorf("ScheduleInterval must be greater than zero and ScheduleMaxDelay must not be negative")
+	}
+	// The notifications held back in memory would be lost on restart.
+	if c.DeliveryQueueRedisURL != "" && (c.DeliveryQueueKey == "" || c.DeliveryQueueVisibility <= 0) {
+		return fmt.Errorf("DeliveryQueueKey must be set and DeliveryQueueVisibility greater than zero with a DeliveryQueueRedisURL")
+	}
+	if c.EncryptionKeyRegistry {
+		if c.DeliveryQueueRedisURL != "" && c.EncryptionKeyRedisKey == "" {
+			return fmt.Errorf("EncryptionKeyRedisKey must be set with a DeliveryQueueRedisURL")
+		}
+		if c.DeliveryQueueRedisURL == "" && c.EncryptionKeyFile == "" {
+			return fmt.Errorf("EncryptionKeyRegistry requires an EncryptionKeyFile or a DeliveryQueueRedisURL")
+		}
+	}
+	if c.HoldsNotifications() && (c.ScheduleDir == "" || c.ScheduleInterval <= 0) {
+		return fmt.Errorf("ScheduleDir must be set and ScheduleInterval greater than zero when notifications are scheduled or held back")
+	}
+	if c.RetryQueueDir != "" && (c.RetryQueueDelay <= 0 || c.RetryQueueInterval <= 0) {
+		return fmt.Errorf("RetryQueueDelay and RetryQueueInterval must be greater than zero")
+	}
+	for template, attempts := range c.TemplateRetryAttempts {
+		if attempts < 1 {
+			return fmt.Errorf("TemplateRetryAttempts for %v must be greater than zero", template)
+		}
+	}
+	for platform, rate := range c.PlatformRates {
+		if rate < 1 {
+			return fmt.Errorf("PlatformRates for %v must be greater than zero", platform)
+		}
+	}
+	for platform, burst := range c.PlatformBursts {
+		if burst < 1 {
+			return fmt.Errorf("PlatformBursts for %v must be greater than zero", platform)
+		}
+	}
+	for template, window := range c.CoalesceWindow {
+		if window <= 0 {
+			return fmt.Errorf("CoalesceWindow for %v must be greater than zero", template)
+		}
+	}
+	for template, limit := range c.TemplateConcurrency {
+		if limit < 1 {
+			return fmt.Errorf("TemplateConcurrency for %v must be greater than zero", template)
+		}
+	}
+	if c.SummaryHour < 0 || c.SummaryHour > 23 {
+		return fmt.Errorf("SummaryHour must be between 0 and 23")
+	}
+	for template, pushType := range c.TemplatePushTypes {
+		if pushType != "background" && pushType != "alert" {
+			return fmt.Errorf("TemplatePushTypes for %v must be background or alert", template)
+		}
+	}
+	for template, hour := range c.DeliverAtLocalHour {
+		if hour < 0 || hour > 23 {
+			return fmt.Errorf("DeliverAtLocalHour for %v must be between 0 and 23", template)
+		}
+	}
 
 	return nil
 }
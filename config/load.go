@@ -0,0 +1,37 @@
+package config
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/Netflix/go-env"
+	"github.com/joho/godotenv"
+)
+
+// Load reads the config from the environment and validates it. The variables
+// of the env file, when set, take precedence over the environment, so the
+// config can be changed while running and reloaded.
+func Load(envFile string) (*Config, error) {
+	environ, err := env.EnvironToEnvSet(os.Environ())
+	if err != nil {
+		return nil, err
+	}
+	if envFile != "" {
+		variables, err := godotenv.Read(envFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config file %v: %w", envFile, err)
+		}
+		for key, value := range variables {
+			environ[key] = value
+		}
+	}
+
+	var config Config
+	if err := env.Unmarshal(environ, &config); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return &config, nil
+}
@@ -0,0 +1,39 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ApplyProfile loads the named profile from a json file holding environment
+// variables per profile, e.g. {"staging":{"NOTIFY_WORKERS_NUM":"4"}}, and sets
+// them in the process environment. Variables already set in the environment
+// take precedence over the profile.
+func ApplyProfile(path string, name string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read profiles file %v: %w", path, err)
+	}
+
+	var profiles map[string]map[string]string
+	if err := json.Unmarshal(content, &profiles); err != nil {
+		return fmt.Errorf("failed to parse profiles file %v: %w", path, err)
+	}
+
+	profile, ok := profiles[name]
+	if !ok {
+		return fmt.Errorf("profile %v not found in %v", name, path)
+	}
+
+	for key, value := range profile {
+		if _, ok := os.LookupEnv(key); ok {
+			continue
+		}
+		if err := os.Setenv(key, value); err != nil {
+			return fmt.Errorf("failed to set %v: %w", key, err)
+		}
+	}
+
+	return nil
+}
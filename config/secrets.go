@@ -0,0 +1,73 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// SecretProvider resolves a reference to a secret, e.g. a path in a secret
+// manager, to the secret content.
+type SecretProvider interface {
+	Secret(ctx context.Context, ref string) ([]byte, error)
+}
+
+// FileSecretProvider reads secrets from files, the reference being the path.
+type FileSecretProvider struct{}
+
+func (FileSecretProvider) Secret(ctx context.Context, ref string) ([]byte, error) {
+	return os.ReadFile(ref)
+}
+
+// EnvSecretProvider reads secrets from environment variables, the reference
+// being the variable name.
+type EnvSecretProvider struct{}
+
+func (EnvSecretProvider) Secret(ctx context.Context, ref string) ([]byte, error) {
+	value, ok := os.LookupEnv(ref)
+	if !ok {
+		return nil, fmt.Errorf("environment variable %v is not set", ref)
+	}
+	return []byte(value), nil
+}
+
+var (
+	secretProvidersMu sync.RWMutex
+	secretProviders   = map[string]SecretProvider{
+		"file": FileSecretProvider{},
+		"env":  EnvSecretProvider{},
+	}
+)
+
+// RegisterSecretProvider makes a provider available for the references
+// prefixed with its scheme, e.g. "vault:secret/data/fcm".
+func RegisterSecretProvider(scheme string, provider SecretProvider) {
+	secretProvidersMu.Lock()
+	defer secretProvidersMu.Unlock()
+	secretProviders[scheme] = provider
+}
+
+// ResolveSecret returns the secret of a "scheme:ref" reference using the
+// provider registered for the scheme. References without a scheme are file
+// paths.
+func ResolveSecret(ctx context.Context, reference string) ([]byte, error) {
+	scheme, ref := "file", reference
+	if i := strings.Index(reference, ":"); i > 0 {
+		scheme, ref = reference[:i], reference[i+1:]
+	}
+
+	secretProvidersMu.RLock()
+	provider, ok := secretProviders[scheme]
+	secretProvidersMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no secret provider for %v", scheme)
+	}
+
+	secret, err := provider.Secret(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve secret %v: %w", reference, err)
+	}
+	return secret, nil
+}
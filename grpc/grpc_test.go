@@ -0,0 +1,182 @@
+package grpc
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/breez/notify/channel"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/grpc/notifypb"
+	"github.com/breez/notify/http"
+	"github.com/breez/notify/notify"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"gotest.tools/v3/assert"
+)
+
+type testService struct {
+	sentQueue chan *notify.Notification
+}
+
+func (s *testService) Send(ctx context.Context, notification *notify.Notification) error {
+	s.sentQueue <- notification
+	return nil
+}
+
+// dialTestServer serves the NotifyService over an in memory connection,
+// returning a client of it.
+func dialTestServer(t *testing.T, c *config.Config, service notify.Service) notifypb.NotifyServiceClient {
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
+	sender := http.NewSender(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig)
+	options, err := serverOptions(&c.GRPCConfig, c.HTTPConfig.WebhookSecret)
+	assert.NilError(t, err)
+	server := NewServer(sender, options...)
+	listener := bufconn.Listen(1024 * 1024)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.Dial("bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NilError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return notifypb.NewNotifyServiceClient(conn)
+}
+
+// authorized returns the context of a call carrying the webhook secret of the
+// test configs.
+func authorized(ctx context.Context) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer secret")
+}
+
+func testItem(platform string, paymentHash string) http.BatchItem {
+	return http.BatchItem{
+		Query:   http.MobilePushWebHookQuery{Platform: platform, Token: "1234"},
+		Payload: json.RawMessage(`{"template":"payment_received","data":{"payment_hash":"` + paymentHash + `"}}`),
+	}
+}
+
+// testRequest returns the request of Send for the json of the item.
+func testRequest(t *testing.T, item http.BatchItem) *notifypb.SendRequest {
+	body, err := json.Marshal(item)
+	assert.NilError(t, err)
+	return &notifypb.SendRequest{Item: body}
+}
+
+// testBatchRequest returns the request of SendBatch for the json of the items.
+func testBatchRequest(t *testing.T, items ...http.BatchItem) *notifypb.SendBatchRequest {
+	body, err := json.Marshal(items)
+	assert.NilError(t, err)
+	return &notifypb.SendBatchRequest{Items: body}
+}
+
+func TestSend(t *testing.T) {
+	service := &testService{sentQueue: make(chan *notify.Notification, 10)}
+	client := dialTestServer(t, &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{WebhookSecret: "secret", BatchMaxItems: 2, BatchConcurrency: 1}}, service)
+
+	ctx := metadata.AppendToOutgoingContext(authorized(context.Background()), requestIDMetadata, "grpc-request")
+	result, err := client.Send(ctx, testRequest(t, testItem("android", "1")))
+	assert.NilError(t, err)
+	assert.Equal(t, result.Status, int32(200))
+	sent := <-service.sentQueue
+	assert.Equal(t, sent.Data["payment_hash"], "1")
+	assert.Equal(t, sent.RequestID, "grpc-request")
+	assert.Equal(t, result.Notification.Id, "grpc-request")
+	assert.Equal(t, result.Notification.NotificationId, sent.ID)
+	assert.Equal(t, result.Notification.Result, http.ResultSent)
+
+	// Failures are reported with the status matching the webhook response.
+	_, err = client.Send(authorized(context.Background()), testRequest(t, testItem("windows", "2")))
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+	_, err = client.Send(authorized(context.Background()), &notifypb.SendRequest{Item: []byte("not json")})
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+
+	response, err := client.SendBatch(authorized(context.Background()), testBatchRequest(t, testItem("android", "3"), testItem("windows", "4")))
+	assert.NilError(t, err)
+	assert.Equal(t, len(response.Items), 2)
+	assert.Equal(t, response.Items[0].Status, int32(200))
+	assert.Equal(t, response.Items[1].Status, int32(400))
+	assert.Equal(t, response.Items[1].Error.Code, http.ErrCodeUnsupportedPlatform)
+	assert.Equal(t, (<-service.sentQueue).Data["payment_hash"], "3")
+
+	_, err = client.SendBatch(authorized(context.Background()), testBatchRequest(t, testItem("android", "5"), testItem("android", "6"), testItem("android", "7")))
+	assert.Equal(t, status.Code(err), codes.InvalidArgument)
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestSendRequiresSecret(t *testing.T) {
+	service := &testService{sentQueue: make(chan *notify.Notification, 10)}
+	client := dialTestServer(t, &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{WebhookSecret: "secret"}}, service)
+
+	_, err := client.Send(context.Background(), testRequest(t, testItem("android", "1")))
+	assert.Equal(t, status.Code(err), codes.Unauthenticated)
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	_, err = client.Send(authorized(context.Background()), testRequest(t, testItem("android", "1")))
+	assert.NilError(t, err)
+	assert.Equal(t, (<-service.sentQueue).Data["payment_hash"], "1")
+
+	// The service does not start without a secret.
+	_, err = serverOptions(&config.GRPCConfig{}, "")
+	assert.ErrorContains(t, err, "requires the webhook secret")
+}
+
+func TestSendChecksLikeWebhook(t *testing.T) {
+	service := &testService{sentQueue: make(chan *notify.Notification, 10)}
+	client := dialTestServer(t, &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{
+		WebhookSecret:      "secret",
+		BatchMaxItems:      2,
+		BatchConcurrency:   1,
+		SignatureProviders: config.SignatureProviders{"sender": {Secret: "provider"}},
+		ReplayProtection:   true,
+		ReplayWindow:       time.Minute,
+		IdempotencyWindow:  time.Minute,
+	}}, service)
+
+	// The signature covers the json bytes of the request, the nonce being used
+	// once.
+	signed := func(body []byte, nonce string, secret string) context.Context {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(body)
+		return metadata.AppendToOutgoingContext(authorized(context.Background()),
+			"x-hook-signature", hex.EncodeToString(mac.Sum(nil)),
+			"x-notify-timestamp", strconv.FormatInt(time.Now().Unix(), 10),
+			"x-notify-nonce", nonce)
+	}
+
+	item := testRequest(t, testItem("android", "1"))
+	_, err := client.Send(signed(item.Item, "1", "wrong"), item)
+	assert.Equal(t, status.Code(err), codes.Unauthenticated)
+	result, err := client.Send(signed(item.Item, "2", "provider"), item)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Notification.Result, http.ResultSent)
+	assert.Equal(t, (<-service.sentQueue).Data["payment_hash"], "1")
+
+	_, err = client.Send(signed(item.Item, "2", "provider"), item)
+	assert.Equal(t, status.Code(err), codes.Unauthenticated)
+
+	// The same notification is deduplicated within the idempotency window.
+	result, err = client.Send(signed(item.Item, "3", "provider"), item)
+	assert.NilError(t, err)
+	assert.Equal(t, result.Notification.Result, http.ResultDeduplicated)
+
+	request := testBatchRequest(t, testItem("android", "2"))
+	_, err = client.SendBatch(signed(request.Items, "4", "wrong"), request)
+	assert.Equal(t, status.Code(err), codes.Unauthenticated)
+	response, err := client.SendBatch(signed(request.Items, "5", "provider"), request)
+	assert.NilError(t, err)
+	assert.Equal(t, response.Items[0].Status, int32(200))
+	assert.Equal(t, (<-service.sentQueue).Data["payment_hash"], "2")
+	assert.Equal(t, len(service.sentQueue), 0)
+}
@@ -0,0 +1,5 @@
+// Package notifypb holds the messages and the stubs of the NotifyService,
+// generated from notify.proto.
+package notifypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative notify.proto
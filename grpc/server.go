@@ -0,0 +1,109 @@
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/breez/notify/channel"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/grpc/notifypb"
+	"github.com/breez/notify/http"
+	"github.com/breez/notify/notify"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Run serves the NotifyService on the address of the gRPC config until ctx is
+// cancelled, then waits for the in-flight calls to complete. The calls are
+// checked against the config of the webhook and require its secret, the
+// service failing to start without one.
+func Run(ctx context.Context, notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.Config) error {
+	options, err := serverOptions(&config.GRPCConfig, config.HTTPConfig.WebhookSecret)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", config.GRPCConfig.Address)
+	if err != nil {
+		return err
+	}
+	server := NewServer(http.NewSender(notifier, channel, &config.HTTPConfig), options...)
+
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+	notifier.Logger().Info("shutting down the grpc server, draining in-flight calls")
+	server.GracefulStop()
+	return <-served
+}
+
+// NewServer returns a server of the NotifyService sending the notifications
+// with the sender.
+func NewServer(sender *http.Sender, options ...grpc.ServerOption) *grpc.Server {
+	server := grpc.NewServer(options...)
+	notifypb.RegisterNotifyServiceServer(server, &notifyService{sender: sender})
+	return server
+}
+
+// serverOptions returns the options requiring the secret as a bearer token,
+// and serving over TLS when a certificate is configured.
+func serverOptions(config *config.GRPCConfig, secret string) ([]grpc.ServerOption, error) {
+	if secret == "" {
+		return nil, errors.New("the grpc service requires the webhook secret")
+	}
+	options := []grpc.ServerOption{grpc.UnaryInterceptor(bearerAuth(secret))}
+	if config.TLSCertFile == "" && config.TLSKeyFile == "" {
+		if config.TLSClientCAFile != "" {
+			return nil, errors.New("the tls client ca requires the tls certificate and key files")
+		}
+		return options, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the tls certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if config.TLSClientCAFile != "" {
+		pem, err := os.ReadFile(config.TLSClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the tls client ca: %w", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate found in the tls client ca file")
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return append(options, grpc.Creds(credentials.NewTLS(tlsConfig))), nil
+}
+
+// bearerAuth requires the token in the authorization metadata of the calls,
+// as "Bearer <token>".
+func bearerAuth(token string) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		var provided string
+		if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+			provided = strings.TrimPrefix(values[0], "Bearer ")
+		}
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			return nil, status.Error(codes.Unauthenticated, "invalid bearer token")
+		}
+		return handler(ctx, req)
+	}
+}
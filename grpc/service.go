@@ -0,0 +1,140 @@
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	nethttp "net/http"
+
+	"github.com/breez/notify/grpc/notifypb"
+	"github.com/breez/notify/http"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// requestIDMetadata is the request id of the call, generated when missing.
+const requestIDMetadata = "x-request-id"
+
+// notifyService sends the notifications like the webhook.
+type notifyService struct {
+	notifypb.UnimplementedNotifyServiceServer
+	sender *http.Sender
+}
+
+func (s *notifyService) Send(ctx context.Context, request *notifypb.SendRequest) (*notifypb.SendResponse, error) {
+	item := new(http.BatchItem)
+	if err := json.Unmarshal(request.Item, item); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid item: %v", err))
+	}
+	result := s.sender.Send(ctx, requestID(ctx), header(ctx), request.Item, item)
+	if result.Error != nil {
+		return nil, status.Error(statusCode(result.Status), result.Error.Message)
+	}
+	return sendResponse(&result), nil
+}
+
+func (s *notifyService) SendBatch(ctx context.Context, request *notifypb.SendBatchRequest) (*notifypb.SendBatchResponse, error) {
+	var items []http.BatchItem
+	if err := json.Unmarshal(request.Items, &items); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("invalid batch: %v", err))
+	}
+	response, err := s.sender.SendBatch(ctx, requestID(ctx), header(ctx), request.Items, items)
+	var callErr *http.CallError
+	if errors.As(err, &callErr) {
+		return nil, status.Error(statusCode(callErr.Status), err.Error())
+	}
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	batch := &notifypb.SendBatchResponse{}
+	for i := range response.Items {
+		batch.Items = append(batch.Items, sendResponse(&response.Items[i]))
+	}
+	for _, quorum := range response.Quorums {
+		batch.Quorums = append(batch.Quorums, &notifypb.Quorum{
+			Template: quorum.Template,
+			Required: int32(quorum.Required),
+			Sent:     int32(quorum.Sent),
+			Devices:  int32(quorum.Devices),
+			Met:      quorum.Met,
+		})
+	}
+	return batch, nil
+}
+
+// sendResponse returns the message of the result of a notification.
+func sendResponse(result *http.BatchItemResult) *notifypb.SendResponse {
+	response := &notifypb.SendResponse{Status: int32(result.Status), Retryable: result.Retryable}
+	if n := result.Notification; n != nil {
+		response.Notification = &notifypb.Notification{
+			Id:             n.ID,
+			NotificationId: n.NotificationID,
+			EventId:        n.EventID,
+			Template:       n.Template,
+			Platform:       n.Platform,
+			Target:         n.Target,
+			Result:         n.Result,
+			MessageId:      n.MessageID,
+			MigratedToken:  n.MigratedToken,
+			ErrorReason:    n.ErrorReason,
+			Deduplicated:   n.Deduplicated,
+		}
+		if n.DeliverAt != nil {
+			response.Notification.DeliverAt = timestamppb.New(*n.DeliverAt)
+		}
+	}
+	if e := result.Error; e != nil {
+		response.Error = &notifypb.Error{Code: e.Code, Message: e.Message}
+		for _, field := range e.Fields {
+			response.Error.Fields = append(response.Error.Fields, &notifypb.FieldError{Field: field.Field, Tag: field.Tag, Param: field.Param})
+		}
+	}
+	return response
+}
+
+// requestID returns the request id of the metadata of the call.
+func requestID(ctx context.Context) string {
+	if values := metadata.ValueFromIncomingContext(ctx, requestIDMetadata); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// header returns the metadata of the call as the headers of a webhook
+// request, e.g. the signatures, the replay protection and the idempotency key.
+func header(ctx context.Context) nethttp.Header {
+	md, _ := metadata.FromIncomingContext(ctx)
+	header := make(nethttp.Header, len(md))
+	for key, values := range md {
+		for _, value := range values {
+			header.Add(key, value)
+		}
+	}
+	return header
+}
+
+// statusCode returns the status code matching the http status of a failed
+// notification.
+func statusCode(httpStatus int) codes.Code {
+	switch httpStatus {
+	case nethttp.StatusBadRequest, nethttp.StatusRequestEntityTooLarge:
+		return codes.InvalidArgument
+	case nethttp.StatusUnauthorized:
+		return codes.Unauthenticated
+	case nethttp.StatusNotFound, nethttp.StatusGone:
+		return codes.NotFound
+	case nethttp.StatusTooManyRequests:
+		return codes.ResourceExhausted
+	case nethttp.StatusServiceUnavailable, nethttp.StatusBadGateway:
+		return codes.Unavailable
+	case nethttp.StatusGatewayTimeout:
+		return codes.DeadlineExceeded
+	}
+	if httpStatus >= nethttp.StatusInternalServerError {
+		return codes.Internal
+	}
+	return codes.Unknown
+}
@@ -0,0 +1,171 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// streamOutcomes streams the delivery outcomes as server sent events until
+// the client disconnects. Targets are masked.
+func streamOutcomes(notifier *notify.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		outcomes, unsubscribe := notifier.SubscribeOutcomes(100)
+		defer unsubscribe()
+
+		// Let the client know it is subscribed before the first event.
+		c.Header("Content-Type", "text/event-stream")
+		c.Writer.WriteHeaderNow()
+		c.Writer.Flush()
+
+		c.Stream(func(w io.Writer) bool {
+			select {
+			case outcome := <-outcomes:
+				outcome.TargetIdentifier = notify.MaskToken(outcome.TargetIdentifier)
+				c.SSEvent("outcome", outcome)
+				return true
+			case <-c.Request.Context().Done():
+				return false
+			}
+		})
+	}
+}
+
+// deliveryReport returns the delivery counts and failure rates per template
+// and platform over the report window.
+func deliveryReport(notifier *notify.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		report, ok := notifier.Report()
+		if !ok {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, errors.New("delivery report is disabled"))
+			return
+		}
+		c.JSON(http.StatusOK, report)
+	}
+}
+
+// InvalidTokensResponse lists the tokens the providers reported as
+// unregistered, masked.
+type InvalidTokensResponse struct {
+	Tokens []notify.TokenInvalidation `json:"tokens"`
+}
+
+// invalidTokens lists the tokens invalidated within the ttl, the most recent
+// first.
+func invalidTokens(notifier *notify.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		invalidations, err := notifier.InvalidTokens()
+		if err != nil {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+			return
+		}
+		for i := range invalidations {
+			invalidations[i].Token = notify.MaskToken(invalidations[i].Token)
+		}
+		c.JSON(http.StatusOK, InvalidTokensResponse{Tokens: invalidations})
+	}
+}
+
+// defaultHistoryLimit is the number of notifications listed when the query
+// sets no limit.
+const defaultHistoryLimit = 100
+
+// HistoryQuery filters the notifications listed by the admins, by prefix for
+// the token.
+type HistoryQuery struct {
+	Template    string `form:"template"`
+	Platform    string `form:"platform"`
+	Status      string `form:"status" binding:"omitempty,oneof=queued sent failed retrying"`
+	TokenPrefix string `form:"token_prefix"`
+	Limit       int    `form:"limit" binding:"omitempty,min=1,max=1000"`
+}
+
+// HistoryResponse lists the recent notifications, the most recently updated
+// first.
+type HistoryResponse struct {
+	Notifications []*notify.NotificationStatus `json:"notifications"`
+}
+
+// notificationHistory lists the delivery statuses of the recent notifications
+// along with the notifications, their failures included.
+func notificationHistory(notifier *notify.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		var query HistoryQuery
+		if err := c.ShouldBindQuery(&query); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+			return
+		}
+		if query.Limit == 0 {
+			query.Limit = defaultHistoryLimit
+		}
+		statuses, err := notifier.Statuses(notify.StatusFilter{
+			Template:    query.Template,
+			Platform:    query.Platform,
+			Status:      notify.DeliveryStatus(query.Status),
+			TokenPrefix: query.TokenPrefix,
+			Limit:       query.Limit,
+		})
+		if errors.Is(err, notify.ErrStatusDisabled) {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+			return
+		}
+		if err != nil {
+			notifier.Logger().Error("failed to list the delivery statuses", "request_id", c.GetString(requestIDKey), "error", err)
+			abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, errors.New("failed to list the delivery statuses"))
+			return
+		}
+		for _, status := range statuses {
+			maskNotification(status)
+		}
+		if statuses == nil {
+			statuses = []*notify.NotificationStatus{}
+		}
+		c.JSON(http.StatusOK, HistoryResponse{Notifications: statuses})
+	}
+}
+
+// resendNotification sends a failed notification again, responding with its
+// status once delivered or failed again.
+func resendNotification(notifier *notify.Notifier, timeout time.Duration) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.Param("id")
+		ctx, cancel := withNotifyTimeout(notify.WithRequestID(c.Request.Context(), c.GetString(requestIDKey)), timeout)
+		defer cancel()
+		_, err := notifier.Resend(ctx, id)
+		switch {
+		case errors.Is(err, notify.ErrStatusDisabled):
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+			return
+		case errors.Is(err, notify.ErrStatusNotFound):
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownNotification, err)
+			return
+		case errors.Is(err, notify.ErrNotResendable):
+			abortWithError(c, http.StatusConflict, ErrCodeNotResendable, err)
+			return
+		case err != nil:
+			// The failure is reported by the status.
+			notifier.Logger().Info("failed to send the notification again", "request_id", c.GetString(requestIDKey), "id", id, "error", err)
+		}
+		status, err := notifier.Status(id)
+		if err != nil {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownNotification, err)
+			return
+		}
+		maskNotification(status)
+		c.JSON(http.StatusOK, status)
+	}
+}
+
+// maskNotification masks the target of the notification of the status.
+func maskNotification(status *notify.NotificationStatus) {
+	if status.Notification == nil {
+		return
+	}
+	notification := *status.Notification
+	notification.TargetIdentifier = notify.MaskToken(notification.TargetIdentifier)
+	status.Notification = &notification
+}
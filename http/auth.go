@@ -0,0 +1,34 @@
+package http
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bearerAuth requires the token as a bearer token in the Authorization
+// header.
+func bearerAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+			abortWithError(c, http.StatusUnauthorized, ErrCodeUnauthorized, errors.New("invalid bearer token"))
+			return
+		}
+		c.Next()
+	}
+}
+
+// webhookAuth requires the webhook secret as a bearer token, unless no secret
+// is configured.
+func webhookAuth(secret string) gin.HandlerFunc {
+	if secret == "" {
+		return func(c *gin.Context) {
+			c.Next()
+		}
+	}
+	return bearerAuth(secret)
+}
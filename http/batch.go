@@ -0,0 +1,350 @@
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/breez/notify/channel"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/gin-gonic/gin/binding"
+	"golang.org/x/exp/slog"
+)
+
+// BatchItem is a notification of a batch request, addressed to the device of
+// its query.
+type BatchItem struct {
+	Query   MobilePushWebHookQuery `json:"query"`
+	Payload json.RawMessage        `json:"payload"`
+}
+
+// BatchItemResult is the outcome of a notification of a batch. The status is
+// the one the notification would have been responded with on its own.
+type BatchItemResult struct {
+	Status       int                   `json:"status"`
+	Notification *NotificationResponse `json:"notification,omitempty"`
+	Error        *ErrorBody            `json:"error,omitempty"`
+	// Retryable is set on the failures worth sending again, as they are
+	// caused by a rate limit or a transient failure of the service.
+	Retryable bool `json:"retryable,omitempty"`
+}
+
+// BatchResponse lists the results of the notifications in the order of the
+// batch items.
+type BatchResponse struct {
+	Items []BatchItemResult `json:"items"`
+	// Quorums reports whether the notifications of the templates requiring a
+	// delivery quorum were sent to enough devices.
+	Quorums []QuorumResult `json:"quorums,omitempty"`
+}
+
+// QuorumResult tells whether a notification was sent to the number of
+// devices its template requires, out of the devices it was addressed to.
+type QuorumResult struct {
+	Template string `json:"template"`
+	Required int    `json:"required"`
+	Sent     int    `json:"sent"`
+	Devices  int    `json:"devices"`
+	Met      bool   `json:"met"`
+}
+
+// notifyRequest is the request notifications are sent for, whether it
+// reached the webhook or another transport.
+type notifyRequest struct {
+	// ctx is cancelled along with the request.
+	ctx context.Context
+	// detached outlives the request, for the wake ups completing once it is
+	// responded to.
+	detached  context.Context
+	requestID string
+	// header holds the headers of the request, or the metadata of the call.
+	header http.Header
+	// dedup is nil when the notifications of the request are not
+	// deduplicated.
+	dedup DedupStore
+}
+
+// ginRequest returns the request of the gin context.
+func ginRequest(c *gin.Context) *notifyRequest {
+	return &notifyRequest{ctx: c.Request.Context(), detached: withSpan(c), requestID: c.GetString(requestIDKey), header: c.Request.Header}
+}
+
+// batchHandler sends the notifications of a batch concurrently, reporting the
+// result of each of them.
+type batchHandler struct {
+	notifier         *notify.Notifier
+	channel          *channel.HttpCallbackChannel
+	basePath         string
+	platforms        map[string]bool
+	enabledPlatforms []string
+	// limiter is nil when the notifications per token are not limited.
+	limiter    RateLimiter
+	signatures *signatureVerifier
+	// relayTemplates await the reply of the app, like the callback payloads.
+	relayTemplates map[string]bool
+	catalog        *messageCatalog
+	config         *config.HTTPConfig
+	metrics        *metrics
+}
+
+// newBatchHandler returns the handler of the batches of the webhook served at
+// basePath, the limiter being nil when the tokens are not rate limited.
+func newBatchHandler(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, basePath string, config *config.HTTPConfig, limiter RateLimiter, m *metrics) *batchHandler {
+	enabledPlatforms := []string(config.Platforms)
+	if len(enabledPlatforms) == 0 {
+		enabledPlatforms = defaultPlatforms
+	}
+	platforms := make(map[string]bool, len(enabledPlatforms))
+	for _, platform := range enabledPlatforms {
+		platforms[platform] = true
+	}
+	relayTemplates := make(map[string]bool, len(config.RelayReplyTemplates))
+	for _, template := range config.RelayReplyTemplates {
+		relayTemplates[template] = true
+	}
+	return &batchHandler{
+		notifier:         notifier,
+		channel:          channel,
+		basePath:         basePath,
+		platforms:        platforms,
+		enabledPlatforms: enabledPlatforms,
+		limiter:          limiter,
+		signatures:       newSignatureVerifier(config.SignatureProviders),
+		relayTemplates:   relayTemplates,
+		catalog:          defaultCatalog.withMessages(config.Messages),
+		config:           config,
+		metrics:          m,
+	}
+}
+
+// handle responds with 200 when all the notifications were sent and with 207
+// when some of them failed.
+func (b *batchHandler) handle(c *gin.Context) {
+	requestID := c.GetString(requestIDKey)
+	logger := b.notifier.Logger().With("request_id", requestID)
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, errors.New("failed to read request body"))
+		return
+	}
+	var items []BatchItem
+	if err := json.Unmarshal(body, &items); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, fmt.Errorf("invalid batch: %w", err))
+		return
+	}
+	if err := b.checkSize(items); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+		return
+	}
+
+	// The providers sign the whole batch.
+	payloads := make([]string, 0, len(items))
+	for _, item := range items {
+		payloads = append(payloads, payloadName(item.Payload))
+	}
+	if err := b.signatures.verify(c.Request.Header, body, payloads...); err != nil {
+		logger.Info("rejecting batch without a valid provider signature")
+		abortWithError(c, http.StatusUnauthorized, ErrCodeUnauthorized, err)
+		return
+	}
+
+	b.respondWithResults(c, b.sendAll(ginRequest(c), items, logger))
+}
+
+// checkSize fails empty batches and those exceeding the maximum items.
+func (b *batchHandler) checkSize(items []BatchItem) error {
+	if len(items) == 0 {
+		return errors.New("empty batch")
+	}
+	if len(items) > b.config.BatchMaxItems {
+		return fmt.Errorf("batch of %v items exceeds the maximum of %v", len(items), b.config.BatchMaxItems)
+	}
+	return nil
+}
+
+// sendAll sends the items concurrently, returning their results in order.
+func (b *batchHandler) sendAll(r *notifyRequest, items []BatchItem, logger *slog.Logger) []BatchItemResult {
+	concurrency := b.config.BatchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	workers := make(chan struct{}, concurrency)
+	results := make([]BatchItemResult, len(items))
+	var wg sync.WaitGroup
+	for i := range items {
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			results[i] = b.send(r, &items[i], logger.With("item", i))
+		}(i)
+	}
+	wg.Wait()
+	return results
+}
+
+// respondWithResults responds with the status of the results.
+func (b *batchHandler) respondWithResults(c *gin.Context, results []BatchItemResult) {
+	status, response := b.response(results)
+	c.JSON(status, response)
+}
+
+// response returns the response of the results and its status: 200 when all
+// the notifications were sent, or scheduled, and 207 when some of them
+// failed. The notifications of a template requiring a delivery quorum are
+// sent once it is met, even though some of their devices failed, and the
+// status is 502 when a quorum is not met.
+func (b *batchHandler) response(results []BatchItemResult) (int, *BatchResponse) {
+	response := &BatchResponse{Items: results, Quorums: b.quorums(results)}
+	for _, quorum := range response.Quorums {
+		if !quorum.Met {
+			return http.StatusBadGateway, response
+		}
+	}
+	for _, result := range results {
+		if result.Error == nil {
+			continue
+		}
+		if result.Notification == nil || b.config.DeliveryQuorum[result.Notification.Template] == 0 {
+			return http.StatusMultiStatus, response
+		}
+	}
+	return http.StatusOK, response
+}
+
+// quorums counts the devices the notifications of the templates requiring a
+// delivery quorum were sent to. A quorum larger than the devices requires
+// all of them.
+func (b *batchHandler) quorums(results []BatchItemResult) []QuorumResult {
+	var quorums []QuorumResult
+	index := make(map[string]int)
+	for _, result := range results {
+		if result.Notification == nil {
+			continue
+		}
+		template := result.Notification.Template
+		required := b.config.DeliveryQuorum[template]
+		if required == 0 {
+			continue
+		}
+		i, ok := index[template]
+		if !ok {
+			i = len(quorums)
+			index[template] = i
+			quorums = append(quorums, QuorumResult{Template: template, Required: required})
+		}
+		quorums[i].Devices++
+		if result.Error == nil && result.Notification.Result == ResultSent {
+			quorums[i].Sent++
+		}
+	}
+	for i := range quorums {
+		if quorums[i].Required > quorums[i].Devices {
+			quorums[i].Required = quorums[i].Devices
+		}
+		quorums[i].Met = quorums[i].Sent >= quorums[i].Required
+	}
+	return quorums
+}
+
+// send validates and sends a notification of the batch.
+func (b *batchHandler) send(r *notifyRequest, item *BatchItem, logger *slog.Logger) BatchItemResult {
+	ctx := notify.WithRequestID(r.ctx, r.requestID)
+	// Items not sent yet when the request is cancelled are not sent at all.
+	if err := ctx.Err(); err != nil {
+		return failedItem(&requestError{status: http.StatusServiceUnavailable, code: ErrCodeBackendUnavailable, err: errors.New("request cancelled")}, nil)
+	}
+
+	query := item.Query
+	if err := binding.Validator.ValidateStruct(&query); err != nil {
+		return failedItem(&requestError{status: http.StatusBadRequest, code: ErrCodeInvalidQuery, err: err}, nil)
+	}
+	if query.Platform == "" || query.Token == "" {
+		return failedItem(&requestError{status: http.StatusBadRequest, code: ErrCodeInvalidQuery, err: errors.New("platform and token are required")}, nil)
+	}
+	if !b.platforms[query.Platform] {
+		return failedItem(&requestError{status: http.StatusBadRequest, code: ErrCodeUnsupportedPlatform, err: unsupportedPlatform(query.Platform, b.enabledPlatforms)}, nil)
+	}
+	if err := checkAppData(query.AppData, b.config); err != nil {
+		return failedItem(&requestError{status: http.StatusBadRequest, code: ErrCodeInvalidQuery, err: err}, nil)
+	}
+	if query.AppData == nil && b.config.DefaultAppData != "" {
+		query.AppData = &b.config.DefaultAppData
+	}
+	logger = logger.With("platform", query.Platform, "token", notify.MaskToken(query.Token))
+
+	if b.limiter != nil {
+		allowed, _, err := b.limiter.Allow(ctx, query.Token)
+		if err != nil {
+			logger.Error("failed to check the rate limit, allowing the notification", "error", err)
+		} else if !allowed {
+			return failedItem(&requestError{status: http.StatusTooManyRequests, code: ErrCodeRateLimited, err: errors.New("too many notifications to this device")}, nil)
+		}
+	}
+
+	validPayload, notification, reqErr := parseNotification(r, item.Payload, &query, b.config, b.catalog, b.metrics, logger)
+	if reqErr != nil {
+		return failedItem(reqErr, nil)
+	}
+	if swapStatusFiltered(validPayload, &query, b.config) {
+		logger.Debug("dropping filtered swap status")
+		return BatchItemResult{Status: http.StatusOK, Notification: newNotificationResponse(r.requestID, notification, ResultFiltered)}
+	}
+	// The replies awaited by these payloads are the response of their request.
+	if validPayload.RequiresCallback() || b.relayTemplates[notification.Template] {
+		return failedItem(&requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload,
+			err: fmt.Errorf("template %v awaits a reply and can't be batched", notification.Template)}, nil)
+	}
+	if notification.DeliverAt != nil {
+		response, reqErr := scheduleNotification(r, b.notifier, &query, notification)
+		if reqErr != nil {
+			return failedItem(reqErr, nil)
+		}
+		return BatchItemResult{Status: http.StatusAccepted, Notification: response}
+	}
+
+	dedupKey, reserved := reserveNotification(r, b.config, notification, logger)
+	if !reserved {
+		return BatchItemResult{Status: http.StatusOK, Notification: newNotificationResponse(r.requestID, notification, ResultDeduplicated)}
+	}
+
+	var result *notify.Result
+	var err error
+	if window, ok := b.config.WakeFallback[notification.Template]; ok {
+		// The wake up is sent once the batch is responded to.
+		err = b.channel.WakeWithFallback(notify.WithRequestID(r.detached, r.requestID), b.notifier, b.basePath, notification, window)
+	} else {
+		sendCtx, cancel := withNotifyTimeout(ctx, b.config.NotifyTimeout)
+		result, err = b.notifier.NotifyAndWait(sendCtx, notification)
+		cancel()
+	}
+	if err != nil {
+		logger.Info("failed to notify", "template", notification.Template, "error", err)
+		releaseNotification(r, dedupKey, logger)
+		reqErr := notifyError(err, &query, notification)
+		if reqErr.reason == "" {
+			return failedItem(reqErr, nil)
+		}
+		return failedItem(reqErr, newFailedResponse(r.requestID, notification, reqErr.reason))
+	}
+	return BatchItemResult{Status: http.StatusOK, Notification: newDeliveredResponse(r.requestID, notification, result)}
+}
+
+// failedItem returns the result of a notification of the batch that failed,
+// along with the notification when its delivery failed.
+func failedItem(reqErr *requestError, notification *NotificationResponse) BatchItemResult {
+	return BatchItemResult{
+		Status:       reqErr.status,
+		Notification: notification,
+		Error:        &ErrorBody{Code: reqErr.code, Message: reqErr.err.Error(), Fields: fieldErrors(reqErr.err)},
+		Retryable:    reqErr.status == http.StatusTooManyRequests || reqErr.status >= http.StatusInternalServerError,
+	}
+}
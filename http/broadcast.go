@@ -0,0 +1,263 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// maxBroadcasts is the number of broadcasts whose progress is kept, the
+// oldest being forgotten first.
+const maxBroadcasts = 20
+
+const (
+	BroadcastRunning   = "running"
+	BroadcastDone      = "done"
+	BroadcastCancelled = "cancelled"
+)
+
+// BroadcastQuery selects the devices a broadcast is sent to.
+type BroadcastQuery struct {
+	Platform string `form:"platform" binding:"required"`
+	// DryRun only counts the devices, sending nothing.
+	DryRun bool `form:"dry_run"`
+}
+
+// BroadcastStatus reports the progress of a broadcast.
+type BroadcastStatus struct {
+	ID       string `json:"id"`
+	Platform string `json:"platform"`
+	Template string `json:"template,omitempty"`
+	// Total is the number of devices of the broadcast, Sent and Failed those
+	// it was sent to so far.
+	Total      int        `json:"total"`
+	Sent       int        `json:"sent"`
+	Failed     int        `json:"failed"`
+	State      string     `json:"state,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// broadcast is a notification being sent to the devices of a platform.
+type broadcast struct {
+	sync.Mutex
+	status BroadcastStatus
+	cancel context.CancelFunc
+}
+
+func (b *broadcast) snapshot() BroadcastStatus {
+	b.Lock()
+	defer b.Unlock()
+	return b.status
+}
+
+// broadcasts runs one broadcast at a time, keeping the progress of the most
+// recent ones.
+type broadcasts struct {
+	sync.Mutex
+	// order lists the ids of the broadcasts from the oldest.
+	order []string
+	byID  map[string]*broadcast
+	// running is nil when no broadcast is in progress.
+	running *broadcast
+}
+
+func newBroadcasts() *broadcasts {
+	return &broadcasts{byID: make(map[string]*broadcast)}
+}
+
+// start adds the broadcast, returning false when another one is in progress.
+func (s *broadcasts) start(b *broadcast) bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.running != nil {
+		return false
+	}
+	s.running = b
+	s.byID[b.status.ID] = b
+	s.order = append(s.order, b.status.ID)
+	if len(s.order) > maxBroadcasts {
+		delete(s.byID, s.order[0])
+		s.order = s.order[1:]
+	}
+	return true
+}
+
+// finish marks the broadcast done, or cancelled when it was.
+func (s *broadcasts) finish(b *broadcast, cancelled bool) {
+	s.Lock()
+	if s.running == b {
+		s.running = nil
+	}
+	s.Unlock()
+	now := time.Now()
+	b.Lock()
+	defer b.Unlock()
+	b.status.State = BroadcastDone
+	if cancelled {
+		b.status.State = BroadcastCancelled
+	}
+	b.status.FinishedAt = &now
+}
+
+func (s *broadcasts) get(id string) (*broadcast, bool) {
+	s.Lock()
+	defer s.Unlock()
+	b, ok := s.byID[id]
+	return b, ok
+}
+
+// addBroadcastRouter registers the admin endpoints sending a notification to
+// all the devices of a platform and reporting the progress of the broadcasts.
+func addBroadcastRouter(admin *gin.RouterGroup, batch *batchHandler, config *config.HTTPConfig, state *broadcasts) {
+	admin.POST("/broadcast", func(c *gin.Context) {
+		var query BroadcastQuery
+		if err := c.ShouldBindQuery(&query); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+			return
+		}
+		if !batch.platforms[query.Platform] {
+			abortWithError(c, http.StatusBadRequest, ErrCodeUnsupportedPlatform, unsupportedPlatform(query.Platform, batch.enabledPlatforms))
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, errors.New("failed to read request body"))
+			return
+		}
+		devices, err := batch.notifier.PlatformDevices(query.Platform)
+		if err != nil {
+			abortWithDeviceError(c, err)
+			return
+		}
+		if len(devices) == 0 {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownDevice, fmt.Errorf("no device is registered on %v", query.Platform))
+			return
+		}
+
+		// The payload is checked once, rather than failing on every device.
+		logger := batch.notifier.Logger().With("request_id", c.GetString(requestIDKey), "platform", query.Platform)
+		firstQuery := deviceQuery(devices[0])
+		validPayload, notification, reqErr := parseNotification(ginRequest(c), body, &firstQuery, config, batch.catalog, batch.metrics, logger)
+		if reqErr != nil {
+			abortWithError(c, reqErr.status, reqErr.code, reqErr.err)
+			return
+		}
+		if validPayload.RequiresCallback() || batch.relayTemplates[notification.Template] {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, fmt.Errorf("template %v awaits a reply and can't be broadcast", notification.Template))
+			return
+		}
+		if query.DryRun {
+			c.JSON(http.StatusOK, BroadcastStatus{Platform: query.Platform, Template: notification.Template, Total: len(devices)})
+			return
+		}
+
+		now := time.Now()
+		ctx, cancel := context.WithCancel(context.Background())
+		b := &broadcast{
+			status: BroadcastStatus{
+				ID:        newRequestID(),
+				Platform:  query.Platform,
+				Template:  notification.Template,
+				Total:     len(devices),
+				State:     BroadcastRunning,
+				StartedAt: &now,
+			},
+			cancel: cancel,
+		}
+		if !state.start(b) {
+			cancel()
+			abortWithError(c, http.StatusConflict, ErrCodeBroadcastRunning, errors.New("another broadcast is in progress"))
+			return
+		}
+		logger.Info("starting broadcast", "broadcast_id", b.status.ID, "template", notification.Template, "devices", len(devices))
+		r := &notifyRequest{ctx: ctx, detached: ctx, requestID: b.status.ID, header: c.Request.Header.Clone()}
+		go func() {
+			batch.broadcast(r, b, devices, body, config.BroadcastRate)
+			state.finish(b, ctx.Err() != nil)
+			cancel()
+			status := b.snapshot()
+			logger.Info("broadcast finished", "broadcast_id", status.ID, "state", status.State, "sent", status.Sent, "failed", status.Failed)
+		}()
+
+		c.Header("Location", path.Join(admin.BasePath(), "broadcast", b.status.ID))
+		c.JSON(http.StatusAccepted, b.snapshot())
+	})
+
+	admin.GET("/broadcast/:id", func(c *gin.Context) {
+		b, ok := state.get(c.Param("id"))
+		if !ok {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, errors.New("unknown broadcast"))
+			return
+		}
+		c.JSON(http.StatusOK, b.snapshot())
+	})
+
+	// A broadcast is cancelled before the devices it was not sent to yet.
+	admin.DELETE("/broadcast/:id", func(c *gin.Context) {
+		b, ok := state.get(c.Param("id"))
+		if !ok {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, errors.New("unknown broadcast"))
+			return
+		}
+		b.cancel()
+		c.JSON(http.StatusOK, b.snapshot())
+	})
+}
+
+// deviceQuery returns the query notifying the device.
+func deviceQuery(device notify.Device) MobilePushWebHookQuery {
+	return MobilePushWebHookQuery{Platform: device.Platform, Token: device.Token, AppData: device.AppData}
+}
+
+// broadcast sends the body to the devices at the rate per second, with the
+// concurrency of the batches, counting the devices it was sent to or failed
+// for, until the request is cancelled.
+func (b *batchHandler) broadcast(r *notifyRequest, progress *broadcast, devices []notify.Device, body []byte, rate int) {
+	if rate < 1 {
+		rate = 1
+	}
+	concurrency := b.config.BatchConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	workers := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	logger := b.notifier.Logger().With("broadcast_id", r.requestID)
+	for i, device := range devices {
+		select {
+		case <-ticker.C:
+		case <-r.ctx.Done():
+		}
+		if r.ctx.Err() != nil {
+			break
+		}
+		workers <- struct{}{}
+		wg.Add(1)
+		go func(i int, device notify.Device) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			item := BatchItem{Query: deviceQuery(device), Payload: body}
+			result := b.send(r, &item, logger.With("item", i))
+			progress.Lock()
+			defer progress.Unlock()
+			if result.Error != nil {
+				progress.status.Failed++
+			} else {
+				progress.status.Sent++
+			}
+		}(i, device)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// CapabilitiesQuery identifies the device registering its capabilities.
+type CapabilitiesQuery struct {
+	Platform string `form:"platform"`
+	Token    string `form:"token"`
+}
+
+var knownCapabilities = map[notify.Capability]bool{
+	notify.CapabilitySilent:    true,
+	notify.CapabilityRichMedia: true,
+	notify.CapabilityActions:   true,
+}
+
+// registerCapabilities stores the capabilities of a device, e.g.
+// {"silent":false}, so its notifications are tailored to them.
+func registerCapabilities(notifier *notify.Notifier, platforms map[string]bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, ok := bindDeviceQuery(c, platforms)
+		if !ok {
+			return
+		}
+
+		var capabilities notify.Capabilities
+		if err := c.ShouldBindJSON(&capabilities); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+			return
+		}
+		for capability := range capabilities {
+			if !knownCapabilities[capability] {
+				abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, fmt.Errorf("unknown capability %q", capability))
+				return
+			}
+		}
+
+		if err := notifier.SetCapabilities(query.Platform, query.Token, capabilities); err != nil {
+			if errors.Is(err, notify.ErrCapabilitiesDisabled) {
+				abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+				return
+			}
+			abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	}
+}
+
+// bindDeviceQuery binds the device of the query, or of the headers, aborting
+// the request when it is missing or its platform is not supported.
+func bindDeviceQuery(c *gin.Context, platforms map[string]bool) (CapabilitiesQuery, bool) {
+	var query CapabilitiesQuery
+	if err := c.ShouldBindQuery(&query); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+		return query, false
+	}
+	if query.Platform == "" {
+		query.Platform = c.GetHeader(platformHeader)
+	}
+	if query.Token == "" {
+		query.Token = c.GetHeader(tokenHeader)
+	}
+	if query.Platform == "" || query.Token == "" {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery,
+			fmt.Errorf("platform and token are required, in the query or the %v and %v headers", platformHeader, tokenHeader))
+		return query, false
+	}
+	if !platforms[query.Platform] {
+		abortWithError(c, http.StatusBadRequest, ErrCodeUnsupportedPlatform, fmt.Errorf("unsupported platform %q", query.Platform))
+		return query, false
+	}
+	return query, true
+}
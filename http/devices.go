@@ -0,0 +1,184 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+// maxClientIDLength bounds the ids of the clients registering devices.
+const maxClientIDLength = 128
+
+// DeviceRequest registers a device of a client, or updates the device having
+// the previous token.
+type DeviceRequest struct {
+	Platform string  `json:"platform" binding:"required"`
+	Token    string  `json:"token" binding:"required"`
+	AppData  *string `json:"app_data"`
+	// PreviousToken is the token the device had before the update, the token
+	// itself when empty.
+	PreviousToken string `json:"previous_token"`
+}
+
+// DeviceResponse is a device registered for a client, its token masked.
+type DeviceResponse struct {
+	Platform string  `json:"platform"`
+	Token    string  `json:"token"`
+	AppData  *string `json:"app_data,omitempty"`
+}
+
+// DevicesResponse lists the devices of a client.
+type DevicesResponse struct {
+	Devices []DeviceResponse `json:"devices"`
+}
+
+// addDeviceRouter registers the endpoints managing the devices of the
+// clients, which are then notified with the client_id query.
+func addDeviceRouter(r *gin.RouterGroup, notifier *notify.Notifier, platforms map[string]bool, config *config.HTTPConfig) {
+	r.GET("/devices/:client_id", func(c *gin.Context) {
+		respondWithDevices(c, notifier, c.Param("client_id"))
+	})
+
+	r.POST("/devices/:client_id", func(c *gin.Context) {
+		clientID, request, ok := bindDevice(c, platforms, config)
+		if !ok {
+			return
+		}
+		if err := notifier.RegisterDevice(clientID, request.device()); err != nil {
+			abortWithDeviceError(c, err)
+			return
+		}
+		respondWithDevices(c, notifier, clientID)
+	})
+
+	r.PUT("/devices/:client_id", func(c *gin.Context) {
+		clientID, request, ok := bindDevice(c, platforms, config)
+		if !ok {
+			return
+		}
+		previousToken := request.PreviousToken
+		if previousToken == "" {
+			previousToken = request.Token
+		}
+		if err := notifier.UpdateDevice(clientID, previousToken, request.device()); err != nil {
+			abortWithDeviceError(c, err)
+			return
+		}
+		respondWithDevices(c, notifier, clientID)
+	})
+
+	r.DELETE("/devices/:client_id", func(c *gin.Context) {
+		var query CapabilitiesQuery
+		if err := c.ShouldBindQuery(&query); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+			return
+		}
+		if query.Platform == "" || query.Token == "" {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("platform and token are required"))
+			return
+		}
+		if err := notifier.RemoveDevice(c.Param("client_id"), query.Platform, query.Token); err != nil {
+			abortWithDeviceError(c, err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	})
+}
+
+func (r *DeviceRequest) device() notify.Device {
+	return notify.Device{Platform: r.Platform, Token: r.Token, AppData: r.AppData}
+}
+
+// bindDevice binds and validates the device of the request body, aborting
+// the request when it is invalid.
+func bindDevice(c *gin.Context, platforms map[string]bool, config *config.HTTPConfig) (string, *DeviceRequest, bool) {
+	clientID := c.Param("client_id")
+	if len(clientID) > maxClientIDLength {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, fmt.Errorf("client id exceeds %v characters", maxClientIDLength))
+		return "", nil, false
+	}
+	var request DeviceRequest
+	if err := c.ShouldBindJSON(&request); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+		return "", nil, false
+	}
+	if !platforms[request.Platform] {
+		abortWithError(c, http.StatusBadRequest, ErrCodeUnsupportedPlatform, fmt.Errorf("unsupported platform %q", request.Platform))
+		return "", nil, false
+	}
+	if err := checkAppData(request.AppData, config); err != nil {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+		return "", nil, false
+	}
+	return clientID, &request, true
+}
+
+// respondWithDevices responds with the devices of the client.
+func respondWithDevices(c *gin.Context, notifier *notify.Notifier, clientID string) {
+	devices, err := notifier.Devices(clientID)
+	if err != nil {
+		abortWithDeviceError(c, err)
+		return
+	}
+	response := DevicesResponse{Devices: make([]DeviceResponse, 0, len(devices))}
+	for _, device := range devices {
+		response.Devices = append(response.Devices, DeviceResponse{
+			Platform: device.Platform,
+			Token:    notify.MaskToken(device.Token),
+			AppData:  device.AppData,
+		})
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// abortWithDeviceError responds with the error of the device registry.
+func abortWithDeviceError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, notify.ErrDevicesDisabled):
+		abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+	case errors.Is(err, notify.ErrDeviceNotFound):
+		abortWithError(c, http.StatusNotFound, ErrCodeUnknownDevice, err)
+	default:
+		abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, errors.New("failed to access the device registry"))
+	}
+}
+
+// notifyClient sends the notification of the body to the devices registered
+// for the client of the query, responding with the result of each of them
+// like a batch. The app_data of the query overrides those of the devices.
+func (b *batchHandler) notifyClient(c *gin.Context, query MobilePushWebHookQuery, body []byte, logger *slog.Logger) {
+	devices, err := b.notifier.Devices(query.ClientID)
+	if errors.Is(err, notify.ErrDevicesDisabled) {
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("platform and token are required, the device registry is disabled"))
+		return
+	}
+	if err != nil {
+		logger.Error("failed to read the devices of the client", "error", err)
+		abortWithDeviceError(c, err)
+		return
+	}
+
+	var items []BatchItem
+	for _, device := range devices {
+		if query.Platform != "" && device.Platform != query.Platform {
+			continue
+		}
+		deviceQuery := query
+		deviceQuery.Platform = device.Platform
+		deviceQuery.Token = device.Token
+		if deviceQuery.AppData == nil {
+			deviceQuery.AppData = device.AppData
+		}
+		items = append(items, BatchItem{Query: deviceQuery, Payload: body})
+	}
+	if len(items) == 0 {
+		abortWithError(c, http.StatusNotFound, ErrCodeUnknownDevice, errors.New("no device is registered for the client"))
+		return
+	}
+	b.respondWithResults(c, b.sendAll(ginRequest(c), items, logger.With("client_id", query.ClientID)))
+}
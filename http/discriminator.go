@@ -0,0 +1,73 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// discriminators are the top level fields identifying the payload type.
+var discriminators = []string{"template", "event"}
+
+// payloadDiscriminator holds the fields identifying the payload type.
+type payloadDiscriminator struct {
+	Template string `json:"template"`
+	Event    string `json:"event"`
+}
+
+// payloadName returns the template or event of the body, empty when the body
+// is not a json object or has neither.
+func payloadName(body []byte) string {
+	var discriminator payloadDiscriminator
+	if err := json.Unmarshal(body, &discriminator); err != nil {
+		return ""
+	}
+	if discriminator.Template != "" {
+		return discriminator.Template
+	}
+	return discriminator.Event
+}
+
+// checkDiscriminator makes sure the body identifies a single payload type: it
+// must not repeat a discriminator field nor carry more than one of them.
+// Bodies that are not json objects are left for the binding to reject.
+func checkDiscriminator(body []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return nil
+	}
+
+	counts := make(map[string]int)
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return nil
+		}
+		key, ok := token.(string)
+		if !ok {
+			return nil
+		}
+		counts[key]++
+
+		// Skip the value, whatever its type.
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil
+		}
+	}
+
+	var found []string
+	for _, field := range discriminators {
+		if counts[field] > 1 {
+			return fmt.Errorf("ambiguous payload: duplicate %v field", field)
+		}
+		if counts[field] == 1 {
+			found = append(found, field)
+		}
+	}
+	if len(found) > 1 {
+		return errors.New("ambiguous payload: both template and event fields are set")
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package http
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// EncryptionKeyRequest is the X25519 public key of a device, base64 encoded.
+type EncryptionKeyRequest struct {
+	PublicKey string `json:"public_key" binding:"required"`
+}
+
+// registerEncryptionKey stores the public key of a device, e.g.
+// {"public_key":"..."}, so the content of its notifications is encrypted.
+func registerEncryptionKey(notifier *notify.Notifier, platforms map[string]bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, ok := bindDeviceQuery(c, platforms)
+		if !ok {
+			return
+		}
+		var request EncryptionKeyRequest
+		if err := c.ShouldBindJSON(&request); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+			return
+		}
+		key, err := base64.StdEncoding.DecodeString(request.PublicKey)
+		if err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, notify.ErrInvalidEncryptionKey)
+			return
+		}
+		setEncryptionKey(c, notifier, query, key)
+	}
+}
+
+// removeEncryptionKey stops encrypting the notifications of a device.
+func removeEncryptionKey(notifier *notify.Notifier, platforms map[string]bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		query, ok := bindDeviceQuery(c, platforms)
+		if !ok {
+			return
+		}
+		setEncryptionKey(c, notifier, query, nil)
+	}
+}
+
+func setEncryptionKey(c *gin.Context, notifier *notify.Notifier, query CapabilitiesQuery, key []byte) {
+	err := notifier.SetEncryptionKey(query.Platform, query.Token, key)
+	switch {
+	case errors.Is(err, notify.ErrEncryptionKeysDisabled):
+		abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+	case errors.Is(err, notify.ErrInvalidEncryptionKey):
+		abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+	case err != nil:
+		abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, err)
+	default:
+		c.Status(http.StatusOK)
+	}
+}
@@ -0,0 +1,81 @@
+package http
+
+import (
+	"errors"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// Error codes returned in the error envelope. They are stable and safe for
+// clients to rely on, unlike the error messages.
+const (
+	ErrCodeInvalidQuery        = "invalid_query"
+	ErrCodeUnsupportedPlatform = "unsupported_platform"
+	ErrCodeInvalidToken        = "invalid_token"
+	ErrCodeInvalidPayload      = "invalid_payload"
+	ErrCodePayloadTooLarge     = "payload_too_large"
+	ErrCodeInvalidResponse     = "invalid_response"
+	ErrCodeUnknownRequest      = "unknown_request"
+	ErrCodeUnknownDevice       = "unknown_device"
+	ErrCodeUnknownNotification = "unknown_notification"
+	ErrCodeNotResendable       = "not_resendable"
+	ErrCodeBroadcastRunning    = "broadcast_running"
+	ErrCodeUnauthorized        = "unauthorized"
+	ErrCodeRateLimited         = "rate_limited"
+	ErrCodeBackendUnavailable  = "backend_unavailable"
+	ErrCodeTimeout             = "timeout"
+	ErrCodeInternal            = "internal_error"
+)
+
+type ErrorBody struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	// Fields lists the failed validation rules when the request did not
+	// pass the validation.
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// FieldError is a failed validation rule of a field, e.g. the tag required or
+// the tag oneof along with its param "ios android".
+type FieldError struct {
+	Field string `json:"field"`
+	Tag   string `json:"tag"`
+	Param string `json:"param,omitempty"`
+}
+
+// ErrorResponse is the json envelope of all error responses.
+type ErrorResponse struct {
+	Error ErrorBody `json:"error"`
+	// Notification describes the notification when its delivery failed.
+	Notification *NotificationResponse `json:"notification,omitempty"`
+}
+
+// requestError is the error response of a notification request. The reason
+// is set when the delivery of the notification failed.
+type requestError struct {
+	status int
+	code   string
+	err    error
+	reason notify.ErrorReason
+}
+
+// abortWithError aborts the request responding with the error envelope.
+func abortWithError(c *gin.Context, status int, code string, err error) {
+	c.Error(err)
+	c.AbortWithStatusJSON(status, ErrorResponse{Error: ErrorBody{Code: code, Message: err.Error(), Fields: fieldErrors(err)}})
+}
+
+// fieldErrors returns the failed rules of a validation error.
+func fieldErrors(err error) []FieldError {
+	var validationErrors validator.ValidationErrors
+	if !errors.As(err, &validationErrors) {
+		return nil
+	}
+	fields := make([]FieldError, 0, len(validationErrors))
+	for _, fieldErr := range validationErrors {
+		fields = append(fields, FieldError{Field: fieldErr.Namespace(), Tag: fieldErr.Tag(), Param: fieldErr.Param()})
+	}
+	return fields
+}
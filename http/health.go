@@ -0,0 +1,57 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// readinessTimeout bounds the readiness check so a hung backend doesn't block
+// the probe.
+const readinessTimeout = 2 * time.Second
+
+// HealthResponse is the body of the health and readiness probes. The
+// readiness probe lists the failing platforms, the number of notifications
+// waiting to be sent and the reason of the last delivery failure of the
+// platforms whose last delivery failed.
+type HealthResponse struct {
+	Status     string                        `json:"status"`
+	Platforms  map[string]string             `json:"platforms,omitempty"`
+	QueueDepth *int                          `json:"queue_depth,omitempty"`
+	LastErrors map[string]notify.ErrorReason `json:"last_errors,omitempty"`
+}
+
+func addHealthRoutes(r *gin.Engine, notifier *notify.Notifier) {
+	// The service is alive as long as it serves requests.
+	r.GET("/healthz", func(c *gin.Context) {
+		c.JSON(http.StatusOK, HealthResponse{Status: "ok"})
+	})
+
+	// The service is ready once the services of all platforms can deliver,
+	// and their providers passed their last check.
+	r.GET("/readyz", func(c *gin.Context) {
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		defer cancel()
+
+		depth := notifier.QueueDepth(ctx)
+		response := HealthResponse{Status: "ok", QueueDepth: &depth}
+		if lastErrors := notifier.LastErrors(); len(lastErrors) > 0 {
+			response.LastErrors = lastErrors
+		}
+		err := notifier.Healthy(ctx)
+		if err == nil {
+			c.JSON(http.StatusOK, response)
+			return
+		}
+		response.Status = "unavailable"
+		var healthErr *notify.HealthError
+		if errors.As(err, &healthErr) {
+			response.Platforms = healthErr.Platforms
+		}
+		c.JSON(http.StatusServiceUnavailable, response)
+	})
+}
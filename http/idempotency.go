@@ -0,0 +1,136 @@
+package http
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"golang.org/x/exp/slog"
+)
+
+const idempotencyHeader = "Idempotency-Key"
+
+// forceHeader bypasses the deduplication of the request when allowed.
+const forceHeader = "X-Notify-Force"
+
+// DedupStore remembers the idempotency keys of the notifications sent within
+// the idempotency window. A shared store deduplicates across instances.
+type DedupStore interface {
+	// Reserve records the key for the ttl, returning false when the key is
+	// already recorded.
+	Reserve(ctx context.Context, key string, ttl time.Duration) (bool, error)
+	// Release forgets the key, so a notification that failed can be sent again.
+	Release(ctx context.Context, key string) error
+}
+
+// memoryDedupStore is a DedupStore for a single instance, keeping the most
+// recently reserved keys when bounded.
+type memoryDedupStore struct {
+	sync.Mutex
+	// order lists the keys from the most to the least recently reserved.
+	order *list.List
+	keys  map[string]*list.Element
+	// maxKeys is zero when the keys are not bounded.
+	maxKeys int
+}
+
+type dedupEntry struct {
+	key    string
+	expiry time.Time
+}
+
+func newMemoryDedupStore(maxKeys int) *memoryDedupStore {
+	return &memoryDedupStore{order: list.New(), keys: make(map[string]*list.Element), maxKeys: maxKeys}
+}
+
+func (m *memoryDedupStore) Reserve(ctx context.Context, key string, ttl time.Duration) (bool, error) {
+	m.Lock()
+	defer m.Unlock()
+	now := time.Now()
+	if element, ok := m.keys[key]; ok {
+		if now.Before(element.Value.(*dedupEntry).expiry) {
+			return false, nil
+		}
+		m.remove(element)
+	}
+	// The least recently reserved keys expire first, as they share the ttl.
+	for element := m.order.Back(); element != nil && !now.Before(element.Value.(*dedupEntry).expiry); element = m.order.Back() {
+		m.remove(element)
+	}
+	if m.maxKeys > 0 && m.order.Len() >= m.maxKeys {
+		m.remove(m.order.Back())
+	}
+	m.keys[key] = m.order.PushFront(&dedupEntry{key: key, expiry: now.Add(ttl)})
+	return true, nil
+}
+
+func (m *memoryDedupStore) Release(ctx context.Context, key string) error {
+	m.Lock()
+	defer m.Unlock()
+	if element, ok := m.keys[key]; ok {
+		m.remove(element)
+	}
+	return nil
+}
+
+func (m *memoryDedupStore) remove(element *list.Element) {
+	m.order.Remove(element)
+	delete(m.keys, element.Value.(*dedupEntry).key)
+}
+
+// reserveNotification reserves the idempotency key of the notification in the
+// store of the request, returning false when it was already sent within the
+// window. The returned key is released when the notification fails, it is
+// empty when none was reserved.
+func reserveNotification(r *notifyRequest, config *config.HTTPConfig, notification *notify.Notification, logger *slog.Logger) (string, bool) {
+	if config.AllowForce && r.header.Get(forceHeader) == "true" {
+		logger.Debug("forced notification, skipping deduplication")
+		return "", true
+	}
+	if r.dedup == nil {
+		return "", true
+	}
+	key := idempotencyKey(r.header.Get(idempotencyHeader), notification)
+	reserved, err := r.dedup.Reserve(r.detached, key, config.IdempotencyWindow)
+	if err != nil {
+		logger.Error("failed to reserve idempotency key, sending anyway", "error", err)
+		return "", true
+	}
+	if !reserved {
+		logger.Debug("suppressing duplicate notification")
+		return "", false
+	}
+	return key, true
+}
+
+// releaseNotification releases the idempotency key reserved for a
+// notification that failed, so it can be sent again.
+func releaseNotification(r *notifyRequest, key string, logger *slog.Logger) {
+	if key == "" {
+		return
+	}
+	if err := r.dedup.Release(r.detached, key); err != nil {
+		logger.Error("failed to release idempotency key", "error", err)
+	}
+}
+
+// idempotencyKey returns the idempotency key header of the request, or a hash
+// of the target and the content of the notification when it is missing.
+func idempotencyKey(header string, notification *notify.Notification) string {
+	if header != "" {
+		return "key:" + header
+	}
+	data, _ := json.Marshal(notification.Data)
+	hash := sha256.New()
+	for _, part := range []string{notification.Type, notification.TargetIdentifier, notification.Template, string(data)} {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return "hash:" + hex.EncodeToString(hash.Sum(nil))
+}
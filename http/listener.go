@@ -0,0 +1,53 @@
+package http
+
+import (
+	"net"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+// connLimitListener closes the connections accepted beyond a maximum of
+// concurrently open ones, rather than queueing them.
+type connLimitListener struct {
+	net.Listener
+	slots  chan struct{}
+	logger *slog.Logger
+}
+
+func newConnLimitListener(listener net.Listener, max int, logger *slog.Logger) *connLimitListener {
+	return &connLimitListener{
+		Listener: listener,
+		slots:    make(chan struct{}, max),
+		logger:   logger,
+	}
+}
+
+func (l *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		select {
+		case l.slots <- struct{}{}:
+			return &limitedConn{Conn: conn, release: func() { <-l.slots }}, nil
+		default:
+			l.logger.Info("refusing connection, too many open connections", "remote_addr", conn.RemoteAddr().String())
+			conn.Close()
+		}
+	}
+}
+
+// limitedConn frees its slot once closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
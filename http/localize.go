@@ -0,0 +1,108 @@
+package http
+
+import (
+	_ "embed"
+	"encoding/json"
+	"sort"
+
+	"golang.org/x/text/language"
+)
+
+// messagesJSON holds the display messages of the templates per language, the
+// English ones being the defaults of the payloads.
+//
+//go:embed messages.json
+var messagesJSON []byte
+
+// messageCatalog resolves the display message of a template in the language
+// of the device.
+type messageCatalog struct {
+	messages map[string]map[string]string
+	matcher  language.Matcher
+	tags     []language.Tag
+}
+
+func newMessageCatalog(data []byte) (*messageCatalog, error) {
+	var messages map[string]map[string]string
+	if err := json.Unmarshal(data, &messages); err != nil {
+		return nil, err
+	}
+	return catalogOf(messages), nil
+}
+
+// catalogOf returns the catalog of the messages per language and template.
+func catalogOf(messages map[string]map[string]string) *messageCatalog {
+	// English comes first as the fallback of the unsupported languages.
+	langs := make([]string, 0, len(messages))
+	for lang := range messages {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	tags := []language.Tag{language.English}
+	for _, lang := range langs {
+		tags = append(tags, language.Make(lang))
+	}
+	return &messageCatalog{messages: messages, matcher: language.NewMatcher(tags), tags: tags}
+}
+
+// withMessages returns the catalog with the messages replacing those of the
+// same language and template, adding the languages it does not have. The
+// English messages replace the defaults of the payloads.
+func (c *messageCatalog) withMessages(overrides map[string]map[string]string) *messageCatalog {
+	if len(overrides) == 0 {
+		return c
+	}
+	messages := make(map[string]map[string]string, len(c.messages)+len(overrides))
+	for lang, templates := range c.messages {
+		messages[lang] = make(map[string]string, len(templates))
+		for template, message := range templates {
+			messages[lang][template] = message
+		}
+	}
+	for lang, templates := range overrides {
+		if messages[lang] == nil {
+			messages[lang] = make(map[string]string, len(templates))
+		}
+		for template, message := range templates {
+			messages[lang][template] = message
+		}
+	}
+	return catalogOf(messages)
+}
+
+// defaultCatalog is the catalog of the embedded messages.
+var defaultCatalog = func() *messageCatalog {
+	catalog, err := newMessageCatalog(messagesJSON)
+	if err != nil {
+		panic(err)
+	}
+	return catalog
+}()
+
+// translate returns the message of the template in the language preferred by
+// lang, a language tag or an Accept-Language header, falling back to the
+// English message.
+func (c *messageCatalog) translate(template string, lang string, message string) string {
+	if translated, ok := c.messages[c.language(lang)][template]; ok {
+		return translated
+	}
+	return message
+}
+
+// language returns the base language of the catalog matching lang, English
+// when none does.
+func (c *messageCatalog) language(lang string) string {
+	if lang == "" {
+		return "en"
+	}
+	preferred, _, err := language.ParseAcceptLanguage(lang)
+	if err != nil || len(preferred) == 0 {
+		return "en"
+	}
+	_, index, confidence := c.matcher.Match(preferred...)
+	if confidence == language.No {
+		return "en"
+	}
+	base, _ := c.tags[index].Base()
+	return base.String()
+}
@@ -0,0 +1,77 @@
+package http
+
+import (
+	"reflect"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// noPayload is the payload label of the requests matching no payload.
+const noPayload = "none"
+
+// metrics counts the payloads matched by the webhook, the notifications it
+// received and the requests it rejected.
+type metrics struct {
+	payloads      *prometheus.CounterVec
+	notifications *prometheus.CounterVec
+	rejected      *prometheus.CounterVec
+}
+
+func newMetrics(registerer prometheus.Registerer) *metrics {
+	m := &metrics{
+		payloads: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_payloads_total",
+			Help: "Webhook requests by matched payload type, none when no payload matched.",
+		}, []string{"payload"}),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_notifications_received_total",
+			Help: "Valid notifications received by the webhook, by template.",
+		}, []string{"template"}),
+		rejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_payloads_rejected_total",
+			Help: "Webhook payloads rejected by the validation, by error code.",
+		}, []string{"code"}),
+	}
+	registerer.MustRegister(m.payloads, m.notifications, m.rejected)
+	return m
+}
+
+// observeNotification counts a valid notification received, m may be nil when
+// metrics are disabled.
+func (m *metrics) observeNotification(notification *notify.Notification) {
+	if m == nil {
+		return
+	}
+	m.notifications.WithLabelValues(notification.Template).Inc()
+}
+
+// observeRejected counts a payload rejected with the error code, m may be nil
+// when metrics are disabled.
+func (m *metrics) observeRejected(code string) {
+	if m == nil {
+		return
+	}
+	m.rejected.WithLabelValues(code).Inc()
+}
+
+// observePayload counts the matched payload, m may be nil when metrics are
+// disabled.
+func (m *metrics) observePayload(payload NotificationConvertible) {
+	if m == nil {
+		return
+	}
+	name := noPayload
+	if payload != nil {
+		name = reflect.TypeOf(payload).Elem().Name()
+	}
+	m.payloads.WithLabelValues(name).Inc()
+}
+
+// metricsHandler exposes the metrics of the registry in the Prometheus
+// exposition format.
+func metricsHandler(registry *prometheus.Registry) gin.HandlerFunc {
+	return gin.WrapH(promhttp.HandlerFor(registry, promhttp.HandlerOpts{}))
+}
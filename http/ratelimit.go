@@ -0,0 +1,115 @@
+package http
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+// RateLimiter limits the requests per key. A shared limiter enforces the
+// limits across instances.
+type RateLimiter interface {
+	// Allow takes a request of the key, returning false along with how long
+	// to wait for the next one when the limit is reached.
+	Allow(ctx context.Context, key string) (bool, time.Duration, error)
+}
+
+// tokenBucketLimiter is a RateLimiter for a single instance, refilling a
+// bucket of burst tokens per key at rate tokens per minute.
+type tokenBucketLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	burst    float64
+	buckets  map[string]*tokenBucket
+	pruned   time.Time
+	now      func() time.Time
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newTokenBucketLimiter(ratePerMinute int, burst int) *tokenBucketLimiter {
+	if burst <= 0 {
+		burst = ratePerMinute
+	}
+	return &tokenBucketLimiter{
+		interval: time.Minute / time.Duration(ratePerMinute),
+		burst:    float64(burst),
+		buckets:  make(map[string]*tokenBucket),
+		now:      time.Now,
+	}
+}
+
+func (l *tokenBucketLimiter) Allow(ctx context.Context, key string) (bool, time.Duration, error) {
+	l.Lock()
+	defer l.Unlock()
+	now := l.now()
+	l.prune(now)
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+float64(now.Sub(bucket.updated))/float64(l.interval))
+	bucket.updated = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) * float64(l.interval)), nil
+	}
+	bucket.tokens--
+	return true, 0, nil
+}
+
+// prune forgets the buckets that are full again, at most once a minute.
+func (l *tokenBucketLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	refill := time.Duration(l.burst * float64(l.interval))
+	for key, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= refill {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// tokenRateLimit rejects the requests to a device token beyond the limits of
+// the limiter with a 429 and a Retry-After header.
+func tokenRateLimit(limiter RateLimiter, logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			token = c.GetHeader(tokenHeader)
+		}
+		// Requests without a token are rejected by the handler.
+		if token == "" {
+			c.Next()
+			return
+		}
+
+		allowed, retryAfter, err := limiter.Allow(c, token)
+		if err != nil {
+			logger.Error("failed to check the rate limit, allowing the request", "request_id", c.GetString(requestIDKey), "error", err)
+			c.Next()
+			return
+		}
+		if !allowed {
+			logger.Debug("rate limiting notifications to token", "request_id", c.GetString(requestIDKey), "token", notify.MaskToken(token))
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			abortWithError(c, http.StatusTooManyRequests, ErrCodeRateLimited, errors.New("too many notifications to this device"))
+			return
+		}
+		c.Next()
+	}
+}
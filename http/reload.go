@@ -0,0 +1,107 @@
+package http
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/breez/notify/channel"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Handler serves the routes of the webhook, which Reload rebuilds with a new
+// config while the server keeps listening.
+type Handler struct {
+	notifier *notify.Notifier
+	channel  *channel.HttpCallbackChannel
+	state    *routerState
+	engine   atomic.Pointer[gin.Engine]
+}
+
+// NewHandler returns the handler of the webhook, exposing the metrics of
+// registry when it is not nil.
+func NewHandler(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig, registry *prometheus.Registry) *Handler {
+	h := &Handler{notifier: notifier, channel: channel, state: newRouterState(registry)}
+	h.Reload(config)
+	return h
+}
+
+// Reload rebuilds the routes with the config, e.g. their secrets, swap status
+// filters and rate limits, the requests in flight completing with the former
+// routes. The listener settings of the config are only read by Run.
+func (h *Handler) Reload(config *config.HTTPConfig) {
+	r := newRouter(h.notifier, h.channel, config, h.state)
+	r.SetTrustedProxies(nil)
+	h.engine.Store(r)
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.engine.Load().ServeHTTP(w, r)
+}
+
+// routerState is the state of the routes kept when they are rebuilt: the
+// metrics, and the rate limits, idempotency keys and nonces as long as their
+// settings are unchanged.
+type routerState struct {
+	sync.Mutex
+	// registry is nil when the metrics are not exposed.
+	registry *prometheus.Registry
+	metrics  *metrics
+
+	limiter      *tokenBucketLimiter
+	limiterRate  [2]int
+	dedup        *memoryDedupStore
+	dedupMaxKeys int
+	nonces       map[string]*nonceCache
+	// broadcasts keeps running across reloads.
+	broadcasts *broadcasts
+}
+
+func newRouterState(registry *prometheus.Registry) *routerState {
+	state := &routerState{registry: registry, nonces: make(map[string]*nonceCache), broadcasts: newBroadcasts()}
+	if registry != nil {
+		state.metrics = newMetrics(registry)
+	}
+	return state
+}
+
+// tokenLimiter returns the limiter of the rate and burst, the same one until
+// they change.
+func (s *routerState) tokenLimiter(ratePerMinute int, burst int) *tokenBucketLimiter {
+	s.Lock()
+	defer s.Unlock()
+	if s.limiter == nil || s.limiterRate != [2]int{ratePerMinute, burst} {
+		s.limiter = newTokenBucketLimiter(ratePerMinute, burst)
+		s.limiterRate = [2]int{ratePerMinute, burst}
+	}
+	return s.limiter
+}
+
+// dedupStore returns the idempotency store of maxKeys, the same one until it
+// changes.
+func (s *routerState) dedupStore(maxKeys int) *memoryDedupStore {
+	s.Lock()
+	defer s.Unlock()
+	if s.dedup == nil || s.dedupMaxKeys != maxKeys {
+		s.dedup = newMemoryDedupStore(maxKeys)
+		s.dedupMaxKeys = maxKeys
+	}
+	return s.dedup
+}
+
+// nonceCache returns the nonces of the route seen within the window, the same
+// cache until the window changes.
+func (s *routerState) nonceCache(route string, window time.Duration) *nonceCache {
+	s.Lock()
+	defer s.Unlock()
+	nonces, ok := s.nonces[route]
+	if !ok || nonces.window != window {
+		nonces = newNonceCache(window)
+		s.nonces[route] = nonces
+	}
+	return nonces
+}
@@ -0,0 +1,91 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	timestampHeader = "X-Notify-Timestamp"
+	nonceHeader     = "X-Notify-Nonce"
+)
+
+// nonceCache remembers the nonces seen within the replay window.
+type nonceCache struct {
+	sync.Mutex
+	window time.Duration
+	seen   map[string]time.Time
+	// expiries lists the nonces of seen from the first to expire, the window
+	// being the same for all of them.
+	expiries []nonceExpiry
+}
+
+type nonceExpiry struct {
+	nonce  string
+	expiry time.Time
+}
+
+func newNonceCache(window time.Duration) *nonceCache {
+	return &nonceCache{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// add records the nonce and returns false if it was already seen within the
+// window. Only the expired nonces are visited.
+func (n *nonceCache) add(nonce string, now time.Time) bool {
+	n.Lock()
+	defer n.Unlock()
+	for len(n.expiries) > 0 && now.After(n.expiries[0].expiry) {
+		delete(n.seen, n.expiries[0].nonce)
+		n.expiries = n.expiries[1:]
+	}
+	if _, ok := n.seen[nonce]; ok {
+		return false
+	}
+	expiry := now.Add(n.window)
+	n.seen[nonce] = expiry
+	n.expiries = append(n.expiries, nonceExpiry{nonce: nonce, expiry: expiry})
+	return true
+}
+
+// replayProtection rejects the requests failing checkReplay.
+func replayProtection(nonces *nonceCache, window time.Duration, skew time.Duration, logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if err := checkReplay(c.Request.Header, nonces, window, skew); err != nil {
+			logger.Debug("rejecting replayed request", "request_id", c.GetString(requestIDKey), "error", err)
+			abortWithError(c, http.StatusUnauthorized, ErrCodeUnauthorized, err)
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkReplay fails the requests whose timestamp header is older than the
+// window or in the future, allowing for the clock skew of the sender either
+// way, and those whose nonce header was already used while the timestamp was
+// valid. The headers are only authenticated for the signature providers
+// signing them: the requests of the others can be replayed with fresh ones.
+func checkReplay(header http.Header, nonces *nonceCache, window time.Duration, skew time.Duration) error {
+	now := time.Now()
+	timestamp, err := strconv.ParseInt(header.Get(timestampHeader), 10, 64)
+	if err != nil {
+		return errors.New("invalid timestamp")
+	}
+	age := now.Sub(time.Unix(timestamp, 0))
+	if age > window+skew || age < -skew {
+		return errors.New("stale timestamp")
+	}
+	nonce := header.Get(nonceHeader)
+	if nonce == "" || !nonces.add(nonce, now) {
+		return errors.New("invalid nonce")
+	}
+	return nil
+}
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	requestIDHeader = "X-Request-ID"
+	// requestIDKey holds the id of the request in the gin context.
+	requestIDKey = "request_id"
+	// maxRequestIDLength bounds the ids accepted from the senders, longer ones
+	// are replaced by a generated id.
+	maxRequestIDLength = 128
+)
+
+// requestIDHandler correlates the logs of a request with its response. The
+// X-Request-ID header of the sender is kept, a random id is generated when it
+// is missing, and the id is echoed in the X-Request-ID response header.
+func requestIDHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader(requestIDHeader)
+		if requestID == "" || len(requestID) > maxRequestIDLength {
+			requestID = newRequestID()
+		}
+		c.Set(requestIDKey, requestID)
+		c.Header(requestIDHeader, requestID)
+		c.Next()
+	}
+}
+
+// newRequestID returns a random request id.
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// accessLog logs each request once responded to, with its id, replacing the
+// plain text logs of gin.
+func accessLog(logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		startedAt := time.Now()
+		c.Next()
+		logger.Info("request",
+			"request_id", c.GetString(requestIDKey),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration", time.Since(startedAt),
+			"client_ip", c.ClientIP())
+	}
+}
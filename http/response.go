@@ -0,0 +1,108 @@
+package http
+
+import (
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// Results of a notification in the notification response.
+const (
+	ResultSent         = "sent"
+	ResultQueued       = "queued"
+	ResultDeferred     = "deferred"
+	ResultDeduplicated = "deduplicated"
+	ResultFiltered     = "filtered"
+	ResultScheduled    = "scheduled"
+	ResultFailed       = "failed"
+)
+
+// NotificationResponse describes a notification and the outcome of sending
+// it, identified by the id of the request. It is the body of successful
+// responses and is attached to the error envelope when the delivery failed.
+// Targets are masked.
+type NotificationResponse struct {
+	ID string `json:"id"`
+	// NotificationID identifies the notification in the delivery statuses,
+	// it is empty when the notification was not sent.
+	NotificationID string `json:"notification_id,omitempty"`
+	EventID        string `json:"event_id,omitempty"`
+	Template       string `json:"template"`
+	Platform       string `json:"platform"`
+	Target         string `json:"target"`
+	Result         string `json:"result"`
+	MessageID      string `json:"message_id,omitempty"`
+	MigratedToken  string `json:"migrated_token,omitempty"`
+	ErrorReason    string `json:"error_reason,omitempty"`
+	// DeliverAt is the time a scheduled notification is sent at.
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	// Deduplicated is kept alongside the result for the senders relying on
+	// the idempotency flag.
+	Deduplicated bool `json:"deduplicated,omitempty"`
+}
+
+// newNotificationResponse returns the response describing the notification
+// with the given result.
+func newNotificationResponse(requestID string, notification *notify.Notification, result string) *NotificationResponse {
+	return &NotificationResponse{
+		ID:             requestID,
+		NotificationID: notification.ID,
+		EventID:        notification.EventID,
+		Template:       notification.Template,
+		Platform:       notification.Type,
+		Target:         notify.MaskToken(notification.TargetIdentifier),
+		Result:         result,
+		Deduplicated:   result == ResultDeduplicated,
+	}
+}
+
+// respondWithNotification responds with the notification and the result of
+// its delivery.
+func respondWithNotification(c *gin.Context, notification *notify.Notification, result *notify.Result) {
+	c.JSON(http.StatusOK, newDeliveredResponse(c.GetString(requestIDKey), notification, result))
+}
+
+// respondAccepted responds to a notification sent later, its status being
+// polled at the location of the notification under basePath.
+func respondAccepted(c *gin.Context, basePath string, response *NotificationResponse) {
+	if response.NotificationID != "" {
+		c.Header("Location", path.Join(basePath, "notifications", response.NotificationID))
+	}
+	c.JSON(http.StatusAccepted, response)
+}
+
+// newDeliveredResponse returns the response describing a notification sent
+// with the given result, nil meaning it is queued.
+func newDeliveredResponse(requestID string, notification *notify.Notification, result *notify.Result) *NotificationResponse {
+	response := newNotificationResponse(requestID, notification, ResultQueued)
+	if result != nil {
+		response.Result = ResultSent
+		if result.Deferred {
+			response.Result = ResultDeferred
+		}
+		response.MessageID = result.MessageID
+		response.MigratedToken = result.MigratedToken
+	}
+	return response
+}
+
+// abortWithDeliveryError aborts the request responding with the error
+// envelope along with the notification that failed to be delivered.
+func abortWithDeliveryError(c *gin.Context, status int, code string, err error, notification *notify.Notification, reason notify.ErrorReason) {
+	c.Error(err)
+	c.AbortWithStatusJSON(status, ErrorResponse{
+		Error:        ErrorBody{Code: code, Message: err.Error()},
+		Notification: newFailedResponse(c.GetString(requestIDKey), notification, reason),
+	})
+}
+
+// newFailedResponse returns the response describing a notification that
+// failed to be delivered for the given reason.
+func newFailedResponse(requestID string, notification *notify.Notification, reason notify.ErrorReason) *NotificationResponse {
+	response := newNotificationResponse(requestID, notification, ResultFailed)
+	response.ErrorReason = string(reason)
+	return response
+}
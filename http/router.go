@@ -2,24 +2,107 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/breez/notify/bolt11"
 	"github.com/breez/notify/channel"
 	"github.com/breez/notify/config"
 	"github.com/breez/notify/notify"
 	"github.com/gin-gonic/gin"
 	"github.com/gin-gonic/gin/binding"
-	"github.com/google/martian/v3/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"golang.org/x/exp/slog"
 )
 
 type MobilePushWebHookQuery struct {
-	Platform string  `form:"platform" binding:"required,oneof=ios android"`
-	Token    string  `form:"token" binding:"required"`
-	AppData  *string `form:"app_data"`
+	// Platform and Token can also be sent in the X-Push-Platform and
+	// X-Push-Token headers, keeping the token out of access logs. The query
+	// takes precedence.
+	Platform string  `form:"platform" json:"platform"`
+	Token    string  `form:"token" json:"token"`
+	AppData  *string `form:"app_data" json:"app_data"`
+	// ClientID notifies the devices registered for the client instead of a
+	// token, only those of the platform when one is given.
+	ClientID string `form:"client_id" json:"client_id"`
+	// App is the app of the token among those served by the service, each
+	// having its own push credentials, the default one when empty.
+	App string `form:"app" json:"app"`
+	// AppID selects the app of the token among those configured for the
+	// platform, e.g. the mainnet or testnet build of an iOS app.
+	AppID    string  `form:"app_id" json:"app_id"`
+	Timezone *string `form:"timezone" json:"timezone"`
+	// TemplateVersion is the version of the template data the app expects,
+	// also accepted in the X-Template-Version header, the current version
+	// when omitted.
+	TemplateVersion int `form:"template_version" json:"template_version" binding:"omitempty,min=1"`
+	// Lang is the language of the display message, the Accept-Language
+	// header when empty.
+	Lang string `form:"lang" json:"lang"`
+	// Silent forces a data only push when true, or an alert when false,
+	// overriding the default of the template.
+	Silent *bool `form:"silent" json:"silent"`
+	// PushType is the background or alert equivalent of Silent, which takes
+	// precedence when both are set.
+	PushType string `form:"notification_type" json:"notification_type" binding:"omitempty,oneof=background alert"`
+	// Summary opts the device in the daily summary of non urgent notifications.
+	Summary bool `form:"summary" json:"summary"`
+	// RetryOn lists the failure reasons the notification is retried on, e.g.
+	// retry_on=throttled&retry_on=timeout, overriding those of the template.
+	RetryOn []string `form:"retry_on" json:"retry_on" binding:"omitempty,dive,oneof=unregistered too_large throttled timeout auth unavailable unknown"`
+	// CollapseKey overrides the collapse key of the payload.
+	CollapseKey string `form:"collapse_key" json:"collapse_key"`
+	// Priority overrides the priority of the payload, high or normal.
+	Priority string `form:"priority" json:"priority" binding:"omitempty,oneof=high normal"`
+}
+
+// newNotification creates a notification of the template addressed to the
+// device of the query.
+func (q *MobilePushWebHookQuery) newNotification(template string, displayMessage string, data map[string]interface{}) *notify.Notification {
+	var retryOn []notify.ErrorReason
+	for _, reason := range q.RetryOn {
+		retryOn = append(retryOn, notify.ErrorReason(reason))
+	}
+	silent := q.Silent
+	if silent == nil && q.PushType != "" {
+		background := q.PushType == notify.PushBackground
+		silent = &background
+	}
+	return &notify.Notification{
+		Template:         template,
+		DisplayMessage:   displayMessage,
+		Type:             q.Platform,
+		TargetIdentifier: q.Token,
+		App:              q.App,
+		AppID:            q.AppID,
+		AppData:          q.AppData,
+		Timezone:         q.Timezone,
+		Silent:           silent,
+		Summary:          q.Summary,
+		CollapseKey:      q.CollapseKey,
+		Priority:         q.Priority,
+		RetryOn:          retryOn,
+		TemplateVersion:  q.TemplateVersion,
+		Data:             data,
+	}
 }
 
 type NotificationConvertible interface {
@@ -27,6 +110,28 @@ type NotificationConvertible interface {
 	ToNotification(query *MobilePushWebHookQuery) *notify.Notification
 }
 
+// PayloadOverrides are optional fields any payload can carry to override the
+// defaults of its template.
+type PayloadOverrides struct {
+	DisplayMessage *string `json:"display_message"`
+	// EventID is the id of the sender event the notification originates
+	// from, echoed in the notification data.
+	EventID string `json:"event_id" binding:"max=128"`
+	// Category overrides the default notification category of the template.
+	Category string `json:"category" binding:"max=64"`
+	// DeliverAt schedules the notification at the given time, and
+	// DelaySeconds the given number of seconds after it is received, rather
+	// than sending it right away.
+	DeliverAt    *time.Time `json:"deliver_at"`
+	DelaySeconds int        `json:"delay_seconds" binding:"omitempty,min=1"`
+}
+
+// PayloadValidator is implemented by payloads having checks beyond their
+// binding rules, run once the payload matched.
+type PayloadValidator interface {
+	Validate() error
+}
+
 type LnurlPayInfoPayload struct {
 	Template string `json:"template" binding:"required,eq=lnurlpay_info"`
 	Data     struct {
@@ -40,17 +145,23 @@ func (p *LnurlPayInfoPayload) RequiresCallback() bool {
 }
 
 func (p *LnurlPayInfoPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	return &notify.Notification{
-		Template:         p.Template,
-		DisplayMessage:   "Receiving payment",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data: map[string]interface{}{
-			"callback_url": p.Data.CallbackURL,
-			"reply_url":    p.Data.ReplyURL,
-		},
+	notification := query.newNotification(p.Template, "Receiving payment", map[string]interface{}{
+		"callback_url": p.Data.CallbackURL,
+		"reply_url":    p.Data.ReplyURL,
+	})
+	notification.Action = lnurlPayAction("Open wallet", p.Data.CallbackURL)
+	return notification
+}
+
+// lnurlPayAction links to the callback url using the LUD-17 lnurlp scheme so
+// the wallet opens on the payment. No action is returned for invalid urls.
+func lnurlPayAction(label string, callbackURL string) *notify.Action {
+	link, err := url.Parse(callbackURL)
+	if err != nil || (link.Scheme != "https" && link.Scheme != "http") {
+		return nil
 	}
+	link.Scheme = "lnurlp"
+	return &notify.Action{Label: label, Link: link.String()}
 }
 
 type LnurlPayInvoicePayload struct {
@@ -60,33 +171,49 @@ type LnurlPayInvoicePayload struct {
 		Comment   *string `json:"comment"`
 		ReplyURL  string  `json:"reply_url" binding:"required"`
 		VerifyURL *string `json:"verify_url"`
+		Invoice   *string `json:"invoice"`
 	} `json:"data"`
 }
 
+// Validate cross checks the amount and expiry of the invoice, when provided,
+// with the requested amount.
+func (p *LnurlPayInvoicePayload) Validate() error {
+	if p.Data.Invoice == nil {
+		return nil
+	}
+	invoice, err := bolt11.Decode(*p.Data.Invoice)
+	if err != nil {
+		return err
+	}
+	if invoice.AmountMsat != nil && *invoice.AmountMsat != p.Data.Amount {
+		return fmt.Errorf("invoice amount %v does not match the requested amount %v", *invoice.AmountMsat, p.Data.Amount)
+	}
+	if time.Now().After(invoice.ExpiresAt()) {
+		return errors.New("invoice is expired")
+	}
+	return nil
+}
+
 func (p *LnurlPayInvoicePayload) RequiresCallback() bool {
 	return false
 }
 
 func (p *LnurlPayInvoicePayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	notification := notify.Notification{
-		Template:         p.Template,
-		DisplayMessage:   "Invoice requested",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data: map[string]interface{}{
-			"amount":    p.Data.Amount,
-			"reply_url": p.Data.ReplyURL,
-		},
-	}
+	notification := query.newNotification(p.Template, "Invoice requested", map[string]interface{}{
+		"amount":    p.Data.Amount,
+		"reply_url": p.Data.ReplyURL,
+	})
 	if p.Data.Comment != nil {
 		notification.Data["comment"] = p.Data.Comment
 	}
 	if p.Data.VerifyURL != nil {
 		notification.Data["verify_url"] = p.Data.VerifyURL
 	}
+	if p.Data.Invoice != nil {
+		notification.Data["invoice"] = p.Data.Invoice
+	}
 
-	return &notification
+	return notification
 }
 
 type LnurlPayVerifyPayload struct {
@@ -102,17 +229,10 @@ func (p *LnurlPayVerifyPayload) RequiresCallback() bool {
 }
 
 func (p *LnurlPayVerifyPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	return &notify.Notification{
-		Template:         p.Template,
-		DisplayMessage:   "Verify payment",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data: map[string]interface{}{
-			"payment_hash": p.Data.PaymentHash,
-			"reply_url":    p.Data.ReplyURL,
-		},
-	}
+	return query.newNotification(p.Template, "Verify payment", map[string]interface{}{
+		"payment_hash": p.Data.PaymentHash,
+		"reply_url":    p.Data.ReplyURL,
+	})
 }
 
 type PaymentReceivedPayload struct {
@@ -127,14 +247,53 @@ func (p *PaymentReceivedPayload) RequiresCallback() bool {
 }
 
 func (p *PaymentReceivedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	return &notify.Notification{
-		Template:         p.Template,
-		DisplayMessage:   "Incoming payment",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data:             map[string]interface{}{"payment_hash": p.Data.PaymentHash},
-	}
+	return query.newNotification(p.Template, "Incoming payment", map[string]interface{}{"payment_hash": p.Data.PaymentHash})
+}
+
+type LnurlWithdrawPayload struct {
+	Template string `json:"template" binding:"required,eq=lnurl_withdraw"`
+	Data     struct {
+		CallbackURL     string `json:"callback_url" binding:"required"`
+		K1              string `json:"k1" binding:"required"`
+		MinWithdrawable uint64 `json:"min_withdrawable" binding:"ltefield=MaxWithdrawable"`
+		MaxWithdrawable uint64 `json:"max_withdrawable" binding:"required,min=1"`
+		ReplyURL        string `json:"reply_url" binding:"required"`
+	} `json:"data"`
+}
+
+func (p *LnurlWithdrawPayload) RequiresCallback() bool {
+	return false
+}
+
+func (p *LnurlWithdrawPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
+	return query.newNotification(p.Template, "Withdrawal requested", map[string]interface{}{
+		"callback_url":     p.Data.CallbackURL,
+		"k1":               p.Data.K1,
+		"min_withdrawable": p.Data.MinWithdrawable,
+		"max_withdrawable": p.Data.MaxWithdrawable,
+		"reply_url":        p.Data.ReplyURL,
+	})
+}
+
+// Bolt12OfferInvoiceRequestPayload asks the wallet for an invoice of one of
+// its BOLT12 offers, to be posted to the reply url.
+type Bolt12OfferInvoiceRequestPayload struct {
+	Template string `json:"template" binding:"required,eq=bolt12_offer_invoice_request"`
+	Data     struct {
+		OfferID  string `json:"offer_id" binding:"required"`
+		ReplyURL string `json:"reply_url" binding:"required,url"`
+	} `json:"data"`
+}
+
+func (p *Bolt12OfferInvoiceRequestPayload) RequiresCallback() bool {
+	return false
+}
+
+func (p *Bolt12OfferInvoiceRequestPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
+	return query.newNotification(p.Template, "Invoice request", map[string]interface{}{
+		"offer_id":  p.Data.OfferID,
+		"reply_url": p.Data.ReplyURL,
+	})
 }
 
 type TxConfirmedPayload struct {
@@ -149,14 +308,10 @@ func (p *TxConfirmedPayload) RequiresCallback() bool {
 }
 
 func (p *TxConfirmedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	return &notify.Notification{
-		Template:         p.Template,
-		DisplayMessage:   "Transaction confirmed",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data:             map[string]interface{}{"tx_id": p.Data.TxID},
-	}
+	notification := query.newNotification(p.Template, "Transaction confirmed", map[string]interface{}{"tx_id": p.Data.TxID})
+	// Confirmations are not urgent, and the latest one stands for the others.
+	withDefaults(notification, notify.PriorityNormal, p.Template)
+	return notification
 }
 
 type AddressTxsConfirmedPayload struct {
@@ -171,14 +326,78 @@ func (p *AddressTxsConfirmedPayload) RequiresCallback() bool {
 }
 
 func (p *AddressTxsConfirmedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	return &notify.Notification{
-		Template:         p.Template,
-		DisplayMessage:   "Address transactions confirmed",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data:             map[string]interface{}{"address": p.Data.Address},
-	}
+	notification := query.newNotification(p.Template, "Address transactions confirmed", map[string]interface{}{"address": p.Data.Address})
+	withDefaults(notification, notify.PriorityNormal, p.Template+"/"+p.Data.Address)
+	return notification
+}
+
+// LiquidAssetReceivedPayload notifies the receipt of a Liquid asset, its
+// amount being in the base units of the asset.
+type LiquidAssetReceivedPayload struct {
+	Template string `json:"template" binding:"required,eq=liquid_asset_received"`
+	Data     struct {
+		AssetID string `json:"asset_id" binding:"required,len=64,hexadecimal"`
+		Amount  uint64 `json:"amount" binding:"required,min=1"`
+		TxID    string `json:"tx_id" binding:"required,len=64,hexadecimal"`
+	} `json:"data"`
+}
+
+func (p *LiquidAssetReceivedPayload) RequiresCallback() bool {
+	return false
+}
+
+func (p *LiquidAssetReceivedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
+	return query.newNotification(p.Template, "Asset received", map[string]interface{}{
+		"asset_id": p.Data.AssetID,
+		"amount":   p.Data.Amount,
+		"tx_id":    p.Data.TxID,
+	})
+}
+
+// PeginConfirmedPayload notifies the confirmation of a peg-in, the transaction
+// being the one of the Liquid claim.
+type PeginConfirmedPayload struct {
+	Template string `json:"template" binding:"required,eq=pegin_confirmed"`
+	Data     struct {
+		TxID      string `json:"tx_id" binding:"required,len=64,hexadecimal"`
+		AmountSat uint64 `json:"amount_sat" binding:"required,min=1"`
+	} `json:"data"`
+}
+
+func (p *PeginConfirmedPayload) RequiresCallback() bool {
+	return false
+}
+
+func (p *PeginConfirmedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
+	notification := query.newNotification(p.Template, "Peg-in confirmed", map[string]interface{}{
+		"tx_id":      p.Data.TxID,
+		"amount_sat": p.Data.AmountSat,
+	})
+	withDefaults(notification, notify.PriorityNormal, "")
+	return notification
+}
+
+// PegoutConfirmedPayload notifies the confirmation of a peg-out, the
+// transaction being the one paying the bitcoin address.
+type PegoutConfirmedPayload struct {
+	Template string `json:"template" binding:"required,eq=pegout_confirmed"`
+	Data     struct {
+		TxID      string `json:"tx_id" binding:"required,len=64,hexadecimal"`
+		AmountSat uint64 `json:"amount_sat" binding:"required,min=1"`
+	} `json:"data"`
+}
+
+func (p *PegoutConfirmedPayload) RequiresCallback() bool {
+	return false
+}
+
+func (p *PegoutConfirmedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
+	notification := query.newNotification(p.Template, "Peg-out confirmed", map[string]interface{}{
+		"tx_id":      p.Data.TxID,
+		"amount_sat": p.Data.AmountSat,
+	})
+	withDefaults(notification, notify.PriorityNormal, "")
+	return notification
 }
 
 type SwapUpdatedPayload struct {
@@ -194,14 +413,61 @@ func (p *SwapUpdatedPayload) RequiresCallback() bool {
 }
 
 func (p *SwapUpdatedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	return &notify.Notification{
-		Template:         notify.NOTIFICATION_SWAP_UPDATED,
-		DisplayMessage:   "Swap updated",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data:             map[string]interface{}{"id": p.Data.Id, "status": p.Data.Status},
+	notification := query.newNotification(notify.NOTIFICATION_SWAP_UPDATED, "Swap updated", map[string]interface{}{"id": p.Data.Id, "status": p.Data.Status})
+	// Only the latest status of a swap matters.
+	withDefaults(notification, notify.PriorityHigh, "swap/"+p.Data.Id)
+	return notification
+}
+
+// swapStatusFiltered reports whether the payload is a swap update whose status
+// is filtered out for the app of the query.
+func swapStatusFiltered(payload NotificationConvertible, query *MobilePushWebHookQuery, config *config.HTTPConfig) bool {
+	swap, ok := payload.(*SwapUpdatedPayload)
+	return ok && !config.SwapStatusFilter(query.App).Forwards(swap.Data.Status)
+}
+
+// withDefaults sets the priority and collapse key of the template on the
+// notification, unless overridden by the query. An empty collapse key leaves
+// the notifications of the template uncollapsed.
+func withDefaults(notification *notify.Notification, priority string, collapseKey string) {
+	if notification.Priority == "" {
+		notification.Priority = priority
 	}
+	if notification.CollapseKey == "" {
+		notification.CollapseKey = collapseKey
+	}
+}
+
+// StatusMessage returns the human readable message of the swap status, or the
+// raw status when it has no message.
+func (p *SwapUpdatedPayload) StatusMessage(messages map[string]string) string {
+	if message, ok := messages[p.Data.Status]; ok {
+		return message
+	}
+	return p.Data.Status
+}
+
+type SwapRefundedPayload struct {
+	Event string `json:"event" binding:"required,eq=swap.refunded"`
+	Data  struct {
+		Id         string `json:"id" binding:"required"`
+		RefundTxID string `json:"refund_txid" binding:"required"`
+		AmountSat  uint64 `json:"amount_sat" binding:"required,min=1"`
+	} `json:"data"`
+}
+
+func (p *SwapRefundedPayload) RequiresCallback() bool {
+	return false
+}
+
+func (p *SwapRefundedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
+	notification := query.newNotification(notify.NOTIFICATION_SWAP_REFUNDED, "Swap refunded", map[string]interface{}{
+		"id":          p.Data.Id,
+		"refund_txid": p.Data.RefundTxID,
+		"amount_sat":  p.Data.AmountSat,
+	})
+	withDefaults(notification, notify.PriorityNormal, "")
+	return notification
 }
 
 type InvoiceRequestPayload struct {
@@ -217,111 +483,787 @@ func (p *InvoiceRequestPayload) RequiresCallback() bool {
 }
 
 func (p *InvoiceRequestPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
-	return &notify.Notification{
-		Template:         notify.NOTIFICATION_INVOICE_REQUEST,
-		DisplayMessage:   "Invoice request",
-		Type:             query.Platform,
-		TargetIdentifier: query.Token,
-		AppData:          query.AppData,
-		Data:             map[string]interface{}{"offer": p.Data.Offer, "invoice_request": p.Data.InvoiceRequest},
+	return query.newNotification(notify.NOTIFICATION_INVOICE_REQUEST, "Invoice request", map[string]interface{}{"offer": p.Data.Offer, "invoice_request": p.Data.InvoiceRequest})
+}
+
+// defaultPlatforms are the platforms accepted unless configured otherwise.
+var defaultPlatforms = []string{"ios", "android", "web", "unifiedpush", "apns"}
+
+const debugHeader = "X-Notify-Debug"
+
+// Headers carrying the target device as an alternative to the query.
+const (
+	platformHeader = "X-Push-Platform"
+	tokenHeader    = "X-Push-Token"
+)
+
+// templateVersionHeader is the version of the template data the app expects,
+// as an alternative to the query.
+const templateVersionHeader = "X-Template-Version"
+
+// ttlHeader overrides the TTL of the template, in seconds.
+const ttlHeader = "X-Notify-TTL"
+
+type debugResponse struct {
+	Notification *notify.Notification `json:"notification"`
+	Payload      interface{}          `json:"payload"`
+}
+
+// PreviewQuery is the query of the render endpoint, the platform is omitted as
+// the notification is rendered for all of them.
+type PreviewQuery struct {
+	Token   string  `form:"token"`
+	AppData *string `form:"app_data"`
+}
+
+// Run serves the webhook with the handler on the address of the config until
+// ctx is cancelled. It then stops accepting connections and waits up to the
+// drain timeout for the in-flight requests to complete.
+func Run(ctx context.Context, handler *Handler, config *config.HTTPConfig) error {
+	logger := handler.notifier.Logger()
+	listener, err := listen(config, logger)
+	if err != nil {
+		return err
+	}
+	server := &http.Server{
+		Handler:      handler,
+		ReadTimeout:  config.ReadTimeout,
+		WriteTimeout: config.WriteTimeout,
+		IdleTimeout:  config.IdleTimeout,
 	}
+	return serve(ctx, server, listener, config.DrainTimeout, logger)
 }
 
-func Run(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig) error {
-	r := setupRouter(notifier, channel)
-	r.SetTrustedProxies(nil)
-	return r.Run(config.Address)
+// listen listens on the address of the config, over TLS when a certificate is
+// configured, requiring client certificates signed by the client CA when one
+// is configured.
+func listen(config *config.HTTPConfig, logger *slog.Logger) (net.Listener, error) {
+	var tlsConfig *tls.Config
+	if config.TLSCertFile != "" || config.TLSKeyFile != "" {
+		if config.TLSCertFile == "" || config.TLSKeyFile == "" {
+			return nil, errors.New("both the tls certificate and key files are required")
+		}
+		cert, err := tls.LoadX509KeyPair(config.TLSCertFile, config.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the tls certificate: %w", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+		if config.TLSClientCAFile != "" {
+			pem, err := os.ReadFile(config.TLSClientCAFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read the tls client ca: %w", err)
+			}
+			clientCAs := x509.NewCertPool()
+			if !clientCAs.AppendCertsFromPEM(pem) {
+				return nil, errors.New("no certificate found in the tls client ca file")
+			}
+			tlsConfig.ClientCAs = clientCAs
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	} else if config.TLSClientCAFile != "" {
+		return nil, errors.New("the tls client ca requires the tls certificate and key files")
+	}
+
+	address := config.Address
+	if address == "" {
+		address = ":8080"
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if config.MaxConnections > 0 {
+		listener = newConnLimitListener(listener, config.MaxConnections, logger)
+	}
+	if tlsConfig != nil {
+		listener = tls.NewListener(listener, tlsConfig)
+	}
+	return listener, nil
+}
+
+// serve serves on the listener until ctx is cancelled, then shuts the server
+// down, waiting up to drainTimeout for the in-flight requests.
+func serve(ctx context.Context, server *http.Server, listener net.Listener, drainTimeout time.Duration, logger *slog.Logger) error {
+	served := make(chan error, 1)
+	go func() {
+		served <- server.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down, draining in-flight requests", "drain_timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to drain in-flight requests: %w", err)
+	}
+	if err := <-served; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func setupRouter(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig, registry *prometheus.Registry) *gin.Engine {
+	return newRouter(notifier, channel, config, newRouterState(registry))
 }
 
-func setupRouter(notifier *notify.Notifier, channel *channel.HttpCallbackChannel) *gin.Engine {
-	r := gin.Default()
+// newRouter builds the routes of the config, their state being kept in state
+// when they are rebuilt.
+func newRouter(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig, state *routerState) *gin.Engine {
+	r := gin.New()
+	r.Use(gin.Recovery(), requestIDHandler(), accessLog(notifier.Logger()))
+	if config.BodyLogSampleRate > 0 {
+		r.Use(sampledBodyLogging(config.BodyLogSampleRate, notifier.Logger()))
+	}
+	addHealthRoutes(r, notifier)
+	if state.registry != nil {
+		// The metrics require the admin token when one is configured.
+		metricsHandlers := []gin.HandlerFunc{metricsHandler(state.registry)}
+		if config.AdminToken != "" {
+			metricsHandlers = append([]gin.HandlerFunc{bearerAuth(config.AdminToken)}, metricsHandlers...)
+		}
+		r.GET("/metrics", metricsHandlers...)
+	}
 	router := r.Group("api/v1")
-	addRouter(router, notifier, channel)
+	// Responses are posted by the apps, which don't hold the webhook secret.
+	addResponseRouter(router, channel)
+	// Live subscribers authenticate with their token, like the apps.
+	router.GET("/subscribe", subscribe(notifier))
+	addRouter(router.Group("", tracing(), webhookAuth(config.WebhookSecret)), notifier, channel, config, state)
+	// The admin endpoints are only exposed along with their token.
+	if config.AdminToken != "" {
+		admin := router.Group("admin", bearerAuth(config.AdminToken))
+		admin.GET("/events", streamOutcomes(notifier))
+		admin.GET("/report", deliveryReport(notifier))
+		admin.GET("/notifications", notificationHistory(notifier))
+		admin.POST("/notifications/:id/resend", resendNotification(notifier, config.NotifyTimeout))
+		admin.GET("/tokens/invalidated", invalidTokens(notifier))
+		// The broadcasts are only rate limited as a whole.
+		addBroadcastRouter(admin, newBatchHandler(notifier, channel, router.BasePath(), config, nil, state.metrics), config, state.broadcasts)
+	}
 	return r
 }
 
-func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.HttpCallbackChannel) {
-	r.POST("/notify", func(c *gin.Context) {
-		body, _ := io.ReadAll(c.Request.Body)
+func addRouter(r *gin.RouterGroup, notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig, state *routerState) {
+	var notifyHandlers []gin.HandlerFunc
+	if config.ReplayProtection {
+		nonces := state.nonceCache("notify", config.ReplayWindow+2*config.ReplayClockSkew)
+		notifyHandlers = append(notifyHandlers, replayProtection(nonces, config.ReplayWindow, config.ReplayClockSkew, notifier.Logger()))
+	}
+	var limiter RateLimiter
+	if config.TokenRateLimit > 0 {
+		limiter = state.tokenLimiter(config.TokenRateLimit, config.TokenRateBurst)
+		notifyHandlers = append(notifyHandlers, tokenRateLimit(limiter, notifier.Logger()))
+	}
+
+	batch := newBatchHandler(notifier, channel, r.BasePath(), config, limiter, state.metrics)
+	platforms, enabledPlatforms := batch.platforms, batch.enabledPlatforms
+	signatures, catalog, relayTemplates := batch.signatures, batch.catalog, batch.relayTemplates
+
+	var dedup DedupStore
+	if config.IdempotencyWindow > 0 {
+		dedup = state.dedupStore(config.IdempotencyMaxKeys)
+	}
+
+	r.POST("/notify", append(notifyHandlers, func(c *gin.Context) {
+		request := ginRequest(c)
+		request.dedup = dedup
+		requestID := request.requestID
+		ctx := notify.WithRequestID(request.detached, requestID)
+		logger := notifier.Logger().With("request_id", requestID)
+
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			logger.Debug("failed to read body", "content_length", c.Request.ContentLength, "error", err)
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, errors.New("failed to read request body"))
+			return
+		}
+		if c.Request.ContentLength >= 0 && int64(len(body)) != c.Request.ContentLength {
+			logger.Info("content length mismatch", "content_length", c.Request.ContentLength, "read", len(body))
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload,
+				fmt.Errorf("body length %v does not match the content length %v", len(body), c.Request.ContentLength))
+			return
+		}
+		if len(bytes.TrimSpace(body)) == 0 {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, errors.New("empty request body"))
+			return
+		}
 		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+		if err := signatures.verify(c.Request.Header, body, payloadName(body)); err != nil {
+			logger.Info("rejecting payload without a valid provider signature")
+			abortWithError(c, http.StatusUnauthorized, ErrCodeUnauthorized, err)
+			return
+		}
 
 		// Make sure the query string fits the mobile push structure
 		var query MobilePushWebHookQuery
 		if err := c.ShouldBindQuery(&query); err != nil {
-			c.AbortWithError(http.StatusBadRequest, err)
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
 			return
 		}
-
-		// Find a matching notification payload
-		payloads := []NotificationConvertible{
-			&PaymentReceivedPayload{},
-			&TxConfirmedPayload{},
-			&AddressTxsConfirmedPayload{},
-			&LnurlPayInfoPayload{},
-			&LnurlPayInvoicePayload{},
-			&LnurlPayVerifyPayload{},
-			&SwapUpdatedPayload{},
-			&InvoiceRequestPayload{},
-		}
-		var validPayload NotificationConvertible
-		for _, p := range payloads {
-			if err := c.ShouldBindBodyWith(p, binding.JSON); err != nil {
-				continue
+		if query.Platform == "" {
+			query.Platform = c.GetHeader(platformHeader)
+		}
+		if query.Token == "" {
+			query.Token = c.GetHeader(tokenHeader)
+		}
+		if query.ClientID == "" && (query.Platform == "" || query.Token == "") {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery,
+				fmt.Errorf("platform and token are required, in the query or the %v and %v headers", platformHeader, tokenHeader))
+			return
+		}
+		if header := c.GetHeader(templateVersionHeader); header != "" && query.TemplateVersion == 0 {
+			version, err := strconv.Atoi(header)
+			if err != nil || version < 1 {
+				abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, fmt.Errorf("invalid %v header %q", templateVersionHeader, header))
+				return
 			}
-			validPayload = p
-			break
+			query.TemplateVersion = version
 		}
+		// A client is notified on all its devices, like a batch.
+		if query.Token == "" {
+			batch.notifyClient(c, query, body, logger)
+			return
+		}
+		if !platforms[query.Platform] {
+			abortWithError(c, http.StatusBadRequest, ErrCodeUnsupportedPlatform, unsupportedPlatform(query.Platform, enabledPlatforms))
+			return
+		}
+		if err := checkAppData(query.AppData, config); err != nil {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+			return
+		}
+		if query.AppData == nil && config.DefaultAppData != "" {
+			query.AppData = &config.DefaultAppData
+		}
+		logger = logger.With("platform", query.Platform, "token", notify.MaskToken(query.Token))
 
-		if validPayload == nil {
-			log.Debugf("invalid payload, body: %s", body)
-			c.AbortWithError(http.StatusBadRequest, fmt.Errorf("unsupported payload, body: %s", body))
+		validPayload, notification, reqErr := parseNotification(request, body, &query, config, catalog, state.metrics, logger)
+		if reqErr != nil {
+			abortWithError(c, reqErr.status, reqErr.code, reqErr.err)
+			return
+		}
+		logger = logger.With("template", notification.Template)
+		if swapStatusFiltered(validPayload, &query, config) {
+			logger.Debug("dropping filtered swap status")
+			c.JSON(http.StatusOK, newNotificationResponse(requestID, notification, ResultFiltered))
+			return
+		}
+		if notification.DeliverAt != nil {
+			if validPayload.RequiresCallback() || relayTemplates[notification.Template] {
+				reqErr := unschedulable(notification)
+				abortWithError(c, reqErr.status, reqErr.code, reqErr.err)
+				return
+			}
+			response, reqErr := scheduleNotification(request, notifier, &query, notification)
+			if reqErr != nil {
+				logger.Info("failed to schedule notification", "error", reqErr.err)
+				abortWithError(c, reqErr.status, reqErr.code, reqErr.err)
+				return
+			}
+			respondAccepted(c, r.BasePath(), response)
 			return
 		}
 
-		if validPayload.RequiresCallback() {
-			response, err := channel.Notify(c, notifier, r.BasePath(), validPayload.ToNotification(&query))
+		// The replies of the relayed templates are sent to the channel, which
+		// posts them to the reply_url of the sender.
+		if validPayload.RequiresCallback() || relayTemplates[notification.Template] {
+			response, err := channel.Notify(ctx, notifier, r.BasePath(), notification)
 			if c.IsAborted() {
 				return
 			}
 			if err != nil {
-				log.Debugf("failed to notify with channel, query: %v, error: %v", query, err)
-				c.AbortWithStatus(http.StatusInternalServerError)
+				logger.Info("failed to notify with channel", "error", err)
+				reqErr := callbackError(err, &query, notification)
+				abortWithError(c, reqErr.status, reqErr.code, reqErr.err)
 				return
 			}
 			c.Header("Content-Type", "application/json")
 			c.Writer.Write([]byte(response))
 			return
 		} else {
-			if err := notifier.Notify(c, validPayload.ToNotification(&query)); err != nil {
-				log.Debugf("failed to notify, query: %v, error: %v", query, err)
-				c.AbortWithStatus(http.StatusInternalServerError)
+			// Requests awaiting a callback expect their own response, so only
+			// plain notifications are deduplicated.
+			dedupKey, reserved := reserveNotification(request, config, notification, logger)
+			if !reserved {
+				c.JSON(http.StatusOK, newNotificationResponse(requestID, notification, ResultDeduplicated))
 				return
 			}
+
+			// The result correlates the webhook call with the provider message,
+			// wake ups only return once the silent push is queued.
+			var result *notify.Result
+			if window, ok := config.WakeFallback[notification.Template]; ok {
+				err = channel.WakeWithFallback(ctx, notifier, r.BasePath(), notification, window)
+			} else if config.AsyncDelivery {
+				// The notification is sent once responded to, the gin context
+				// not being cancelled along with the request.
+				err = notifier.Notify(ctx, notification)
+			} else {
+				sendCtx, cancel := withNotifyTimeout(notify.WithRequestID(c.Request.Context(), requestID), config.NotifyTimeout)
+				result, err = notifier.NotifyAndWait(sendCtx, notification)
+				cancel()
+			}
+			if err != nil {
+				logger.Info("failed to notify", "error", err)
+				releaseNotification(request, dedupKey, logger)
+				reqErr := notifyError(err, &query, notification)
+				if reqErr.reason == "" {
+					abortWithError(c, reqErr.status, reqErr.code, reqErr.err)
+					return
+				}
+				abortWithDeliveryError(c, reqErr.status, reqErr.code, reqErr.err, notification, reqErr.reason)
+				return
+			}
+
+			if config.DebugResponses && c.GetHeader(debugHeader) == "true" {
+				resolved, payload, err := notifier.Render(notification)
+				if err != nil {
+					logger.Debug("failed to render notification", "error", err)
+					abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, errors.New("failed to render notification"))
+					return
+				}
+				c.JSON(http.StatusOK, debugResponse{Notification: resolved, Payload: payload})
+				return
+			}
+			if config.AsyncDelivery && result == nil {
+				respondAccepted(c, r.BasePath(), newDeliveredResponse(requestID, notification, nil))
+				return
+			}
+			respondWithNotification(c, notification, result)
 		}
+	})...)
 
-		c.Status(http.StatusOK)
-	})
+	// The tokens of a batch are in its items, they are rate limited one by one.
+	var batchHandlers []gin.HandlerFunc
+	if config.ReplayProtection {
+		nonces := state.nonceCache("batch", config.ReplayWindow+2*config.ReplayClockSkew)
+		batchHandlers = append(batchHandlers, replayProtection(nonces, config.ReplayWindow, config.ReplayClockSkew, notifier.Logger()))
+	}
+	r.POST("/notify/batch", append(batchHandlers, batch.handle)...)
 
+	r.PUT("/capabilities", registerCapabilities(notifier, platforms))
+	r.PUT("/encryption_key", registerEncryptionKey(notifier, platforms))
+	r.DELETE("/encryption_key", removeEncryptionKey(notifier, platforms))
+	addDeviceRouter(r, notifier, platforms, config)
+	r.GET("/notifications/:id", notificationStatus(notifier))
+	r.DELETE("/notifications/:id", cancelScheduled(notifier))
+
+	// Rendering is a debugging tool, it is only exposed along with debug responses.
+	if config.DebugResponses {
+		r.POST("/render", func(c *gin.Context) {
+			var query PreviewQuery
+			if err := c.ShouldBindQuery(&query); err != nil {
+				abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+				return
+			}
+			if query.Token == "" {
+				query.Token = "preview"
+			}
+			if err := checkAppData(query.AppData, config); err != nil {
+				abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, err)
+				return
+			}
+			if query.AppData == nil && config.DefaultAppData != "" {
+				query.AppData = &config.DefaultAppData
+			}
+
+			body, err := io.ReadAll(c.Request.Body)
+			if err != nil {
+				abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, errors.New("failed to read request body"))
+				return
+			}
+			validPayload, err := matchPayload(body)
+			if err != nil {
+				abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+				return
+			}
+
+			logger := notifier.Logger().With("request_id", c.GetString(requestIDKey))
+			notification, err := toNotification(ginRequest(c), validPayload, body, &MobilePushWebHookQuery{Token: query.Token, AppData: query.AppData}, config, catalog, logger)
+			if err != nil {
+				abortWithError(c, http.StatusBadRequest, ErrCodeInvalidPayload, err)
+				return
+			}
+			c.JSON(http.StatusOK, notifier.RenderAll(notification))
+		})
+	}
+}
+
+func addResponseRouter(r *gin.RouterGroup, channel *channel.HttpCallbackChannel) {
 	r.POST("/response/:responseId", func(c *gin.Context) {
 		responseId := c.Param("responseId")
 
 		reqId, err := strconv.ParseUint(responseId, 10, 64)
 		if err != nil {
-			c.AbortWithError(http.StatusBadRequest, errors.New("invalid response"))
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidResponse, errors.New("invalid response"))
 			return
 		}
 
 		all, err := io.ReadAll(c.Request.Body)
 		if err != nil {
-			c.AbortWithError(http.StatusInternalServerError, errors.New("internal error"))
+			abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, errors.New("internal error"))
 			return
 		}
 
 		if err := channel.OnResponse(reqId, string(all)); err != nil {
-			c.AbortWithError(http.StatusInternalServerError, err)
+			abortWithError(c, http.StatusInternalServerError, ErrCodeUnknownRequest, err)
 			return
 		}
 
 		c.Status(http.StatusOK)
 	})
 }
+
+// parseNotification binds the body to its payload and builds the
+// notification addressed to the device of the query, returning the error
+// response when the request is invalid.
+func parseNotification(r *notifyRequest, body []byte, query *MobilePushWebHookQuery, config *config.HTTPConfig, catalog *messageCatalog, m *metrics, logger *slog.Logger) (NotificationConvertible, *notify.Notification, *requestError) {
+	_, span := tracer.Start(r.ctx, "parse notification")
+	defer span.End()
+	validPayload, notification, reqErr := validateNotification(r, body, query, config, catalog, m, logger)
+	if reqErr != nil {
+		span.SetStatus(codes.Error, reqErr.code)
+		m.observeRejected(reqErr.code)
+		return nil, nil, reqErr
+	}
+	span.SetAttributes(attribute.String("template", notification.Template), attribute.String("platform", notification.Type))
+	m.observeNotification(notification)
+	return validPayload, notification, nil
+}
+
+// validateNotification matches the body with a payload and validates the
+// notification it converts to.
+func validateNotification(r *notifyRequest, body []byte, query *MobilePushWebHookQuery, config *config.HTTPConfig, catalog *messageCatalog, m *metrics, logger *slog.Logger) (NotificationConvertible, *notify.Notification, *requestError) {
+	if err := checkDiscriminator(body); err != nil {
+		logger.Debug("ambiguous payload", "body", string(body))
+		return nil, nil, &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload, err: err}
+	}
+
+	// Find a matching notification payload
+	validPayload, err := matchPayload(body)
+	m.observePayload(validPayload)
+	if errors.Is(err, errUnsupportedPayload) {
+		logger.Debug("unsupported payload", "body", string(body))
+		return nil, nil, &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload, err: fmt.Errorf("unsupported payload, body: %s", body)}
+	}
+	if err != nil {
+		logger.Debug("invalid payload", "body", string(body), "error", err)
+		return nil, nil, &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload, err: err}
+	}
+	if validator, ok := validPayload.(PayloadValidator); ok {
+		if err := validator.Validate(); err != nil {
+			logger.Debug("invalid payload", "body", string(body), "error", err)
+			return nil, nil, &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload, err: err}
+		}
+	}
+
+	notification, err := toNotification(r, validPayload, body, query, config, catalog, logger)
+	if err != nil {
+		logger.Debug("invalid payload", "body", string(body), "error", err)
+		return nil, nil, &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload, err: err}
+	}
+	if err := checkDataSize(notification, config.TemplateMaxDataSize); err != nil {
+		logger.Info("notification data too large", "template", notification.Template, "error", err)
+		return nil, nil, &requestError{status: http.StatusRequestEntityTooLarge, code: ErrCodePayloadTooLarge, err: err}
+	}
+	return validPayload, notification, nil
+}
+
+// notifyError returns the error response of a notification that failed to
+// be sent.
+func notifyError(err error, query *MobilePushWebHookQuery, notification *notify.Notification) *requestError {
+	if errors.Is(err, notify.ErrServiceNotFound) {
+		return &requestError{status: http.StatusBadRequest, code: ErrCodeUnsupportedPlatform,
+			err: fmt.Errorf("platform %q is not configured", query.Platform)}
+	}
+	if errors.Is(err, notify.ErrUnknownApp) {
+		return &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidQuery, err: fmt.Errorf("unknown app %q", query.App)}
+	}
+	if errors.Is(err, notify.ErrUnsupportedTemplateVersion) {
+		return &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidQuery,
+			err: fmt.Errorf("unsupported version %v of template %v", query.TemplateVersion, notification.Template)}
+	}
+	if errors.Is(err, notify.ErrQueueFull) {
+		return &requestError{status: http.StatusTooManyRequests, code: ErrCodeRateLimited, err: err}
+	}
+	if errors.Is(err, notify.ErrShuttingDown) {
+		return &requestError{status: http.StatusServiceUnavailable, code: ErrCodeBackendUnavailable, err: err}
+	}
+	if errors.Is(err, notify.ErrThrottled) {
+		return &requestError{status: http.StatusServiceUnavailable, code: ErrCodeRateLimited, err: err, reason: notify.ReasonThrottled}
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &requestError{status: http.StatusGatewayTimeout, code: ErrCodeTimeout, err: errors.New("timed out sending the notification"), reason: notify.ReasonTimeout}
+	}
+	// Permanent delivery failures are caused by the request.
+	reason := notify.Reason(err)
+	switch reason {
+	case notify.ReasonUnregistered:
+		return &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidToken, err: errors.New("device token is not registered"), reason: reason}
+	case notify.ReasonTooLarge:
+		return &requestError{status: http.StatusRequestEntityTooLarge, code: ErrCodePayloadTooLarge, err: errors.New("notification is too large"), reason: reason}
+	case notify.ReasonCircuitOpen:
+		return &requestError{status: http.StatusServiceUnavailable, code: ErrCodeBackendUnavailable, err: errors.New("push provider is unavailable"), reason: reason}
+	}
+	return &requestError{status: http.StatusInternalServerError, code: ErrCodeBackendUnavailable, err: errors.New("failed to notify"), reason: reason}
+}
+
+// callbackError returns the error response of a notification awaiting a
+// reply that failed.
+func callbackError(err error, query *MobilePushWebHookQuery, notification *notify.Notification) *requestError {
+	if errors.Is(err, notify.ErrUnknownApp) {
+		return &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidQuery, err: fmt.Errorf("unknown app %q", query.App)}
+	}
+	if errors.Is(err, notify.ErrUnsupportedTemplateVersion) {
+		return &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidQuery,
+			err: fmt.Errorf("unsupported version %v of template %v", query.TemplateVersion, notification.Template)}
+	}
+	if errors.Is(err, channel.ErrCallbackTimeout) {
+		return &requestError{status: http.StatusGatewayTimeout, code: ErrCodeTimeout, err: errors.New("the app did not reply in time")}
+	}
+	if errors.Is(err, channel.ErrReplyRelayFailed) {
+		return &requestError{status: http.StatusBadGateway, code: ErrCodeBackendUnavailable, err: errors.New("failed to relay the reply to the reply_url")}
+	}
+	return &requestError{status: http.StatusInternalServerError, code: ErrCodeBackendUnavailable, err: errors.New("failed to notify")}
+}
+
+// withNotifyTimeout bounds the time waiting for a notification to be sent,
+// zero meaning no bound.
+func withNotifyTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// checkAppData checks the app_data provided by a sender against the maximum
+// length and, when required, that it is json.
+func checkAppData(appData *string, config *config.HTTPConfig) error {
+	if appData == nil {
+		return nil
+	}
+	if config.MaxAppDataLength > 0 && len(*appData) > config.MaxAppDataLength {
+		return fmt.Errorf("app_data length %v exceeds the maximum of %v", len(*appData), config.MaxAppDataLength)
+	}
+	if config.AppDataJSON && !json.Valid([]byte(*appData)) {
+		return errors.New("app_data is not valid json")
+	}
+	return nil
+}
+
+// unsupportedPlatform returns the error of a platform that is not enabled.
+func unsupportedPlatform(platform string, enabledPlatforms []string) error {
+	return fmt.Errorf("unsupported platform %q, enabled platforms: %v", platform, strings.Join(enabledPlatforms, ", "))
+}
+
+// toNotification converts the payload to a notification, applying the
+// configured adjustments and the overrides of the request body.
+func toNotification(r *notifyRequest, payload NotificationConvertible, body []byte, query *MobilePushWebHookQuery, config *config.HTTPConfig, catalog *messageCatalog, logger *slog.Logger) (*notify.Notification, error) {
+	notification := payload.ToNotification(query)
+	// The request id follows the notification through the queues, to the
+	// response of the provider.
+	notification.RequestID = r.requestID
+	lang := query.Lang
+	if lang == "" {
+		lang = r.header.Get("Accept-Language")
+	}
+	notification.DisplayMessage = catalog.translate(notification.Template, lang, notification.DisplayMessage)
+	defaultMessage := notification.DisplayMessage
+	if swap, ok := payload.(*SwapUpdatedPayload); ok && len(config.SwapStatusMessages) > 0 {
+		notification.DisplayMessage = swap.StatusMessage(config.SwapStatusMessages)
+	}
+
+	if header := r.header.Get(ttlHeader); header != "" {
+		seconds, err := strconv.Atoi(header)
+		if err != nil || seconds <= 0 {
+			return nil, fmt.Errorf("invalid %v header %q", ttlHeader, header)
+		}
+		notification.TTL = time.Duration(seconds) * time.Second
+		if config.MaxTTL > 0 && notification.TTL > config.MaxTTL {
+			notification.TTL = config.MaxTTL
+		}
+	}
+
+	var overrides PayloadOverrides
+	if err := binding.JSON.BindBody(body, &overrides); err != nil {
+		return nil, err
+	}
+	if overrides.EventID != "" {
+		notification.EventID = overrides.EventID
+		if notification.Data == nil {
+			notification.Data = make(map[string]interface{})
+		}
+		notification.Data["event_id"] = overrides.EventID
+	}
+	if overrides.Category != "" {
+		notification.Category = overrides.Category
+	}
+	if overrides.DeliverAt != nil && overrides.DelaySeconds > 0 {
+		return nil, errors.New("deliver_at and delay_seconds are exclusive")
+	}
+	if overrides.DeliverAt != nil {
+		if !overrides.DeliverAt.After(time.Now()) {
+			return nil, errors.New("deliver_at must be in the future")
+		}
+		notification.DeliverAt = overrides.DeliverAt
+	}
+	if overrides.DelaySeconds > 0 {
+		deliverAt := time.Now().Add(time.Duration(overrides.DelaySeconds) * time.Second)
+		notification.DeliverAt = &deliverAt
+	}
+	if overrides.DisplayMessage != nil {
+		message := sanitizeDisplayMessage(*overrides.DisplayMessage)
+		if length := utf8.RuneCountInString(message); length > config.MaxDisplayMessageLength {
+			return nil, fmt.Errorf("display_message length %v exceeds the maximum of %v", length, config.MaxDisplayMessageLength)
+		}
+		if message != "" {
+			notification.DisplayMessage = message
+		}
+	}
+	message, err := interpolateDisplayMessage(notification.DisplayMessage, notification.Data)
+	if err != nil {
+		logger.Info("falling back to the default display message", "template", notification.Template, "error", err)
+		message = defaultMessage
+		if config.DisplayMessageFallback != "" {
+			message = config.DisplayMessageFallback
+		}
+	}
+	notification.DisplayMessage = message
+	if config.DisplayMessageTruncation > 0 {
+		notification.DisplayMessage = truncateDisplayMessage(notification.DisplayMessage, config.DisplayMessageTruncation)
+	}
+	return notification, nil
+}
+
+// placeholderPattern matches the {key} placeholders of the display messages.
+var placeholderPattern = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+
+// interpolateDisplayMessage replaces the {key} placeholders of the message
+// with the values of the data. It fails when a key is missing, rather than
+// displaying a broken message.
+func interpolateDisplayMessage(message string, data map[string]interface{}) (string, error) {
+	var missing []string
+	interpolated := placeholderPattern.ReplaceAllStringFunc(message, func(placeholder string) string {
+		key := placeholder[1 : len(placeholder)-1]
+		value, ok := data[key]
+		if !ok || value == nil {
+			missing = append(missing, key)
+			return placeholder
+		}
+		if pointer, ok := value.(*string); ok {
+			return sanitizeDisplayMessage(*pointer)
+		}
+		return sanitizeDisplayMessage(fmt.Sprint(value))
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("display message references missing data %v", strings.Join(missing, ", "))
+	}
+	return interpolated, nil
+}
+
+// truncateDisplayMessage cuts the message to at most max characters, ending
+// with an ellipsis when truncated.
+func truncateDisplayMessage(message string, max int) string {
+	runes := []rune(message)
+	if len(runes) <= max {
+		return message
+	}
+	return strings.TrimRightFunc(string(runes[:max-1]), unicode.IsSpace) + "…"
+}
+
+// sanitizeDisplayMessage replaces line breaks and drops the other control
+// characters of a sender provided message.
+func sanitizeDisplayMessage(message string) string {
+	sanitized := strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, message)
+	return strings.Join(strings.Fields(sanitized), " ")
+}
+
+// checkDataSize makes sure the serialized Data of the notification is within
+// the configured maximum size of its template.
+func checkDataSize(notification *notify.Notification, maxSizes map[string]int) error {
+	maxSize, ok := maxSizes[notification.Template]
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(notification.Data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal notification data %v", err)
+	}
+	if len(data) > maxSize {
+		return fmt.Errorf("%v data size %v exceeds the maximum of %v bytes", notification.Template, len(data), maxSize)
+	}
+	return nil
+}
+
+// payloadTypes maps the template or event of a payload to its type.
+var payloadTypes = map[string]func() NotificationConvertible{
+	notify.NOTIFICATION_PAYMENT_RECEIVED:             func() NotificationConvertible { return &PaymentReceivedPayload{} },
+	notify.NOTIFICATION_TX_CONFIRMED:                 func() NotificationConvertible { return &TxConfirmedPayload{} },
+	notify.NOTIFICATION_ADDRESS_TXS_CONFIRMED:        func() NotificationConvertible { return &AddressTxsConfirmedPayload{} },
+	notify.NOTIFICATION_LNURLPAY_INFO:                func() NotificationConvertible { return &LnurlPayInfoPayload{} },
+	notify.NOTIFICATION_LNURLPAY_INVOICE:             func() NotificationConvertible { return &LnurlPayInvoicePayload{} },
+	notify.NOTIFICATION_LNURLPAY_VERIFY:              func() NotificationConvertible { return &LnurlPayVerifyPayload{} },
+	notify.NOTIFICATION_LNURL_WITHDRAW:               func() NotificationConvertible { return &LnurlWithdrawPayload{} },
+	notify.NOTIFICATION_LIQUID_ASSET_RECEIVED:        func() NotificationConvertible { return &LiquidAssetReceivedPayload{} },
+	notify.NOTIFICATION_PEGIN_CONFIRMED:              func() NotificationConvertible { return &PeginConfirmedPayload{} },
+	notify.NOTIFICATION_PEGOUT_CONFIRMED:             func() NotificationConvertible { return &PegoutConfirmedPayload{} },
+	notify.NOTIFICATION_BOLT12_OFFER_INVOICE_REQUEST: func() NotificationConvertible { return &Bolt12OfferInvoiceRequestPayload{} },
+	"swap.update":     func() NotificationConvertible { return &SwapUpdatedPayload{} },
+	"swap.refunded":   func() NotificationConvertible { return &SwapRefundedPayload{} },
+	"invoice.request": func() NotificationConvertible { return &InvoiceRequestPayload{} },
+}
+
+var payloadTypesMu sync.RWMutex
+
+// RegisterPayload adds a payload type identified by the template or event
+// field of the bodies, letting projects embedding the webhook accept their own
+// payloads. The notifications of these templates are sent like those of the
+// built in ones. It is meant to be called at init and panics when the name is
+// empty or already registered.
+func RegisterPayload(name string, factory func() NotificationConvertible) {
+	payloadTypesMu.Lock()
+	defer payloadTypesMu.Unlock()
+	if name == "" || factory == nil {
+		panic("http: RegisterPayload requires a name and a factory")
+	}
+	if _, ok := payloadTypes[name]; ok {
+		panic("http: RegisterPayload called twice for payload " + name)
+	}
+	payloadTypes[name] = factory
+}
+
+// errUnsupportedPayload is returned for bodies that do not identify a known
+// payload type.
+var errUnsupportedPayload = errors.New("unsupported payload")
+
+// matchPayload binds the body to the payload type identified by its template
+// or event field. A body of a known type that does not pass the validation
+// returns the validation error, errUnsupportedPayload is returned when the
+// type is unknown.
+func matchPayload(body []byte) (NotificationConvertible, error) {
+	name := payloadName(body)
+	payloadTypesMu.RLock()
+	newPayload, ok := payloadTypes[name]
+	payloadTypesMu.RUnlock()
+	if !ok {
+		return nil, errUnsupportedPayload
+	}
+	payload := newPayload()
+	if err := binding.JSON.BindBody(body, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
@@ -1,16 +1,47 @@
 package http
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/breez/notify/channel"
 	"github.com/breez/notify/config"
 	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"golang.org/x/exp/slog"
+	"golang.org/x/net/websocket"
 	"gotest.tools/assert"
 )
 
@@ -81,19 +112,98 @@ func TestAddressTXsChangedHook(t *testing.T) {
 	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, expected)
 }
 
-func testValidNotification(t *testing.T, url string, body []byte, expected *notify.Notification) {
+func TestDebugResponse(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{DebugResponses: true}}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	req.Header.Set(debugHeader, "true")
+	router.ServeHTTP(w, req)
+	<-service.sentQueue
+
+	assert.Equal(t, 200, w.Code)
+	var response debugResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Notification.Template, notify.NOTIFICATION_PAYMENT_RECEIVED)
+	assert.Equal(t, response.Notification.TargetIdentifier, "1234")
+}
+
+func TestDebugResponseDisabled(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
 	service := newTestService()
-	config := &config.Config{WorkersNum: 2}
-	notifier := notify.NewNotifier(config, map[string]notify.Service{"android": service})
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	req.Header.Set(debugHeader, "true")
+	router.ServeHTTP(w, req)
+	<-service.sentQueue
+
+	assert.Equal(t, 200, w.Code)
+	var response NotificationResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Result, ResultSent)
+	assert.Equal(t, response.Platform, "android")
+}
+
+type messageService struct {
+	*TestService
+}
+
+func (m *messageService) SendMessage(c context.Context, notification *notify.Notification) (string, error) {
+	return "projects/breez/messages/1", m.Send(c, notification)
+}
+
+func TestNotifyResult(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := &messageService{newTestService()}
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	<-service.sentQueue
+
+	assert.Equal(t, 200, w.Code)
+	var response NotificationResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Assert(t, response.ID != "")
+	assert.Assert(t, response.NotificationID != "")
+	response.ID, response.NotificationID = "", ""
+	assert.DeepEqual(t, response, NotificationResponse{
+		Template:  notify.NOTIFICATION_PAYMENT_RECEIVED,
+		Platform:  "android",
+		Target:    "***",
+		Result:    ResultSent,
+		MessageID: "projects/breez/messages/1",
+	})
+}
+
+func setupTestRouter(c *config.Config, service notify.Service) *gin.Engine {
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
 	channel := channel.NewHttpCallbackChannel("http://localhost:8080")
-	router := setupRouter(notifier, channel)
+	return setupRouter(notifier, channel, &c.HTTPConfig, nil)
+}
+
+func testValidNotification(t *testing.T, url string, body []byte, expected *notify.Notification) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
 
 	w := httptest.NewRecorder()
 	req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
 	router.ServeHTTP(w, req)
 
 	assert.Equal(t, 200, w.Code)
-	assert.DeepEqual(t, *expected, *<-service.sentQueue)
+	// The notification carries the id of the request it was received in.
+	sent := *<-service.sentQueue
+	assert.Equal(t, sent.RequestID, w.Header().Get(requestIDHeader))
+	var response NotificationResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, sent.ID, response.NotificationID)
+	sent.RequestID, sent.ID = "", ""
+	assert.DeepEqual(t, *expected, sent)
 }
 
 type TestService struct {
@@ -109,3 +219,2302 @@ func (t *TestService) Send(c context.Context, notification *notify.Notification)
 	t.sentQueue <- notification
 	return nil
 }
+
+func TestReplayProtection(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{
+		WorkersNum: 2,
+		HTTPConfig: config.HTTPConfig{ReplayProtection: true, ReplayWindow: time.Minute, ReplayClockSkew: 10 * time.Second},
+	}, service)
+
+	send := func(timestamp time.Time, nonce string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		req.Header.Set(timestampHeader, strconv.FormatInt(timestamp.Unix(), 10))
+		req.Header.Set(nonceHeader, nonce)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, send(time.Now(), "nonce1"), 200)
+	<-service.sentQueue
+	assert.Equal(t, send(time.Now(), "nonce1"), 401)
+	assert.Equal(t, send(time.Now().Add(-2*time.Minute), "nonce2"), 401)
+	assert.Equal(t, send(time.Now(), ""), 401)
+
+	// Timestamps are accepted within the clock skew on either side.
+	assert.Equal(t, send(time.Now().Add(5*time.Second), "nonce3"), 200)
+	<-service.sentQueue
+	assert.Equal(t, send(time.Now().Add(-time.Minute-5*time.Second), "nonce4"), 200)
+	<-service.sentQueue
+	assert.Equal(t, send(time.Now().Add(30*time.Second), "nonce5"), 401)
+
+	// The nonces are forgotten once expired.
+	nonces := newNonceCache(time.Minute)
+	now := time.Now()
+	assert.Equal(t, nonces.add("nonce1", now), true)
+	assert.Equal(t, nonces.add("nonce2", now.Add(time.Second)), true)
+	assert.Equal(t, nonces.add("nonce1", now.Add(30*time.Second)), false)
+	assert.Equal(t, nonces.add("nonce3", now.Add(time.Minute+time.Millisecond)), true)
+	assert.Equal(t, len(nonces.seen), 2)
+	assert.Equal(t, nonces.add("nonce1", now.Add(time.Minute+time.Millisecond)), true)
+}
+
+func TestSignedTimestamp(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{
+		ReplayProtection: true,
+		ReplayWindow:     time.Minute,
+		ReplayClockSkew:  10 * time.Second,
+		SignatureProviders: config.SignatureProviders{
+			"lsp": {Secret: "secret", SignsTimestamp: true},
+		},
+	}}, service)
+	sign := func(message string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		mac.Write([]byte(message))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	send := func(timestamp string, nonce string, signature string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		req.Header.Set(timestampHeader, timestamp)
+		req.Header.Set(nonceHeader, nonce)
+		req.Header.Set(defaultSignatureHeader, signature)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := sign(timestamp + ".nonce1." + body)
+	// The signature covers the timestamp and the nonce, not only the body.
+	assert.Equal(t, send(timestamp, "nonce1", sign(body)), 401)
+	assert.Equal(t, send(timestamp, "nonce2", signature), 401)
+	assert.Equal(t, send(timestamp, "nonce3", signature), 401)
+	assert.Equal(t, send(timestamp, "nonce1", signature), 401)
+
+	// A captured request can't be replayed with a fresh timestamp and nonce.
+	timestamp = strconv.FormatInt(time.Now().Unix(), 10)
+	signature = sign(timestamp + ".nonce4." + body)
+	assert.Equal(t, send(timestamp, "nonce4", signature), 200)
+	<-service.sentQueue
+	fresh := strconv.FormatInt(time.Now().Add(time.Second).Unix(), 10)
+	assert.Equal(t, send(fresh, "nonce5", signature), 401)
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestLnurlPayInfoAction(t *testing.T) {
+	body := []byte(`{"template":"lnurlpay_info","data":{"callback_url":"https://example.com/lnurlp/1234","reply_url":"https://example.com/reply"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	notification := <-service.sentQueue
+	assert.DeepEqual(t, *notification.Action, notify.Action{Label: "Open wallet", Link: "lnurlp://example.com/lnurlp/1234"})
+}
+
+func TestUnsupportedPayloadErrorCode(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(`{"template":"unknown"}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeInvalidPayload)
+}
+
+func TestRenderAllPlatforms(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{DebugResponses: true}}, newTestService())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/render", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	var previews map[string]*notify.Preview
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &previews))
+	assert.Equal(t, len(previews), 1)
+	assert.Equal(t, previews["android"].Notification.Type, "android")
+	assert.Equal(t, previews["android"].Notification.Template, notify.NOTIFICATION_PAYMENT_RECEIVED)
+}
+
+func TestDefaultAppData(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{DefaultAppData: "default"}}, service)
+
+	send := func(url string) *notify.Notification {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return <-service.sentQueue
+	}
+
+	assert.Equal(t, *send("/api/v1/notify?platform=android&token=1234").AppData, "default")
+	assert.Equal(t, *send("/api/v1/notify?platform=android&token=1234&app_data=custom").AppData, "custom")
+}
+
+func TestAppDataValidation(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{MaxAppDataLength: 20, AppDataJSON: true}}, service)
+
+	send := func(appData string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&app_data="+url.QueryEscape(appData), bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := send(`{"prefer":"android"}`)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, *(<-service.sentQueue).AppData, `{"prefer":"android"}`)
+
+	w = send(`{"timezone":"Europe/Lisbon"}`)
+	assert.Equal(t, 400, w.Code)
+	assert.Assert(t, strings.Contains(w.Body.String(), "app_data length 28 exceeds the maximum of 20"), w.Body.String())
+
+	w = send(`{"prefer":`)
+	assert.Equal(t, 400, w.Code)
+	assert.Assert(t, strings.Contains(w.Body.String(), "app_data is not valid json"), w.Body.String())
+}
+
+func TestLnurlPayInvoiceAmountMismatch(t *testing.T) {
+	invoice := "lnbc2500u1pvjluezsp5zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zyg3zygspp5qqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqqqsyqcyq5rqwzqfqypqdq5xysxxatsyp3k7enxv4jsxqzpu9qrsgquk0rl77nj30yxdy8j9vdx85fkpmdla2087ne0xh8nhedh8w27kyke0lp53ut353s06fv3qfegext0eh0ymjpf39tuven09sam30g4vgpfna3rh"
+	body := []byte(`{"template":"lnurlpay_invoice","data":{"amount":1000,"reply_url":"https://example.com/reply","invoice":"` + invoice + `"}}`)
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Message, "invoice amount 250000000 does not match the requested amount 1000")
+}
+
+func TestSilentQuery(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&silent=true", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, *(<-service.sentQueue).Silent, true)
+}
+
+func TestAppIDQuery(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&app_id=testnet", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, (<-service.sentQueue).AppID, "testnet")
+}
+
+func TestAppQuery(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&app=unknown", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, 400)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeInvalidQuery)
+	assert.Equal(t, response.Error.Message, `unknown app "unknown"`)
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestTTLHeader(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{MaxTTL: time.Minute}}, service)
+
+	send := func(ttl string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		req.Header.Set("X-Notify-TTL", ttl)
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, send("30"), 200)
+	assert.Equal(t, (<-service.sentQueue).TTL, 30*time.Second)
+	assert.Equal(t, send("3600"), 200)
+	assert.Equal(t, (<-service.sentQueue).TTL, time.Minute)
+	assert.Equal(t, send("soon"), 400)
+}
+
+func TestRetryOnQuery(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&retry_on=throttled&retry_on=timeout", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.DeepEqual(t, (<-service.sentQueue).RetryOn, []notify.ErrorReason{notify.ReasonThrottled, notify.ReasonTimeout})
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&retry_on=sometimes", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestAmbiguousPayload(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	bodies := []string{
+		`{"template":"payment_received","event":"swap.update","data":{"payment_hash":"1234","id":"1","status":"s"}}`,
+		`{"template":"tx_confirmed","template":"payment_received","data":{"payment_hash":"1234"}}`,
+	}
+	for _, body := range bodies {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 400, w.Code)
+	}
+}
+
+func TestSwapStatusMessages(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{
+		WorkersNum: 2,
+		HTTPConfig: config.HTTPConfig{SwapStatusMessages: map[string]string{"transaction.mempool": "Swap transaction seen"}},
+	}, service)
+
+	send := func(status string) string {
+		body := []byte(`{"event":"swap.update","data":{"id":"1","status":"` + status + `"}}`)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return (<-service.sentQueue).DisplayMessage
+	}
+
+	assert.Equal(t, send("transaction.mempool"), "Swap transaction seen")
+	assert.Equal(t, send("swap.expired"), "swap.expired")
+}
+
+func TestTemplateMaxDataSize(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	router := setupTestRouter(&config.Config{
+		WorkersNum: 2,
+		HTTPConfig: config.HTTPConfig{TemplateMaxDataSize: map[string]int{notify.NOTIFICATION_PAYMENT_RECEIVED: 10}},
+	}, newTestService())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 413, w.Code)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodePayloadTooLarge)
+	assert.Equal(t, response.Error.Message, "payment_received data size 23 exceeds the maximum of 10 bytes")
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	req.ContentLength = 10
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestTargetHeaders(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	send := func(url string, headers map[string]string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, bytes.NewBuffer(body))
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, send("/api/v1/notify", map[string]string{"X-Push-Platform": "android", "X-Push-Token": "header"}), 200)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "header")
+
+	// The query takes precedence.
+	assert.Equal(t, send("/api/v1/notify?token=query", map[string]string{"X-Push-Platform": "android", "X-Push-Token": "header"}), 200)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "query")
+
+	assert.Equal(t, send("/api/v1/notify?platform=android", nil), 400)
+}
+
+func TestPlatforms(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	send := func(router *gin.Engine, platform string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform="+platform+"&token=1234", bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	w := send(router, "windows")
+	assert.Equal(t, w.Code, 400)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeUnsupportedPlatform)
+	assert.Equal(t, response.Error.Message, `unsupported platform "windows", enabled platforms: ios, android, web, unifiedpush, apns`)
+
+	// Enabled platforms without a service are rejected before being queued.
+	w = send(router, "web")
+	assert.Equal(t, w.Code, 400)
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeUnsupportedPlatform)
+	assert.Equal(t, response.Error.Message, `platform "web" is not configured`)
+
+	router = setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{Platforms: []string{"ios"}}}, newTestService())
+	assert.Equal(t, send(router, "android").Code, 400)
+}
+
+func TestEmptyBody(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(""))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, 400, w.Code)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Message, "empty request body")
+}
+
+func TestSwapRefundedHook(t *testing.T) {
+	query := MobilePushWebHookQuery{
+		Platform: "android",
+		Token:    "1234",
+	}
+	body := []byte(`{"event":"swap.refunded","data":{"id":"swap1","refund_txid":"abcd","amount_sat":5000}}`)
+	var payload SwapRefundedPayload
+	assert.NilError(t, json.Unmarshal(body, &payload))
+	expected := payload.ToNotification(&query)
+	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, expected)
+}
+
+func TestLiquidHooks(t *testing.T) {
+	query := MobilePushWebHookQuery{
+		Platform: "android",
+		Token:    "1234",
+	}
+	txID := strings.Repeat("ab", 32)
+	assetID := strings.Repeat("6f", 32)
+
+	body := []byte(`{"template":"liquid_asset_received","data":{"asset_id":"` + assetID + `","amount":2500,"tx_id":"` + txID + `"}}`)
+	var received LiquidAssetReceivedPayload
+	assert.NilError(t, json.Unmarshal(body, &received))
+	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, received.ToNotification(&query))
+
+	body = []byte(`{"template":"pegin_confirmed","data":{"tx_id":"` + txID + `","amount_sat":100000}}`)
+	var pegin PeginConfirmedPayload
+	assert.NilError(t, json.Unmarshal(body, &pegin))
+	expected := pegin.ToNotification(&query)
+	assert.Equal(t, expected.Priority, notify.PriorityNormal)
+	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, expected)
+
+	body = []byte(`{"template":"pegout_confirmed","data":{"tx_id":"` + txID + `","amount_sat":100000}}`)
+	var pegout PegoutConfirmedPayload
+	assert.NilError(t, json.Unmarshal(body, &pegout))
+	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, pegout.ToNotification(&query))
+}
+
+func TestLiquidHooksValidation(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	txID := strings.Repeat("ab", 32)
+	tests := []struct {
+		body  string
+		field FieldError
+	}{
+		{`{"template":"liquid_asset_received","data":{"asset_id":"lbtc","amount":2500,"tx_id":"` + txID + `"}}`, FieldError{Field: "LiquidAssetReceivedPayload.Data.AssetID", Tag: "len", Param: "64"}},
+		{`{"template":"liquid_asset_received","data":{"asset_id":"` + strings.Repeat("zz", 32) + `","amount":2500,"tx_id":"` + txID + `"}}`, FieldError{Field: "LiquidAssetReceivedPayload.Data.AssetID", Tag: "hexadecimal"}},
+		{`{"template":"pegin_confirmed","data":{"tx_id":"` + txID + `"}}`, FieldError{Field: "PeginConfirmedPayload.Data.AmountSat", Tag: "required"}},
+		{`{"template":"pegout_confirmed","data":{"amount_sat":100000}}`, FieldError{Field: "PegoutConfirmedPayload.Data.TxID", Tag: "required"}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(test.body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, w.Code, 400)
+		var response ErrorResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Equal(t, response.Error.Code, ErrCodeInvalidPayload)
+		assert.DeepEqual(t, response.Error.Fields, []FieldError{test.field})
+	}
+}
+
+func TestTemplatePriority(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+	send := func(query string, body string) *notify.Notification {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234"+query, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		return <-service.sentQueue
+	}
+
+	confirmed := send("", `{"template":"tx_confirmed","data":{"tx_id":"1234"}}`)
+	assert.Equal(t, confirmed.Priority, notify.PriorityNormal)
+	assert.Equal(t, confirmed.CollapseKey, notify.NOTIFICATION_TX_CONFIRMED)
+
+	confirmed = send("&priority=high&collapse_key=tx1", `{"template":"tx_confirmed","data":{"tx_id":"1234"}}`)
+	assert.Equal(t, confirmed.Priority, notify.PriorityHigh)
+	assert.Equal(t, confirmed.CollapseKey, "tx1")
+
+	received := send("", `{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	assert.Equal(t, received.Priority, "")
+	assert.Equal(t, received.CollapseKey, "")
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&priority=urgent", bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 400)
+}
+
+func TestPushType(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+	send := func(query string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234"+query, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, send("&notification_type=background").Code, 200)
+	assert.Equal(t, *(<-service.sentQueue).Silent, true)
+	assert.Equal(t, send("&notification_type=alert").Code, 200)
+	assert.Equal(t, *(<-service.sentQueue).Silent, false)
+	// The silent query takes precedence.
+	assert.Equal(t, send("&notification_type=background&silent=false").Code, 200)
+	assert.Equal(t, *(<-service.sentQueue).Silent, false)
+	assert.Equal(t, send("&notification_type=banner").Code, 400)
+}
+
+func TestLnurlWithdrawHook(t *testing.T) {
+	query := MobilePushWebHookQuery{
+		Platform: "android",
+		Token:    "1234",
+	}
+	body := []byte(`{"template":"lnurl_withdraw","data":{"callback_url":"https://breez.technology/lnurlw/cb","k1":"abcd","min_withdrawable":1000,"max_withdrawable":100000,"reply_url":"https://breez.technology/reply"}}`)
+	var payload LnurlWithdrawPayload
+	assert.NilError(t, json.Unmarshal(body, &payload))
+	expected := payload.ToNotification(&query)
+	assert.Equal(t, expected.Template, notify.NOTIFICATION_LNURL_WITHDRAW)
+	// The withdrawal is useless once the sender gave up waiting.
+	expected.TTL = time.Minute
+	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, expected)
+}
+
+func TestBolt12OfferInvoiceRequestHook(t *testing.T) {
+	query := MobilePushWebHookQuery{
+		Platform: "android",
+		Token:    "1234",
+	}
+	body := []byte(`{"template":"bolt12_offer_invoice_request","data":{"offer_id":"offer1","reply_url":"https://breez.technology/reply"}}`)
+	var payload Bolt12OfferInvoiceRequestPayload
+	assert.NilError(t, json.Unmarshal(body, &payload))
+	expected := payload.ToNotification(&query)
+	expected.TTL = time.Minute
+	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, expected)
+}
+
+func TestLnurlWithdrawAmounts(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+
+	body := []byte(`{"template":"lnurl_withdraw","data":{"callback_url":"https://breez.technology/lnurlw/cb","k1":"abcd","min_withdrawable":200000,"max_withdrawable":100000,"reply_url":"https://breez.technology/reply"}}`)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, 400)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeInvalidPayload)
+	assert.DeepEqual(t, response.Error.Fields, []FieldError{{Field: "LnurlWithdrawPayload.Data.MinWithdrawable", Tag: "ltefield", Param: "MaxWithdrawable"}})
+}
+
+func TestLnurlWithdrawMissingCallback(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+
+	body := []byte(`{"template":"lnurl_withdraw","data":{"k1":"abcd","max_withdrawable":100000,"reply_url":"https://breez.technology/reply"}}`)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, 400)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeInvalidPayload)
+	assert.DeepEqual(t, response.Error.Fields, []FieldError{{Field: "LnurlWithdrawPayload.Data.CallbackURL", Tag: "required"}})
+}
+
+func TestUnsupportedPayload(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	bodies := []string{
+		`{"template":"payment_sent","data":{"payment_hash":"1234"}}`,
+		`{"data":{"payment_hash":"1234"}}`,
+		`not json`,
+	}
+	for _, body := range bodies {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+
+		assert.Equal(t, w.Code, 400)
+		var response ErrorResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		assert.Assert(t, strings.HasPrefix(response.Error.Message, "unsupported payload"))
+		assert.Assert(t, response.Error.Fields == nil)
+	}
+}
+
+func TestDisplayMessageOverride(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{MaxDisplayMessageLength: 20}}, service)
+
+	send := func(displayMessage string) int {
+		body := []byte(`{"template":"payment_received","display_message":"` + displayMessage + `","data":{"payment_hash":"1234"}}`)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, send(`Received\n 1000 sats`), 200)
+	assert.Equal(t, (<-service.sentQueue).DisplayMessage, "Received 1000 sats")
+	assert.Equal(t, send("Received a payment of 1000 sats"), 400)
+}
+
+func TestEventID(t *testing.T) {
+	body := []byte(`{"template":"payment_received","event_id":"evt_1","data":{"payment_hash":"1234"}}`)
+	testValidNotification(t, "/api/v1/notify?platform=android&token=1234", body, &notify.Notification{
+		Template:         notify.NOTIFICATION_PAYMENT_RECEIVED,
+		DisplayMessage:   "Incoming payment",
+		Type:             "android",
+		TargetIdentifier: "1234",
+		EventID:          "evt_1",
+		Data:             map[string]interface{}{"payment_hash": "1234", "event_id": "evt_1"},
+	})
+}
+
+func TestDisplayMessageTruncation(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{MaxDisplayMessageLength: 200, DisplayMessageTruncation: 10}}, service)
+
+	body := []byte(`{"template":"payment_received","display_message":"Reçu un paiement de 1000 sats","data":{"payment_hash":"1234"}}`)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, (<-service.sentQueue).DisplayMessage, "Reçu un p…")
+	assert.Equal(t, truncateDisplayMessage("Incoming payment", 16), "Incoming payment")
+}
+
+func TestWakeWithFallback(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{
+		WorkersNum: 2,
+		HTTPConfig: config.HTTPConfig{WakeFallback: map[string]time.Duration{notify.NOTIFICATION_PAYMENT_RECEIVED: 50 * time.Millisecond}},
+	}, service)
+
+	send := func() *notify.Notification {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, 200, w.Code)
+		return <-service.sentQueue
+	}
+
+	// Not acknowledged, the alert follows.
+	wake := send()
+	assert.Equal(t, *wake.Silent, true)
+	alert := <-service.sentQueue
+	assert.Equal(t, *alert.Silent, false)
+	assert.Assert(t, alert.Data["ack_url"] == nil)
+
+	// Acknowledged, no alert.
+	wake = send()
+	ackURL, _ := url.Parse(wake.Data["ack_url"].(string))
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", ackURL.Path, bytes.NewBufferString("{}"))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	select {
+	case <-service.sentQueue:
+		t.Fatal("alert sent after acknowledgement")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestAdminEvents(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	server := httptest.NewServer(setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{AdminToken: "secret"}}, service))
+	defer server.Close()
+
+	res, err := http.Get(server.URL + "/api/v1/admin/events")
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, 401)
+
+	req, _ := http.NewRequest("GET", server.URL+"/api/v1/admin/events", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err = http.DefaultClient.Do(req)
+	assert.NilError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, res.StatusCode, 200)
+
+	notifyRes, err := http.Post(server.URL+"/api/v1/notify?platform=android&token=1234567890", "application/json", bytes.NewBuffer(body))
+	assert.NilError(t, err)
+	notifyRes.Body.Close()
+	<-service.sentQueue
+
+	scanner := bufio.NewScanner(res.Body)
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "data:") {
+			var outcome notify.Outcome
+			assert.NilError(t, json.Unmarshal([]byte(strings.TrimPrefix(scanner.Text(), "data:")), &outcome))
+			assert.Equal(t, outcome.Template, notify.NOTIFICATION_PAYMENT_RECEIVED)
+			assert.Equal(t, outcome.TargetIdentifier, "12345678***")
+			assert.Equal(t, outcome.Delivered, true)
+			return
+		}
+	}
+	t.Fatal("no outcome streamed")
+}
+
+func TestConnLimitListener(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	limited := newConnLimitListener(listener, 1, slog.Default())
+	defer limited.Close()
+
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := limited.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	first, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	defer first.Close()
+	firstServer := <-accepted
+
+	// The second connection is closed by the server.
+	second, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = second.Read(make([]byte, 1))
+	assert.Equal(t, err, io.EOF)
+
+	// Once the first one is closed a new connection is accepted.
+	firstServer.Close()
+	third, err := net.Dial("tcp", listener.Addr().String())
+	assert.NilError(t, err)
+	defer third.Close()
+	select {
+	case <-accepted:
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+}
+
+type unhealthyService struct {
+	attempts chan *notify.Notification
+}
+
+func (u *unhealthyService) Send(c context.Context, notification *notify.Notification) error {
+	u.attempts <- notification
+	return notify.NewDeliveryError(notify.ReasonAuth, errors.New("invalid credentials"))
+}
+
+func (u *unhealthyService) Healthy(ctx context.Context) error {
+	return errors.New("credentials not loaded")
+}
+
+func TestHealthProbes(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	for path, body := range map[string]string{"/healthz": `{"status":"ok"}`, "/readyz": `{"status":"ok","queue_depth":0}`} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", path, nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		assert.Equal(t, w.Body.String(), body)
+	}
+
+	service := &unhealthyService{attempts: make(chan *notify.Notification, 1)}
+	router = setupTestRouter(&config.Config{WorkersNum: 2}, service)
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+	router.ServeHTTP(w, req)
+	<-service.attempts
+
+	// The outcome is recorded right after the send returns.
+	var response HealthResponse
+	for i := 0; i < 100 && response.LastErrors == nil; i++ {
+		time.Sleep(time.Millisecond)
+		w = httptest.NewRecorder()
+		req, _ = http.NewRequest("GET", "/readyz", nil)
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 503)
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	}
+	// The notification may still be counted in the queue.
+	assert.Assert(t, response.QueueDepth != nil)
+	response.QueueDepth = nil
+	assert.DeepEqual(t, response, HealthResponse{
+		Status:     "unavailable",
+		Platforms:  map[string]string{"android": "credentials not loaded"},
+		LastErrors: map[string]notify.ErrorReason{"android": notify.ReasonAuth},
+	})
+}
+
+type checkedService struct {
+	checks chan struct{}
+	err    error
+}
+
+func (s *checkedService) Send(c context.Context, notification *notify.Notification) error {
+	return nil
+}
+
+func (s *checkedService) CheckProvider(ctx context.Context) error {
+	s.checks <- struct{}{}
+	return s.err
+}
+
+func TestReadinessProviderChecks(t *testing.T) {
+	service := &checkedService{checks: make(chan struct{}, 2), err: errors.New("invalid credentials")}
+	notifier := notify.NewNotifier(&config.Config{WorkersNum: 2, ProviderCheckInterval: time.Hour}, map[string]notify.Service{"android": service})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &config.HTTPConfig{}, nil)
+
+	readiness := func() (int, HealthResponse) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		router.ServeHTTP(w, req)
+		var response HealthResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w.Code, response
+	}
+
+	// The platforms are not ready until their provider is checked.
+	code, response := readiness()
+	assert.Equal(t, code, 503)
+	assert.DeepEqual(t, response.Platforms, map[string]string{"android": "provider not checked yet"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		notifier.RunProviderChecks(ctx)
+		close(done)
+	}()
+	<-service.checks
+	for i := 0; i < 100 && response.Platforms["android"] == "provider not checked yet"; i++ {
+		time.Sleep(time.Millisecond)
+		code, response = readiness()
+	}
+	assert.Equal(t, code, 503)
+	assert.DeepEqual(t, response.Platforms, map[string]string{"android": "invalid credentials"})
+	cancel()
+	<-done
+
+	service.err = nil
+	go notifier.RunProviderChecks(context.Background())
+	<-service.checks
+	for i := 0; i < 100 && code != 200; i++ {
+		time.Sleep(time.Millisecond)
+		code, response = readiness()
+	}
+	assert.Equal(t, code, 200)
+	assert.Equal(t, *response.QueueDepth, 0)
+}
+
+func TestWebhookSecret(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{WebhookSecret: "secret"}}, service)
+
+	send := func(authorization string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, send(""), 401)
+	assert.Equal(t, send("Bearer wrong"), 401)
+	assert.Equal(t, send("Bearer secret"), 200)
+	<-service.sentQueue
+
+	// Responses are posted by the apps without the secret.
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/response/1", bytes.NewBufferString("{}"))
+	router.ServeHTTP(w, req)
+	assert.Assert(t, w.Code != 401)
+}
+
+func TestHandlerReload(t *testing.T) {
+	body := []byte(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	service := newTestService()
+	c := &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{WebhookSecret: "secret", TokenRateLimit: 6, TokenRateBurst: 2}}
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
+	handler := NewHandler(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig, nil)
+
+	send := func(secret string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		req.Header.Set("Authorization", "Bearer "+secret)
+		handler.ServeHTTP(w, req)
+		if w.Code == 200 {
+			<-service.sentQueue
+		}
+		return w.Code
+	}
+	assert.Equal(t, send("secret"), 200)
+
+	// The secret is replaced while the rate limits of the tokens are kept.
+	handler.Reload(&config.HTTPConfig{WebhookSecret: "rotated", TokenRateLimit: 6, TokenRateBurst: 2})
+	assert.Equal(t, send("secret"), 401)
+	assert.Equal(t, send("rotated"), 200)
+	assert.Equal(t, send("rotated"), 429)
+
+	// Changing the rate limit starts over.
+	handler.Reload(&config.HTTPConfig{WebhookSecret: "rotated", TokenRateLimit: 60})
+	assert.Equal(t, send("rotated"), 200)
+}
+
+func TestRegisterCapabilities(t *testing.T) {
+	put := func(router *gin.Engine, url string, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", url, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, CapabilityRegistry: true}, service)
+	assert.Equal(t, put(router, "/api/v1/capabilities?platform=android&token=1234", `{"silent":false}`), 200)
+	assert.Equal(t, put(router, "/api/v1/capabilities?platform=android&token=1234", `{"hologram":false}`), 400)
+	assert.Equal(t, put(router, "/api/v1/capabilities?platform=windows&token=1234", `{"silent":false}`), 400)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234",
+		bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, *(<-service.sentQueue).Silent, false)
+
+	router = setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	assert.Equal(t, put(router, "/api/v1/capabilities?platform=android&token=1234", `{"silent":false}`), 404)
+}
+
+func TestEncryptionKey(t *testing.T) {
+	send := func(router http.Handler, method string, url string, body string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, EncryptionKeyRegistry: true}, service)
+	assert.Equal(t, send(router, "PUT", "/api/v1/encryption_key?platform=android&token=1234", `{"public_key":"`+key+`"}`), 200)
+	assert.Equal(t, send(router, "PUT", "/api/v1/encryption_key?platform=android&token=1234", `{"public_key":"AAAA"}`), 400)
+	assert.Equal(t, send(router, "PUT", "/api/v1/encryption_key?platform=windows&token=1234", `{"public_key":"`+key+`"}`), 400)
+
+	assert.Equal(t, send(router, "POST", "/api/v1/notify?platform=android&token=1234", `{"template":"payment_received","data":{"payment_hash":"1234"}}`), 200)
+	res := <-service.sentQueue
+	assert.Assert(t, res.Encrypted)
+	assert.Equal(t, res.Data["scheme"], notify.EncryptionScheme)
+
+	assert.Equal(t, send(router, "DELETE", "/api/v1/encryption_key?platform=android&token=1234", ""), 200)
+	assert.Equal(t, send(router, "POST", "/api/v1/notify?platform=android&token=1234", `{"template":"payment_received","data":{"payment_hash":"1234"}}`), 200)
+	assert.Equal(t, (<-service.sentQueue).Data["payment_hash"], "1234")
+
+	router = setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	assert.Equal(t, send(router, "PUT", "/api/v1/encryption_key?platform=android&token=1234", `{"public_key":"`+key+`"}`), 404)
+}
+
+// spanRecorder records the spans of the tests, the global tracer provider
+// being set only once.
+var (
+	spanRecorder     = tracetest.NewSpanRecorder()
+	spanRecorderOnce sync.Once
+)
+
+func TestTracing(t *testing.T) {
+	spanRecorderOnce.Do(func() {
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+		otel.SetTextMapPropagator(propagation.TraceContext{})
+	})
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234",
+		bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	<-service.sentQueue
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range spanRecorder.Ended() {
+		if span.SpanContext().TraceID().String() == "4bf92f3577b34da6a3ce929d0e0e4736" {
+			spans[span.Name()] = span
+		}
+	}
+	request := spans["POST /api/v1/notify"]
+	assert.Assert(t, request != nil)
+	assert.Equal(t, request.Parent().SpanID().String(), "00f067aa0ba902b7")
+	assert.Equal(t, spans["parse notification"].Parent().SpanID(), request.SpanContext().SpanID())
+	assert.Equal(t, spans["deliver"].Parent().SpanID(), request.SpanContext().SpanID())
+	assert.Equal(t, spans["send android"].Parent().SpanID(), spans["deliver"].SpanContext().SpanID())
+}
+
+func TestScheduledNotification(t *testing.T) {
+	send := func(router http.Handler, method string, url string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	router := setupTestRouter(&config.Config{WorkersNum: 2, Scheduling: true, DeliveryStatus: true}, newTestService())
+	w := send(router, "POST", "/api/v1/notify?platform=android&token=1234", `{"template":"payment_received","data":{"payment_hash":"1234"},"delay_seconds":3600}`)
+	assert.Equal(t, w.Code, http.StatusAccepted)
+	var response NotificationResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Result, ResultScheduled)
+	assert.Assert(t, response.DeliverAt.After(time.Now().Add(59*time.Minute)))
+	assert.Equal(t, w.Header().Get("Location"), "/api/v1/notifications/"+response.NotificationID)
+	assert.Equal(t, send(router, "GET", w.Header().Get("Location"), "").Code, http.StatusOK)
+
+	assert.Equal(t, send(router, "DELETE", "/api/v1/notifications/"+response.NotificationID, "").Code, http.StatusNoContent)
+	assert.Equal(t, send(router, "DELETE", "/api/v1/notifications/"+response.NotificationID, "").Code, http.StatusNotFound)
+
+	past := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	assert.Equal(t, send(router, "POST", "/api/v1/notify?platform=android&token=1234", `{"template":"payment_received","data":{"payment_hash":"1234"},"deliver_at":"`+past+`"}`).Code, 400)
+	future := time.Now().Add(time.Hour).Format(time.RFC3339)
+	assert.Equal(t, send(router, "POST", "/api/v1/notify?platform=android&token=1234", `{"template":"payment_received","data":{"payment_hash":"1234"},"deliver_at":"`+future+`","delay_seconds":60}`).Code, 400)
+
+	router = setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	assert.Equal(t, send(router, "POST", "/api/v1/notify?platform=android&token=1234", `{"template":"payment_received","data":{"payment_hash":"1234"},"deliver_at":"`+future+`"}`).Code, 400)
+}
+
+func TestIdempotency(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{IdempotencyWindow: time.Minute}}, service)
+	send := func(body string, key string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		if key != "" {
+			req.Header.Set(idempotencyHeader, key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, send(body, "").Code, 200)
+	<-service.sentQueue
+	w := send(body, "")
+	assert.Equal(t, w.Code, 200)
+	var response NotificationResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Result, ResultDeduplicated)
+	assert.Equal(t, response.Deduplicated, true)
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	// Another payment is a different notification.
+	assert.Equal(t, send(`{"template":"payment_received","data":{"payment_hash":"5678"}}`, "").Code, 200)
+	<-service.sentQueue
+
+	// The header takes precedence over the content.
+	assert.Equal(t, send(body, "event-1").Code, 200)
+	<-service.sentQueue
+	assert.NilError(t, json.Unmarshal(send(`{"template":"payment_received","data":{"payment_hash":"9999"}}`, "event-1").Body.Bytes(), &response))
+	assert.Equal(t, response.Result, ResultDeduplicated)
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestIdempotencyForce(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	send := func(router http.Handler, force bool) NotificationResponse {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		if force {
+			req.Header.Set(forceHeader, "true")
+		}
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		var response NotificationResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{IdempotencyWindow: time.Minute, AllowForce: true}}, service)
+	assert.Equal(t, send(router, false).Result, ResultSent)
+	<-service.sentQueue
+	assert.Equal(t, send(router, false).Result, ResultDeduplicated)
+	assert.Equal(t, send(router, true).Result, ResultSent)
+	<-service.sentQueue
+
+	// The header is ignored unless allowed.
+	service = newTestService()
+	router = setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{IdempotencyWindow: time.Minute}}, service)
+	assert.Equal(t, send(router, false).Result, ResultSent)
+	<-service.sentQueue
+	assert.Equal(t, send(router, true).Result, ResultDeduplicated)
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestSwapStatusFilter(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{
+		SwapStatusAllow:      config.StringList{"invoice.set", "transaction.claimed", "swap.expired"},
+		SwapStatusDeny:       config.StringList{"swap.expired"},
+		AppSwapStatusFilters: config.AppStatusFilters{"satsails": {Deny: []string{"invoice.set"}}},
+		BatchMaxItems:        2,
+		BatchConcurrency:     1,
+	}}, service)
+	send := func(query string, status string) NotificationResponse {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234"+query,
+			bytes.NewBufferString(`{"event":"swap.update","data":{"id":"1","status":"`+status+`"}}`))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		var response NotificationResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response
+	}
+
+	assert.Equal(t, send("", "invoice.set").Result, ResultSent)
+	assert.Equal(t, (<-service.sentQueue).Data["status"], "invoice.set")
+	assert.Equal(t, send("", "transaction.mempool").Result, ResultFiltered)
+	assert.Equal(t, send("", "swap.expired").Result, ResultFiltered)
+	assert.Equal(t, send("&app=satsails", "invoice.set").Result, ResultFiltered)
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	// The items of a batch are filtered one by one.
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify/batch", bytes.NewBufferString(`[
+		{"query":{"platform":"android","token":"1234"},"payload":{"event":"swap.update","data":{"id":"1","status":"transaction.mempool"}}},
+		{"query":{"platform":"android","token":"5678"},"payload":{"event":"swap.update","data":{"id":"1","status":"transaction.claimed"}}}
+	]`))
+	router.ServeHTTP(w, req)
+	var batch BatchResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &batch))
+	assert.Equal(t, batch.Items[0].Notification.Result, ResultFiltered)
+	assert.Equal(t, batch.Items[1].Notification.Result, ResultSent)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "5678")
+}
+
+// failingService fails the first sends with a permanent reason.
+type failingService struct {
+	*TestService
+	failures int32
+}
+
+func (f *failingService) Send(c context.Context, notification *notify.Notification) error {
+	if atomic.AddInt32(&f.failures, -1) >= 0 {
+		return notify.NewDeliveryError(notify.ReasonUnregistered, errors.New("not registered"))
+	}
+	return f.TestService.Send(c, notification)
+}
+
+func TestIdempotencyReleasedOnFailure(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := &failingService{TestService: newTestService(), failures: 1}
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{IdempotencyWindow: time.Minute}}, service)
+	send := func() int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, send(), 400)
+	assert.Equal(t, send(), 200)
+	<-service.sentQueue
+}
+
+func TestMemoryDedupStore(t *testing.T) {
+	store := newMemoryDedupStore(2)
+	ctx := context.Background()
+	reserve := func(key string, ttl time.Duration) bool {
+		reserved, err := store.Reserve(ctx, key, ttl)
+		assert.NilError(t, err)
+		return reserved
+	}
+
+	assert.Assert(t, reserve("a", time.Minute))
+	assert.Assert(t, !reserve("a", time.Minute))
+	assert.Assert(t, reserve("b", time.Minute))
+	// The least recently reserved key is forgotten beyond the bound.
+	assert.Assert(t, reserve("c", time.Minute))
+	assert.Assert(t, reserve("a", time.Minute))
+	assert.Assert(t, !reserve("c", time.Minute))
+
+	// Expired keys are reserved again.
+	assert.Assert(t, reserve("d", -time.Second))
+	assert.Assert(t, reserve("d", time.Minute))
+	assert.Equal(t, store.order.Len(), 2)
+}
+
+func TestDeliveryErrorResponse(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := &failingService{TestService: newTestService(), failures: 1}
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=12345678abcd", bytes.NewBufferString(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, 400)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeInvalidToken)
+	assert.Assert(t, response.Notification != nil)
+	assert.Equal(t, response.Notification.Result, ResultFailed)
+	assert.Equal(t, response.Notification.ErrorReason, string(notify.ReasonUnregistered))
+	assert.Equal(t, response.Notification.Target, "12345678***")
+	assert.Equal(t, response.Notification.MessageID, "")
+}
+
+func TestTokenRateLimit(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{TokenRateLimit: 6, TokenRateBurst: 2}}, service)
+	send := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token="+token, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, send("1234").Code, 200)
+		<-service.sentQueue
+	}
+	w := send("1234")
+	assert.Equal(t, w.Code, 429)
+	assert.Equal(t, w.Header().Get("Retry-After"), "10")
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeRateLimited)
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	// Other devices have their own bucket.
+	assert.Equal(t, send("5678").Code, 200)
+	<-service.sentQueue
+}
+
+func TestTokenBucketLimiter(t *testing.T) {
+	now := time.Now()
+	limiter := newTokenBucketLimiter(60, 2)
+	limiter.now = func() time.Time { return now }
+	allow := func() (bool, time.Duration) {
+		allowed, retryAfter, err := limiter.Allow(context.Background(), "1234")
+		assert.NilError(t, err)
+		return allowed, retryAfter
+	}
+
+	allowed, _ := allow()
+	assert.Assert(t, allowed)
+	allowed, _ = allow()
+	assert.Assert(t, allowed)
+	allowed, retryAfter := allow()
+	assert.Assert(t, !allowed)
+	assert.Equal(t, retryAfter, time.Second)
+
+	// A token is back after the interval, the burst after the window.
+	now = now.Add(time.Second)
+	allowed, _ = allow()
+	assert.Assert(t, allowed)
+	allowed, _ = allow()
+	assert.Assert(t, !allowed)
+	now = now.Add(time.Minute)
+	allowed, _ = allow()
+	assert.Assert(t, allowed)
+	allowed, _ = allow()
+	assert.Assert(t, allowed)
+}
+
+func TestValidationFieldErrors(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&retry_on=always",
+		bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, 400)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeInvalidQuery)
+	assert.DeepEqual(t, response.Error.Fields, []FieldError{
+		{Field: "MobilePushWebHookQuery.RetryOn[0]", Tag: "oneof", Param: "unregistered too_large throttled timeout auth unavailable unknown"},
+	})
+}
+
+func TestMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := &config.Config{WorkersNum: 2}
+	service := newTestService()
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
+	notifier.UseMetrics(notify.NewMetrics(registry))
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig, registry)
+	send := func(body string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+	}
+
+	send(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	<-service.sentQueue
+	send(`{"template":"unknown"}`)
+	send(`{"template":"payment_received","data":{}}`)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	assert.Assert(t, strings.Contains(w.Body.String(), `webhook_payloads_total{payload="PaymentReceivedPayload"} 1`))
+	assert.Assert(t, strings.Contains(w.Body.String(), `webhook_payloads_total{payload="none"} 2`))
+	assert.Assert(t, strings.Contains(w.Body.String(), `notifications_total{platform="android",result="sent",template="payment_received"} 1`))
+	assert.Assert(t, strings.Contains(w.Body.String(), `webhook_notifications_received_total{template="payment_received"} 1`))
+	assert.Assert(t, strings.Contains(w.Body.String(), `webhook_payloads_rejected_total{code="invalid_payload"} 2`))
+	assert.Assert(t, strings.Contains(w.Body.String(), `provider_request_duration_seconds_count{platform="android",result="sent"} 1`))
+}
+
+func TestLocalizedDisplayMessage(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+	send := func(query string, acceptLanguage string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234"+query, bytes.NewBufferString(body))
+		if acceptLanguage != "" {
+			req.Header.Set("Accept-Language", acceptLanguage)
+		}
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		return (<-service.sentQueue).DisplayMessage
+	}
+
+	assert.Equal(t, send("", ""), "Incoming payment")
+	assert.Equal(t, send("", "fr-CH, fr;q=0.9, en;q=0.8"), "Paiement entrant")
+	assert.Equal(t, send("", "pt-BR"), "Pagamento a chegar")
+	assert.Equal(t, send("&lang=es", "fr"), "Pago entrante")
+	// Unsupported languages fall back to English.
+	assert.Equal(t, send("", "ja"), "Incoming payment")
+	assert.Equal(t, send("&lang=invalid-language-tag", ""), "Incoming payment")
+}
+
+func TestMessageOverrides(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{Messages: config.LanguageMessages{
+		"en": {"payment_received": "Payment on its way"},
+		"pt": {"payment_received": "Pagamento recebido"},
+		"it": {"payment_received": "Pagamento in arrivo"},
+	}}}, service)
+	send := func(lang string) string {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234&lang="+lang, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		return (<-service.sentQueue).DisplayMessage
+	}
+
+	assert.Equal(t, send(""), "Payment on its way")
+	assert.Equal(t, send("ja"), "Payment on its way")
+	assert.Equal(t, send("pt"), "Pagamento recebido")
+	assert.Equal(t, send("it"), "Pagamento in arrivo")
+	// The embedded translations are kept.
+	assert.Equal(t, send("fr"), "Paiement entrant")
+}
+
+func TestTemplateVersion(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	c := &config.Config{WorkersNum: 2}
+	service := newTestService()
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
+	notifier.RegisterTemplateVersion(notify.NOTIFICATION_PAYMENT_RECEIVED, 1, func(data map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"hash": data["payment_hash"]}
+	})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig, nil)
+	send := func(query string, header string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234"+query, bytes.NewBufferString(body))
+		if header != "" {
+			req.Header.Set(templateVersionHeader, header)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, send("&template_version=1", ""), 200)
+	assert.DeepEqual(t, (<-service.sentQueue).Data, map[string]interface{}{"hash": "1234"})
+	assert.Equal(t, send("", "1"), 200)
+	assert.DeepEqual(t, (<-service.sentQueue).Data, map[string]interface{}{"hash": "1234"})
+	assert.Equal(t, send("", ""), 200)
+	assert.DeepEqual(t, (<-service.sentQueue).Data, map[string]interface{}{"payment_hash": "1234"})
+
+	assert.Equal(t, send("&template_version=2", ""), 400)
+	assert.Equal(t, send("", "v1"), 400)
+}
+
+func TestGracefulShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NilError(t, err)
+	address := "http://" + listener.Addr().String()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: handler}, listener, 5*time.Second, slog.Default())
+	}()
+
+	inflight := make(chan int, 1)
+	go func() {
+		res, err := http.Get(address)
+		if err != nil {
+			inflight <- 0
+			return
+		}
+		res.Body.Close()
+		inflight <- res.StatusCode
+	}()
+	<-started
+
+	cancel()
+	// New connections are refused once the shutdown began.
+	for i := 0; ; i++ {
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		assert.Assert(t, i < 100, "connections still accepted")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The in-flight request completes before the server returns.
+	close(release)
+	assert.Equal(t, <-inflight, 200)
+	assert.NilError(t, <-served)
+}
+
+func TestDisplayMessageInterpolation(t *testing.T) {
+	send := func(c *config.Config, displayMessage string) string {
+		service := newTestService()
+		router := setupTestRouter(c, service)
+		body := []byte(`{"event":"swap.refunded","display_message":"` + displayMessage + `","data":{"id":"swap1","refund_txid":"abcd","amount_sat":5000}}`)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200)
+		return (<-service.sentQueue).DisplayMessage
+	}
+
+	c := &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{MaxDisplayMessageLength: 200}}
+	assert.Equal(t, send(c, "Refunded {amount_sat} sats"), "Refunded 5000 sats")
+	// Missing data falls back to the default message of the template.
+	assert.Equal(t, send(c, "Refunded {amount_msat} msats"), "Swap refunded")
+
+	c.HTTPConfig.DisplayMessageFallback = "Your swap was updated"
+	assert.Equal(t, send(c, "Refunded {amount_msat} msats"), "Your swap was updated")
+}
+
+func TestRequestID(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	send := func(requestID string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(`{"template":"unknown"}`))
+		if requestID != "" {
+			req.Header.Set(requestIDHeader, requestID)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, send("req-1").Header().Get(requestIDHeader), "req-1")
+	assert.Assert(t, send("").Header().Get(requestIDHeader) != "")
+	assert.Assert(t, send(strings.Repeat("a", maxRequestIDLength+1)).Header().Get(requestIDHeader) != strings.Repeat("a", maxRequestIDLength+1))
+}
+
+func TestStructuredLogs(t *testing.T) {
+	var logs bytes.Buffer
+	service := &failingService{TestService: newTestService(), failures: 1}
+	c := &config.Config{WorkersNum: 2}
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
+	notifier.UseLogger(slog.New(slog.HandlerOptions{Level: slog.LevelInfo}.NewJSONHandler(&logs)))
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig, nil)
+	send := func(body string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=12345678abcd", bytes.NewBufferString(body))
+		req.Header.Set(requestIDHeader, "req-1")
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 400)
+	}
+
+	parse := func() (records []map[string]interface{}) {
+		for _, line := range bytes.Split(bytes.TrimSpace(logs.Bytes()), []byte("\n")) {
+			var record map[string]interface{}
+			assert.NilError(t, json.Unmarshal(line, &record))
+			// Every request is logged once responded to.
+			if record["msg"] == "request" {
+				assert.Equal(t, record["request_id"], "req-1")
+				assert.Equal(t, record["status"], float64(400))
+				continue
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+
+	// Bodies are only logged at the debug level.
+	send(`{"template":"payment_received","data":{}}`)
+	assert.Equal(t, len(parse()), 0)
+	assert.Assert(t, !strings.Contains(logs.String(), "data"))
+
+	send(`{"template":"payment_received","data":{"payment_hash":"1234"}}`)
+	records := parse()
+	assert.Equal(t, len(records), 2)
+	for _, record := range records {
+		assert.Equal(t, record["request_id"], "req-1")
+		assert.Equal(t, record["template"], notify.NOTIFICATION_PAYMENT_RECEIVED)
+		assert.Equal(t, record["platform"], "android")
+		assert.Equal(t, record["token"], "12345678***")
+	}
+	assert.Equal(t, records[1]["msg"], "failed to notify")
+	assert.Assert(t, !strings.Contains(logs.String(), "12345678abcd"))
+}
+
+func TestSampledBodyLogging(t *testing.T) {
+	var logs bytes.Buffer
+	c := &config.Config{WorkersNum: 2, DeviceRegistry: true, EncryptionKeyRegistry: true, HTTPConfig: config.HTTPConfig{
+		BodyLogSampleRate: 1,
+		BatchMaxItems:     10,
+		BatchConcurrency:  1,
+	}}
+	service := newTestService()
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
+	notifier.UseLogger(slog.New(slog.HandlerOptions{Level: slog.LevelInfo}.NewJSONHandler(&logs)))
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig, nil)
+	send := func(method string, path string, body string) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		assert.Equal(t, w.Code, 200, w.Body.String())
+	}
+
+	// The tokens and keys of the bodies are masked like those of the query.
+	send("POST", "/api/v1/notify/batch", `[{"query":{"platform":"android","token":"batchtoken1234"},"payload":{"template":"payment_received","data":{"payment_hash":"1"}}}]`)
+	<-service.sentQueue
+	send("POST", "/api/v1/devices/user1", `{"platform":"android","token":"devicetoken1234"}`)
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{9}, 32))
+	send("PUT", "/api/v1/encryption_key?platform=android&token=querytoken1234", `{"public_key":"`+key+`"}`)
+	for _, secret := range []string{"batchtoken1234", "devicetoken1234", "querytoken1234", key} {
+		assert.Assert(t, !strings.Contains(logs.String(), secret), secret)
+	}
+	assert.Assert(t, strings.Contains(logs.String(), `\"token\":\"batchtok***\"`), logs.String())
+	assert.Assert(t, strings.Contains(logs.String(), `\"payment_hash\":\"1\"`))
+	assert.Equal(t, redactBody([]byte("token=1234")), "[redacted, not json]")
+}
+
+func TestBatch(t *testing.T) {
+	service := &failingService{TestService: newTestService(), failures: 1}
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{BatchMaxItems: 3, BatchConcurrency: 1}}, service)
+	body := `[
+		{"query":{"platform":"android","token":"1234"},"payload":{"template":"payment_received","data":{"payment_hash":"1"}}},
+		{"query":{"platform":"android","token":"5678"},"payload":{"template":"payment_received","data":{"payment_hash":"2"}}},
+		{"query":{"platform":"windows","token":"5678"},"payload":{"template":"payment_received","data":{"payment_hash":"3"}}}
+	]`
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify/batch", bytes.NewBufferString(body))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, http.StatusMultiStatus)
+	var response BatchResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, len(response.Items), 3)
+
+	failed := response.Items[0]
+	assert.Equal(t, failed.Status, 400)
+	assert.Equal(t, failed.Error.Code, ErrCodeInvalidToken)
+	assert.Equal(t, failed.Notification.Result, ResultFailed)
+	assert.Equal(t, failed.Notification.ErrorReason, string(notify.ReasonUnregistered))
+	assert.Assert(t, !failed.Retryable)
+
+	sent := response.Items[1]
+	assert.Equal(t, sent.Status, 200)
+	assert.Assert(t, sent.Error == nil)
+	assert.Equal(t, sent.Notification.Result, ResultSent)
+	assert.Equal(t, (<-service.sentQueue).Data["payment_hash"], "2")
+
+	rejected := response.Items[2]
+	assert.Equal(t, rejected.Status, 400)
+	assert.Equal(t, rejected.Error.Code, ErrCodeUnsupportedPlatform)
+	assert.Assert(t, rejected.Notification == nil)
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	// Only rate limits and transient failures are worth sending again.
+	assert.Assert(t, failedItem(&requestError{status: http.StatusServiceUnavailable, code: ErrCodeRateLimited, err: notify.ErrThrottled}, nil).Retryable)
+	assert.Assert(t, failedItem(&requestError{status: http.StatusTooManyRequests, code: ErrCodeRateLimited, err: notify.ErrThrottled}, nil).Retryable)
+}
+
+func TestBatchTooLarge(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{BatchMaxItems: 1, BatchConcurrency: 1}}, service)
+	item := `{"query":{"platform":"android","token":"1234"},"payload":{"template":"payment_received","data":{"payment_hash":"1"}}}`
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify/batch", bytes.NewBufferString("["+item+","+item+"]"))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, 400)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Message, "batch of 2 items exceeds the maximum of 1")
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/notify/batch", bytes.NewBufferString("["+item+"]"))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 200)
+	<-service.sentQueue
+}
+
+func TestSignatureVerification(t *testing.T) {
+	body := `{"event":"swap.update","data":{"id":"1","status":"transaction.mempool"}}`
+	sign := func(body string, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	send := func(router *gin.Engine, path string, body string, signature string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		if signature != "" {
+			req.Header.Set("X-Boltz-Signature", signature)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	notifyPath := "/api/v1/notify?platform=android&token=1234"
+
+	// Signatures are not checked by default.
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+	assert.Equal(t, send(router, notifyPath, body, ""), 200)
+	<-service.sentQueue
+
+	router = setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{
+		BatchMaxItems: 10,
+		SignatureProviders: config.SignatureProviders{
+			"boltz": {Header: "X-Boltz-Signature", Secret: "secret", Payloads: []string{"swap.update"}},
+		},
+	}}, service)
+	assert.Equal(t, send(router, notifyPath, body, sign(body, "secret")), 200)
+	<-service.sentQueue
+	assert.Equal(t, send(router, notifyPath, body, "sha256="+sign(body, "secret")), 200)
+	<-service.sentQueue
+	assert.Equal(t, send(router, notifyPath, body, sign(body, "other")), 401)
+	assert.Equal(t, send(router, notifyPath, body, "not hex"), 401)
+	assert.Equal(t, send(router, notifyPath, body, ""), 401)
+
+	// The payloads of other senders need no signature.
+	assert.Equal(t, send(router, notifyPath, `{"template":"payment_received","data":{"payment_hash":"1234"}}`, ""), 200)
+	<-service.sentQueue
+
+	// Batches are signed as a whole.
+	batch := `[{"query":{"platform":"android","token":"1234"},"payload":` + body + `}]`
+	assert.Equal(t, send(router, "/api/v1/notify/batch", batch, ""), 401)
+	assert.Equal(t, send(router, "/api/v1/notify/batch", batch, sign(batch, "secret")), 200)
+	<-service.sentQueue
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestSignatureSenders(t *testing.T) {
+	sign := func(body string, secret string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(body))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{
+		SignatureProviders: config.SignatureProviders{
+			"lsp":   {Header: "X-Signature", Secret: "new", Secrets: []string{"old"}},
+			"boltz": {Header: "X-Boltz-Signature", Secret: "boltz", Payloads: []string{"swap.update"}},
+		},
+	}}, service)
+	send := func(body string, header string, signature string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		if signature != "" {
+			req.Header.Set(header, signature)
+		}
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// Senders without payloads sign all the payloads, with any of their
+	// active secrets.
+	payment := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	assert.Equal(t, send(payment, "X-Signature", ""), 401)
+	assert.Equal(t, send(payment, "X-Signature", sign(payment, "revoked")), 401)
+	assert.Equal(t, send(payment, "X-Signature", sign(payment, "new")), 200)
+	<-service.sentQueue
+	assert.Equal(t, send(payment, "X-Signature", sign(payment, "old")), 200)
+	<-service.sentQueue
+
+	// The payloads of a provider are only accepted from it.
+	swap := `{"event":"swap.update","data":{"id":"1","status":"transaction.mempool"}}`
+	assert.Equal(t, send(swap, "X-Signature", sign(swap, "new")), 401)
+	assert.Equal(t, send(swap, "X-Boltz-Signature", sign(swap, "boltz")), 200)
+	<-service.sentQueue
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+// slowService blocks until the context of the send is done.
+type slowService struct {
+	cancelled chan error
+}
+
+func (s *slowService) Send(c context.Context, notification *notify.Notification) error {
+	<-c.Done()
+	s.cancelled <- c.Err()
+	return c.Err()
+}
+
+func TestNotifyTimeout(t *testing.T) {
+	service := &slowService{cancelled: make(chan error, 1)}
+	router := setupTestRouter(&config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{NotifyTimeout: 50 * time.Millisecond}}, service)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+	router.ServeHTTP(w, req)
+
+	assert.Equal(t, w.Code, http.StatusGatewayTimeout)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeTimeout)
+	assert.Equal(t, response.Notification.ErrorReason, string(notify.ReasonTimeout))
+	assert.Equal(t, <-service.cancelled, context.DeadlineExceeded)
+}
+
+// replyingService replies to the notifications awaiting a reply through the
+// channel, as the app would.
+type replyingService struct {
+	channel *channel.HttpCallbackChannel
+	reply   string
+}
+
+func (r *replyingService) Send(c context.Context, notification *notify.Notification) error {
+	callbackURL := notification.Data["reply_url"].(string)
+	reqID, err := strconv.ParseUint(callbackURL[strings.LastIndex(callbackURL, "/")+1:], 10, 64)
+	if err != nil {
+		return err
+	}
+	if r.reply != "" {
+		go r.channel.OnResponse(reqID, r.reply)
+	}
+	return nil
+}
+
+type relayedReply struct {
+	replyURL string
+	reply    string
+}
+
+type fakeReplyClient struct {
+	replies chan relayedReply
+	err     error
+}
+
+func (f *fakeReplyClient) PostReply(ctx context.Context, replyURL string, reply string) error {
+	f.replies <- relayedReply{replyURL: replyURL, reply: reply}
+	return f.err
+}
+
+func TestRelayReply(t *testing.T) {
+	body := `{"template":"lnurlpay_info","data":{"callback_url":"https://example.com/lnurlp/1234","reply_url":"https://example.com/reply"}}`
+	send := func(reply string, client *fakeReplyClient) *httptest.ResponseRecorder {
+		c := &config.Config{WorkersNum: 2, HTTPConfig: config.HTTPConfig{RelayReplyTemplates: []string{notify.NOTIFICATION_LNURLPAY_INFO}}}
+		callbackChannel := channel.NewHttpCallbackChannel("http://localhost:8080")
+		callbackChannel.SetCallbackTimeout(50 * time.Millisecond)
+		callbackChannel.UseReplyClient(client)
+		service := &replyingService{channel: callbackChannel, reply: reply}
+		notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service})
+		router := setupRouter(notifier, callbackChannel, &c.HTTPConfig, nil)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	client := &fakeReplyClient{replies: make(chan relayedReply, 1)}
+	w := send(`{"tag":"payRequest"}`, client)
+	assert.Equal(t, w.Code, 200)
+	assert.Equal(t, w.Body.String(), `{"tag":"payRequest"}`)
+	assert.Equal(t, <-client.replies, relayedReply{replyURL: "https://example.com/reply", reply: `{"tag":"payRequest"}`})
+
+	// Failing to relay the reply fails the request.
+	client = &fakeReplyClient{replies: make(chan relayedReply, 1), err: errors.New("unreachable")}
+	w = send(`{"tag":"payRequest"}`, client)
+	assert.Equal(t, w.Code, http.StatusBadGateway)
+	<-client.replies
+
+	// Nothing is relayed when the app doesn't reply in time.
+	client = &fakeReplyClient{replies: make(chan relayedReply, 1)}
+	w = send("", client)
+	assert.Equal(t, w.Code, http.StatusGatewayTimeout)
+	var response ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Error.Code, ErrCodeTimeout)
+	assert.Equal(t, len(client.replies), 0)
+}
+
+func TestTLSListener(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NilError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NilError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NilError(t, err)
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	assert.NilError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NilError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+
+	// A certificate without its key is an error rather than plain http.
+	_, err = listen(&config.HTTPConfig{Address: "127.0.0.1:0", TLSCertFile: certFile}, slog.Default())
+	assert.ErrorContains(t, err, "tls")
+
+	listener, err := listen(&config.HTTPConfig{Address: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile}, slog.Default())
+	assert.NilError(t, err)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Assert(t, r.TLS != nil)
+		w.WriteHeader(http.StatusOK)
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: handler}, listener, time.Second, slog.Default())
+	}()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}}
+	res, err := client.Get("https://" + listener.Addr().String())
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, 200)
+
+	cancel()
+	assert.NilError(t, <-served)
+
+	// With a client CA, only the clients presenting a certificate it signed
+	// are served.
+	_, err = listen(&config.HTTPConfig{Address: "127.0.0.1:0", TLSClientCAFile: certFile}, slog.Default())
+	assert.ErrorContains(t, err, "tls")
+	listener, err = listen(&config.HTTPConfig{Address: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile, TLSClientCAFile: certFile}, slog.Default())
+	assert.NilError(t, err)
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		served <- serve(ctx, &http.Server{Handler: handler}, listener, time.Second, slog.Default())
+	}()
+	_, err = client.Get("https://" + listener.Addr().String())
+	assert.Assert(t, err != nil)
+	clientCert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.NilError(t, err)
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}}}}
+	res, err = client.Get("https://" + listener.Addr().String())
+	assert.NilError(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, 200)
+	cancel()
+	assert.NilError(t, <-served)
+}
+
+type channelOpenedPayload struct {
+	Template string `json:"template" binding:"required,eq=channel_opened"`
+	Data     struct {
+		ChannelID string `json:"channel_id" binding:"required"`
+	} `json:"data"`
+}
+
+func (p *channelOpenedPayload) RequiresCallback() bool {
+	return false
+}
+
+func (p *channelOpenedPayload) ToNotification(query *MobilePushWebHookQuery) *notify.Notification {
+	return query.newNotification(p.Template, "Channel opened", map[string]interface{}{"channel_id": p.Data.ChannelID})
+}
+
+func init() {
+	RegisterPayload("channel_opened", func() NotificationConvertible { return &channelOpenedPayload{} })
+}
+
+func TestRegisterPayload(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, service)
+
+	w := httptest.NewRecorder()
+	body := []byte(`{"template":"channel_opened","data":{"channel_id":"abc"}}`)
+	req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBuffer(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code, w.Body.String())
+	notification := <-service.sentQueue
+	assert.Equal(t, notification.Template, "channel_opened")
+	assert.Equal(t, notification.Data["channel_id"], "abc")
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(`{"template":"channel_opened","data":{}}`))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, 400, w.Code)
+
+	assert.Assert(t, panics(func() {
+		RegisterPayload("channel_opened", func() NotificationConvertible { return &channelOpenedPayload{} })
+	}))
+}
+
+func panics(f func()) (panicked bool) {
+	defer func() { panicked = recover() != nil }()
+	f()
+	return false
+}
+
+func TestNotificationStatus(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := &failingService{TestService: newTestService(), failures: 1}
+	router := setupTestRouter(&config.Config{WorkersNum: 2, DeliveryStatus: true}, service)
+	send := func() NotificationResponse {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=12345678abcd", bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		var response ErrorResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		if response.Notification != nil {
+			return *response.Notification
+		}
+		var notification NotificationResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &notification))
+		return notification
+	}
+	status := func(id string) (int, notify.NotificationStatus) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/api/v1/notifications/"+id, nil)
+		router.ServeHTTP(w, req)
+		var status notify.NotificationStatus
+		json.Unmarshal(w.Body.Bytes(), &status)
+		return w.Code, status
+	}
+
+	failed := send()
+	assert.Equal(t, failed.Result, ResultFailed)
+	code, record := status(failed.NotificationID)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, record.Status, notify.StatusFailed)
+	assert.Equal(t, record.ErrorReason, string(notify.ReasonUnregistered))
+	assert.Equal(t, record.Target, "12345678***")
+	assert.Equal(t, record.RequestID, failed.ID)
+
+	sent := send()
+	<-service.sentQueue
+	code, record = status(sent.NotificationID)
+	assert.Equal(t, code, 200)
+	assert.Equal(t, record.Status, notify.StatusSent)
+	assert.Equal(t, record.Template, notify.NOTIFICATION_PAYMENT_RECEIVED)
+	assert.Equal(t, record.ErrorReason, "")
+
+	code, _ = status("unknown")
+	assert.Equal(t, code, 404)
+
+	// Statuses are only tracked when enabled.
+	router = setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	code, _ = status(sent.NotificationID)
+	assert.Equal(t, code, 404)
+}
+
+// blockingService holds the notifications it sends until released.
+type blockingService struct {
+	*TestService
+	release chan struct{}
+}
+
+func (b *blockingService) Send(c context.Context, notification *notify.Notification) error {
+	b.TestService.Send(c, notification)
+	<-b.release
+	return nil
+}
+
+func TestAsyncDelivery(t *testing.T) {
+	service := &blockingService{TestService: newTestService(), release: make(chan struct{})}
+	router := setupTestRouter(&config.Config{WorkersNum: 1, QueueSize: 1, HTTPConfig: config.HTTPConfig{AsyncDelivery: true}}, service)
+	send := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token=1234", bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	// The request is responded to before the notification is sent.
+	w := send()
+	assert.Equal(t, w.Code, 202)
+	var response NotificationResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, response.Result, ResultQueued)
+	assert.Assert(t, response.NotificationID != "")
+	assert.Equal(t, w.Header().Get("Location"), "/api/v1/notifications/"+response.NotificationID)
+	sent := <-service.sentQueue
+	assert.Equal(t, sent.ID, response.NotificationID)
+
+	// Once the worker is busy and the queue full, the requests are rejected.
+	assert.Equal(t, send().Code, 202)
+	w = send()
+	assert.Equal(t, w.Code, 429)
+	var errResponse ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &errResponse))
+	assert.Equal(t, errResponse.Error.Code, ErrCodeRateLimited)
+	close(service.release)
+	<-service.sentQueue
+}
+
+func TestAdminNotificationHistory(t *testing.T) {
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	service := &failingService{TestService: newTestService(), failures: 1}
+	router := setupTestRouter(&config.Config{WorkersNum: 2, DeliveryStatus: true, HTTPConfig: config.HTTPConfig{AdminToken: "secret"}}, service)
+	admin := func(method string, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/api/v1/admin"+path, nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	history := func(query string) []*notify.NotificationStatus {
+		w := admin("GET", "/notifications"+query)
+		assert.Equal(t, w.Code, 200)
+		var response HistoryResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return response.Notifications
+	}
+	for _, token := range []string{"12345678abcd", "87654321dcba"} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/api/v1/notify?platform=android&token="+token, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+	}
+	<-service.sentQueue
+
+	assert.Equal(t, len(history("")), 2)
+	failed := history("?status=failed")
+	assert.Equal(t, len(failed), 1)
+	assert.Equal(t, failed[0].ErrorReason, string(notify.ReasonUnregistered))
+	assert.Equal(t, failed[0].Notification.TargetIdentifier, "12345678***")
+	sent := history("?token_prefix=87654321d&platform=android")
+	assert.Equal(t, len(sent), 1)
+	assert.Equal(t, sent[0].Status, notify.StatusSent)
+	assert.Equal(t, len(history("?template=tx_confirmed")), 0)
+	assert.Equal(t, admin("GET", "/notifications?status=lost").Code, 400)
+
+	// A failed notification is sent again under the same id.
+	w := admin("POST", "/notifications/"+failed[0].ID+"/resend")
+	assert.Equal(t, w.Code, 200)
+	var resent notify.NotificationStatus
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &resent))
+	assert.Equal(t, resent.Status, notify.StatusSent)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "12345678abcd")
+	assert.Equal(t, admin("POST", "/notifications/"+failed[0].ID+"/resend").Code, 409)
+	assert.Equal(t, admin("POST", "/notifications/unknown/resend").Code, 404)
+}
+
+func TestDevices(t *testing.T) {
+	service := newTestService()
+	c := &config.Config{WorkersNum: 2, DeviceRegistry: true, HTTPConfig: config.HTTPConfig{BatchConcurrency: 2}}
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service, "ios": service})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig, nil)
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("POST", "/api/v1/devices/user1", `{"platform":"android","token":"android-token-1","app_data":"a"}`)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	w = do("POST", "/api/v1/devices/user1", `{"platform":"ios","token":"ios-token-1"}`)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	var devices DevicesResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &devices))
+	assert.Equal(t, len(devices.Devices), 2)
+	assert.Equal(t, devices.Devices[1].Token, "ios-toke***")
+	assert.Equal(t, do("POST", "/api/v1/devices/user1", `{"platform":"pager","token":"1"}`).Code, 400)
+
+	// The token of a device is updated once refreshed by the provider.
+	w = do("PUT", "/api/v1/devices/user1", `{"platform":"ios","token":"ios-token-2","previous_token":"ios-token-1"}`)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.Equal(t, do("PUT", "/api/v1/devices/user1", `{"platform":"ios","token":"ios-token-3","previous_token":"unknown"}`).Code, 404)
+
+	// The client is notified on all its devices.
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+	w = do("POST", "/api/v1/notify?client_id=user1", body)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	var response BatchResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, len(response.Items), 2)
+	sent := map[string]*notify.Notification{}
+	for i := 0; i < 2; i++ {
+		notification := <-service.sentQueue
+		sent[notification.TargetIdentifier] = notification
+	}
+	assert.Equal(t, *sent["android-token-1"].AppData, "a")
+	assert.Equal(t, sent["ios-token-2"].Type, "ios")
+
+	// Or on those of a platform.
+	w = do("POST", "/api/v1/notify?client_id=user1&platform=ios", body)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "ios-token-2")
+
+	assert.Equal(t, do("DELETE", "/api/v1/devices/user1?platform=ios&token=ios-token-2", "").Code, 204)
+	assert.Equal(t, do("DELETE", "/api/v1/devices/user1?platform=ios&token=ios-token-2", "").Code, 404)
+	assert.Equal(t, do("POST", "/api/v1/notify?client_id=user1&platform=ios", body).Code, 404)
+	assert.Equal(t, do("POST", "/api/v1/notify?client_id=user2", body).Code, 404)
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestDeliveryQuorum(t *testing.T) {
+	service := newTestService()
+	failing := &failingService{TestService: newTestService(), failures: 100}
+	c := &config.Config{WorkersNum: 2, DeviceRegistry: true, HTTPConfig: config.HTTPConfig{BatchMaxItems: 10, BatchConcurrency: 2}}
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": failing, "ios": service})
+	assert.NilError(t, notifier.RegisterDevice("user1", notify.Device{Platform: "ios", Token: "ios-token-1"}))
+	assert.NilError(t, notifier.RegisterDevice("user1", notify.Device{Platform: "android", Token: "android-token-1"}))
+	do := func(quorum int, path string, body string) (*httptest.ResponseRecorder, BatchResponse) {
+		httpConfig := c.HTTPConfig
+		httpConfig.DeliveryQuorum = config.TemplateLimits{"payment_received": quorum}
+		router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &httpConfig, nil)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", path, bytes.NewBufferString(body))
+		router.ServeHTTP(w, req)
+		var response BatchResponse
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &response))
+		return w, response
+	}
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+
+	// One of the two devices is enough, the failure of the other is reported.
+	w, response := do(1, "/api/v1/notify?client_id=user1", body)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.DeepEqual(t, response.Quorums, []QuorumResult{{Template: "payment_received", Required: 1, Sent: 1, Devices: 2, Met: true}})
+	assert.Equal(t, len(response.Items), 2)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "ios-token-1")
+
+	w, response = do(2, "/api/v1/notify?client_id=user1", body)
+	assert.Equal(t, w.Code, 502, w.Body.String())
+	assert.Equal(t, response.Quorums[0].Met, false)
+	<-service.sentQueue
+
+	// A quorum larger than the devices requires all of them.
+	w, response = do(3, "/api/v1/notify?client_id=user1&platform=ios", body)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.DeepEqual(t, response.Quorums, []QuorumResult{{Template: "payment_received", Required: 1, Sent: 1, Devices: 1, Met: true}})
+	<-service.sentQueue
+
+	// The items of a batch count as the devices of the notification.
+	batch := `[{"query":{"platform":"android","token":"1"},"payload":` + body + `},{"query":{"platform":"ios","token":"2"},"payload":` + body + `}]`
+	w, response = do(2, "/api/v1/notify/batch", batch)
+	assert.Equal(t, w.Code, 502, w.Body.String())
+	assert.Equal(t, response.Quorums[0].Sent, 1)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "2")
+}
+
+func TestAdminBroadcast(t *testing.T) {
+	service := newTestService()
+	c := &config.Config{WorkersNum: 2, DeviceRegistry: true, HTTPConfig: config.HTTPConfig{AdminToken: "secret", BroadcastRate: 20, BatchConcurrency: 2}}
+	notifier := notify.NewNotifier(c, map[string]notify.Service{"android": service, "ios": service})
+	router := setupRouter(notifier, channel.NewHttpCallbackChannel("http://localhost:8080"), &c.HTTPConfig, nil)
+	do := func(method string, path string, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, bytes.NewBufferString(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	status := func(w *httptest.ResponseRecorder) BroadcastStatus {
+		var status BroadcastStatus
+		assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &status))
+		return status
+	}
+	body := `{"template":"payment_received","data":{"payment_hash":"1234"}}`
+
+	assert.Equal(t, do("POST", "/api/v1/admin/broadcast?platform=android", body).Code, 404)
+	assert.Equal(t, do("POST", "/api/v1/devices/user1", `{"platform":"android","token":"android-token-1"}`).Code, 200)
+	assert.Equal(t, do("POST", "/api/v1/devices/user2", `{"platform":"android","token":"android-token-2"}`).Code, 200)
+	assert.Equal(t, do("POST", "/api/v1/devices/user3", `{"platform":"android","token":"android-token-2"}`).Code, 200)
+	assert.Equal(t, do("POST", "/api/v1/devices/user1", `{"platform":"ios","token":"ios-token-1"}`).Code, 200)
+
+	// The broadcasts require the admin token and a valid payload.
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("POST", "/api/v1/admin/broadcast?platform=android", bytes.NewBufferString(body))
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 401)
+	assert.Equal(t, do("POST", "/api/v1/admin/broadcast?platform=android", `{"template":"unknown"}`).Code, 400)
+
+	// A dry run counts the devices of the platform, each token once.
+	w = do("POST", "/api/v1/admin/broadcast?platform=android&dry_run=true", body)
+	assert.Equal(t, w.Code, 200, w.Body.String())
+	assert.Equal(t, status(w).Total, 2)
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	w = do("POST", "/api/v1/admin/broadcast?platform=android", body)
+	assert.Equal(t, w.Code, 202, w.Body.String())
+	started := status(w)
+	assert.Equal(t, started.State, BroadcastRunning)
+	assert.Equal(t, w.Header().Get("Location"), "/api/v1/admin/broadcast/"+started.ID)
+	// One broadcast runs at a time.
+	w = do("POST", "/api/v1/admin/broadcast?platform=android", body)
+	assert.Equal(t, w.Code, 409)
+	var conflict ErrorResponse
+	assert.NilError(t, json.Unmarshal(w.Body.Bytes(), &conflict))
+	assert.Equal(t, conflict.Error.Code, ErrCodeBroadcastRunning)
+
+	sent := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		notification := <-service.sentQueue
+		sent[notification.TargetIdentifier] = true
+		assert.Equal(t, notification.Type, "android")
+	}
+	assert.Assert(t, sent["android-token-1"] && sent["android-token-2"])
+	var progress BroadcastStatus
+	for i := 0; i < 100; i++ {
+		if progress = status(do("GET", "/api/v1/admin/broadcast/"+started.ID, "")); progress.State != BroadcastRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, progress.State, BroadcastDone)
+	assert.Equal(t, progress.Sent, 2)
+	assert.Equal(t, progress.Failed, 0)
+	assert.Assert(t, progress.FinishedAt != nil)
+
+	// A cancelled broadcast stops sending.
+	w = do("POST", "/api/v1/admin/broadcast?platform=android", body)
+	assert.Equal(t, w.Code, 202, w.Body.String())
+	cancelled := status(w)
+	assert.Equal(t, do("DELETE", "/api/v1/admin/broadcast/"+cancelled.ID, "").Code, 200)
+	for i := 0; i < 100; i++ {
+		if progress = status(do("GET", "/api/v1/admin/broadcast/"+cancelled.ID, "")); progress.State != BroadcastRunning {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, progress.State, BroadcastCancelled)
+	assert.Equal(t, do("GET", "/api/v1/admin/broadcast/unknown", "").Code, 404)
+}
+
+func TestLiveSubscription(t *testing.T) {
+	service := newTestService()
+	router := setupTestRouter(&config.Config{WorkersNum: 2, LiveSubscriptions: true}, service)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/subscribe", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 400)
+
+	conn, err := websocket.Dial("ws"+strings.TrimPrefix(server.URL, "http")+"/api/v1/subscribe?token=1234", "", server.URL)
+	assert.NilError(t, err)
+	defer conn.Close()
+
+	resp, err := http.Post(server.URL+"/api/v1/notify?platform=android&token=1234", "application/json",
+		bytes.NewBufferString(`{"template":"payment_received","data":{"payment_hash":"1234"}}`))
+	assert.NilError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, resp.StatusCode, 200)
+	sent := <-service.sentQueue
+
+	// The subscriber gets the notification pushed to the device.
+	var received notify.Notification
+	assert.NilError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+	assert.NilError(t, websocket.JSON.Receive(conn, &received))
+	assert.DeepEqual(t, received, *sent)
+}
+
+func TestLiveSubscriptionDisabled(t *testing.T) {
+	router := setupTestRouter(&config.Config{WorkersNum: 2}, newTestService())
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/v1/subscribe?token=1234", nil)
+	router.ServeHTTP(w, req)
+	assert.Equal(t, w.Code, 404)
+}
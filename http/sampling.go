@@ -0,0 +1,110 @@
+package http
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"net/url"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/exp/slog"
+)
+
+// sensitiveParams are the query params redacted from the logged requests.
+var sensitiveParams = []string{"token"}
+
+// sensitiveFields are the json fields redacted from the logged bodies at any
+// depth, e.g. the tokens of the batch items and of the devices.
+var sensitiveFields = map[string]bool{
+	"token":             true,
+	"previous_token":    true,
+	"migrated_token":    true,
+	"target_identifier": true,
+	"public_key":        true,
+}
+
+type bodyRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (b *bodyRecorder) Write(data []byte) (int, error) {
+	b.body.Write(data)
+	return b.ResponseWriter.Write(data)
+}
+
+// sampledBodyLogging logs the request and response bodies of the given
+// fraction of the requests, with the sensitive query params and json fields
+// redacted.
+func sampledBodyLogging(rate float64, logger *slog.Logger) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if rand.Float64() >= rate {
+			c.Next()
+			return
+		}
+
+		body, _ := io.ReadAll(c.Request.Body)
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+		recorder := &bodyRecorder{ResponseWriter: c.Writer}
+		c.Writer = recorder
+
+		c.Next()
+
+		logger.Info("sampled request",
+			"request_id", c.GetString(requestIDKey),
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"query", redactQuery(c.Request.URL.Query()),
+			"body", redactBody(body),
+			"status", recorder.Status(),
+			"response", redactBody(recorder.body.Bytes()))
+	}
+}
+
+func redactQuery(query url.Values) string {
+	for _, param := range sensitiveParams {
+		if value := query.Get(param); value != "" {
+			query.Set(param, notify.MaskToken(value))
+		}
+	}
+	return query.Encode()
+}
+
+// redactBody returns the json body with its sensitive fields masked. The
+// bodies that are not json are left out, their tokens can't be found.
+func redactBody(body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return "[redacted, not json]"
+	}
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return "[redacted, not json]"
+	}
+	return string(redacted)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if text, ok := field.(string); ok && sensitiveFields[key] {
+				v[key] = notify.MaskToken(text)
+				continue
+			}
+			v[key] = redactValue(field)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
@@ -0,0 +1,55 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// scheduleNotification schedules the notification at its delivery time,
+// returning the response describing the scheduled notification.
+func scheduleNotification(r *notifyRequest, notifier *notify.Notifier, query *MobilePushWebHookQuery, notification *notify.Notification) (*NotificationResponse, *requestError) {
+	ctx := notify.WithRequestID(r.ctx, r.requestID)
+	if _, err := notifier.Schedule(ctx, notification, *notification.DeliverAt); err != nil {
+		return nil, scheduleError(err, query, notification)
+	}
+	response := newNotificationResponse(r.requestID, notification, ResultScheduled)
+	response.DeliverAt = notification.DeliverAt
+	return response, nil
+}
+
+// scheduleError returns the error response of a notification that failed to
+// be scheduled.
+func scheduleError(err error, query *MobilePushWebHookQuery, notification *notify.Notification) *requestError {
+	if errors.Is(err, notify.ErrSchedulingDisabled) || errors.Is(err, notify.ErrScheduleTooFar) || errors.Is(err, notify.ErrUrgentNotSchedulable) {
+		return &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload, err: err}
+	}
+	return notifyError(err, query, notification)
+}
+
+// unschedulable returns the error of the notifications awaiting a reply,
+// which is the response of their request.
+func unschedulable(notification *notify.Notification) *requestError {
+	return &requestError{status: http.StatusBadRequest, code: ErrCodeInvalidPayload,
+		err: fmt.Errorf("template %v awaits a reply and can't be scheduled", notification.Template)}
+}
+
+// cancelScheduled cancels the scheduled or held back notification of the id
+// returned when it was notified.
+func cancelScheduled(notifier *notify.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := notifier.CancelScheduled(c.Param("id"))
+		switch {
+		case errors.Is(err, notify.ErrScheduledNotFound):
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownNotification, err)
+		case err != nil:
+			notifier.Logger().Error("failed to cancel the scheduled notification", "request_id", c.GetString(requestIDKey), "error", err)
+			abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, errors.New("failed to cancel the scheduled notification"))
+		default:
+			c.Status(http.StatusNoContent)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package http
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/breez/notify/channel"
+	"github.com/breez/notify/config"
+	"github.com/breez/notify/notify"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Sender validates and sends notifications like the items of the webhook
+// batches, for the transports other than the webhook, e.g. gRPC. The calls
+// pass the checks of the webhook: the signatures of the providers, the replay
+// protection and, for single notifications, the idempotency keys. The replies
+// awaited by the wake ups are posted to the webhook.
+type Sender struct {
+	batch  *batchHandler
+	config *config.HTTPConfig
+	// nonces is nil without replay protection.
+	nonces *nonceCache
+	// dedup is nil when the notifications are not deduplicated.
+	dedup DedupStore
+}
+
+// CallError rejects a call of the Sender as a whole, with the status the
+// webhook would have responded with.
+type CallError struct {
+	Status int
+	Err    error
+}
+
+func (e *CallError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// NewSender returns a Sender checking the notifications against the config of
+// the webhook. Its tokens, nonces and idempotency keys are tracked apart from
+// those of the webhook.
+func NewSender(notifier *notify.Notifier, channel *channel.HttpCallbackChannel, config *config.HTTPConfig) *Sender {
+	var limiter RateLimiter
+	if config.TokenRateLimit > 0 {
+		limiter = newTokenBucketLimiter(config.TokenRateLimit, config.TokenRateBurst)
+	}
+	sender := &Sender{
+		batch:  newBatchHandler(notifier, channel, "/api/v1", config, limiter, nil),
+		config: config,
+	}
+	if config.ReplayProtection {
+		sender.nonces = newNonceCache(config.ReplayWindow + 2*config.ReplayClockSkew)
+	}
+	if config.IdempotencyWindow > 0 {
+		sender.dedup = newMemoryDedupStore(config.IdempotencyMaxKeys)
+	}
+	return sender
+}
+
+// Send sends the notification of the item, returning its result. The body is
+// the item as received, the providers signing it, and the header holds the
+// metadata of the call. The request id is generated when empty.
+func (s *Sender) Send(ctx context.Context, requestID string, header http.Header, body []byte, item *BatchItem) BatchItemResult {
+	r := s.request(ctx, requestID, header)
+	logger := s.batch.notifier.Logger().With("request_id", r.requestID)
+	if err := s.authorize(r, body, payloadName(item.Payload)); err != nil {
+		logger.Info("rejecting call", "error", err)
+		return failedItem(&requestError{status: http.StatusUnauthorized, code: ErrCodeUnauthorized, err: err}, nil)
+	}
+	r.dedup = s.dedup
+	return s.batch.send(r, item, logger)
+}
+
+// SendBatch sends the items concurrently, returning their results in order.
+// It fails with a CallError when the batch is empty, exceeds the maximum
+// items or is not authorized.
+func (s *Sender) SendBatch(ctx context.Context, requestID string, header http.Header, body []byte, items []BatchItem) (*BatchResponse, error) {
+	if err := s.batch.checkSize(items); err != nil {
+		return nil, &CallError{Status: http.StatusBadRequest, Err: err}
+	}
+	r := s.request(ctx, requestID, header)
+	logger := s.batch.notifier.Logger().With("request_id", r.requestID)
+	payloads := make([]string, 0, len(items))
+	for _, item := range items {
+		payloads = append(payloads, payloadName(item.Payload))
+	}
+	if err := s.authorize(r, body, payloads...); err != nil {
+		logger.Info("rejecting call", "error", err)
+		return nil, &CallError{Status: http.StatusUnauthorized, Err: err}
+	}
+	_, response := s.batch.response(s.batch.sendAll(r, items, logger))
+	return response, nil
+}
+
+// authorize applies the replay protection and checks the signature of the
+// body by the providers of the payloads, like the webhook does.
+func (s *Sender) authorize(r *notifyRequest, body []byte, payloads ...string) error {
+	if s.nonces != nil {
+		if err := checkReplay(r.header, s.nonces, s.config.ReplayWindow, s.config.ReplayClockSkew); err != nil {
+			return err
+		}
+	}
+	return s.batch.signatures.verify(r.header, body, payloads...)
+}
+
+// request returns the request of a call carrying ctx, generating its id when
+// it is missing or invalid.
+func (s *Sender) request(ctx context.Context, requestID string, header http.Header) *notifyRequest {
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		requestID = newRequestID()
+	}
+	if header == nil {
+		header = make(http.Header)
+	}
+	return &notifyRequest{
+		ctx:       ctx,
+		detached:  trace.ContextWithSpan(context.Background(), trace.SpanFromContext(ctx)),
+		requestID: requestID,
+		header:    header,
+	}
+}
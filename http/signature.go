@@ -0,0 +1,99 @@
+package http
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/breez/notify/config"
+)
+
+const defaultSignatureHeader = "X-Hook-Signature"
+
+var errInvalidSignature = errors.New("invalid signature")
+
+// signatureVerifier checks that the payloads are signed by one of the
+// providers sending them.
+type signatureVerifier struct {
+	// providers lists the providers restricted to each template or event.
+	providers map[string][]config.SignatureProvider
+	// senders are the providers of all the other payloads, which need no
+	// signature when there are none.
+	senders []config.SignatureProvider
+}
+
+func newSignatureVerifier(providers config.SignatureProviders) *signatureVerifier {
+	verifier := &signatureVerifier{providers: make(map[string][]config.SignatureProvider)}
+	for _, provider := range providers {
+		if provider.Header == "" {
+			provider.Header = defaultSignatureHeader
+		}
+		if len(provider.Payloads) == 0 {
+			verifier.senders = append(verifier.senders, provider)
+			continue
+		}
+		for _, payload := range provider.Payloads {
+			verifier.providers[payload] = append(verifier.providers[payload], provider)
+		}
+	}
+	return verifier
+}
+
+// verify checks the signature of the raw body of a request carrying the
+// payloads, found in its headers, returning errInvalidSignature when none of
+// the providers sending a payload signed the body.
+func (s *signatureVerifier) verify(header http.Header, body []byte, payloads ...string) error {
+	for _, payload := range payloads {
+		providers, ok := s.providers[payload]
+		if !ok {
+			providers = s.senders
+		}
+		if len(providers) == 0 {
+			continue
+		}
+		if !signedBy(header, body, providers) {
+			return errInvalidSignature
+		}
+	}
+	return nil
+}
+
+// signedBy returns whether the body is signed with a secret of one of the
+// providers.
+func signedBy(header http.Header, body []byte, providers []config.SignatureProvider) bool {
+	for _, provider := range providers {
+		signature := header.Get(provider.Header)
+		message := body
+		if provider.SignsTimestamp {
+			message = timestampedBody(header, body)
+		}
+		for _, secret := range provider.ActiveSecrets() {
+			if validSignature(message, secret, signature) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// validSignature returns whether the signature is the hex encoded
+// HMAC-SHA256 of the body, optionally prefixed with "sha256=".
+func validSignature(body []byte, secret string, signature string) bool {
+	decoded, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil || len(decoded) == 0 {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(decoded, mac.Sum(nil))
+}
+
+// timestampedBody returns "timestamp.nonce.body", binding the replay
+// protection headers of the request to its body.
+func timestampedBody(header http.Header, body []byte) []byte {
+	prefix := header.Get(timestampHeader) + "." + header.Get(nonceHeader) + "."
+	return append([]byte(prefix), body...)
+}
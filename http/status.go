@@ -0,0 +1,30 @@
+package http
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+)
+
+// notificationStatus responds with the delivery status of the notification
+// of the id returned when it was sent.
+func notificationStatus(notifier *notify.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		status, err := notifier.Status(c.Param("id"))
+		switch {
+		case errors.Is(err, notify.ErrStatusDisabled):
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+		case errors.Is(err, notify.ErrStatusNotFound):
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownNotification, err)
+		case err != nil:
+			notifier.Logger().Error("failed to read the delivery status", "request_id", c.GetString(requestIDKey), "error", err)
+			abortWithError(c, http.StatusInternalServerError, ErrCodeInternal, errors.New("failed to read the delivery status"))
+		default:
+			// The notification itself is only shown to the admins.
+			status.Notification = nil
+			c.JSON(http.StatusOK, status)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package http
+
+import (
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/breez/notify/notify"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+)
+
+// liveBufferSize is the number of notifications kept for a slow subscriber
+// before dropping the following ones.
+const liveBufferSize = 16
+
+// subscribe upgrades to a websocket streaming the notifications sent to the
+// token of the query as json, until the client disconnects.
+func subscribe(notifier *notify.Notifier) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.Query("token")
+		if token == "" {
+			abortWithError(c, http.StatusBadRequest, ErrCodeInvalidQuery, errors.New("token is required"))
+			return
+		}
+		notifications, unsubscribe, err := notifier.SubscribeLive(token, liveBufferSize)
+		if err != nil {
+			abortWithError(c, http.StatusNotFound, ErrCodeUnknownRequest, err)
+			return
+		}
+		defer unsubscribe()
+
+		logger := notifier.Logger().With("request_id", c.GetString(requestIDKey), "token", notify.MaskToken(token))
+		// The desktop clients send no origin, so it is not checked.
+		server := websocket.Server{Handler: func(conn *websocket.Conn) {
+			// The clients send nothing, reading only tells when they are
+			// gone.
+			closed := make(chan struct{})
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				close(closed)
+			}()
+			logger.Info("live subscriber connected")
+			for {
+				select {
+				case notification := <-notifications:
+					if err := websocket.JSON.Send(conn, notification); err != nil {
+						logger.Info("live subscriber failed to receive", "error", err)
+						return
+					}
+				case <-closed:
+					logger.Info("live subscriber disconnected")
+					return
+				}
+			}
+		}}
+		server.ServeHTTP(c.Writer, c.Request)
+	}
+}
@@ -0,0 +1,49 @@
+package notify
+
+import "errors"
+
+// ErrUnknownApp is returned for the notifications of an app that is not
+// served by the notifier.
+var ErrUnknownApp = errors.New("unknown app")
+
+// UseApp serves the app along with the default one, delivering the
+// notifications of the app through its own services, e.g. those of its push
+// projects. It must be set before sending notifications.
+func (n *Notifier) UseApp(app string, services map[string]Service) {
+	if n.apps == nil {
+		n.apps = make(map[string]map[string]Service)
+	}
+	n.apps[app] = services
+	if n.breakers != nil {
+		for serviceType := range services {
+			key := app + "/" + serviceType
+			n.breakers[key] = newCircuitBreaker(key, n.breakerThreshold, n.breakerCooldown, n.Logger)
+		}
+	}
+}
+
+// service returns the service delivering the notifications of the type, for
+// the app of the notification. The live subscribers are shared by the apps.
+func (n *Notifier) service(request *Notification, serviceType string) (Service, error) {
+	services := n.serviceByType
+	if request.App != "" && serviceType != PlatformWebSocket {
+		var ok bool
+		if services, ok = n.apps[request.App]; !ok {
+			return nil, ErrUnknownApp
+		}
+	}
+	service, ok := services[serviceType]
+	if !ok {
+		return nil, ErrServiceNotFound
+	}
+	return service, nil
+}
+
+// breakerKey returns the key of the circuit breaker of the service of the
+// notification.
+func breakerKey(request *Notification) string {
+	if request.App == "" || request.Type == PlatformWebSocket {
+		return request.Type
+	}
+	return request.App + "/" + request.Type
+}
@@ -0,0 +1,89 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// ErrCircuitOpen is returned without trying the service while its circuit is
+// open, as it failed repeatedly.
+var ErrCircuitOpen = NewDeliveryError(ReasonCircuitOpen, errors.New("service is unavailable, circuit is open"))
+
+// circuitBreaker fails the sends of a service fast once it failed threshold
+// times in a row, rather than having every send wait for the failing service.
+// Once the cooldown passed, a single probe is let through, closing the circuit
+// when it succeeds and opening it again otherwise.
+type circuitBreaker struct {
+	sync.Mutex
+	platform  string
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openedAt  time.Time
+	// probing is set while the probe of a half open circuit is under way.
+	probing bool
+	// logger returns the logger of the notifier, which may be replaced.
+	logger func() *slog.Logger
+}
+
+func newCircuitBreaker(platform string, threshold int, cooldown time.Duration, logger func() *slog.Logger) *circuitBreaker {
+	return &circuitBreaker{platform: platform, threshold: threshold, cooldown: cooldown, logger: logger}
+}
+
+// allow reports whether a send may go through. A nil breaker allows all the
+// sends.
+func (b *circuitBreaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.failures < b.threshold {
+		return true
+	}
+	if b.probing || now.Sub(b.openedAt) < b.cooldown {
+		return false
+	}
+	b.probing = true
+	b.logger().Info("circuit half open, probing the service", "platform", b.platform)
+	return true
+}
+
+// record counts the failure of a send, the failures caused by the
+// notification itself not telling anything about the service.
+func (b *circuitBreaker) record(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	probe := b.probing
+	b.probing = false
+	if !breaksCircuit(err) {
+		if b.failures >= b.threshold {
+			b.logger().Info("circuit closed, the service recovered", "platform", b.platform)
+		}
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures == b.threshold || probe {
+		b.logger().Error("circuit open, the service failed repeatedly", "platform", b.platform, "failures", b.failures, "cooldown", b.cooldown, "error", err)
+		b.openedAt = now
+	}
+}
+
+func breaksCircuit(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) {
+		return false
+	}
+	switch Reason(err) {
+	case ReasonUnregistered, ReasonTooLarge:
+		return false
+	}
+	return true
+}
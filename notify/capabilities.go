@@ -0,0 +1,92 @@
+package notify
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrCapabilitiesDisabled = errors.New("capability registry is disabled")
+)
+
+// Capability is a feature of a device the payload of its pushes depends on.
+type Capability string
+
+const (
+	// CapabilitySilent is the handling of data only pushes in the background.
+	CapabilitySilent Capability = "silent"
+	// CapabilityRichMedia is the rendering of notifications by a notification
+	// service extension.
+	CapabilityRichMedia Capability = "rich_media"
+	// CapabilityActions is the rendering of action buttons.
+	CapabilityActions Capability = "actions"
+)
+
+// Capabilities are the capabilities a device reported, those missing are
+// assumed to be supported.
+type Capabilities map[Capability]bool
+
+// Supports reports whether the capability is supported.
+func (c Capabilities) Supports(capability Capability) bool {
+	supported, ok := c[capability]
+	return !ok || supported
+}
+
+// CapabilityRegistry stores the capabilities of the targets.
+type CapabilityRegistry interface {
+	Capabilities(notificationType string, target string) (Capabilities, bool)
+	SetCapabilities(notificationType string, target string, capabilities Capabilities)
+}
+
+// memoryCapabilities is an in memory CapabilityRegistry.
+type memoryCapabilities struct {
+	sync.RWMutex
+	targets map[string]Capabilities
+}
+
+func newMemoryCapabilities() *memoryCapabilities {
+	return &memoryCapabilities{targets: make(map[string]Capabilities)}
+}
+
+func (m *memoryCapabilities) Capabilities(notificationType string, target string) (Capabilities, bool) {
+	m.RLock()
+	defer m.RUnlock()
+	capabilities, ok := m.targets[notificationType+"/"+target]
+	return capabilities, ok
+}
+
+func (m *memoryCapabilities) SetCapabilities(notificationType string, target string, capabilities Capabilities) {
+	m.Lock()
+	defer m.Unlock()
+	m.targets[notificationType+"/"+target] = capabilities
+}
+
+// UseCapabilityRegistry replaces the registry the capabilities of the targets
+// are read from, for example with a shared store.
+func (n *Notifier) UseCapabilityRegistry(registry CapabilityRegistry) {
+	n.capabilities = registry
+}
+
+// SetCapabilities registers the capabilities of a target, the payload of its
+// following notifications is tailored to them.
+func (n *Notifier) SetCapabilities(notificationType string, target string, capabilities Capabilities) error {
+	if n.capabilities == nil {
+		return ErrCapabilitiesDisabled
+	}
+	n.capabilities.SetCapabilities(notificationType, target, capabilities)
+	return nil
+}
+
+// tailor adapts the notification to the capabilities of its target: silent
+// pushes fall back to alerts and actions are dropped when not supported.
+func tailor(request *Notification, capabilities Capabilities) {
+	request.Capabilities = capabilities
+	if !capabilities.Supports(CapabilitySilent) {
+		silent := false
+		request.Silent = &silent
+	}
+	if !capabilities.Supports(CapabilityActions) {
+		request.Action = nil
+		request.Category = ""
+	}
+}
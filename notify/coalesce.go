@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// defaultCoalesceMessages are the bodies of the coalesced notifications per
+// template, {count} being replaced with the number of notifications.
+var defaultCoalesceMessages = map[string]string{
+	NOTIFICATION_PAYMENT_RECEIVED:      "{count} incoming payments",
+	NOTIFICATION_TX_CONFIRMED:          "{count} transactions confirmed",
+	NOTIFICATION_ADDRESS_TXS_CONFIRMED: "{count} transactions confirmed",
+	NOTIFICATION_SWAP_UPDATED:          "{count} swap updates",
+	NOTIFICATION_LIQUID_ASSET_RECEIVED: "{count} assets received",
+}
+
+// defaultCoalesceMessage is the body of the coalesced notifications of the
+// templates without a message.
+const defaultCoalesceMessage = "{count} new notifications"
+
+// coalescedNotifications holds the notifications of a template and target
+// arrived within the window, and the entry of their coalesced notification.
+type coalescedNotifications struct {
+	entry         *ScheduledEntry
+	notifications []*Notification
+}
+
+// coalesceWindow holds the notifications of the templates having a window,
+// sending a single notification per template and target for those arrived
+// within it. The coalesced notification is the latest one, with the count of
+// the notifications in its body and the data of all of them, kept in the
+// schedule until the window ends.
+type coalesceWindow struct {
+	sync.Mutex
+	windows  map[string]time.Duration
+	messages map[string]string
+	holder   holder
+	logFor   func(context.Context, *Notification) *slog.Logger
+	pending  map[string]*coalescedNotifications
+}
+
+func newCoalesceWindow(windows map[string]time.Duration, messages map[string]string, holder holder, logFor func(context.Context, *Notification) *slog.Logger) *coalesceWindow {
+	allMessages := make(map[string]string, len(defaultCoalesceMessages)+len(messages))
+	for template, message := range defaultCoalesceMessages {
+		allMessages[template] = message
+	}
+	for template, message := range messages {
+		allMessages[template] = message
+	}
+	return &coalesceWindow{
+		windows:  windows,
+		messages: allMessages,
+		holder:   holder,
+		logFor:   logFor,
+		pending:  make(map[string]*coalescedNotifications),
+	}
+}
+
+// add holds the notification if its template is coalesced, returning false
+// when it should be sent right away, along with the previous latest
+// notification, now folded in the coalesced one, if any.
+func (w *coalesceWindow) add(request *Notification, now time.Time) (bool, *Notification, error) {
+	window, ok := w.windows[request.Template]
+	if !ok || window <= 0 || IsUrgent(request.Template) {
+		return false, nil, nil
+	}
+
+	key := strings.Join([]string{request.Template, request.Type, request.App, request.TargetIdentifier}, "/")
+	w.Lock()
+	defer w.Unlock()
+	// A window past its end is being sent, the notification opens a new one.
+	pending, ok := w.pending[key]
+	if !ok || !pending.entry.DeliverAt.After(now) {
+		entry := &ScheduledEntry{Notification: request, DeliverAt: now.Add(window), Stage: stageCoalesce, Key: key}
+		if err := w.holder.hold(entry, ""); err != nil {
+			return false, nil, err
+		}
+		w.pending[key] = &coalescedNotifications{entry: entry, notifications: []*Notification{request}}
+		return true, nil, nil
+	}
+
+	notifications := append(pending.notifications[:len(pending.notifications):len(pending.notifications)], request)
+	entry := &ScheduledEntry{Notification: w.coalesce(notifications), DeliverAt: pending.entry.DeliverAt, Stage: stageCoalesce, Key: key}
+	if err := w.holder.hold(entry, pending.entry.Notification.ID); err != nil {
+		return false, nil, err
+	}
+	folded := pending.notifications[len(pending.notifications)-1]
+	pending.entry, pending.notifications = entry, notifications
+	w.logFor(context.Background(), request).Info("coalescing notification", "count", len(notifications))
+	return true, folded, nil
+}
+
+// take deletes the due entry from the schedule, closing its window unless a
+// new one was opened meanwhile.
+func (w *coalesceWindow) take(entry *ScheduledEntry) error {
+	w.Lock()
+	defer w.Unlock()
+	if pending, ok := w.pending[entry.Key]; ok && pending.entry.Notification.ID == entry.Notification.ID {
+		delete(w.pending, entry.Key)
+	}
+	return w.holder.release(entry.Notification.ID)
+}
+
+// coalesce returns the notification sent for the notifications, the latest
+// one with the count in its body and the data of every notification in
+// coalesced_events.
+func (w *coalesceWindow) coalesce(notifications []*Notification) *Notification {
+	latest := notifications[len(notifications)-1]
+	if len(notifications) == 1 {
+		return latest
+	}
+	coalesced := *latest
+	events := make([]interface{}, 0, len(notifications))
+	for _, notification := range notifications {
+		events = append(events, notification.Data)
+	}
+	coalesced.Data = make(map[string]interface{}, len(latest.Data)+2)
+	for key, value := range latest.Data {
+		coalesced.Data[key] = value
+	}
+	coalesced.Data["coalesced_count"] = len(notifications)
+	coalesced.Data["coalesced_events"] = events
+	message, ok := w.messages[latest.Template]
+	if !ok {
+		message = defaultCoalesceMessage
+	}
+	coalesced.Body = strings.ReplaceAll(message, "{count}", strconv.Itoa(len(notifications)))
+	return &coalesced
+}
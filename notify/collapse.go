@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// collapseWindow holds notifications having a collapse key for a window,
+// delivering only the latest notification of each key and target that
+// arrived within it. The latest notification is kept in the schedule until
+// the window ends.
+type collapseWindow struct {
+	sync.Mutex
+	window time.Duration
+	holder holder
+	logFor func(context.Context, *Notification) *slog.Logger
+	// pending are the entries of the open windows, by key.
+	pending map[string]*ScheduledEntry
+}
+
+func newCollapseWindow(window time.Duration, holder holder, logFor func(context.Context, *Notification) *slog.Logger) *collapseWindow {
+	return &collapseWindow{
+		window:  window,
+		holder:  holder,
+		logFor:  logFor,
+		pending: make(map[string]*ScheduledEntry),
+	}
+}
+
+// add holds the notification if it can be collapsed, returning false when it
+// should be sent right away, along with the notification it replaced if any.
+func (w *collapseWindow) add(request *Notification, now time.Time) (bool, *Notification, error) {
+	if request.CollapseKey == "" || IsUrgent(request.Template) {
+		return false, nil, nil
+	}
+
+	key := request.Type + "/" + request.TargetIdentifier + "/" + request.CollapseKey
+	entry := &ScheduledEntry{Notification: request, DeliverAt: now.Add(w.window), Stage: stageCollapse, Key: key}
+	w.Lock()
+	defer w.Unlock()
+	// A window past its end is being sent, the notification opens a new one.
+	pending, ok := w.pending[key]
+	if !ok || !pending.DeliverAt.After(now) {
+		if err := w.holder.hold(entry, ""); err != nil {
+			return false, nil, err
+		}
+		w.pending[key] = entry
+		return true, nil, nil
+	}
+
+	w.logFor(context.Background(), request).Info("collapsing notification", "collapse_key", request.CollapseKey)
+	entry.DeliverAt = pending.DeliverAt
+	if err := w.holder.hold(entry, pending.Notification.ID); err != nil {
+		return false, nil, err
+	}
+	w.pending[key] = entry
+	return true, pending.Notification, nil
+}
+
+// take deletes the due entry from the schedule, closing its window unless a
+// new one was opened meanwhile.
+func (w *collapseWindow) take(entry *ScheduledEntry) error {
+	w.Lock()
+	defer w.Unlock()
+	if pending, ok := w.pending[entry.Key]; ok && pending.Notification.ID == entry.Notification.ID {
+		delete(w.pending, entry.Key)
+	}
+	return w.holder.release(entry.Notification.ID)
+}
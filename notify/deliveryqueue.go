@@ -0,0 +1,197 @@
+package notify
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// QueuedNotification is a notification popped from a DeliveryQueue, along
+// with the id acknowledging its delivery.
+type QueuedNotification struct {
+	ID           string        `json:"id"`
+	Notification *Notification `json:"notification"`
+	// Attempts is the number of times the notification was popped.
+	Attempts int `json:"attempts"`
+}
+
+// DeliveryQueue hands the notifications queued by any instance of the
+// service to the workers of any instance, e.g. backed by a Redis list shared
+// by the instances. Notifications are delivered at least once: those popped
+// and not acknowledged within the visibility timeout of the queue are popped
+// again.
+type DeliveryQueue interface {
+	Push(ctx context.Context, notification *Notification) error
+	// Pop waits for a notification until ctx is done.
+	Pop(ctx context.Context) (*QueuedNotification, error)
+	Ack(ctx context.Context, id string) error
+	// Depth returns the number of notifications waiting to be popped.
+	Depth(ctx context.Context) (int, error)
+}
+
+// memoryDeliveryQueue is an in memory DeliveryQueue, only shared by the
+// notifiers of a process.
+type memoryDeliveryQueue struct {
+	sync.Mutex
+	visibility time.Duration
+	pending    *list.List
+	// inFlight are the popped notifications and the time they are popped
+	// again at unless acknowledged.
+	inFlight map[string]inFlightNotification
+	// ready is signaled when a notification is pushed.
+	ready chan struct{}
+}
+
+type inFlightNotification struct {
+	queued   *QueuedNotification
+	deadline time.Time
+}
+
+// NewMemoryDeliveryQueue returns a DeliveryQueue kept in memory, popping the
+// notifications not acknowledged within the visibility timeout again.
+func NewMemoryDeliveryQueue(visibility time.Duration) DeliveryQueue {
+	return &memoryDeliveryQueue{
+		visibility: visibility,
+		pending:    list.New(),
+		inFlight:   make(map[string]inFlightNotification),
+		ready:      make(chan struct{}, 1),
+	}
+}
+
+func (q *memoryDeliveryQueue) Push(ctx context.Context, notification *Notification) error {
+	q.Lock()
+	q.pending.PushBack(&QueuedNotification{ID: newNotificationID(), Notification: notification})
+	q.Unlock()
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+func (q *memoryDeliveryQueue) Pop(ctx context.Context) (*QueuedNotification, error) {
+	for {
+		if queued := q.pop(time.Now()); queued != nil {
+			return queued, nil
+		}
+		select {
+		case <-q.ready:
+		case <-time.After(q.visibility):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pop returns the first pending notification, nil when there is none, once
+// the expired notifications in flight are pending again.
+func (q *memoryDeliveryQueue) pop(now time.Time) *QueuedNotification {
+	q.Lock()
+	defer q.Unlock()
+	for id, inFlight := range q.inFlight {
+		if now.After(inFlight.deadline) {
+			delete(q.inFlight, id)
+			q.pending.PushFront(inFlight.queued)
+		}
+	}
+	front := q.pending.Front()
+	if front == nil {
+		return nil
+	}
+	queued := q.pending.Remove(front).(*QueuedNotification)
+	queued.Attempts++
+	q.inFlight[queued.ID] = inFlightNotification{queued: queued, deadline: now.Add(q.visibility)}
+	popped := *queued
+	return &popped
+}
+
+func (q *memoryDeliveryQueue) Ack(ctx context.Context, id string) error {
+	q.Lock()
+	defer q.Unlock()
+	delete(q.inFlight, id)
+	return nil
+}
+
+func (q *memoryDeliveryQueue) Depth(ctx context.Context) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+	return q.pending.Len(), nil
+}
+
+// UseDeliveryQueue pushes the notifications nobody waits for to the queue,
+// to be delivered by any instance running RunDeliveryQueue, rather than by the
+// workers of the notifier. It must be set before sending notifications.
+func (n *Notifier) UseDeliveryQueue(queue DeliveryQueue) {
+	n.deliveryQueue = queue
+}
+
+// RunDeliveryQueue delivers the notifications of the delivery queue with the
+// workers of the notifier until ctx is done. The notifications are popped as
+// the workers are free, and acknowledged once delivered or failed.
+func (n *Notifier) RunDeliveryQueue(ctx context.Context) {
+	for {
+		n.observeQueueDepth(ctx)
+		queued, err := n.deliveryQueue.Pop(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			n.logger.Error("failed to pop from the delivery queue", "error", err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		if !n.enqueueQueued(ctx, queued) {
+			return
+		}
+	}
+}
+
+// enqueueQueued queues a notification of the delivery queue for the workers,
+// waiting for room in the queue of the workers. It returns false once ctx is
+// done.
+func (n *Notifier) enqueueQueued(ctx context.Context, queued *QueuedNotification) bool {
+	logger := n.logFor(ctx, queued.Notification).With("queued_id", queued.ID, "attempts", queued.Attempts)
+	for {
+		err := n.enqueue(ctx, queued.Notification, func(result *Result, err error) {
+			// The notifications cancelled by a shutdown are left for another
+			// instance to deliver.
+			if ctx.Err() != nil {
+				return
+			}
+			if err := n.deliveryQueue.Ack(context.Background(), queued.ID); err != nil {
+				logger.Error("failed to acknowledge the queued notification", "error", err)
+			}
+		})
+		if err == nil {
+			return true
+		}
+		if !errors.Is(err, ErrQueueFull) {
+			logger.Error("failed to queue the notification of the delivery queue", "error", err)
+			return ctx.Err() == nil
+		}
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// observeQueueDepth records the depth of the delivery queue in the metrics.
+func (n *Notifier) observeQueueDepth(ctx context.Context) {
+	if n.metrics == nil {
+		return
+	}
+	depth, err := n.deliveryQueue.Depth(ctx)
+	if err != nil {
+		n.logger.Error("failed to read the delivery queue depth", "error", err)
+		return
+	}
+	n.metrics.deliveryQueueDepth.Set(float64(depth))
+}
@@ -0,0 +1,195 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	ErrDevicesDisabled = errors.New("device registry is disabled")
+	ErrDeviceNotFound  = errors.New("device not found")
+)
+
+// Device is a push target registered for a client.
+type Device struct {
+	Platform string  `json:"platform"`
+	Token    string  `json:"token"`
+	AppData  *string `json:"app_data,omitempty"`
+}
+
+// DeviceStore stores the devices of the clients, keyed by a stable client id
+// so senders can notify a client without knowing its push tokens.
+type DeviceStore interface {
+	Devices(clientID string) ([]Device, error)
+	// SetDevice adds the device to the client, replacing the device having
+	// the same platform and token.
+	SetDevice(clientID string, device Device) error
+	// RemoveDevice returns ErrDeviceNotFound when the client has no such
+	// device.
+	RemoveDevice(clientID string, platform string, token string) error
+	// PlatformDevices returns the devices of all the clients on the platform,
+	// each token once.
+	PlatformDevices(platform string) ([]Device, error)
+}
+
+// memoryDevices is an in memory DeviceStore, saved to a json file after each
+// change when it has one.
+type memoryDevices struct {
+	sync.RWMutex
+	clients map[string][]Device
+	// file is empty when the devices are only kept in memory.
+	file string
+}
+
+func newMemoryDevices() *memoryDevices {
+	return &memoryDevices{clients: make(map[string][]Device)}
+}
+
+// NewFileDeviceStore returns a DeviceStore persisted in the json file, loading
+// the devices it already holds.
+func NewFileDeviceStore(file string) (DeviceStore, error) {
+	store := newMemoryDevices()
+	store.file = file
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &store.clients); err != nil {
+		return nil, fmt.Errorf("invalid device store %v: %w", file, err)
+	}
+	return store, nil
+}
+
+func (m *memoryDevices) Devices(clientID string) ([]Device, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return append([]Device(nil), m.clients[clientID]...), nil
+}
+
+func (m *memoryDevices) SetDevice(clientID string, device Device) error {
+	m.Lock()
+	defer m.Unlock()
+	devices := m.clients[clientID]
+	replaced := false
+	for i, d := range devices {
+		if d.Platform == device.Platform && d.Token == device.Token {
+			devices[i] = device
+			replaced = true
+		}
+	}
+	if !replaced {
+		devices = append(devices, device)
+	}
+	m.clients[clientID] = devices
+	return m.save()
+}
+
+func (m *memoryDevices) RemoveDevice(clientID string, platform string, token string) error {
+	m.Lock()
+	defer m.Unlock()
+	devices := m.clients[clientID]
+	for i, d := range devices {
+		if d.Platform == platform && d.Token == token {
+			devices = append(devices[:i:i], devices[i+1:]...)
+			if len(devices) == 0 {
+				delete(m.clients, clientID)
+			} else {
+				m.clients[clientID] = devices
+			}
+			return m.save()
+		}
+	}
+	return ErrDeviceNotFound
+}
+
+func (m *memoryDevices) PlatformDevices(platform string) ([]Device, error) {
+	m.RLock()
+	defer m.RUnlock()
+	var devices []Device
+	seen := make(map[string]bool)
+	for _, clientDevices := range m.clients {
+		for _, device := range clientDevices {
+			if device.Platform == platform && !seen[device.Token] {
+				seen[device.Token] = true
+				devices = append(devices, device)
+			}
+		}
+	}
+	return devices, nil
+}
+
+// save writes the devices to a temporary file renamed over the store file, so
+// the store is never left half written. It must be called with the lock held.
+func (m *memoryDevices) save() error {
+	if m.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(m.clients)
+	if err != nil {
+		return err
+	}
+	tmp := m.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.file)
+}
+
+// UseDeviceStore replaces the store the devices of the clients are kept in,
+// for example with a persistent one.
+func (n *Notifier) UseDeviceStore(store DeviceStore) {
+	n.devices = store
+}
+
+// Devices returns the devices registered for the client.
+func (n *Notifier) Devices(clientID string) ([]Device, error) {
+	if n.devices == nil {
+		return nil, ErrDevicesDisabled
+	}
+	return n.devices.Devices(clientID)
+}
+
+// RegisterDevice adds the device to the client, replacing the device having
+// the same platform and token.
+func (n *Notifier) RegisterDevice(clientID string, device Device) error {
+	if n.devices == nil {
+		return ErrDevicesDisabled
+	}
+	return n.devices.SetDevice(clientID, device)
+}
+
+// UpdateDevice replaces the device of the client having the previous token,
+// e.g. once the provider refreshed the token.
+func (n *Notifier) UpdateDevice(clientID string, previousToken string, device Device) error {
+	if n.devices == nil {
+		return ErrDevicesDisabled
+	}
+	if previousToken != device.Token {
+		if err := n.devices.RemoveDevice(clientID, device.Platform, previousToken); err != nil {
+			return err
+		}
+	}
+	return n.devices.SetDevice(clientID, device)
+}
+
+// PlatformDevices returns the devices of all the clients on the platform.
+func (n *Notifier) PlatformDevices(platform string) ([]Device, error) {
+	if n.devices == nil {
+		return nil, ErrDevicesDisabled
+	}
+	return n.devices.PlatformDevices(platform)
+}
+
+// RemoveDevice removes the device from the client.
+func (n *Notifier) RemoveDevice(clientID string, platform string, token string) error {
+	if n.devices == nil {
+		return ErrDevicesDisabled
+	}
+	return n.devices.RemoveDevice(clientID, platform, token)
+}
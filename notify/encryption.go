@@ -0,0 +1,287 @@
+package notify
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf"
+)
+
+var (
+	ErrEncryptionKeysDisabled = errors.New("encryption key registry is disabled")
+	ErrInvalidEncryptionKey   = errors.New("encryption key must be a 32 bytes X25519 public key")
+	ErrEncryptionKeyNotFound  = errors.New("encryption key of the target not found")
+)
+
+// EncryptionScheme identifies how the content of the encrypted notifications
+// is encrypted: an X25519 key agreement between an ephemeral key and the key
+// of the target, HKDF-SHA256 and ChaCha20-Poly1305.
+const EncryptionScheme = "x25519-hkdf-sha256-chacha20poly1305"
+
+// encryptionInfo binds the derived keys to the scheme.
+var encryptionInfo = []byte("breez-notify " + EncryptionScheme)
+
+// defaultEncryptedMessage is displayed by the encrypted notifications until
+// the app decrypts them.
+const defaultEncryptedMessage = "New notification"
+
+// EncryptedContent is the content of a notification sealed in the ciphertext
+// of its encrypted data.
+type EncryptedContent struct {
+	DisplayMessage string                 `json:"display_message"`
+	Body           string                 `json:"body,omitempty"`
+	Action         *Action                `json:"action,omitempty"`
+	Data           map[string]interface{} `json:"data"`
+}
+
+// EncryptionKeyRegistry stores the X25519 public keys of the targets.
+type EncryptionKeyRegistry interface {
+	// EncryptionKey returns nil when the target has no key.
+	EncryptionKey(notificationType string, target string) ([]byte, error)
+	// SetEncryptionKey removes the key of the target when key is nil.
+	SetEncryptionKey(notificationType string, target string, key []byte) error
+}
+
+// memoryEncryptionKeys is an in memory EncryptionKeyRegistry, saved to a json
+// file after each change when it has one.
+type memoryEncryptionKeys struct {
+	sync.RWMutex
+	targets map[string][]byte
+	// file is empty when the keys are only kept in memory.
+	file string
+}
+
+func newMemoryEncryptionKeys() *memoryEncryptionKeys {
+	return &memoryEncryptionKeys{targets: make(map[string][]byte)}
+}
+
+// NewFileEncryptionKeys returns an EncryptionKeyRegistry persisted in the json
+// file, loading the keys it already holds.
+func NewFileEncryptionKeys(file string) (EncryptionKeyRegistry, error) {
+	keys := newMemoryEncryptionKeys()
+	keys.file = file
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return keys, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &keys.targets); err != nil {
+		return nil, fmt.Errorf("invalid encryption keys %v: %w", file, err)
+	}
+	return keys, nil
+}
+
+func (m *memoryEncryptionKeys) EncryptionKey(notificationType string, target string) ([]byte, error) {
+	m.RLock()
+	defer m.RUnlock()
+	return m.targets[notificationType+"/"+target], nil
+}
+
+func (m *memoryEncryptionKeys) SetEncryptionKey(notificationType string, target string, key []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if key == nil {
+		delete(m.targets, notificationType+"/"+target)
+	} else {
+		m.targets[notificationType+"/"+target] = key
+	}
+	return m.save()
+}
+
+// save writes the keys to a temporary file renamed over the keys file, so the
+// file is never left half written. It must be called with the lock held.
+func (m *memoryEncryptionKeys) save() error {
+	if m.file == "" {
+		return nil
+	}
+	data, err := json.Marshal(m.targets)
+	if err != nil {
+		return err
+	}
+	tmp := m.file + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.file)
+}
+
+// UseEncryptionKeyRegistry replaces the registry the encryption keys of the
+// targets are read from, for example with a shared store.
+func (n *Notifier) UseEncryptionKeyRegistry(registry EncryptionKeyRegistry) {
+	n.encryptionKeys = registry
+}
+
+// SetEncryptionKey registers the X25519 public key of a target, the content
+// of its following notifications is encrypted to it. A nil key stops the
+// encryption.
+func (n *Notifier) SetEncryptionKey(notificationType string, target string, key []byte) error {
+	if n.encryptionKeys == nil {
+		return ErrEncryptionKeysDisabled
+	}
+	if key != nil && !validEncryptionKey(key) {
+		return ErrInvalidEncryptionKey
+	}
+	return n.encryptionKeys.SetEncryptionKey(notificationType, target, key)
+}
+
+// requireEncryption marks the notification of a target having a key as
+// encrypted, so it is refused rather than sent in clear should the key not
+// be found once it is delivered, e.g. by another instance.
+func (n *Notifier) requireEncryption(request *Notification) error {
+	if n.encryptionKeys == nil || request.Encrypt {
+		return nil
+	}
+	key, err := n.encryptionKeys.EncryptionKey(request.Type, request.TargetIdentifier)
+	if err != nil {
+		return fmt.Errorf("failed to look up the encryption key: %w", err)
+	}
+	request.Encrypt = key != nil
+	return nil
+}
+
+// encryptionKey returns the key the notification is encrypted to, nil when it
+// is sent in clear. It fails when the notification requires encryption but
+// its key is not found.
+func (n *Notifier) encryptionKey(request *Notification) ([]byte, error) {
+	if n.encryptionKeys == nil {
+		if request.Encrypt {
+			return nil, ErrEncryptionKeyNotFound
+		}
+		return nil, nil
+	}
+	key, err := n.encryptionKeys.EncryptionKey(request.Type, request.TargetIdentifier)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up the encryption key: %w", err)
+	}
+	if key == nil && request.Encrypt {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	return key, nil
+}
+
+// validEncryptionKey reports whether the key is an X25519 public key, low
+// order points making the shared secrets predictable.
+func validEncryptionKey(key []byte) bool {
+	if len(key) != curve25519.PointSize {
+		return false
+	}
+	scalar := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(scalar); err != nil {
+		return false
+	}
+	_, err := curve25519.X25519(scalar, key)
+	return err == nil
+}
+
+// encrypt seals the messages, action and data of the notification with the
+// key of its target. The providers only see the placeholder message and the
+// encrypted data: the scheme, the ephemeral key and the ciphertext.
+func encrypt(request *Notification, key []byte, message string) error {
+	ephemeral := make([]byte, curve25519.ScalarSize)
+	if _, err := rand.Read(ephemeral); err != nil {
+		return err
+	}
+	ephemeralKey, err := curve25519.X25519(ephemeral, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	aead, err := encryptionCipher(ephemeral, key, ephemeralKey, key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := json.Marshal(EncryptedContent{
+		DisplayMessage: request.DisplayMessage,
+		Body:           request.Body,
+		Action:         request.Action,
+		Data:           request.Data,
+	})
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	request.DisplayMessage = message
+	request.Body = ""
+	request.Action = nil
+	request.Encrypted = true
+	request.Data = map[string]interface{}{
+		"scheme":        EncryptionScheme,
+		"ephemeral_key": base64.StdEncoding.EncodeToString(ephemeralKey),
+		"ciphertext":    base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, nil)),
+	}
+	return nil
+}
+
+// Decrypt opens the encrypted data of a notification with the private key of
+// its target, as the apps do.
+func Decrypt(privateKey []byte, data map[string]interface{}) (*EncryptedContent, error) {
+	if data["scheme"] != EncryptionScheme {
+		return nil, fmt.Errorf("unsupported encryption scheme %v", data["scheme"])
+	}
+	ephemeralKey, err := decodeField(data, "ephemeral_key")
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, err := decodeField(data, "ciphertext")
+	if err != nil {
+		return nil, err
+	}
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := encryptionCipher(privateKey, ephemeralKey, ephemeralKey, publicKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	plaintext, err := aead.Open(nil, ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, err
+	}
+	var content EncryptedContent
+	if err := json.Unmarshal(plaintext, &content); err != nil {
+		return nil, err
+	}
+	return &content, nil
+}
+
+// encryptionCipher derives the cipher of a notification from the key
+// agreement of the private and peer keys, salted with both public keys.
+func encryptionCipher(privateKey, peerKey, ephemeralKey, targetKey []byte) (cipher.AEAD, error) {
+	shared, err := curve25519.X25519(privateKey, peerKey)
+	if err != nil {
+		return nil, err
+	}
+	salt := append(append([]byte(nil), ephemeralKey...), targetKey...)
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, shared, salt, encryptionInfo), key); err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+func decodeField(data map[string]interface{}, key string) ([]byte, error) {
+	value, ok := data[key].(string)
+	if !ok {
+		return nil, fmt.Errorf("missing %v", key)
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
@@ -0,0 +1,73 @@
+package notify
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrorReason classifies why a notification failed to be delivered.
+type ErrorReason string
+
+const (
+	ReasonUnregistered ErrorReason = "unregistered"
+	ReasonTooLarge     ErrorReason = "too_large"
+	ReasonThrottled    ErrorReason = "throttled"
+	ReasonTimeout      ErrorReason = "timeout"
+	ReasonAuth         ErrorReason = "auth"
+	ReasonCircuitOpen  ErrorReason = "circuit_open"
+	ReasonUnavailable  ErrorReason = "unavailable"
+	ReasonUnknown      ErrorReason = "unknown"
+)
+
+// DeliveryError is returned by services when the provider fails to deliver a
+// notification, with the reason it failed.
+type DeliveryError struct {
+	Reason ErrorReason
+	Err    error
+}
+
+func NewDeliveryError(reason ErrorReason, err error) *DeliveryError {
+	return &DeliveryError{Reason: reason, Err: err}
+}
+
+func (e *DeliveryError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DeliveryError) Unwrap() error {
+	return e.Err
+}
+
+// Reason returns the reason of a delivery failure.
+func Reason(err error) ErrorReason {
+	var deliveryErr *DeliveryError
+	if errors.As(err, &deliveryErr) {
+		return deliveryErr.Reason
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ReasonTimeout
+	}
+	return ReasonUnknown
+}
+
+// Retryable returns whether a failure with the given reason may succeed when
+// sent again. Invalid tokens, oversized payloads and bad credentials fail the
+// same way on every attempt.
+func Retryable(reason ErrorReason) bool {
+	switch reason {
+	case ReasonUnregistered, ReasonTooLarge, ReasonAuth:
+		return false
+	}
+	return true
+}
+
+// ProviderFailure returns whether a failure with the given reason is caused
+// by the provider, unavailable, rejecting the credentials or out of quota,
+// rather than by the notification or its target.
+func ProviderFailure(reason ErrorReason) bool {
+	switch reason {
+	case ReasonUnavailable, ReasonAuth, ReasonThrottled:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// providerCheckTimeout bounds the check of a provider, so a hung provider
+// doesn't delay the checks of the others.
+const providerCheckTimeout = 10 * time.Second
+
+// HealthChecker is implemented by services that can tell whether they are
+// able to deliver notifications.
+type HealthChecker interface {
+	Healthy(ctx context.Context) error
+}
+
+// ProviderChecker is implemented by services that can verify their
+// credentials and their connectivity with the push provider, without
+// delivering a notification.
+type ProviderChecker interface {
+	CheckProvider(ctx context.Context) error
+}
+
+// HealthError lists the platforms whose service is not ready, along with the
+// reason of their last delivery failure when known.
+type HealthError struct {
+	Platforms  map[string]string
+	LastErrors map[string]ErrorReason
+}
+
+func (e *HealthError) Error() string {
+	var failing []string
+	for platform, err := range e.Platforms {
+		failing = append(failing, fmt.Sprintf("%v: %v", platform, err))
+	}
+	sort.Strings(failing)
+	return "services not ready: " + strings.Join(failing, ", ")
+}
+
+// lastErrors remembers the reason of the last delivery failure per platform,
+// until a delivery to the platform succeeds.
+type lastErrors struct {
+	sync.Mutex
+	reasons map[string]ErrorReason
+}
+
+func (l *lastErrors) record(outcome Outcome) {
+	l.Lock()
+	defer l.Unlock()
+	if outcome.Delivered {
+		delete(l.reasons, outcome.Type)
+		return
+	}
+	if l.reasons == nil {
+		l.reasons = make(map[string]ErrorReason)
+	}
+	l.reasons[outcome.Type] = ErrorReason(outcome.Reason)
+}
+
+func (l *lastErrors) get(platform string) (ErrorReason, bool) {
+	l.Lock()
+	defer l.Unlock()
+	reason, ok := l.reasons[platform]
+	return reason, ok
+}
+
+func (l *lastErrors) all() map[string]ErrorReason {
+	l.Lock()
+	defer l.Unlock()
+	reasons := make(map[string]ErrorReason, len(l.reasons))
+	for platform, reason := range l.reasons {
+		reasons[platform] = reason
+	}
+	return reasons
+}
+
+// providerChecks keeps the result of the last check of the provider of each
+// platform, run every interval.
+type providerChecks struct {
+	sync.Mutex
+	interval time.Duration
+	// failures are the errors of the failed checks, by platform.
+	failures map[string]string
+	// checked is false until the providers were checked once.
+	checked bool
+}
+
+func (p *providerChecks) set(failures map[string]string) {
+	p.Lock()
+	defer p.Unlock()
+	p.failures = failures
+	p.checked = true
+}
+
+// failure returns why the provider of the platform is not ready, if so.
+func (p *providerChecks) failure(platform string) (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+	if !p.checked {
+		return "provider not checked yet", true
+	}
+	failure, ok := p.failures[platform]
+	return failure, ok
+}
+
+// LastErrors returns the reason of the last delivery failure of the platforms
+// whose last delivery failed.
+func (n *Notifier) LastErrors() map[string]ErrorReason {
+	return n.lastErrors.all()
+}
+
+// QueueDepth returns the number of notifications queued or being sent by the
+// workers, along with those waiting in the delivery queue.
+func (n *Notifier) QueueDepth(ctx context.Context) int {
+	depth := n.queue.SubmittedTasks() - n.queue.SuccessTasks() - n.queue.FailureTasks()
+	if n.deliveryQueue != nil {
+		queued, err := n.deliveryQueue.Depth(ctx)
+		if err != nil {
+			n.logger.Error("failed to read the delivery queue depth", "error", err)
+		}
+		depth += queued
+	}
+	return depth
+}
+
+// RunProviderChecks checks the credentials and the connectivity of the
+// providers of every platform right away, then every interval of the checks
+// until ctx is done. Healthy reports the platforms whose last check failed,
+// and all of them until the first checks are done. It returns right away when
+// the providers are not checked.
+func (n *Notifier) RunProviderChecks(ctx context.Context) {
+	if n.providerChecks == nil {
+		return
+	}
+	ticker := time.NewTicker(n.providerChecks.interval)
+	defer ticker.Stop()
+	for {
+		n.providerChecks.set(n.CheckProviders(ctx))
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// CheckProviders checks the providers of every platform concurrently,
+// returning the errors of the failed checks by platform.
+func (n *Notifier) CheckProviders(ctx context.Context) map[string]string {
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		failures = make(map[string]string)
+	)
+	check := func(platform string, service Service) {
+		checker, ok := service.(ProviderChecker)
+		if !ok {
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, providerCheckTimeout)
+			defer cancel()
+			if err := checker.CheckProvider(checkCtx); err != nil {
+				n.logger.Error("provider check failed", "platform", platform, "error", err)
+				mu.Lock()
+				failures[platform] = err.Error()
+				mu.Unlock()
+			}
+		}()
+	}
+	for platform, service := range n.serviceByType {
+		check(platform, service)
+	}
+	for app, services := range n.apps {
+		for platform, service := range services {
+			check(app+"/"+platform, service)
+		}
+	}
+	wg.Wait()
+	return failures
+}
+
+// Healthy checks the services of every platform, along with the last check of
+// their provider when the providers are checked, returning a *HealthError
+// listing the platforms that are not ready.
+func (n *Notifier) Healthy(ctx context.Context) error {
+	healthErr := &HealthError{
+		Platforms:  make(map[string]string),
+		LastErrors: make(map[string]ErrorReason),
+	}
+	check := func(platform string, service Service) {
+		var failure string
+		if checker, ok := service.(HealthChecker); ok {
+			if err := checker.Healthy(ctx); err != nil {
+				failure = err.Error()
+			}
+		}
+		if _, ok := service.(ProviderChecker); ok && failure == "" && n.providerChecks != nil {
+			failure, _ = n.providerChecks.failure(platform)
+		}
+		if failure == "" {
+			return
+		}
+		healthErr.Platforms[platform] = failure
+		if reason, ok := n.lastErrors.get(platform); ok {
+			healthErr.LastErrors[platform] = reason
+		}
+	}
+	for platform, service := range n.serviceByType {
+		check(platform, service)
+	}
+	// The services of the apps are listed as app/platform.
+	for app, services := range n.apps {
+		for platform, service := range services {
+			check(app+"/"+platform, service)
+		}
+	}
+	if len(healthErr.Platforms) > 0 {
+		return healthErr
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package notify
+
+import (
+	"sync"
+	"time"
+)
+
+// targetInterval spaces the notifications sent to the same target by a
+// minimum interval.
+type targetInterval struct {
+	sync.Mutex
+	interval   time.Duration
+	nextSlot   map[string]time.Time
+	lastPruned time.Time
+}
+
+func newTargetInterval(interval time.Duration) *targetInterval {
+	return &targetInterval{
+		interval: interval,
+		nextSlot: make(map[string]time.Time),
+	}
+}
+
+// reserve returns how long a notification to the target has to wait to
+// respect the interval. When reserveSlot is true the wait is booked, so
+// following notifications are spaced after it.
+func (t *targetInterval) reserve(target string, now time.Time, reserveSlot bool) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	t.prune(now)
+
+	slot := now
+	if next, ok := t.nextSlot[target]; ok && next.After(now) {
+		slot = next
+	}
+	if slot.Equal(now) || reserveSlot {
+		t.nextSlot[target] = slot.Add(t.interval)
+	}
+	return slot.Sub(now)
+}
+
+// prune forgets the targets whose interval already passed, at most once per
+// interval.
+func (t *targetInterval) prune(now time.Time) {
+	if now.Sub(t.lastPruned) < t.interval {
+		return
+	}
+	for target, next := range t.nextSlot {
+		if !next.After(now) {
+			delete(t.nextSlot, target)
+		}
+	}
+	t.lastPruned = now
+}
@@ -0,0 +1,135 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrTokenInvalidated is returned without trying the service for the tokens
+// the provider reported as unregistered.
+var ErrTokenInvalidated = NewDeliveryError(ReasonUnregistered, errors.New("token was invalidated by the provider"))
+
+// TokenInvalidation is a token the provider reported as unregistered, e.g.
+// once the app was uninstalled.
+type TokenInvalidation struct {
+	Platform      string    `json:"platform"`
+	App           string    `json:"app,omitempty"`
+	Token         string    `json:"token"`
+	Template      string    `json:"template"`
+	InvalidatedAt time.Time `json:"invalidated_at"`
+}
+
+type invalidTokenKey struct {
+	platform string
+	app      string
+	token    string
+}
+
+// invalidTokens remembers the tokens reported as unregistered for the ttl,
+// failing their notifications right away rather than sending them to the
+// provider again.
+type invalidTokens struct {
+	sync.Mutex
+	ttl    time.Duration
+	tokens map[invalidTokenKey]TokenInvalidation
+}
+
+func newInvalidTokens(ttl time.Duration) *invalidTokens {
+	return &invalidTokens{ttl: ttl, tokens: make(map[invalidTokenKey]TokenInvalidation)}
+}
+
+func invalidTokenKeyOf(request *Notification) invalidTokenKey {
+	return invalidTokenKey{platform: request.Type, app: request.App, token: request.TargetIdentifier}
+}
+
+// has reports whether the token of the notification was invalidated within
+// the ttl. A nil set has no tokens.
+func (t *invalidTokens) has(request *Notification, now time.Time) bool {
+	if t == nil {
+		return false
+	}
+	t.Lock()
+	defer t.Unlock()
+	key := invalidTokenKeyOf(request)
+	invalidation, ok := t.tokens[key]
+	if ok && now.Sub(invalidation.InvalidatedAt) >= t.ttl {
+		delete(t.tokens, key)
+		return false
+	}
+	return ok
+}
+
+func (t *invalidTokens) add(invalidation TokenInvalidation) {
+	if t == nil {
+		return
+	}
+	t.Lock()
+	defer t.Unlock()
+	for key, previous := range t.tokens {
+		if invalidation.InvalidatedAt.Sub(previous.InvalidatedAt) >= t.ttl {
+			delete(t.tokens, key)
+		}
+	}
+	t.tokens[invalidTokenKey{platform: invalidation.Platform, app: invalidation.App, token: invalidation.Token}] = invalidation
+}
+
+// list returns the invalidations, the most recent first.
+func (t *invalidTokens) list() []TokenInvalidation {
+	t.Lock()
+	defer t.Unlock()
+	invalidations := make([]TokenInvalidation, 0, len(t.tokens))
+	for _, invalidation := range t.tokens {
+		invalidations = append(invalidations, invalidation)
+	}
+	sort.Slice(invalidations, func(i, j int) bool {
+		return invalidations[i].InvalidatedAt.After(invalidations[j].InvalidatedAt)
+	})
+	return invalidations
+}
+
+// OnTokenInvalidated registers the hook called when a provider reports the
+// token of a target as unregistered, so the sender can remove it from its
+// store. It must be set before sending notifications.
+func (n *Notifier) OnTokenInvalidated(hook func(invalidation TokenInvalidation)) {
+	n.tokenInvalidated = hook
+}
+
+// InvalidTokens returns the tokens reported as unregistered within the ttl,
+// the most recent first.
+func (n *Notifier) InvalidTokens() ([]TokenInvalidation, error) {
+	if n.invalidTokens == nil {
+		return nil, ErrInvalidTokensDisabled
+	}
+	return n.invalidTokens.list(), nil
+}
+
+// ErrInvalidTokensDisabled is returned when the invalidated tokens are not
+// remembered.
+var ErrInvalidTokensDisabled = errors.New("invalid tokens are not remembered")
+
+// invalidateToken records the token of the notification the provider
+// reported as unregistered and calls the hook. The live subscribers are not a
+// provider, a missing subscriber tells nothing about the token.
+func (n *Notifier) invalidateToken(ctx context.Context, request *Notification, err error) {
+	if Reason(err) != ReasonUnregistered || request.Type == PlatformWebSocket {
+		return
+	}
+	if n.invalidTokens == nil && n.tokenInvalidated == nil {
+		return
+	}
+	n.logFor(ctx, request).Info("token invalidated by the provider")
+	invalidation := TokenInvalidation{
+		Platform:      request.Type,
+		App:           request.App,
+		Token:         request.TargetIdentifier,
+		Template:      request.Template,
+		InvalidatedAt: time.Now(),
+	}
+	n.invalidTokens.add(invalidation)
+	if n.tokenInvalidated != nil {
+		n.tokenInvalidated(invalidation)
+	}
+}
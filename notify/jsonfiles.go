@@ -0,0 +1,122 @@
+package notify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// errInvalidEntryID is returned for the ids that can't name a file of the
+// directory.
+var errInvalidEntryID = errors.New("invalid entry id")
+
+// jsonFiles keeps each entry of a store in a json file of a directory, named
+// after the id of the entry. It backs the persistent schedule, and held the
+// retry queue before it moved to a database.
+type jsonFiles[T any] struct {
+	sync.Mutex
+	dir string
+}
+
+// newJSONFiles returns the files of the directory, which is created when
+// missing.
+func newJSONFiles[T any](dir string) (*jsonFiles[T], error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &jsonFiles[T]{dir: dir}, nil
+}
+
+// path returns the file of the id. The ids may come from the senders, they
+// must not reach other files.
+func (f *jsonFiles[T]) path(id string) (string, error) {
+	if id == "" || strings.ContainsAny(id, `/\.`) {
+		return "", errInvalidEntryID
+	}
+	return filepath.Join(f.dir, id+".json"), nil
+}
+
+// save writes the entry to a temporary file synced to the disk and renamed
+// over the former one, so an entry is never left half written.
+func (f *jsonFiles[T]) save(id string, entry *T) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	tmp := path + ".tmp"
+	if err := writeSynced(tmp, data); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// writeSynced writes the data to the file, returning once it is on the disk.
+func writeSynced(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// all returns the entries of the directory matching the filter. The entries
+// deleted while they are read are skipped.
+func (f *jsonFiles[T]) all(match func(*T) bool) ([]*T, error) {
+	f.Lock()
+	defer f.Unlock()
+	files, err := os.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*T
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(f.dir, file.Name()))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		entry := new(T)
+		if err := json.Unmarshal(data, entry); err != nil {
+			return nil, fmt.Errorf("invalid entry %v: %w", file.Name(), err)
+		}
+		if match(entry) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+// delete removes the entry of the id, returning os.ErrNotExist when there is
+// none.
+func (f *jsonFiles[T]) delete(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return os.ErrNotExist
+	}
+	f.Lock()
+	defer f.Unlock()
+	return os.Remove(path)
+}
@@ -0,0 +1,80 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// PlatformWebSocket is the type of the notifications delivered only to the
+// live subscribers of their target, for clients without a push provider.
+const PlatformWebSocket = "websocket"
+
+var (
+	ErrLiveDisabled     = errors.New("live subscriptions are disabled")
+	ErrNoLiveSubscriber = NewDeliveryError(ReasonUnregistered, errors.New("no live subscriber for the target"))
+)
+
+// liveFeed fans out the notifications to the subscribers of their target.
+// Notifications are dropped for subscribers that don't keep up, so delivery is
+// never slowed down.
+type liveFeed struct {
+	sync.Mutex
+	subscribers map[string]map[chan *Notification]struct{}
+}
+
+func newLiveFeed() *liveFeed {
+	return &liveFeed{subscribers: make(map[string]map[chan *Notification]struct{})}
+}
+
+// publish returns the number of subscribers the notification was sent to.
+func (f *liveFeed) publish(request *Notification) int {
+	f.Lock()
+	defer f.Unlock()
+	published := 0
+	for subscriber := range f.subscribers[request.TargetIdentifier] {
+		select {
+		case subscriber <- request:
+			published++
+		default:
+		}
+	}
+	return published
+}
+
+// liveService delivers the notifications of the websocket type, failing when
+// their target has no live subscriber.
+type liveService struct {
+	feed *liveFeed
+}
+
+func (s *liveService) Send(ctx context.Context, request *Notification) error {
+	if s.feed.publish(request) == 0 {
+		return ErrNoLiveSubscriber
+	}
+	return nil
+}
+
+// SubscribeLive returns a channel receiving the notifications sent to the
+// target, whatever their type, and a function to call once done with it.
+func (n *Notifier) SubscribeLive(target string, buffer int) (<-chan *Notification, func(), error) {
+	if n.live == nil {
+		return nil, nil, ErrLiveDisabled
+	}
+	subscriber := make(chan *Notification, buffer)
+	n.live.Lock()
+	if n.live.subscribers[target] == nil {
+		n.live.subscribers[target] = make(map[chan *Notification]struct{})
+	}
+	n.live.subscribers[target][subscriber] = struct{}{}
+	n.live.Unlock()
+
+	return subscriber, func() {
+		n.live.Lock()
+		delete(n.live.subscribers[target], subscriber)
+		if len(n.live.subscribers[target]) == 0 {
+			delete(n.live.subscribers, target)
+		}
+		n.live.Unlock()
+	}, nil
+}
@@ -0,0 +1,59 @@
+package notify
+
+import (
+	"context"
+
+	"golang.org/x/exp/slog"
+)
+
+type requestIDKey struct{}
+
+// WithRequestID returns a context carrying the id correlating the logs of a
+// request.
+func WithRequestID(ctx context.Context, requestID string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, requestID)
+}
+
+// RequestID returns the id of the request the context belongs to, if any.
+func RequestID(ctx context.Context) string {
+	requestID, _ := ctx.Value(requestIDKey{}).(string)
+	return requestID
+}
+
+// MaskToken keeps the first characters of a token, enough to correlate logs.
+func MaskToken(token string) string {
+	if len(token) <= 8 {
+		return "***"
+	}
+	return token[:8] + "***"
+}
+
+// UseLogger logs the notifications with the given logger instead of the
+// default one. It must be set before sending notifications.
+func (n *Notifier) UseLogger(logger *slog.Logger) {
+	n.logger = logger
+}
+
+// Logger returns the logger of the notifications.
+func (n *Notifier) Logger() *slog.Logger {
+	return n.logger
+}
+
+// logFor returns the logger with the fields of the notification and of the
+// request it was received in, from the notification or else the context. The
+// token is masked.
+func (n *Notifier) logFor(ctx context.Context, request *Notification) *slog.Logger {
+	logger := n.logger.With(
+		"template", request.Template,
+		"platform", request.Type,
+		"token", MaskToken(request.TargetIdentifier),
+	)
+	requestID := request.RequestID
+	if requestID == "" {
+		requestID = RequestID(ctx)
+	}
+	if requestID != "" {
+		logger = logger.With("request_id", requestID)
+	}
+	return logger
+}
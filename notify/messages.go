@@ -0,0 +1,98 @@
+package notify
+
+import (
+	"strings"
+	"text/template"
+
+	"github.com/breez/notify/config"
+	"golang.org/x/exp/slog"
+)
+
+// anyPlatform is the platform key of the message templates applying to the
+// platforms without their own.
+const anyPlatform = "*"
+
+// messageTemplate renders the title and body of a template, either of them
+// being nil when not overridden.
+type messageTemplate struct {
+	title *template.Template
+	body  *template.Template
+}
+
+// parseMessageTemplates parses the message templates per template and
+// platform, skipping the invalid ones which Config.Validate reports.
+func parseMessageTemplates(templates config.MessageTemplates, logger *slog.Logger) map[string]map[string]*messageTemplate {
+	parsed := make(map[string]map[string]*messageTemplate, len(templates))
+	for name, platforms := range templates {
+		parsed[name] = make(map[string]*messageTemplate, len(platforms))
+		for platform, message := range platforms {
+			title, err := parseMessageText(name, message.Title)
+			if err != nil {
+				logger.Error("skipping invalid message template", "template", name, "platform", platform, "error", err)
+				continue
+			}
+			body, err := parseMessageText(name, message.Body)
+			if err != nil {
+				logger.Error("skipping invalid message template", "template", name, "platform", platform, "error", err)
+				continue
+			}
+			parsed[name][platform] = &messageTemplate{title: title, body: body}
+		}
+	}
+	return parsed
+}
+
+// ReloadMessageTemplates replaces the message templates, the notifications
+// being rendered with either the former or the new ones.
+func (n *Notifier) ReloadMessageTemplates(templates config.MessageTemplates) {
+	parsed := parseMessageTemplates(templates, n.logger)
+	n.messageTemplates.Store(&parsed)
+}
+
+// parseMessageText returns nil for an empty text. Missing data keys fail the
+// rendering rather than displaying "<no value>".
+func parseMessageText(name string, text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New(name).Option("missingkey=error").Parse(text)
+}
+
+// renderMessage replaces the display message and body of the notification
+// with its message template, keeping them when the template fails to render,
+// e.g. because the data lacks a field it displays.
+func (n *Notifier) renderMessage(request *Notification) {
+	templates := *n.messageTemplates.Load()
+	message, ok := templates[request.Template][request.Type]
+	if !ok {
+		message, ok = templates[request.Template][anyPlatform]
+	}
+	if !ok {
+		return
+	}
+	title, err := executeMessage(message.title, request, request.DisplayMessage)
+	if err != nil {
+		n.logger.Error("failed to render message template, keeping the display message", "template", request.Template, "platform", request.Type, "error", err)
+		return
+	}
+	body, err := executeMessage(message.body, request, request.Body)
+	if err != nil {
+		n.logger.Error("failed to render message template, keeping the display message", "template", request.Template, "platform", request.Type, "error", err)
+		return
+	}
+	request.DisplayMessage = title
+	request.Body = body
+}
+
+// executeMessage renders the text of the notification, the given value when
+// the text is not overridden.
+func executeMessage(text *template.Template, request *Notification, value string) (string, error) {
+	if text == nil {
+		return value, nil
+	}
+	var rendered strings.Builder
+	if err := text.Execute(&rendered, request); err != nil {
+		return "", err
+	}
+	return rendered.String(), nil
+}
@@ -0,0 +1,74 @@
+package notify
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics counts the delivered notifications and measures their send
+// latency, as well as the latency of each request to the providers and the
+// depth of the delivery queue.
+type Metrics struct {
+	notifications      *prometheus.CounterVec
+	sendLatency        *prometheus.HistogramVec
+	providerLatency    *prometheus.HistogramVec
+	deliveryQueueDepth prometheus.Gauge
+}
+
+// NewMetrics creates the metrics of the notifier and registers them with
+// registerer.
+func NewMetrics(registerer prometheus.Registerer) *Metrics {
+	m := &Metrics{
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "notifications_total",
+			Help: "Notifications sent, by template, platform and result.",
+		}, []string{"template", "platform", "result"}),
+		sendLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "notification_send_duration_seconds",
+			Help:    "Time to deliver a notification to the provider, retries included.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"template", "platform"}),
+		providerLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "provider_request_duration_seconds",
+			Help:    "Time of a send attempt to the provider, by platform and result.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"platform", "result"}),
+		deliveryQueueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "delivery_queue_depth",
+			Help: "Notifications waiting in the delivery queue shared by the instances.",
+		}),
+	}
+	registerer.MustRegister(m.notifications, m.sendLatency, m.providerLatency, m.deliveryQueueDepth)
+	return m
+}
+
+// UseMetrics records the notifications in the metrics. It must be set before
+// sending notifications.
+func (n *Notifier) UseMetrics(metrics *Metrics) {
+	n.metrics = metrics
+}
+
+// observe records a delivered or failed notification. The result is "sent"
+// or the reason of the failure.
+func (m *Metrics) observe(request *Notification, err error, latency time.Duration) {
+	result := "sent"
+	if err != nil {
+		result = string(Reason(err))
+	}
+	m.notifications.WithLabelValues(request.Template, request.Type, result).Inc()
+	m.sendLatency.WithLabelValues(request.Template, request.Type).Observe(latency.Seconds())
+}
+
+// observeAttempt records the latency of a send attempt to the provider of the
+// platform, m may be nil when metrics are disabled.
+func (m *Metrics) observeAttempt(platform string, err error, latency time.Duration) {
+	if m == nil {
+		return
+	}
+	result := "sent"
+	if err != nil {
+		result = string(Reason(err))
+	}
+	m.providerLatency.WithLabelValues(platform, result).Observe(latency.Seconds())
+}
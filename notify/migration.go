@@ -0,0 +1,40 @@
+package notify
+
+import (
+	"context"
+)
+
+// tokenMigrationKey is the context key of the reporter of token migrations
+// passed to the services.
+type tokenMigrationKey struct{}
+
+// ReportTokenMigration is called by the services when the provider replaced
+// the token of the notification being sent with a canonical one.
+func ReportTokenMigration(ctx context.Context, newToken string) {
+	if report, ok := ctx.Value(tokenMigrationKey{}).(func(string)); ok {
+		report(newToken)
+	}
+}
+
+// OnTokenMigrated registers the hook called with the old and the new token of
+// a target when a provider reports the token was replaced, so the sender can
+// update its store. It must be set before sending notifications.
+func (n *Notifier) OnTokenMigrated(hook func(oldToken, newToken string)) {
+	n.tokenMigrated = hook
+}
+
+// withTokenMigration lets the services report the migration of the token of
+// the request through the context, the new token is stored in migrated.
+func (n *Notifier) withTokenMigration(ctx context.Context, request *Notification, migrated *string) context.Context {
+	oldToken := request.TargetIdentifier
+	return context.WithValue(ctx, tokenMigrationKey{}, func(newToken string) {
+		if newToken == "" || newToken == oldToken {
+			return
+		}
+		n.logFor(ctx, request).Info("token of notification migrated", "new_token", MaskToken(newToken))
+		*migrated = newToken
+		if n.tokenMigrated != nil {
+			n.tokenMigrated(oldToken, newToken)
+		}
+	})
+}
@@ -2,66 +2,950 @@ package notify
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"net/url"
+	"sync/atomic"
+	"time"
 
 	"github.com/breez/notify/config"
 	"github.com/golang-queue/queue"
-	"github.com/google/martian/v3/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/exp/slog"
 )
 
 const (
-	NOTIFICATION_PAYMENT_RECEIVED      = "payment_received"
-	NOTIFICATION_TX_CONFIRMED          = "tx_confirmed"
-	NOTIFICATION_ADDRESS_TXS_CONFIRMED = "address_txs_confirmed"
-	NOTIFICATION_LNURLPAY_INFO         = "lnurlpay_info"
-	NOTIFICATION_LNURLPAY_INVOICE      = "lnurlpay_invoice"
-	NOTIFICATION_LNURLPAY_VERIFY       = "lnurlpay_verify"
-	NOTIFICATION_SWAP_UPDATED          = "swap_updated"
-	NOTIFICATION_INVOICE_REQUEST       = "invoice_request"
+	NOTIFICATION_PAYMENT_RECEIVED             = "payment_received"
+	NOTIFICATION_TX_CONFIRMED                 = "tx_confirmed"
+	NOTIFICATION_ADDRESS_TXS_CONFIRMED        = "address_txs_confirmed"
+	NOTIFICATION_LNURLPAY_INFO                = "lnurlpay_info"
+	NOTIFICATION_LNURLPAY_INVOICE             = "lnurlpay_invoice"
+	NOTIFICATION_LNURLPAY_VERIFY              = "lnurlpay_verify"
+	NOTIFICATION_SWAP_UPDATED                 = "swap_updated"
+	NOTIFICATION_LNURL_WITHDRAW               = "lnurl_withdraw"
+	NOTIFICATION_SWAP_REFUNDED                = "swap_refunded"
+	NOTIFICATION_INVOICE_REQUEST              = "invoice_request"
+	NOTIFICATION_DAILY_SUMMARY                = "daily_summary"
+	NOTIFICATION_LIQUID_ASSET_RECEIVED        = "liquid_asset_received"
+	NOTIFICATION_PEGIN_CONFIRMED              = "pegin_confirmed"
+	NOTIFICATION_PEGOUT_CONFIRMED             = "pegout_confirmed"
+	NOTIFICATION_BOLT12_OFFER_INVOICE_REQUEST = "bolt12_offer_invoice_request"
 )
 
+// Priorities of the notifications, high when not set.
+const (
+	PriorityHigh   = "high"
+	PriorityNormal = "normal"
+)
+
+// Push types of the notifications, delivered either as data only pushes
+// waking the app in the background or as visible alerts.
+const (
+	PushBackground = "background"
+	PushAlert      = "alert"
+)
+
+// defaultTemplateTTL is the TTL of the templates awaited by a sender, which
+// are useless once the sender gave up waiting, unless configured otherwise.
+var defaultTemplateTTL = map[string]time.Duration{
+	NOTIFICATION_LNURLPAY_INFO:                time.Minute,
+	NOTIFICATION_LNURLPAY_INVOICE:             time.Minute,
+	NOTIFICATION_LNURLPAY_VERIFY:              time.Minute,
+	NOTIFICATION_LNURL_WITHDRAW:               time.Minute,
+	NOTIFICATION_INVOICE_REQUEST:              time.Minute,
+	NOTIFICATION_BOLT12_OFFER_INVOICE_REQUEST: time.Minute,
+}
+
 var (
-	ErrServiceNotFound = errors.New("Service not found")
+	ErrServiceNotFound      = errors.New("Service not found")
+	ErrSendDeadlineExceeded = errors.New("send deadline exceeded")
+	ErrThrottled            = errors.New("too many notifications waiting to be sent")
+	ErrQueueFull            = errors.New("too many notifications queued")
+	ErrShuttingDown         = errors.New("notifier is shutting down")
 )
 
 type Notification struct {
-	Template         string
-	DisplayMessage   string
-	Type             string
-	TargetIdentifier string
-	AppData          *string
-	Data             map[string]interface{}
+	// ID identifies the notification in the delivery statuses, it is
+	// generated when the notification is sent.
+	ID             string `json:"id,omitempty"`
+	Template       string `json:"template"`
+	DisplayMessage string `json:"display_message"`
+	// Body is the text displayed below the display message, if any.
+	Body             string `json:"body,omitempty"`
+	Type             string `json:"type"`
+	TargetIdentifier string `json:"target_identifier"`
+	// App is the app the target belongs to, among those served by the
+	// notifier, the default one when empty.
+	App string `json:"app,omitempty"`
+	// AppID selects the app of the target among those sharing the platform,
+	// e.g. the bundle id of the apns platform.
+	AppID    string        `json:"app_id,omitempty"`
+	AppData  *string       `json:"app_data,omitempty"`
+	Timezone *string       `json:"timezone,omitempty"`
+	TTL      time.Duration `json:"ttl,omitempty"`
+	// Summary opts the target in the daily summary, aggregating its non
+	// urgent notifications into a single one.
+	Summary bool `json:"summary,omitempty"`
+	// Silent overrides whether the template is delivered as a data only push
+	// when set.
+	Silent *bool   `json:"silent,omitempty"`
+	Action *Action `json:"action,omitempty"`
+	// Category is the notification category the app registered to render the
+	// actions of the notification.
+	Category string `json:"category,omitempty"`
+	// RequestID is the id of the webhook request the notification was
+	// received in, correlating its logs up to the response of the provider.
+	RequestID string `json:"request_id,omitempty"`
+	// EventID is the id of the sender event the notification originates from.
+	EventID string `json:"event_id,omitempty"`
+	// DeliverAt is the time the sender scheduled the notification at, it is
+	// sent right away when nil.
+	DeliverAt *time.Time `json:"deliver_at,omitempty"`
+	// CollapseKey identifies the notifications superseding each other, only
+	// the latest of those arriving within the collapse window is delivered,
+	// and the providers replace the undelivered ones having the same key.
+	CollapseKey string `json:"collapse_key,omitempty"`
+	// Priority is either PriorityHigh, waking the device right away, or
+	// PriorityNormal, letting the device batch the delivery. High when empty.
+	Priority string `json:"priority,omitempty"`
+	// RetryOn overrides the failure reasons the notification is retried on
+	// when set.
+	RetryOn []ErrorReason `json:"retry_on,omitempty"`
+	// TemplateVersion is the version of the template data the client
+	// expects, the current version when zero.
+	TemplateVersion int `json:"template_version,omitempty"`
+	// Capabilities are the registered capabilities of the target, set when
+	// the notification is sent.
+	Capabilities Capabilities `json:"capabilities,omitempty"`
+	// Encrypt is set when the notification is accepted for a target having
+	// an encryption key, the notification being refused rather than sent in
+	// clear when the key is not found at delivery.
+	Encrypt bool `json:"encrypt,omitempty"`
+	// Encrypted is set when the content of the notification was encrypted
+	// to the key of its target, its Data holding the ciphertext.
+	Encrypted bool                   `json:"encrypted,omitempty"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// Action is a call to action button shown along with the notification.
+type Action struct {
+	Label string `json:"label"`
+	Link  string `json:"link"`
+}
+
+// IsUrgent reports whether the template is awaited by a sender and therefore
+// must never be delayed.
+func IsUrgent(template string) bool {
+	switch template {
+	case NOTIFICATION_LNURLPAY_INFO,
+		NOTIFICATION_LNURLPAY_INVOICE,
+		NOTIFICATION_LNURLPAY_VERIFY,
+		NOTIFICATION_LNURL_WITHDRAW,
+		NOTIFICATION_INVOICE_REQUEST,
+		NOTIFICATION_BOLT12_OFFER_INVOICE_REQUEST:
+		return true
+	}
+	return false
 }
 
 type Service interface {
 	Send(context context.Context, req *Notification) error
 }
 
+// Renderer is implemented by services that can build the provider payload of
+// a notification without sending it.
+type Renderer interface {
+	Render(req *Notification) (interface{}, error)
+}
+
+// MessageSender is implemented by services returning the id the provider
+// assigned to the delivered message.
+type MessageSender interface {
+	SendMessage(ctx context.Context, req *Notification) (string, error)
+}
+
+// SendMessage sends the notification through the service, returning the id
+// of the provider message when the service is a MessageSender.
+func SendMessage(ctx context.Context, service Service, req *Notification) (string, error) {
+	if sender, ok := service.(MessageSender); ok {
+		return sender.SendMessage(ctx, req)
+	}
+	return "", service.Send(ctx, req)
+}
+
+// Result is the outcome of a notification sent with NotifyAndWait.
+type Result struct {
+	// MessageID is the id the provider assigned to the message, when known.
+	MessageID string `json:"message_id,omitempty"`
+	// Platform is the type of the service that delivered the notification.
+	Platform string `json:"platform"`
+	// MigratedToken is the canonical token the provider replaced the token
+	// of the target with, the sender should store it.
+	MigratedToken string `json:"migrated_token,omitempty"`
+	// Deferred is set when the notification was not sent right away, as it
+	// is scheduled, collapsed, aggregated in the summary or too frequent.
+	Deferred bool `json:"deferred,omitempty"`
+}
+
+// deliveredFunc is called with the result of a queued notification once it
+// is delivered or failed.
+type deliveredFunc func(result *Result, err error)
+
 type Notifier struct {
 	queue         *queue.Queue
 	serviceByType map[string]Service
+	// apps are the services of the apps served along with the default one,
+	// by app name.
+	apps         map[string]map[string]Service
+	fieldRenames config.FieldRenames
+	deliverAt    config.TemplateHours
+	templateTTL  config.TemplateDurations
+	// templatePushTypes are the default push types per template.
+	templatePushTypes config.TemplateValues
+	// templateCategories are the default categories per template and
+	// platform.
+	templateCategories config.TemplatePlatformValues
+	// stopping is set once Shutdown is called, the notifications being
+	// refused from then on.
+	stopping atomic.Bool
+	// messageTemplates render the display message and body per template and
+	// platform, they are replaced by ReloadMessageTemplates.
+	messageTemplates atomic.Pointer[map[string]map[string]*messageTemplate]
+	// templateDeadline is the time a template has to be sent within, once
+	// queued.
+	templateDeadline config.TemplateDurations
+	// retryAttempts is the number of attempts to send a notification, unless
+	// overridden for its template by templateRetryAttempts.
+	retryAttempts         int
+	templateRetryAttempts config.TemplateLimits
+	retryDelay            time.Duration
+	retryMaxDelay         time.Duration
+	// templateRetryOn overrides per template the failure reasons that are
+	// retried.
+	templateRetryOn config.TemplateLists
+	// retryQueue is nil when failed notifications are not persisted for
+	// later retries.
+	retryQueue         RetryStore
+	retryQueueDelay    time.Duration
+	retryQueueMaxDelay time.Duration
+	retryQueueMaxAge   time.Duration
+	// deliveryQueue is nil when the notifications are only delivered by the
+	// workers of the notifier.
+	deliveryQueue DeliveryQueue
+	// templateSlots bounds the notifications of a template that are queued or
+	// being sent at the same time.
+	templateSlots map[string]chan struct{}
+	// platformThrottles paces the sends per notification type.
+	platformThrottles map[string]*tokenBucket
+	// breakers fail the sends of the failing services fast, per notification
+	// type. It is empty when the circuits are not broken.
+	breakers         map[string]*circuitBreaker
+	breakerThreshold int
+	breakerCooldown  time.Duration
+	// summary is nil when no template is aggregated in daily summaries.
+	summary *summaryBuffer
+	// targetInterval is nil when no minimum interval per target is configured.
+	targetInterval  *targetInterval
+	dropTooFrequent bool
+	// collapse is nil when notifications are not collapsed.
+	collapse *collapseWindow
+	// coalesce is nil when no template is coalesced.
+	coalesce   *coalesceWindow
+	outcomes   outcomeFeed
+	lastErrors lastErrors
+	// providerChecks is nil when the providers are not checked.
+	providerChecks *providerChecks
+	// report is nil when no report window is configured.
+	report *deliveryReport
+	// capabilities is nil when the capability registry is disabled.
+	capabilities CapabilityRegistry
+	// encryptionKeys is nil when the encryption key registry is disabled.
+	encryptionKeys   EncryptionKeyRegistry
+	encryptedMessage string
+	// schedule keeps the notifications scheduled by the senders, when
+	// scheduling is enabled, and those held back.
+	schedule         ScheduleStore
+	scheduling       bool
+	scheduleMaxDelay time.Duration
+	// devices is nil when the device registry is disabled.
+	devices DeviceStore
+	// statuses is nil when the delivery statuses are not tracked.
+	statuses StatusStore
+	// live is nil when the live subscriptions are disabled.
+	live *liveFeed
+	// tokenMigrated is nil when no hook is registered.
+	tokenMigrated func(oldToken, newToken string)
+	// invalidTokens is nil when the invalidated tokens are not remembered.
+	invalidTokens *invalidTokens
+	// tokenInvalidated is nil when no hook is registered.
+	tokenInvalidated func(invalidation TokenInvalidation)
+	// metrics is nil when the notifications are not measured.
+	metrics *Metrics
+	// templateVersions are the data builders of the former template versions.
+	templateVersions map[string]map[int]DataBuilder
+	logger           *slog.Logger
 }
 
 func NewNotifier(config *config.Config, services map[string]Service) *Notifier {
-	q := queue.NewPool(config.WorkersNum)
-	return &Notifier{
-		queue:         q,
-		serviceByType: services,
+	var queueOptions []queue.Option
+	if config.QueueSize > 0 {
+		queueOptions = append(queueOptions, queue.WithQueueSize(config.QueueSize))
+	}
+	q := queue.NewPool(config.WorkersNum, queueOptions...)
+	templateSlots := make(map[string]chan struct{}, len(config.TemplateConcurrency))
+	for template, limit := range config.TemplateConcurrency {
+		templateSlots[template] = make(chan struct{}, limit)
+	}
+	templateTTL := make(map[string]time.Duration, len(defaultTemplateTTL)+len(config.TemplateTTL))
+	for template, ttl := range defaultTemplateTTL {
+		templateTTL[template] = ttl
 	}
+	for template, ttl := range config.TemplateTTL {
+		templateTTL[template] = ttl
+	}
+	platformThrottles := make(map[string]*tokenBucket, len(config.PlatformRates))
+	for platform, rate := range config.PlatformRates {
+		platformThrottles[platform] = newTokenBucket(rate, config.PlatformBursts[platform], config.ThrottleQueueSize)
+	}
+	notifier := &Notifier{
+		queue:                 q,
+		serviceByType:         services,
+		fieldRenames:          config.FieldRenames,
+		deliverAt:             config.DeliverAtLocalHour,
+		templateTTL:           templateTTL,
+		templatePushTypes:     config.TemplatePushTypes,
+		templateCategories:    config.TemplateCategories,
+		templateDeadline:      config.TemplateDeadline,
+		templateSlots:         templateSlots,
+		platformThrottles:     platformThrottles,
+		retryAttempts:         config.RetryAttempts,
+		templateRetryAttempts: config.TemplateRetryAttempts,
+		retryDelay:            config.RetryDelay,
+		retryMaxDelay:         config.RetryMaxDelay,
+		templateRetryOn:       config.TemplateRetryOn,
+		retryQueueDelay:       config.RetryQueueDelay,
+		retryQueueMaxDelay:    config.RetryQueueMaxDelay,
+		retryQueueMaxAge:      config.RetryQueueMaxAge,
+		logger:                slog.Default(),
+	}
+	notifier.ReloadMessageTemplates(config.MessageTemplates)
+	if len(config.SummaryTemplates) > 0 {
+		notifier.summary = newSummaryBuffer(config.SummaryTemplates, config.SummaryHour, notifier, notifier.logFor)
+	}
+	if config.ReportWindow > 0 {
+		notifier.report = newDeliveryReport(config.ReportWindow)
+	}
+	if config.CollapseWindow > 0 {
+		notifier.collapse = newCollapseWindow(config.CollapseWindow, notifier, notifier.logFor)
+	}
+	if len(config.CoalesceWindow) > 0 {
+		notifier.coalesce = newCoalesceWindow(config.CoalesceWindow, config.CoalesceMessages, notifier, notifier.logFor)
+	}
+	if config.ProviderCheckInterval > 0 {
+		notifier.providerChecks = &providerChecks{interval: config.ProviderCheckInterval}
+	}
+	if config.CapabilityRegistry {
+		notifier.capabilities = newMemoryCapabilities()
+	}
+	if config.EncryptionKeyRegistry {
+		notifier.encryptionKeys = newMemoryEncryptionKeys()
+		notifier.encryptedMessage = config.EncryptedMessage
+		if notifier.encryptedMessage == "" {
+			notifier.encryptedMessage = defaultEncryptedMessage
+		}
+	}
+	notifier.schedule = newMemorySchedule()
+	if config.Scheduling {
+		notifier.scheduling = true
+		notifier.scheduleMaxDelay = config.ScheduleMaxDelay
+	}
+	if config.DeviceRegistry {
+		notifier.devices = newMemoryDevices()
+	}
+	if config.DeliveryStatus {
+		notifier.statuses = newMemoryStatuses(config.DeliveryStatusMaxEntries)
+	}
+	if config.BreakerThreshold > 0 {
+		notifier.breakers = make(map[string]*circuitBreaker, len(notifier.serviceByType))
+		notifier.breakerThreshold, notifier.breakerCooldown = config.BreakerThreshold, config.BreakerCooldown
+		for serviceType := range notifier.serviceByType {
+			notifier.breakers[serviceType] = newCircuitBreaker(serviceType, config.BreakerThreshold, config.BreakerCooldown, notifier.Logger)
+		}
+	}
+	if config.LiveSubscriptions {
+		notifier.live = newLiveFeed()
+		// The services of the caller are left as they are.
+		notifier.serviceByType = make(map[string]Service, len(services)+1)
+		for serviceType, service := range services {
+			notifier.serviceByType[serviceType] = service
+		}
+		if _, ok := services[PlatformWebSocket]; !ok {
+			notifier.serviceByType[PlatformWebSocket] = &liveService{feed: notifier.live}
+		}
+	}
+	if config.InvalidTokenTTL > 0 {
+		notifier.invalidTokens = newInvalidTokens(config.InvalidTokenTTL)
+	}
+	if config.MinTargetInterval > 0 {
+		notifier.targetInterval = newTargetInterval(config.MinTargetInterval)
+		notifier.dropTooFrequent = config.DropTooFrequent
+	}
+	return notifier
 }
 
+// Notify queues the notification, returning once it is queued.
 func (n *Notifier) Notify(c context.Context, request *Notification) error {
-	return n.queue.QueueTask(func(ctx context.Context) error {
-		service, ok := n.serviceByType[request.Type]
-		if !ok {
-			log.Errorf("could not find service %+v %v", request.Type)
-			return ErrServiceNotFound
-		}
-		if err := service.Send(c, request); err != nil {
-			log.Errorf("failed to send notification %+v %v", request, err)
+	_, err := n.notify(c, request, nil)
+	return err
+}
+
+// NotifyAndWait queues the notification and waits for its delivery, returning
+// the provider message id and the platform that delivered it. Notifications
+// that are not sent right away are returned as deferred.
+func (n *Notifier) NotifyAndWait(c context.Context, request *Notification) (*Result, error) {
+	type delivery struct {
+		result *Result
+		err    error
+	}
+	delivered := make(chan delivery, 1)
+	deferred, err := n.notify(c, request, func(result *Result, err error) {
+		delivered <- delivery{result: result, err: err}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if deferred {
+		return &Result{Platform: request.Type, Deferred: true}, nil
+	}
+
+	select {
+	case d := <-delivered:
+		return d.result, d.err
+	case <-c.Done():
+		return nil, c.Err()
+	}
+}
+
+// notify dispatches the notification unless it is aggregated in the summary,
+// coalesced or collapsed, returning whether it was deferred. The notification is given
+// an id when it has none.
+func (n *Notifier) notify(c context.Context, request *Notification, onDelivered deliveredFunc) (bool, error) {
+	if n.stopping.Load() {
+		return false, ErrShuttingDown
+	}
+	if _, err := n.service(request, request.Type); err != nil {
+		return false, err
+	}
+	if _, err := n.versionBuilder(request); err != nil {
+		return false, err
+	}
+	if err := n.requireEncryption(request); err != nil {
+		return false, err
+	}
+	if request.ID == "" {
+		request.ID = newNotificationID()
+	}
+	// The status is queued first, as the delivery may complete before
+	// dispatch returns.
+	n.setStatus(request, StatusQueued, nil, nil)
+	deferred, err := n.aggregate(c, request, onDelivered)
+	if err != nil {
+		n.setStatus(request, StatusFailed, nil, err)
+	}
+	return deferred, err
+}
+
+// aggregate holds the notification back in the summary, coalesce or collapse
+// window it belongs to, dispatching it otherwise.
+func (n *Notifier) aggregate(c context.Context, request *Notification, onDelivered deliveredFunc) (bool, error) {
+	now := time.Now()
+	if n.summary != nil {
+		held, err := n.summary.add(request, now)
+		if held {
+			n.setStatus(request, StatusSummarized, nil, nil)
+		}
+		if held || err != nil {
+			return held, err
+		}
+	}
+	if n.coalesce != nil {
+		held, folded, err := n.coalesce.add(request, now)
+		if folded != nil {
+			n.setStatus(folded, StatusCoalesced, nil, nil)
+		}
+		if held || err != nil {
+			return held, err
+		}
+	}
+	if n.collapse != nil {
+		held, replaced, err := n.collapse.add(request, now)
+		if replaced != nil {
+			n.setStatus(replaced, StatusCollapsed, nil, nil)
+		}
+		if held || err != nil {
+			return held, err
+		}
+	}
+	return n.dispatch(c, request, onDelivered)
+}
+
+// dispatch enqueues the notification, once held back for the local delivery
+// hour or the minimum interval of its target when needed. It returns whether
+// the notification was held back or dropped.
+func (n *Notifier) dispatch(c context.Context, request *Notification, onDelivered deliveredFunc) (bool, error) {
+	if delay, ok := n.scheduleDelay(request, time.Now()); ok {
+		n.logFor(c, request).Info("scheduling notification", "delay", delay)
+		return true, n.delay(request, time.Now().Add(delay))
+	}
+
+	// Notifications awaited by a sender are never held back, but still count
+	// for the interval of the following ones.
+	if n.targetInterval != nil {
+		reserveSlot := IsUrgent(request.Template) || !n.dropTooFrequent
+		delay := n.targetInterval.reserve(request.TargetIdentifier, time.Now(), reserveSlot)
+		if delay > 0 && !IsUrgent(request.Template) {
+			if n.dropTooFrequent {
+				n.logFor(c, request).Info("dropping notification, target was notified too recently")
+				n.setStatus(request, StatusDropped, nil, nil)
+				return true, nil
+			}
+			n.logFor(c, request).Info("delaying notification, target was notified too recently", "delay", delay)
+			return true, n.delay(request, time.Now().Add(delay))
+		}
+	}
+
+	return false, n.enqueue(c, request, onDelivered)
+}
+
+// delay holds the notification back in the schedule until the given time,
+// it is then queued. It can be cancelled meanwhile by its id.
+func (n *Notifier) delay(request *Notification, deliverAt time.Time) error {
+	if err := n.hold(&ScheduledEntry{Notification: request, DeliverAt: deliverAt, Stage: stageDelayed}, ""); err != nil {
+		return err
+	}
+	n.setStatus(request, StatusScheduled, nil, nil)
+	return nil
+}
+
+// enqueue queues the notification for delivery, calling onDelivered, when not
+// nil, with the result of the delivery.
+func (n *Notifier) enqueue(c context.Context, request *Notification, onDelivered deliveredFunc) error {
+	// The notifications nobody waits for may be delivered by any instance.
+	if n.deliveryQueue != nil && onDelivered == nil {
+		return n.deliveryQueue.Push(c, request)
+	}
+	enqueuedAt := time.Now()
+
+	if throttle, ok := n.platformThrottles[request.Type]; ok {
+		if err := throttle.wait(c); err != nil {
 			return err
 		}
-		log.Infof("succeed to send notification %+v", request)
-		return nil
+	}
+
+	// Wait for a free slot of the template before taking a worker, so a busy
+	// template can't occupy the whole pool.
+	slots, limited := n.templateSlots[request.Template]
+	if limited {
+		select {
+		case slots <- struct{}{}:
+		case <-c.Done():
+			return c.Err()
+		}
+	}
+	release := func() {
+		if limited {
+			<-slots
+		}
+	}
+
+	err := n.queue.QueueTask(func(ctx context.Context) error {
+		defer release()
+		startedAt := time.Now()
+		result, err := n.deliver(c, request, enqueuedAt, false)
+		n.record(request, result, err, startedAt)
+		// The sender is told the notification is deferred once it is
+		// persisted for a later retry.
+		if err != nil && n.persistRetry(c, request, err) {
+			result, err = &Result{Platform: request.Type, Deferred: true}, nil
+		}
+		if onDelivered != nil {
+			onDelivered(result, err)
+		}
+		return err
 	})
+	if err != nil {
+		release()
+		if errors.Is(err, queue.ErrQueueShutdown) {
+			err = ErrShuttingDown
+		} else {
+			err = ErrQueueFull
+		}
+	}
+	return err
+}
+
+// record measures and publishes the outcome of a delivery started at the
+// given time.
+func (n *Notifier) record(request *Notification, result *Result, err error, startedAt time.Time) {
+	if err != nil {
+		n.setStatus(request, StatusFailed, result, err)
+	} else {
+		n.setStatus(request, StatusSent, result, nil)
+	}
+	if n.metrics != nil {
+		n.metrics.observe(request, err, time.Since(startedAt))
+	}
+	outcome := newOutcome(request, err)
+	n.lastErrors.record(outcome)
+	if n.report != nil {
+		n.report.add(outcome)
+	}
+	n.outcomes.publish(outcome)
+}
+
+// deliver sends a queued notification through the service of its type,
+// within the deadline of its template. retried is set on the attempts of the
+// retry queue, the live subscribers having got the notification on the first
+// one.
+func (n *Notifier) deliver(c context.Context, request *Notification, enqueuedAt time.Time, retried bool) (result *Result, err error) {
+	c, span := tracer.Start(c, "deliver", trace.WithAttributes(
+		attribute.String("template", request.Template),
+		attribute.String("platform", request.Type),
+		attribute.String("app", request.App),
+	))
+	defer func() { endSpan(span, err) }()
+
+	service, err := n.service(request, request.Type)
+	if err != nil {
+		n.logFor(c, request).Error("could not find service")
+		return nil, err
+	}
+	request, err = n.resolve(request)
+	if err != nil {
+		n.logFor(c, request).Error("refusing to send notification", "error", err)
+		return nil, err
+	}
+	var migratedToken string
+	sendCtx := n.withTokenMigration(c, request, &migratedToken)
+	if deadline, ok := n.templateDeadline[request.Template]; ok {
+		if time.Since(enqueuedAt) > deadline {
+			n.logFor(c, request).Error("dropping notification, not sent within its deadline", "deadline", deadline)
+			return nil, ErrSendDeadlineExceeded
+		}
+		var cancel context.CancelFunc
+		sendCtx, cancel = context.WithDeadline(sendCtx, enqueuedAt.Add(deadline))
+		defer cancel()
+	}
+	// The live subscribers of the target get the notification along with its
+	// device, once.
+	if n.live != nil && request.Type != PlatformWebSocket && !retried {
+		n.live.publish(request)
+	}
+	if result, ok := n.sendPreferred(sendCtx, request); ok {
+		result.MigratedToken = migratedToken
+		return result, nil
+	}
+	messageID, err := n.sendWithRetry(sendCtx, service, request, enqueuedAt)
+	if err != nil {
+		return nil, err
+	}
+	n.logFor(c, request).Info("succeed to send notification", "message_id", messageID)
+	return &Result{MessageID: messageID, Platform: request.Type, MigratedToken: migratedToken}, nil
+}
+
+// sendPreferred tries the service the sender prefers for the notification, if
+// any, returning whether it was sent. Failures are not retried so the
+// notification falls back to its own type quickly.
+func (n *Notifier) sendPreferred(ctx context.Context, request *Notification) (*Result, bool) {
+	preferred := preferredType(request)
+	if preferred == "" || preferred == request.Type {
+		return nil, false
+	}
+	service, err := n.service(request, preferred)
+	if err != nil {
+		return nil, false
+	}
+
+	typed := *request
+	typed.Type = preferred
+	startedAt := time.Now()
+	sendCtx, span := tracer.Start(ctx, "send "+preferred, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.Bool("preferred", true)))
+	messageID, err := SendMessage(sendCtx, service, &typed)
+	endSpan(span, err)
+	n.metrics.observeAttempt(preferred, err, time.Since(startedAt))
+	if err != nil {
+		n.logFor(ctx, request).Info("failed to send notification through preferred platform, falling back", "preferred", preferred, "error", err)
+		return nil, false
+	}
+	n.logFor(ctx, request).Info("succeed to send notification through preferred platform", "preferred", preferred, "message_id", messageID)
+	return &Result{MessageID: messageID, Platform: preferred}, true
+}
+
+// preferredType returns the service type hinted by the "prefer" field of
+// AppData, either a json object or a query string.
+func preferredType(request *Notification) string {
+	if request.AppData == nil {
+		return ""
+	}
+	var appData struct {
+		Prefer string `json:"prefer"`
+	}
+	if err := json.Unmarshal([]byte(*request.AppData), &appData); err == nil {
+		return appData.Prefer
+	}
+	values, err := url.ParseQuery(*request.AppData)
+	if err != nil {
+		return ""
+	}
+	return values.Get("prefer")
+}
+
+// retryable returns whether a failure of the notification with the given
+// reason is retried, following the reasons of the notification, then of its
+// template, then the default classification.
+func (n *Notifier) retryable(request *Notification, reason ErrorReason) bool {
+	if request.RetryOn != nil {
+		for _, r := range request.RetryOn {
+			if r == reason {
+				return true
+			}
+		}
+		return false
+	}
+	if reasons, ok := n.templateRetryOn[request.Template]; ok {
+		for _, r := range reasons {
+			if ErrorReason(r) == reason {
+				return true
+			}
+		}
+		return false
+	}
+	return Retryable(reason)
+}
+
+// backoff returns the delay before the next attempt, doubling the retry delay
+// after each failed attempt up to the maximum delay.
+func (n *Notifier) backoff(attempt int) time.Duration {
+	return exponentialBackoff(n.retryDelay, n.retryMaxDelay, attempt)
+}
+
+// exponentialBackoff doubles the delay after each attempt, up to the maximum
+// delay when it is not zero.
+func exponentialBackoff(delay time.Duration, maxDelay time.Duration, attempt int) time.Duration {
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if maxDelay > 0 && delay >= maxDelay {
+			return maxDelay
+		}
+	}
+	return delay
+}
+
+// sendWithRetry sends the notification, retrying retryable failures with an
+// exponential backoff up to the number of attempts of its template.
+// Notifications are not retried past their TTL as they would be stale. It
+// returns the id of the provider message.
+func (n *Notifier) sendWithRetry(ctx context.Context, service Service, request *Notification, queuedAt time.Time) (string, error) {
+	attempts := n.retryAttempts
+	if templateAttempts, ok := n.templateRetryAttempts[request.Template]; ok {
+		attempts = templateAttempts
+	}
+
+	breaker := n.breakers[breakerKey(request)]
+	for attempt := 1; ; attempt++ {
+		// The failure is left to the retry queue rather than waiting for the
+		// service to recover.
+		if n.invalidTokens.has(request, time.Now()) {
+			n.logFor(ctx, request).Info("not sending notification, token was invalidated")
+			return "", ErrTokenInvalidated
+		}
+		if !breaker.allow(time.Now()) {
+			n.logFor(ctx, request).Info("not sending notification, circuit is open")
+			return "", ErrCircuitOpen
+		}
+		startedAt := time.Now()
+		sendCtx, span := tracer.Start(ctx, "send "+request.Type, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attribute.Int("attempt", attempt)))
+		messageID, err := SendMessage(sendCtx, service, request)
+		endSpan(span, err)
+		breaker.record(err, time.Now())
+		n.metrics.observeAttempt(request.Type, err, time.Since(startedAt))
+		if err == nil {
+			return messageID, nil
+		}
+		logger := n.logFor(ctx, request)
+		logger.Error("failed to send notification", "attempt", attempt, "reason", Reason(err), "error", err)
+		n.invalidateToken(ctx, request, err)
+		if attempt >= attempts {
+			return "", err
+		}
+		if !n.retryable(request, Reason(err)) {
+			logger.Info("not retrying notification", "reason", Reason(err))
+			return "", err
+		}
+		delay := n.backoff(attempt)
+		if request.TTL > 0 && time.Since(queuedAt)+delay > request.TTL {
+			logger.Info("not retrying notification past its ttl")
+			return "", err
+		}
+		n.setStatus(request, StatusRetrying, nil, err)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return "", err
+		}
+	}
+}
+
+// Render resolves the notification as it would be delivered and builds the
+// provider payload of its service, when the service supports rendering.
+func (n *Notifier) Render(request *Notification) (*Notification, interface{}, error) {
+	service, err := n.service(request, request.Type)
+	if err != nil {
+		return nil, nil, err
+	}
+	request, err = n.resolve(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	renderer, ok := service.(Renderer)
+	if !ok {
+		return request, nil, nil
+	}
+	payload, err := renderer.Render(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	return request, payload, nil
+}
+
+// Preview is a notification rendered for a single service type.
+type Preview struct {
+	Notification *Notification `json:"notification,omitempty"`
+	Payload      interface{}   `json:"payload,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// RenderAll renders the notification for every service type of the notifier,
+// regardless of the notification type.
+func (n *Notifier) RenderAll(request *Notification) map[string]*Preview {
+	previews := make(map[string]*Preview, len(n.serviceByType))
+	for serviceType := range n.serviceByType {
+		typed := *request
+		typed.Type = serviceType
+		resolved, payload, err := n.Render(&typed)
+		if err != nil {
+			previews[serviceType] = &Preview{Error: err.Error()}
+			continue
+		}
+		previews[serviceType] = &Preview{Notification: resolved, Payload: payload}
+	}
+	return previews
+}
+
+// resolve returns a copy of the notification with the configuration of its
+// template applied, as it should be delivered. It fails when the content
+// can't be encrypted as required.
+func (n *Notifier) resolve(request *Notification) (*Notification, error) {
+	resolved := *request
+	if ttl, ok := n.templateTTL[request.Template]; ok && request.TTL == 0 {
+		resolved.TTL = ttl
+	}
+	if pushType, ok := n.templatePushTypes[request.Template]; ok && request.Silent == nil {
+		silent := pushType == PushBackground
+		resolved.Silent = &silent
+	}
+	if category, ok := n.templateCategories[request.Template][request.Type]; ok && request.Category == "" {
+		resolved.Category = category
+	}
+	if builder, _ := n.versionBuilder(request); builder != nil {
+		resolved.Data = builder(request.Data)
+	}
+	if renames := n.fieldRenames[request.Template]; len(renames) > 0 {
+		resolved.Data = renameFields(resolved.Data, renames)
+	}
+	n.renderMessage(&resolved)
+	if n.capabilities != nil {
+		if capabilities, ok := n.capabilities.Capabilities(request.Type, request.TargetIdentifier); ok {
+			tailor(&resolved, capabilities)
+		}
+	}
+	key, err := n.encryptionKey(request)
+	if err != nil {
+		return request, err
+	}
+	if key != nil {
+		// The content is never sent in clear to a target expecting it
+		// encrypted.
+		if err := encrypt(&resolved, key, n.encryptedMessage); err != nil {
+			n.logFor(context.Background(), request).Error("failed to encrypt notification, dropping its content", "error", err)
+			resolved.DisplayMessage, resolved.Body, resolved.Action, resolved.Data = n.encryptedMessage, "", nil, nil
+		}
+	}
+	return &resolved, nil
+}
+
+// renameFields returns a copy of data with its keys renamed.
+func renameFields(data map[string]interface{}, renames map[string]string) map[string]interface{} {
+	renamed := make(map[string]interface{}, len(data))
+	for key, value := range data {
+		if newKey, ok := renames[key]; ok {
+			key = newKey
+		}
+		renamed[key] = value
+	}
+	return renamed
+}
+
+// scheduleDelay returns how long the notification should be held back to be
+// delivered at the configured local hour of the device timezone.
+func (n *Notifier) scheduleDelay(request *Notification, now time.Time) (time.Duration, bool) {
+	if IsUrgent(request.Template) {
+		return 0, false
+	}
+	hour, ok := n.deliverAt[request.Template]
+	if !ok {
+		return 0, false
+	}
+	location, err := deviceLocation(request)
+	if err != nil {
+		n.logFor(context.Background(), request).Debug("invalid device timezone", "error", err)
+	}
+	if location == nil {
+		return 0, false
+	}
+	return untilLocalHour(now, location, hour), true
+}
+
+// untilLocalHour returns the duration until the next occurrence of the hour
+// in the location.
+func untilLocalHour(now time.Time, location *time.Location, hour int) time.Duration {
+	local := now.In(location)
+	next := time.Date(local.Year(), local.Month(), local.Day(), hour, 0, 0, 0, location)
+	if !next.After(local) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next.Sub(local)
+}
+
+// deviceLocation resolves the device timezone from the notification, falling
+// back to a "timezone" field when AppData is a json object. The location is
+// nil when the timezone is unknown or invalid.
+func deviceLocation(request *Notification) (*time.Location, error) {
+	var timezone string
+	if request.Timezone != nil {
+		timezone = *request.Timezone
+	} else if request.AppData != nil {
+		var appData struct {
+			Timezone string `json:"timezone"`
+		}
+		if err := json.Unmarshal([]byte(*request.AppData), &appData); err == nil {
+			timezone = appData.Timezone
+		}
+	}
+	if timezone == "" {
+		return nil, nil
+	}
+	return time.LoadLocation(timezone)
 }
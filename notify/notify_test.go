@@ -1,10 +1,22 @@
 package notify
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/alicebob/miniredis/v2"
 	"github.com/breez/notify/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/exp/slog"
 	"gotest.tools/v3/assert"
 )
 
@@ -39,3 +51,1262 @@ func TestNotify(t *testing.T) {
 	assert.Assert(t, len(notifications) == 1)
 	assert.DeepEqual(t, notifications[0], n)
 }
+
+func TestNotifyRenamesFields(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{
+		WorkersNum: 2,
+		FieldRenames: map[string]map[string]string{
+			"t1": {"tx_id": "txid"},
+		},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	n := Notification{
+		Template:         "t1",
+		Type:             "test",
+		TargetIdentifier: "token1",
+		Data:             map[string]interface{}{"tx_id": "1234", "other": "value"},
+	}
+	notifier.Notify(context.Background(), &n)
+
+	res := <-service.sentQueue
+	assert.DeepEqual(t, res.Data, map[string]interface{}{"txid": "1234", "other": "value"})
+	assert.DeepEqual(t, n.Data, map[string]interface{}{"tx_id": "1234", "other": "value"})
+}
+
+func TestScheduleDelay(t *testing.T) {
+	config := &config.Config{
+		WorkersNum:         1,
+		DeliverAtLocalHour: map[string]int{NOTIFICATION_TX_CONFIRMED: 9, NOTIFICATION_LNURLPAY_INFO: 9},
+	}
+	notifier := NewNotifier(config, map[string]Service{})
+	timezone := "America/New_York"
+	now := time.Date(2023, 5, 1, 15, 0, 0, 0, time.UTC) // 11:00 in New York
+
+	delay, ok := notifier.scheduleDelay(&Notification{Template: NOTIFICATION_TX_CONFIRMED, Timezone: &timezone}, now)
+	assert.Assert(t, ok)
+	assert.Equal(t, delay, 22*time.Hour)
+
+	appData := `{"timezone":"America/New_York"}`
+	_, ok = notifier.scheduleDelay(&Notification{Template: NOTIFICATION_TX_CONFIRMED, AppData: &appData}, now)
+	assert.Assert(t, ok)
+
+	_, ok = notifier.scheduleDelay(&Notification{Template: NOTIFICATION_LNURLPAY_INFO, Timezone: &timezone}, now)
+	assert.Assert(t, !ok)
+
+	_, ok = notifier.scheduleDelay(&Notification{Template: NOTIFICATION_TX_CONFIRMED}, now)
+	assert.Assert(t, !ok)
+
+	// The notification is held in the schedule until the local hour, and can
+	// be cancelled meanwhile.
+	notifier = NewNotifier(config, map[string]Service{"test": newTestService()})
+	request := &Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", Timezone: &timezone}
+	assert.NilError(t, notifier.Notify(context.Background(), request))
+	entries, err := notifier.schedule.Due(time.Now().Add(24 * time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Stage, stageDelayed)
+	assert.Equal(t, entries[0].Notification.ID, request.ID)
+	assert.NilError(t, notifier.CancelScheduled(request.ID))
+}
+
+func TestNotifyAppliesTemplateTTL(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{
+		WorkersNum:  2,
+		TemplateTTL: map[string]time.Duration{"t1": 30 * time.Second},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"})
+
+	res := <-service.sentQueue
+	assert.Equal(t, res.TTL, 30*time.Second)
+
+	// A TTL set on the notification takes precedence over the template one.
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1", TTL: time.Minute})
+	res = <-service.sentQueue
+	assert.Equal(t, res.TTL, time.Minute)
+}
+
+func TestNotifyAppliesTemplateCategory(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{
+		WorkersNum:         1,
+		TemplateCategories: map[string]map[string]string{"t1": {"test": "T1_ACTIONS"}},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"})
+	assert.Equal(t, (<-service.sentQueue).Category, "T1_ACTIONS")
+
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", Category: "CUSTOM"})
+	assert.Equal(t, (<-service.sentQueue).Category, "CUSTOM")
+}
+
+func TestNotifyAppliesTemplatePushType(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{
+		WorkersNum:        1,
+		TemplatePushTypes: map[string]string{"t1": PushBackground, "t2": PushAlert},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"})
+	assert.Equal(t, *(<-service.sentQueue).Silent, true)
+	notifier.Notify(context.Background(), &Notification{Template: "t2", Type: "test"})
+	assert.Equal(t, *(<-service.sentQueue).Silent, false)
+
+	alert := false
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", Silent: &alert})
+	assert.Equal(t, *(<-service.sentQueue).Silent, false)
+	notifier.Notify(context.Background(), &Notification{Template: "t3", Type: "test"})
+	assert.Assert(t, (<-service.sentQueue).Silent == nil)
+}
+
+func TestNotifyRendersMessageTemplates(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{
+		WorkersNum: 1,
+		MessageTemplates: map[string]map[string]config.MessageTemplate{
+			"t1": {
+				"*":    {Body: "Receiving {{.Data.amount_sat}} sats"},
+				"test": {Title: "{{.DisplayMessage}}!", Body: "{{.Data.amount_sat}} sats on the way"},
+			},
+			"t2": {"*": {Body: "Receiving {{.Data.amount_sat}} sats"}},
+		},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", DisplayMessage: "Receiving payment",
+		Data: map[string]interface{}{"amount_sat": 1000}})
+	res := <-service.sentQueue
+	assert.Equal(t, res.DisplayMessage, "Receiving payment!")
+	assert.Equal(t, res.Body, "1000 sats on the way")
+
+	notifier.Notify(context.Background(), &Notification{Template: "t2", Type: "test", DisplayMessage: "Receiving payment",
+		Data: map[string]interface{}{"amount_sat": 1000}})
+	res = <-service.sentQueue
+	assert.Equal(t, res.DisplayMessage, "Receiving payment")
+	assert.Equal(t, res.Body, "Receiving 1000 sats")
+
+	// The message is kept when the data lacks a field of the template.
+	notifier.Notify(context.Background(), &Notification{Template: "t2", Type: "test", DisplayMessage: "Receiving payment"})
+	res = <-service.sentQueue
+	assert.Equal(t, res.DisplayMessage, "Receiving payment")
+	assert.Equal(t, res.Body, "")
+
+	// The reloaded templates replace all the former ones.
+	templates := config.MessageTemplates
+	delete(templates, "t1")
+	message := templates["t2"]["*"]
+	message.Body = "{{.Data.amount_sat}} sats"
+	templates["t2"]["*"] = message
+	notifier.ReloadMessageTemplates(templates)
+	notifier.Notify(context.Background(), &Notification{Template: "t2", Type: "test", DisplayMessage: "Receiving payment",
+		Data: map[string]interface{}{"amount_sat": 1000}})
+	res = <-service.sentQueue
+	assert.Equal(t, res.Body, "1000 sats")
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", DisplayMessage: "Receiving payment",
+		Data: map[string]interface{}{"amount_sat": 1000}})
+	res = <-service.sentQueue
+	assert.Equal(t, res.DisplayMessage, "Receiving payment")
+	assert.Equal(t, res.Body, "")
+}
+
+type blockingService struct {
+	started chan struct{}
+	release chan struct{}
+}
+
+func (b *blockingService) Send(c context.Context, notification *Notification) error {
+	b.started <- struct{}{}
+	<-b.release
+	return nil
+}
+
+func TestNotifyTemplateConcurrency(t *testing.T) {
+	service := &blockingService{started: make(chan struct{}, 10), release: make(chan struct{})}
+	config := &config.Config{
+		WorkersNum:          2,
+		TemplateConcurrency: map[string]int{"t1": 1},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}))
+	<-service.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := notifier.Notify(ctx, &Notification{Template: "t1", Type: "test"})
+	assert.Equal(t, err, context.DeadlineExceeded)
+
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "t2", Type: "test"}))
+	<-service.started
+	close(service.release)
+}
+
+func TestNotifyQueueFull(t *testing.T) {
+	service := &blockingService{started: make(chan struct{}, 10), release: make(chan struct{})}
+	notifier := NewNotifier(&config.Config{WorkersNum: 1, QueueSize: 1}, map[string]Service{"test": service})
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}))
+	<-service.started
+
+	// One notification waits for the busy worker, the next one is rejected.
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}))
+	assert.ErrorIs(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}), ErrQueueFull)
+	close(service.release)
+	<-service.started
+}
+
+func TestTargetInterval(t *testing.T) {
+	interval := newTargetInterval(time.Minute)
+	now := time.Now()
+
+	assert.Equal(t, interval.reserve("t1", now, true), time.Duration(0))
+	assert.Equal(t, interval.reserve("t1", now.Add(10*time.Second), true), 50*time.Second)
+	assert.Equal(t, interval.reserve("t1", now.Add(10*time.Second), true), 110*time.Second)
+	assert.Equal(t, interval.reserve("t2", now, false), time.Duration(0))
+	assert.Equal(t, interval.reserve("t2", now, false), time.Minute)
+	assert.Equal(t, interval.reserve("t2", now.Add(time.Minute), false), time.Duration(0))
+}
+
+func TestErrorReason(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", NewDeliveryError(ReasonUnregistered, errors.New("not registered")))
+	assert.Equal(t, Reason(err), ReasonUnregistered)
+	assert.Equal(t, Reason(context.DeadlineExceeded), ReasonTimeout)
+	assert.Equal(t, Reason(errors.New("other")), ReasonUnknown)
+}
+
+func TestNotifyDropsAfterDeadline(t *testing.T) {
+	service := &blockingService{started: make(chan struct{}, 10), release: make(chan struct{})}
+	config := &config.Config{
+		WorkersNum:       1,
+		TemplateDeadline: map[string]time.Duration{"t2": 20 * time.Millisecond},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}))
+	<-service.started
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "t2", Type: "test"}))
+
+	time.Sleep(50 * time.Millisecond)
+	close(service.release)
+	select {
+	case <-service.started:
+		t.Fatal("notification sent after its deadline")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+type flakyService struct {
+	failures int
+	reason   ErrorReason
+	attempts chan *Notification
+}
+
+func (f *flakyService) Send(c context.Context, notification *Notification) error {
+	f.attempts <- notification
+	if f.failures > 0 {
+		f.failures--
+		if f.reason != "" {
+			return NewDeliveryError(f.reason, errors.New("transient"))
+		}
+		return errors.New("transient")
+	}
+	return nil
+}
+
+func TestNotifyRetriesPerTemplate(t *testing.T) {
+	service := &flakyService{failures: 10, attempts: make(chan *Notification, 20)}
+	config := &config.Config{
+		WorkersNum:            1,
+		RetryAttempts:         3,
+		TemplateRetryAttempts: map[string]int{"no_retry": 1},
+		RetryDelay:            time.Millisecond,
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+
+	notifier.Notify(context.Background(), &Notification{Template: "retry", Type: "test"})
+	notifier.Notify(context.Background(), &Notification{Template: "no_retry", Type: "test"})
+
+	counts := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		counts[(<-service.attempts).Template]++
+	}
+	select {
+	case <-service.attempts:
+		t.Fatal("unexpected attempt")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.DeepEqual(t, counts, map[string]int{"retry": 3, "no_retry": 1})
+}
+
+func TestRetryBackoff(t *testing.T) {
+	notifier := NewNotifier(&config.Config{WorkersNum: 1, RetryDelay: time.Second, RetryMaxDelay: 5 * time.Second}, nil)
+	var delays []time.Duration
+	for attempt := 1; attempt <= 5; attempt++ {
+		delays = append(delays, notifier.backoff(attempt))
+	}
+	assert.DeepEqual(t, delays, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second})
+}
+
+func TestSendWithRetry(t *testing.T) {
+	notifier := NewNotifier(&config.Config{WorkersNum: 1, RetryAttempts: 5, RetryDelay: time.Millisecond}, nil)
+
+	// Transient failures are retried until the notification is sent.
+	transient := &flakyService{failures: 2, reason: ReasonThrottled, attempts: make(chan *Notification, 5)}
+	_, err := notifier.sendWithRetry(context.Background(), transient, &Notification{Template: "t1"}, time.Now())
+	assert.NilError(t, err)
+	assert.Equal(t, len(transient.attempts), 3)
+
+	// Permanent failures are returned right away, with their reason.
+	permanent := &flakyService{failures: 5, reason: ReasonUnregistered, attempts: make(chan *Notification, 5)}
+	_, err = notifier.sendWithRetry(context.Background(), permanent, &Notification{Template: "t1"}, time.Now())
+	assert.Equal(t, Reason(err), ReasonUnregistered)
+	assert.Equal(t, len(permanent.attempts), 1)
+
+	// A cancelled context stops the retries.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	cancelled := &flakyService{failures: 5, reason: ReasonThrottled, attempts: make(chan *Notification, 5)}
+	_, err = notifier.sendWithRetry(ctx, cancelled, &Notification{Template: "t1"}, time.Now())
+	assert.Equal(t, Reason(err), ReasonThrottled)
+	assert.Equal(t, len(cancelled.attempts), 1)
+}
+
+func TestNotifyRetryOn(t *testing.T) {
+	service := &flakyService{failures: 10, reason: ReasonUnregistered, attempts: make(chan *Notification, 20)}
+	config := &config.Config{
+		WorkersNum:      1,
+		RetryAttempts:   3,
+		RetryDelay:      time.Millisecond,
+		TemplateRetryOn: map[string][]string{"template_retry": {"unregistered"}},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+
+	notifier.Notify(context.Background(), &Notification{Template: "default", Type: "test"})
+	notifier.Notify(context.Background(), &Notification{Template: "template_retry", Type: "test"})
+	notifier.Notify(context.Background(), &Notification{Template: "request_retry", Type: "test", RetryOn: []ErrorReason{ReasonUnregistered}})
+	notifier.Notify(context.Background(), &Notification{Template: "template_retry", Type: "test", RetryOn: []ErrorReason{ReasonThrottled}})
+
+	counts := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		counts[(<-service.attempts).Template]++
+	}
+	select {
+	case <-service.attempts:
+		t.Fatal("unexpected attempt")
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.DeepEqual(t, counts, map[string]int{"default": 1, "template_retry": 4, "request_retry": 3})
+}
+
+func TestNotifyCollapseWindow(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{WorkersNum: 1, CollapseWindow: 50 * time.Millisecond}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+
+	for _, status := range []string{"created", "pending", "confirmed"} {
+		notifier.Notify(context.Background(), &Notification{Template: "swap", Type: "test", TargetIdentifier: "token1", CollapseKey: "swap1", Data: map[string]interface{}{"status": status}})
+	}
+	notifier.Notify(context.Background(), &Notification{Template: "other", Type: "test", TargetIdentifier: "token1"})
+
+	assert.Equal(t, (<-service.sentQueue).Template, "other")
+	assert.Equal(t, (<-service.sentQueue).Data["status"], "confirmed")
+	select {
+	case <-service.sentQueue:
+		t.Fatal("collapsed notification sent")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestNotifyCoalesceWindow(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{
+		WorkersNum:       1,
+		CoalesceWindow:   map[string]time.Duration{NOTIFICATION_PAYMENT_RECEIVED: 50 * time.Millisecond, "single": 50 * time.Millisecond},
+		CoalesceMessages: map[string]string{"single": "{count} singles"},
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+
+	for _, hash := range []string{"1", "2", "3"} {
+		notifier.Notify(context.Background(), &Notification{Template: NOTIFICATION_PAYMENT_RECEIVED, Type: "test", TargetIdentifier: "token1", DisplayMessage: "Incoming payment", Data: map[string]interface{}{"payment_hash": hash}})
+	}
+	notifier.Notify(context.Background(), &Notification{Template: NOTIFICATION_PAYMENT_RECEIVED, Type: "test", TargetIdentifier: "token2", Data: map[string]interface{}{"payment_hash": "4"}})
+	notifier.Notify(context.Background(), &Notification{Template: "other", Type: "test", TargetIdentifier: "token1"})
+
+	assert.Equal(t, (<-service.sentQueue).Template, "other")
+	sent := map[string]*Notification{}
+	for i := 0; i < 2; i++ {
+		notification := <-service.sentQueue
+		sent[notification.TargetIdentifier] = notification
+	}
+	coalesced := sent["token1"]
+	assert.Equal(t, coalesced.DisplayMessage, "Incoming payment")
+	assert.Equal(t, coalesced.Body, "3 incoming payments")
+	assert.Equal(t, coalesced.Data["payment_hash"], "3")
+	assert.Equal(t, coalesced.Data["coalesced_count"], 3)
+	assert.DeepEqual(t, coalesced.Data["coalesced_events"], []interface{}{
+		map[string]interface{}{"payment_hash": "1"},
+		map[string]interface{}{"payment_hash": "2"},
+		map[string]interface{}{"payment_hash": "3"},
+	})
+	// A single notification is sent as is.
+	assert.Equal(t, sent["token2"].Body, "")
+	assert.Equal(t, sent["token2"].Data["coalesced_count"], nil)
+
+	window := newCoalesceWindow(config.CoalesceWindow, config.CoalesceMessages, nil, nil)
+	assert.Equal(t, window.coalesce([]*Notification{{Template: "single"}, {Template: "single"}}).Body, "2 singles")
+	assert.Equal(t, window.coalesce([]*Notification{{Template: "t1"}, {Template: "t1"}}).Body, "2 new notifications")
+}
+
+func TestNotifyHeldBackStatuses(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{
+		WorkersNum:        1,
+		DeliveryStatus:    true,
+		CollapseWindow:    50 * time.Millisecond,
+		CoalesceWindow:    map[string]time.Duration{NOTIFICATION_PAYMENT_RECEIVED: 50 * time.Millisecond},
+		SummaryTemplates:  []string{NOTIFICATION_TX_CONFIRMED},
+		MinTargetInterval: time.Hour,
+		DropTooFrequent:   true,
+	}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	status := func(request *Notification) DeliveryStatus {
+		status, err := notifier.Status(request.ID)
+		assert.NilError(t, err)
+		return status.Status
+	}
+
+	collapsed := &Notification{Template: "swap", Type: "test", TargetIdentifier: "token1", CollapseKey: "swap1"}
+	collapsing := &Notification{Template: "swap", Type: "test", TargetIdentifier: "token1", CollapseKey: "swap1"}
+	coalesced := &Notification{Template: NOTIFICATION_PAYMENT_RECEIVED, Type: "test", TargetIdentifier: "token2"}
+	coalescing := &Notification{Template: NOTIFICATION_PAYMENT_RECEIVED, Type: "test", TargetIdentifier: "token2"}
+	summarized := &Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", TargetIdentifier: "token3", Summary: true}
+	for _, request := range []*Notification{collapsed, collapsing, coalesced, coalescing, summarized} {
+		assert.NilError(t, notifier.Notify(context.Background(), request))
+	}
+	assert.Equal(t, status(collapsed), StatusCollapsed)
+	assert.Equal(t, status(coalesced), StatusCoalesced)
+	assert.Equal(t, status(summarized), StatusSummarized)
+	assert.Equal(t, status(collapsing), StatusQueued)
+	assert.Equal(t, status(coalescing), StatusQueued)
+
+	// The targets were notified too recently once the windows are sent.
+	<-service.sentQueue
+	<-service.sentQueue
+	dropped := &Notification{Template: "other", Type: "test", TargetIdentifier: "token1"}
+	assert.NilError(t, notifier.Notify(context.Background(), dropped))
+	assert.Equal(t, status(dropped), StatusDropped)
+}
+
+func TestDeliveryReport(t *testing.T) {
+	report := newDeliveryReport(24 * time.Hour)
+	now := time.Now()
+	report.add(Outcome{Template: "t1", Type: "ios", Delivered: true, Time: now.Add(-25 * time.Hour)})
+	report.add(Outcome{Template: "t1", Type: "ios", Delivered: true, Time: now.Add(-2 * time.Hour)})
+	report.add(Outcome{Template: "t1", Type: "ios", Reason: "throttled", Time: now.Add(-time.Hour)})
+	report.add(Outcome{Template: "t1", Type: "ios", Delivered: true, Time: now})
+	report.add(Outcome{Template: "t1", Type: "android", Delivered: true, Time: now})
+
+	assert.DeepEqual(t, report.report(now).Entries, []ReportEntry{
+		{Template: "t1", Type: "android", Delivered: 1},
+		{Template: "t1", Type: "ios", Delivered: 2, Failed: 1, FailureRate: 1.0 / 3, Reasons: map[string]int{"throttled": 1}},
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(10, 1, 1)
+	assert.NilError(t, bucket.wait(context.Background()))
+
+	done := make(chan error)
+	start := time.Now()
+	go func() { done <- bucket.wait(context.Background()) }()
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, bucket.wait(context.Background()), ErrThrottled)
+
+	assert.NilError(t, <-done)
+	assert.Assert(t, time.Since(start) >= 90*time.Millisecond)
+}
+
+func TestTokenBucketBurst(t *testing.T) {
+	bucket := newTokenBucket(10, 3, 0)
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		assert.NilError(t, bucket.wait(context.Background()))
+	}
+	assert.Assert(t, time.Since(start) < 50*time.Millisecond)
+	// The burst is spent, the next send would wait.
+	assert.Equal(t, bucket.wait(context.Background()), ErrThrottled)
+
+	// An idle bucket refills at the rate.
+	time.Sleep(210 * time.Millisecond)
+	assert.NilError(t, bucket.wait(context.Background()))
+	assert.NilError(t, bucket.wait(context.Background()))
+	assert.Equal(t, bucket.wait(context.Background()), ErrThrottled)
+}
+
+func TestSummaryBuffer(t *testing.T) {
+	notifier := NewNotifier(&config.Config{WorkersNum: 1}, nil)
+	summary := newSummaryBuffer([]string{NOTIFICATION_TX_CONFIRMED}, 20, notifier, notifier.logFor)
+	now := time.Now()
+	add := func(request *Notification) bool {
+		held, err := summary.add(request, now)
+		assert.NilError(t, err)
+		return held
+	}
+
+	assert.Assert(t, add(&Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", TargetIdentifier: "t1", Summary: true}))
+	assert.Assert(t, add(&Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", TargetIdentifier: "t1", Summary: true}))
+	assert.Assert(t, !add(&Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", TargetIdentifier: "t2"}))
+	assert.Assert(t, !add(&Notification{Template: NOTIFICATION_LNURLPAY_INFO, Type: "test", TargetIdentifier: "t1", Summary: true}))
+
+	// The summary is kept in the schedule until the summary hour.
+	entries, err := notifier.schedule.Due(now)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+	entries, err = notifier.schedule.Due(now.Add(24 * time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Stage, stageSummary)
+	assert.Equal(t, entries[0].Notification.Template, NOTIFICATION_DAILY_SUMMARY)
+	assert.Equal(t, entries[0].Notification.TargetIdentifier, "t1")
+	assert.Equal(t, entries[0].Notification.Data["total"], 2)
+
+	assert.NilError(t, summary.take(entries[0]))
+	assert.Equal(t, len(summary.targets), 0)
+	assert.Equal(t, summary.take(entries[0]), ErrScheduledNotFound)
+}
+
+func TestNotifyPreferredService(t *testing.T) {
+	preferred := newTestService()
+	platform := newTestService()
+	failing := &flakyService{failures: 10, attempts: make(chan *Notification, 10)}
+	config := &config.Config{WorkersNum: 1}
+	notifier := NewNotifier(config, map[string]Service{"test": platform, "preferred": preferred, "failing": failing})
+
+	appData := "prefer=preferred"
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", AppData: &appData})
+	assert.Equal(t, (<-preferred.sentQueue).Type, "preferred")
+
+	appData = `{"prefer":"failing"}`
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", AppData: &appData})
+	<-failing.attempts
+	assert.Equal(t, (<-platform.sentQueue).Type, "test")
+}
+
+func TestNotifyTailorsToCapabilities(t *testing.T) {
+	service := newTestService()
+	notifier := NewNotifier(&config.Config{WorkersNum: 2, CapabilityRegistry: true}, map[string]Service{"test": service})
+	assert.NilError(t, notifier.SetCapabilities("test", "token1", Capabilities{CapabilitySilent: false, CapabilityActions: false}))
+
+	silent := true
+	notifier.Notify(context.Background(), &Notification{
+		Template:         "t1",
+		Type:             "test",
+		TargetIdentifier: "token1",
+		Silent:           &silent,
+		Action:           &Action{Label: "Open", Link: "https://breez.technology"},
+		Category:         "PAYMENT",
+	})
+	res := <-service.sentQueue
+	assert.Equal(t, *res.Silent, false)
+	assert.Assert(t, res.Action == nil)
+	assert.Equal(t, res.Category, "")
+	assert.Assert(t, res.Capabilities.Supports(CapabilityRichMedia))
+
+	// Targets without registered capabilities are left untouched.
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token2", Silent: &silent})
+	res = <-service.sentQueue
+	assert.Equal(t, *res.Silent, true)
+
+	disabled := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": service})
+	assert.ErrorIs(t, disabled.SetCapabilities("test", "token1", Capabilities{}), ErrCapabilitiesDisabled)
+}
+
+func TestNotifyEncryptsContent(t *testing.T) {
+	service := newTestService()
+	notifier := NewNotifier(&config.Config{WorkersNum: 2, EncryptionKeyRegistry: true}, map[string]Service{"test": service})
+	privateKey := bytes.Repeat([]byte{7}, curve25519.ScalarSize)
+	publicKey, err := curve25519.X25519(privateKey, curve25519.Basepoint)
+	assert.NilError(t, err)
+	assert.Equal(t, notifier.SetEncryptionKey("test", "token1", []byte("short")), ErrInvalidEncryptionKey)
+	assert.Equal(t, notifier.SetEncryptionKey("test", "token1", make([]byte, curve25519.PointSize)), ErrInvalidEncryptionKey)
+	assert.NilError(t, notifier.SetEncryptionKey("test", "token1", publicKey))
+
+	notifier.Notify(context.Background(), &Notification{
+		Template:         "t1",
+		Type:             "test",
+		TargetIdentifier: "token1",
+		DisplayMessage:   "Received 1000 sats",
+		Action:           &Action{Label: "Open", Link: "https://breez.technology"},
+		Data:             map[string]interface{}{"payment_hash": "1234"},
+	})
+	res := <-service.sentQueue
+	assert.Assert(t, res.Encrypted)
+	assert.Equal(t, res.DisplayMessage, defaultEncryptedMessage)
+	assert.Assert(t, res.Action == nil)
+	assert.Assert(t, res.Data["payment_hash"] == nil)
+	content, err := Decrypt(privateKey, res.Data)
+	assert.NilError(t, err)
+	assert.Equal(t, content.DisplayMessage, "Received 1000 sats")
+	assert.Equal(t, content.Action.Link, "https://breez.technology")
+	assert.Equal(t, content.Data["payment_hash"], "1234")
+	_, err = Decrypt(make([]byte, curve25519.ScalarSize), res.Data)
+	assert.Assert(t, err != nil)
+
+	// Removing the key stops the encryption.
+	assert.NilError(t, notifier.SetEncryptionKey("test", "token1", nil))
+	notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1", Data: map[string]interface{}{"payment_hash": "1234"}})
+	res = <-service.sentQueue
+	assert.Assert(t, !res.Encrypted)
+	assert.Equal(t, res.Data["payment_hash"], "1234")
+}
+
+func TestEncryptionKeysPersisted(t *testing.T) {
+	publicKey, err := curve25519.X25519(bytes.Repeat([]byte{7}, curve25519.ScalarSize), curve25519.Basepoint)
+	assert.NilError(t, err)
+	file := filepath.Join(t.TempDir(), "keys.json")
+	keys, err := NewFileEncryptionKeys(file)
+	assert.NilError(t, err)
+	assert.NilError(t, keys.SetEncryptionKey("test", "token1", publicKey))
+	reloaded, err := NewFileEncryptionKeys(file)
+	assert.NilError(t, err)
+	key, err := reloaded.EncryptionKey("test", "token1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, key, publicKey)
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	shared := NewRedisEncryptionKeys(client, "notify:encryption_keys")
+	assert.NilError(t, shared.SetEncryptionKey("test", "token1", publicKey))
+	key, err = NewRedisEncryptionKeys(client, "notify:encryption_keys").EncryptionKey("test", "token1")
+	assert.NilError(t, err)
+	assert.DeepEqual(t, key, publicKey)
+	assert.NilError(t, shared.SetEncryptionKey("test", "token1", nil))
+	key, err = shared.EncryptionKey("test", "token1")
+	assert.NilError(t, err)
+	assert.Assert(t, key == nil)
+}
+
+func TestEncryptionKeyNotFound(t *testing.T) {
+	publicKey, err := curve25519.X25519(bytes.Repeat([]byte{7}, curve25519.ScalarSize), curve25519.Basepoint)
+	assert.NilError(t, err)
+	service := newTestService()
+	notifier := NewNotifier(&config.Config{WorkersNum: 2, EncryptionKeyRegistry: true}, map[string]Service{"test": service})
+	assert.NilError(t, notifier.SetEncryptionKey("test", "token1", publicKey))
+
+	// A notification accepted for a target having a key is not sent in clear
+	// by an instance missing the key.
+	request := &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1", Data: map[string]interface{}{"payment_hash": "1234"}}
+	assert.NilError(t, notifier.requireEncryption(request))
+	assert.Assert(t, request.Encrypt)
+	other := NewNotifier(&config.Config{WorkersNum: 2, EncryptionKeyRegistry: true}, map[string]Service{"test": service})
+	_, err = other.NotifyAndWait(context.Background(), request)
+	assert.ErrorIs(t, err, ErrEncryptionKeyNotFound)
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	_, err = notifier.NotifyAndWait(context.Background(), request)
+	assert.NilError(t, err)
+	assert.Assert(t, (<-service.sentQueue).Encrypted)
+}
+
+func TestNotifyAndWait(t *testing.T) {
+	service := newTestService()
+	notifier := NewNotifier(&config.Config{WorkersNum: 2, CollapseWindow: time.Minute}, map[string]Service{"test": service})
+
+	result, err := notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *result, Result{Platform: "test"})
+	<-service.sentQueue
+
+	// Collapsed notifications are not sent right away.
+	result, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test", CollapseKey: "k"})
+	assert.NilError(t, err)
+	assert.DeepEqual(t, *result, Result{Platform: "test", Deferred: true})
+
+	failing := &flakyService{failures: 1, reason: ReasonUnregistered, attempts: make(chan *Notification, 1)}
+	notifier = NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": failing})
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test"})
+	assert.Equal(t, Reason(err), ReasonUnregistered)
+}
+
+type migratingService struct {
+	newToken string
+}
+
+func (m *migratingService) Send(c context.Context, notification *Notification) error {
+	ReportTokenMigration(c, m.newToken)
+	return nil
+}
+
+func TestNotifyTokenMigration(t *testing.T) {
+	notifier := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": &migratingService{newToken: "canonical"}})
+	migrated := make(chan [2]string, 1)
+	notifier.OnTokenMigrated(func(oldToken, newToken string) {
+		migrated <- [2]string{oldToken, newToken}
+	})
+
+	result, err := notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "old"})
+	assert.NilError(t, err)
+	assert.Equal(t, result.MigratedToken, "canonical")
+	assert.Equal(t, <-migrated, [2]string{"old", "canonical"})
+
+	// Reporting the same token is not a migration.
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "canonical"})
+	assert.NilError(t, err)
+	assert.Equal(t, len(migrated), 0)
+}
+
+func TestNotifyMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics := NewMetrics(registry)
+	failing := &flakyService{failures: 1, reason: ReasonUnregistered, attempts: make(chan *Notification, 2)}
+	notifier := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": failing})
+	notifier.UseMetrics(metrics)
+
+	_, err := notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test"})
+	assert.Equal(t, Reason(err), ReasonUnregistered)
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test"})
+	assert.NilError(t, err)
+
+	assert.Equal(t, testutil.ToFloat64(metrics.notifications.WithLabelValues("t1", "test", "unregistered")), float64(1))
+	assert.Equal(t, testutil.ToFloat64(metrics.notifications.WithLabelValues("t1", "test", "sent")), float64(1))
+	assert.Equal(t, testutil.CollectAndCount(metrics.sendLatency), 1)
+	assert.Equal(t, testutil.CollectAndCount(metrics.providerLatency), 2)
+}
+
+func TestNotifyTemplateVersion(t *testing.T) {
+	service := newTestService()
+	notifier := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": service})
+	notifier.RegisterTemplateVersion(NOTIFICATION_TX_CONFIRMED, 1, func(data map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"txid": data["tx_id"]}
+	})
+
+	notifier.Notify(context.Background(), &Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", TemplateVersion: 1, Data: map[string]interface{}{"tx_id": "1234"}})
+	assert.DeepEqual(t, (<-service.sentQueue).Data, map[string]interface{}{"txid": "1234"})
+
+	// The current version is sent as is.
+	notifier.Notify(context.Background(), &Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", Data: map[string]interface{}{"tx_id": "1234"}})
+	assert.DeepEqual(t, (<-service.sentQueue).Data, map[string]interface{}{"tx_id": "1234"})
+
+	err := notifier.Notify(context.Background(), &Notification{Template: NOTIFICATION_TX_CONFIRMED, Type: "test", TemplateVersion: 2})
+	assert.ErrorIs(t, err, ErrUnsupportedTemplateVersion)
+}
+
+func TestNotifierShutdown(t *testing.T) {
+	service := &blockingService{started: make(chan struct{}, 10), release: make(chan struct{})}
+	notifier := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": service})
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}))
+	<-service.started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, notifier.Shutdown(ctx), context.DeadlineExceeded)
+
+	// The queued notification is delivered before the shutdown completes,
+	// and the notifications are refused meanwhile.
+	assert.Equal(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}), ErrShuttingDown)
+	close(service.release)
+	assert.NilError(t, notifier.Shutdown(context.Background()))
+}
+
+func TestNotifierShutdownFlushesHeld(t *testing.T) {
+	service := newTestService()
+	config := &config.Config{WorkersNum: 1, DeliveryStatus: true, CollapseWindow: time.Hour, CoalesceWindow: map[string]time.Duration{NOTIFICATION_PAYMENT_RECEIVED: time.Hour}}
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	for _, status := range []string{"created", "confirmed"} {
+		assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "swap", Type: "test", TargetIdentifier: "token1", CollapseKey: "swap1", Data: map[string]interface{}{"status": status}}))
+	}
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: NOTIFICATION_PAYMENT_RECEIVED, Type: "test", TargetIdentifier: "token1"}))
+	// The notifications held back for the local hour of their target are not
+	// sent early.
+	delayed := &Notification{ID: "delayed", Template: "t1", Type: "test", TargetIdentifier: "token2"}
+	assert.NilError(t, notifier.delay(delayed, time.Now().Add(time.Hour)))
+	assert.Equal(t, len(service.sentQueue), 0)
+
+	// The windows held in memory are cut short rather than lost.
+	assert.NilError(t, notifier.Shutdown(context.Background()))
+	sent := map[string]*Notification{}
+	for len(service.sentQueue) > 0 {
+		notification := <-service.sentQueue
+		sent[notification.Template] = notification
+	}
+	assert.Equal(t, len(sent), 2)
+	assert.Equal(t, sent["swap"].Data["status"], "confirmed")
+	assert.Equal(t, len(notifier.schedule.(*memorySchedule).all()), 0)
+	status, err := notifier.Status("delayed")
+	assert.NilError(t, err)
+	assert.Equal(t, status.Status, StatusFailed)
+}
+
+func TestNotifyLogsFailures(t *testing.T) {
+	var logs bytes.Buffer
+	service := &flakyService{failures: 1, reason: ReasonUnregistered, attempts: make(chan *Notification, 1)}
+	notifier := NewNotifier(&config.Config{WorkersNum: 1, RetryAttempts: 1}, map[string]Service{"test": service})
+	notifier.UseLogger(slog.New(slog.NewJSONHandler(&logs)))
+
+	ctx := WithRequestID(context.Background(), "req-1")
+	_, err := notifier.NotifyAndWait(ctx, &Notification{Template: "payment_received", Type: "test", TargetIdentifier: "0123456789abcdef"})
+	assert.ErrorContains(t, err, "transient")
+
+	var record map[string]interface{}
+	assert.NilError(t, json.Unmarshal(bytes.SplitN(logs.Bytes(), []byte("\n"), 2)[0], &record))
+	assert.Equal(t, record["msg"], "failed to send notification")
+	assert.Equal(t, record["level"], "ERROR")
+	assert.Equal(t, record["request_id"], "req-1")
+	assert.Equal(t, record["template"], "payment_received")
+	assert.Equal(t, record["platform"], "test")
+	assert.Equal(t, record["token"], "01234567***")
+	assert.Equal(t, record["reason"], "unregistered")
+	assert.Assert(t, !bytes.Contains(logs.Bytes(), []byte("0123456789abcdef")))
+}
+
+func TestBoltRetryStore(t *testing.T) {
+	dir := t.TempDir()
+	files, err := newJSONFiles[RetryEntry](dir)
+	assert.NilError(t, err)
+	now := time.Now()
+	assert.NilError(t, files.save("legacy", &RetryEntry{ID: "legacy", Notification: &Notification{Template: "t1"}, NextAttemptAt: now}))
+
+	// The entries of the former json files are moved to the database.
+	store, err := NewBoltRetryStore(dir)
+	assert.NilError(t, err)
+	defer store.Close()
+	legacy, err := files.all(func(*RetryEntry) bool { return true })
+	assert.NilError(t, err)
+	assert.Equal(t, len(legacy), 0)
+
+	assert.NilError(t, store.Save(&RetryEntry{ID: "later", Notification: &Notification{Template: "t2"}, NextAttemptAt: now.Add(time.Hour)}))
+	assert.NilError(t, store.Save(&RetryEntry{ID: "sooner", Notification: &Notification{Template: "t3"}, NextAttemptAt: now.Add(time.Minute)}))
+	due := func(at time.Time) (ids []string) {
+		entries, err := store.Due(at)
+		assert.NilError(t, err)
+		for _, entry := range entries {
+			ids = append(ids, entry.ID)
+		}
+		return ids
+	}
+	assert.DeepEqual(t, due(now), []string{"legacy"})
+	assert.DeepEqual(t, due(now.Add(time.Hour)), []string{"legacy", "sooner", "later"})
+
+	// Saving an entry again moves it in the index.
+	assert.NilError(t, store.Save(&RetryEntry{ID: "legacy", Notification: &Notification{Template: "t1"}, NextAttemptAt: now.Add(2 * time.Hour)}))
+	assert.DeepEqual(t, due(now.Add(time.Hour)), []string{"sooner", "later"})
+	assert.NilError(t, store.Delete("sooner"))
+	assert.NilError(t, store.Delete("unknown"))
+	assert.DeepEqual(t, due(now.Add(2*time.Hour)), []string{"later", "legacy"})
+}
+
+func TestRetryQueue(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewBoltRetryStore(dir)
+	assert.NilError(t, err)
+	config := &config.Config{WorkersNum: 1, RetryAttempts: 1, RetryQueueDelay: time.Minute, RetryQueueMaxAge: time.Hour}
+
+	// A transient failure is persisted and reported as deferred.
+	failing := &flakyService{failures: 1, reason: ReasonThrottled, attempts: make(chan *Notification, 5)}
+	notifier := NewNotifier(config, map[string]Service{"test": failing})
+	notifier.UseRetryQueue(store)
+	result, err := notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "1234"})
+	assert.NilError(t, err)
+	assert.Assert(t, result.Deferred)
+	entries, err := store.Due(time.Now())
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+
+	// A permanent failure is not persisted.
+	permanent := &flakyService{failures: 1, reason: ReasonUnregistered, attempts: make(chan *Notification, 5)}
+	notifier = NewNotifier(config, map[string]Service{"test": permanent})
+	notifier.UseRetryQueue(store)
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t2", Type: "test"})
+	assert.Equal(t, Reason(err), ReasonUnregistered)
+
+	// The notification is sent once due, by a notifier restarted on the same
+	// directory, and removed from the queue.
+	assert.NilError(t, store.Close())
+	store, err = NewBoltRetryStore(dir)
+	assert.NilError(t, err)
+	defer store.Close()
+	entries, err = store.Due(time.Now().Add(time.Minute))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Notification.Template, "t1")
+	service := newTestService()
+	notifier = NewNotifier(config, map[string]Service{"test": service})
+	notifier.UseRetryQueue(store)
+	notifier.retryDue(context.Background(), time.Now().Add(time.Minute))
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "1234")
+	assert.NilError(t, notifier.Shutdown(context.Background()))
+	entries, err = store.Due(time.Now().Add(24 * time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+
+	// Notifications failing past the max age are dropped.
+	assert.NilError(t, store.Save(&RetryEntry{ID: "old", Notification: &Notification{Template: "t3", Type: "test"}, FailedAt: time.Now().Add(-2 * time.Hour)}))
+	notifier = NewNotifier(config, map[string]Service{"test": service})
+	notifier.UseRetryQueue(store)
+	notifier.retryDue(context.Background(), time.Now())
+	assert.NilError(t, notifier.Shutdown(context.Background()))
+	assert.Equal(t, len(service.sentQueue), 0)
+	entries, err = store.Due(time.Now())
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestSchedule(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileScheduleStore(dir)
+	assert.NilError(t, err)
+	config := &config.Config{WorkersNum: 1, Scheduling: true, ScheduleMaxDelay: time.Hour, DeliveryStatus: true}
+	service := newTestService()
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	notifier.UseScheduleStore(store)
+
+	deliverAt := time.Now().Add(time.Minute)
+	id, err := notifier.Schedule(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "1234"}, deliverAt)
+	assert.NilError(t, err)
+	status, err := notifier.Status(id)
+	assert.NilError(t, err)
+	assert.Equal(t, status.Status, StatusScheduled)
+	_, err = notifier.Schedule(context.Background(), &Notification{Template: "t1", Type: "test"}, time.Now().Add(2*time.Hour))
+	assert.Equal(t, err, ErrScheduleTooFar)
+	_, err = notifier.Schedule(context.Background(), &Notification{Template: NOTIFICATION_LNURLPAY_INFO, Type: "test"}, deliverAt)
+	assert.Equal(t, err, ErrUrgentNotSchedulable)
+
+	// The notification is only sent once due, by a notifier restarted on the
+	// same directory.
+	notifier.sendScheduled(context.Background(), time.Now())
+	assert.Equal(t, len(service.sentQueue), 0)
+	store, err = NewFileScheduleStore(dir)
+	assert.NilError(t, err)
+	notifier = NewNotifier(config, map[string]Service{"test": service})
+	notifier.UseScheduleStore(store)
+	notifier.sendScheduled(context.Background(), deliverAt)
+	assert.Equal(t, (<-service.sentQueue).TargetIdentifier, "1234")
+	entries, err := store.Due(deliverAt)
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+
+	// Cancelled notifications are not sent.
+	id, err = notifier.Schedule(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "5678"}, deliverAt)
+	assert.NilError(t, err)
+	assert.NilError(t, notifier.CancelScheduled(id))
+	assert.Equal(t, notifier.CancelScheduled(id), ErrScheduledNotFound)
+	status, err = notifier.Status(id)
+	assert.NilError(t, err)
+	assert.Equal(t, status.Status, StatusCancelled)
+	notifier.sendScheduled(context.Background(), deliverAt)
+	assert.NilError(t, notifier.Shutdown(context.Background()))
+	assert.Equal(t, len(service.sentQueue), 0)
+}
+
+func TestNotifyHoldsInSchedule(t *testing.T) {
+	dir := t.TempDir()
+	store, err := NewFileScheduleStore(dir)
+	assert.NilError(t, err)
+	config := &config.Config{WorkersNum: 1, CollapseWindow: time.Hour, MinTargetInterval: time.Hour, DeliveryStatus: true}
+	service := newTestService()
+	notifier := NewNotifier(config, map[string]Service{"test": service})
+	notifier.UseScheduleStore(store)
+
+	// The collapsed notification is kept in the schedule, replaced by the
+	// later ones until the window ends.
+	for _, status := range []string{"created", "confirmed"} {
+		assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "swap", Type: "test", TargetIdentifier: "token1", CollapseKey: "swap1", Data: map[string]interface{}{"status": status}}))
+	}
+	entries, err := store.Due(time.Now().Add(time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 1)
+	assert.Equal(t, entries[0].Stage, stageCollapse)
+	assert.Equal(t, entries[0].Notification.Data["status"], "confirmed")
+
+	// A notification delayed for the minimum interval of its target can be
+	// cancelled by its id.
+	assert.NilError(t, notifier.Notify(context.Background(), &Notification{Template: "other", Type: "test", TargetIdentifier: "token2"}))
+	<-service.sentQueue
+	delayed := &Notification{Template: "other", Type: "test", TargetIdentifier: "token2"}
+	assert.NilError(t, notifier.Notify(context.Background(), delayed))
+	status, err := notifier.Status(delayed.ID)
+	assert.NilError(t, err)
+	assert.Equal(t, status.Status, StatusScheduled)
+	assert.NilError(t, notifier.CancelScheduled(delayed.ID))
+
+	// The collapsed notification is sent once due by a notifier restarted on
+	// the same directory.
+	store, err = NewFileScheduleStore(dir)
+	assert.NilError(t, err)
+	notifier = NewNotifier(config, map[string]Service{"test": service})
+	notifier.UseScheduleStore(store)
+	notifier.sendScheduled(context.Background(), time.Now().Add(2*time.Hour))
+	assert.Equal(t, (<-service.sentQueue).Data["status"], "confirmed")
+	assert.NilError(t, notifier.Shutdown(context.Background()))
+	assert.Equal(t, len(service.sentQueue), 0)
+	entries, err = store.Due(time.Now().Add(2 * time.Hour))
+	assert.NilError(t, err)
+	assert.Equal(t, len(entries), 0)
+}
+
+func TestFileDeviceStore(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "devices.json")
+	store, err := NewFileDeviceStore(file)
+	assert.NilError(t, err)
+	assert.NilError(t, store.SetDevice("user1", Device{Platform: "android", Token: "1234"}))
+
+	// The devices are loaded again after a restart.
+	store, err = NewFileDeviceStore(file)
+	assert.NilError(t, err)
+	devices, err := store.Devices("user1")
+	assert.NilError(t, err)
+	assert.Equal(t, len(devices), 1)
+	assert.Equal(t, devices[0].Token, "1234")
+}
+
+func TestMemoryStatuses(t *testing.T) {
+	store := newMemoryStatuses(2)
+	assert.NilError(t, store.SetStatus(&NotificationStatus{ID: "a", Status: StatusQueued}))
+	assert.NilError(t, store.SetStatus(&NotificationStatus{ID: "b", Status: StatusQueued}))
+	assert.NilError(t, store.SetStatus(&NotificationStatus{ID: "a", Status: StatusSent}))
+	// The least recently updated status is dropped beyond the bound.
+	assert.NilError(t, store.SetStatus(&NotificationStatus{ID: "c", Status: StatusQueued}))
+
+	status, err := store.Status("a")
+	assert.NilError(t, err)
+	assert.Equal(t, status.Status, StatusSent)
+	_, err = store.Status("b")
+	assert.ErrorIs(t, err, ErrStatusNotFound)
+}
+
+func TestLiveSubscriptions(t *testing.T) {
+	service := newTestService()
+	notifier := NewNotifier(&config.Config{WorkersNum: 2}, map[string]Service{"test": service})
+	_, _, err := notifier.SubscribeLive("token1", 1)
+	assert.ErrorIs(t, err, ErrLiveDisabled)
+
+	notifier = NewNotifier(&config.Config{WorkersNum: 2, LiveSubscriptions: true, TemplateDeadline: map[string]time.Duration{"t3": time.Minute}}, map[string]Service{"test": service})
+	notifications, unsubscribe, err := notifier.SubscribeLive("token1", 2)
+	assert.NilError(t, err)
+
+	// The subscribers get the notifications pushed to their target.
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	<-service.sentQueue
+	assert.Equal(t, (<-notifications).Template, "t1")
+
+	// The websocket notifications are only streamed.
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t2", Type: PlatformWebSocket, TargetIdentifier: "token1"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-notifications).Template, "t2")
+
+	// The notifications dropped past their deadline and the attempts of the
+	// retry queue are not streamed.
+	_, err = notifier.deliver(context.Background(), &Notification{Template: "t3", Type: "test", TargetIdentifier: "token1"}, time.Now().Add(-time.Hour), false)
+	assert.ErrorIs(t, err, ErrSendDeadlineExceeded)
+	_, err = notifier.deliver(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: "token1"}, time.Now(), true)
+	assert.NilError(t, err)
+	<-service.sentQueue
+	assert.Equal(t, len(notifications), 0)
+
+	unsubscribe()
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t2", Type: PlatformWebSocket, TargetIdentifier: "token1"})
+	assert.Equal(t, Reason(err), ReasonUnregistered)
+}
+
+func TestNotifyCircuitBreaker(t *testing.T) {
+	service := &flakyService{failures: 2, reason: ReasonTimeout, attempts: make(chan *Notification, 10)}
+	notifier := NewNotifier(&config.Config{WorkersNum: 1, BreakerThreshold: 2, BreakerCooldown: 50 * time.Millisecond}, map[string]Service{"test": service})
+	send := func() error {
+		_, err := notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test"})
+		return err
+	}
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, Reason(send()), ReasonTimeout)
+		<-service.attempts
+	}
+
+	// The open circuit fails fast without trying the service.
+	assert.ErrorIs(t, send(), ErrCircuitOpen)
+	assert.Equal(t, len(service.attempts), 0)
+
+	// Once the cooldown passed, a successful probe closes the circuit.
+	time.Sleep(60 * time.Millisecond)
+	assert.NilError(t, send())
+	<-service.attempts
+	assert.NilError(t, send())
+	<-service.attempts
+}
+
+func TestNotifyApps(t *testing.T) {
+	service := newTestService()
+	appService := newTestService()
+	notifier := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": service})
+	notifier.UseApp("brand", map[string]Service{"test": appService})
+
+	_, err := notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test", App: "brand"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-appService.sentQueue).App, "brand")
+	_, err = notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-service.sentQueue).App, "")
+
+	// Only the apps served are accepted, before queueing the notification.
+	assert.ErrorIs(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "test", App: "other"}), ErrUnknownApp)
+	assert.ErrorIs(t, notifier.Notify(context.Background(), &Notification{Template: "t1", Type: "web", App: "brand"}), ErrServiceNotFound)
+	assert.Equal(t, len(service.sentQueue)+len(appService.sentQueue), 0)
+}
+
+func TestTokenInvalidation(t *testing.T) {
+	service := &flakyService{failures: 1, reason: ReasonUnregistered, attempts: make(chan *Notification, 10)}
+	notifier := NewNotifier(&config.Config{WorkersNum: 1, RetryAttempts: 3, InvalidTokenTTL: time.Minute}, map[string]Service{"test": service})
+	invalidations := make(chan TokenInvalidation, 10)
+	notifier.OnTokenInvalidated(func(invalidation TokenInvalidation) {
+		invalidations <- invalidation
+	})
+	send := func(token string) error {
+		_, err := notifier.NotifyAndWait(context.Background(), &Notification{Template: "t1", Type: "test", TargetIdentifier: token, RetryOn: []ErrorReason{ReasonUnregistered}})
+		return err
+	}
+
+	// The invalidated token is not retried, even when its reason is.
+	assert.Equal(t, Reason(send("dead")), ReasonUnregistered)
+	<-service.attempts
+	invalidation := <-invalidations
+	assert.Equal(t, invalidation.Token, "dead")
+	assert.Equal(t, invalidation.Platform, "test")
+
+	// Its following notifications fail without trying the service.
+	assert.ErrorIs(t, send("dead"), ErrTokenInvalidated)
+	assert.NilError(t, send("alive"))
+	assert.Equal(t, (<-service.attempts).TargetIdentifier, "alive")
+	assert.Equal(t, len(service.attempts), 0)
+
+	tokens, err := notifier.InvalidTokens()
+	assert.NilError(t, err)
+	assert.Equal(t, len(tokens), 1)
+	assert.Equal(t, tokens[0].Token, "dead")
+	assert.Equal(t, len(invalidations), 0)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker("test", 2, time.Minute, slog.Default)
+	now := time.Now()
+	unregistered := NewDeliveryError(ReasonUnregistered, errors.New("unregistered"))
+	timeout := NewDeliveryError(ReasonTimeout, errors.New("timeout"))
+
+	// Failures caused by the notification don't count.
+	breaker.record(timeout, now)
+	breaker.record(unregistered, now)
+	breaker.record(timeout, now)
+	assert.Assert(t, breaker.allow(now))
+	breaker.record(timeout, now)
+	assert.Assert(t, !breaker.allow(now))
+
+	// A single probe is let through, and opens the circuit again when failing.
+	later := now.Add(time.Minute)
+	assert.Assert(t, breaker.allow(later))
+	assert.Assert(t, !breaker.allow(later))
+	breaker.record(timeout, later)
+	assert.Assert(t, !breaker.allow(later.Add(time.Second)))
+	assert.Assert(t, breaker.allow(later.Add(time.Minute)))
+	breaker.record(nil, later.Add(time.Minute))
+	assert.Assert(t, breaker.allow(later.Add(time.Minute)))
+
+	var disabled *circuitBreaker
+	assert.Assert(t, disabled.allow(now))
+}
+
+func TestMemoryDeliveryQueue(t *testing.T) {
+	queue := NewMemoryDeliveryQueue(20 * time.Millisecond)
+	ctx := context.Background()
+	assert.NilError(t, queue.Push(ctx, &Notification{Template: "t1"}))
+	assert.NilError(t, queue.Push(ctx, &Notification{Template: "t2"}))
+	depth, err := queue.Depth(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, depth, 2)
+
+	first, err := queue.Pop(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, first.Notification.Template, "t1")
+	second, err := queue.Pop(ctx)
+	assert.NilError(t, err)
+	assert.NilError(t, queue.Ack(ctx, second.ID))
+
+	// The notification not acknowledged in time is popped again.
+	again, err := queue.Pop(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, again.ID, first.ID)
+	assert.Equal(t, again.Attempts, 2)
+	assert.NilError(t, queue.Ack(ctx, again.ID))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = queue.Pop(timeoutCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestRedisDeliveryQueue(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	defer client.Close()
+	queue := NewRedisDeliveryQueue(client, "notify:delivery", 20*time.Millisecond)
+	ctx := context.Background()
+	assert.NilError(t, queue.Push(ctx, &Notification{Template: "t1"}))
+	assert.NilError(t, queue.Push(ctx, &Notification{Template: "t2"}))
+	depth, err := queue.Depth(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, depth, 2)
+
+	first, err := queue.Pop(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, first.Notification.Template, "t1")
+	assert.Equal(t, first.Attempts, 1)
+	second, err := queue.Pop(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, second.Notification.Template, "t2")
+	assert.NilError(t, queue.Ack(ctx, second.ID))
+
+	// The notification not acknowledged in time is popped again.
+	again, err := queue.Pop(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, again.ID, first.ID)
+	assert.Equal(t, again.Attempts, 2)
+	assert.NilError(t, queue.Ack(ctx, again.ID))
+	assert.Assert(t, !server.Exists("notify:delivery:items"))
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = queue.Pop(timeoutCtx)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestNotifyDeliveryQueue(t *testing.T) {
+	queue := NewMemoryDeliveryQueue(time.Minute)
+	producerService := newTestService()
+	producer := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": producerService})
+	producer.UseDeliveryQueue(queue)
+	consumerService := newTestService()
+	consumer := NewNotifier(&config.Config{WorkersNum: 1}, map[string]Service{"test": consumerService})
+	consumer.UseDeliveryQueue(queue)
+	registry := prometheus.NewRegistry()
+	consumer.UseMetrics(NewMetrics(registry))
+
+	// The notifications nobody waits for are delivered by the consumer.
+	assert.NilError(t, producer.Notify(context.Background(), &Notification{Template: "t1", Type: "test"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.RunDeliveryQueue(ctx)
+	assert.Equal(t, (<-consumerService.sentQueue).Template, "t1")
+	assert.Equal(t, len(producerService.sentQueue), 0)
+
+	// The notifications awaited by a sender are delivered right away.
+	_, err := producer.NotifyAndWait(context.Background(), &Notification{Template: "t2", Type: "test"})
+	assert.NilError(t, err)
+	assert.Equal(t, (<-producerService.sentQueue).Template, "t2")
+
+	// The delivered notification is acknowledged.
+	time.Sleep(10 * time.Millisecond)
+	memory := queue.(*memoryDeliveryQueue)
+	memory.Lock()
+	assert.Equal(t, len(memory.inFlight), 0)
+	memory.Unlock()
+	assert.Equal(t, testutil.ToFloat64(consumer.metrics.deliveryQueueDepth), float64(0))
+}
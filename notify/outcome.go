@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"sync"
+	"time"
+)
+
+// Outcome is the result of the delivery of a notification.
+type Outcome struct {
+	Template         string    `json:"template"`
+	Type             string    `json:"type"`
+	TargetIdentifier string    `json:"target_identifier"`
+	EventID          string    `json:"event_id,omitempty"`
+	Delivered        bool      `json:"delivered"`
+	Reason           string    `json:"reason,omitempty"`
+	Time             time.Time `json:"time"`
+}
+
+func newOutcome(request *Notification, err error) Outcome {
+	outcome := Outcome{
+		Template:         request.Template,
+		Type:             request.Type,
+		TargetIdentifier: request.TargetIdentifier,
+		EventID:          request.EventID,
+		Delivered:        err == nil,
+		Time:             time.Now(),
+	}
+	if err != nil {
+		outcome.Reason = string(Reason(err))
+	}
+	return outcome
+}
+
+// outcomeFeed fans out delivery outcomes to subscribers. Outcomes are dropped
+// for subscribers that don't keep up, so delivery is never slowed down.
+type outcomeFeed struct {
+	sync.Mutex
+	subscribers map[chan Outcome]struct{}
+}
+
+func (f *outcomeFeed) publish(outcome Outcome) {
+	f.Lock()
+	defer f.Unlock()
+	for subscriber := range f.subscribers {
+		select {
+		case subscriber <- outcome:
+		default:
+		}
+	}
+}
+
+// SubscribeOutcomes returns a channel receiving the outcome of every
+// delivery, and a function to call once done with it.
+func (n *Notifier) SubscribeOutcomes(buffer int) (<-chan Outcome, func()) {
+	subscriber := make(chan Outcome, buffer)
+	n.outcomes.Lock()
+	if n.outcomes.subscribers == nil {
+		n.outcomes.subscribers = make(map[chan Outcome]struct{})
+	}
+	n.outcomes.subscribers[subscriber] = struct{}{}
+	n.outcomes.Unlock()
+
+	return subscriber, func() {
+		n.outcomes.Lock()
+		delete(n.outcomes.subscribers, subscriber)
+		n.outcomes.Unlock()
+	}
+}
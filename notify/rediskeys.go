@@ -0,0 +1,37 @@
+package notify
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisEncryptionKeys is an EncryptionKeyRegistry shared by the instances
+// through a Redis hash of the keys by target.
+type redisEncryptionKeys struct {
+	client redis.UniversalClient
+	key    string
+}
+
+// NewRedisEncryptionKeys returns an EncryptionKeyRegistry kept in Redis under
+// the key, so that any instance delivering a notification finds the key of
+// its target.
+func NewRedisEncryptionKeys(client redis.UniversalClient, key string) EncryptionKeyRegistry {
+	return &redisEncryptionKeys{client: client, key: key}
+}
+
+func (r *redisEncryptionKeys) EncryptionKey(notificationType string, target string) ([]byte, error) {
+	key, err := r.client.HGet(context.Background(), r.key, notificationType+"/"+target).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	return key, err
+}
+
+func (r *redisEncryptionKeys) SetEncryptionKey(notificationType string, target string, key []byte) error {
+	if key == nil {
+		return r.client.HDel(context.Background(), r.key, notificationType+"/"+target).Err()
+	}
+	return r.client.HSet(context.Background(), r.key, notificationType+"/"+target, key).Err()
+}
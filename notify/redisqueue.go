@@ -0,0 +1,138 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPopScript pops the oldest pending notification, once the expired
+// notifications in flight are pending again, marking it in flight until its
+// deadline. It returns the id, the notification and the attempts of the
+// popped notification, nil when none is pending.
+var redisPopScript = redis.NewScript(`
+local expired = redis.call('ZRANGEBYSCORE', KEYS[2], '-inf', ARGV[1])
+for _, id in ipairs(expired) do
+	redis.call('ZREM', KEYS[2], id)
+	redis.call('RPUSH', KEYS[1], id)
+end
+local id = redis.call('RPOP', KEYS[1])
+if not id then
+	return false
+end
+redis.call('ZADD', KEYS[2], ARGV[2], id)
+local attempts = redis.call('HINCRBY', KEYS[4], id, 1)
+return {id, redis.call('HGET', KEYS[3], id), attempts}
+`)
+
+// redisDeliveryQueue is a DeliveryQueue shared by the instances through a
+// Redis list of the pending ids, a sorted set of the ids in flight by
+// deadline, and hashes of the notifications and their attempts.
+type redisDeliveryQueue struct {
+	client     redis.UniversalClient
+	visibility time.Duration
+	// poll is how often Pop checks for a notification while none is
+	// pending.
+	poll        time.Duration
+	pendingKey  string
+	inFlightKey string
+	itemsKey    string
+	attemptsKey string
+}
+
+// NewRedisDeliveryQueue returns a DeliveryQueue kept in Redis under the key
+// prefix, popping the notifications not acknowledged within the visibility
+// timeout again.
+func NewRedisDeliveryQueue(client redis.UniversalClient, key string, visibility time.Duration) DeliveryQueue {
+	poll := time.Second
+	if visibility < poll {
+		poll = visibility
+	}
+	return &redisDeliveryQueue{
+		client:      client,
+		visibility:  visibility,
+		poll:        poll,
+		pendingKey:  key + ":pending",
+		inFlightKey: key + ":inflight",
+		itemsKey:    key + ":items",
+		attemptsKey: key + ":attempts",
+	}
+}
+
+func (q *redisDeliveryQueue) Push(ctx context.Context, notification *Notification) error {
+	data, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	id := newNotificationID()
+	_, err = q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.itemsKey, id, data)
+		pipe.LPush(ctx, q.pendingKey, id)
+		return nil
+	})
+	return err
+}
+
+func (q *redisDeliveryQueue) Pop(ctx context.Context) (*QueuedNotification, error) {
+	for {
+		queued, err := q.pop(ctx, time.Now())
+		if err != nil || queued != nil {
+			return queued, err
+		}
+		select {
+		case <-time.After(q.poll):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// pop returns the first pending notification, nil when there is none.
+func (q *redisDeliveryQueue) pop(ctx context.Context, now time.Time) (*QueuedNotification, error) {
+	keys := []string{q.pendingKey, q.inFlightKey, q.itemsKey, q.attemptsKey}
+	reply, err := redisPopScript.Run(ctx, q.client, keys, now.UnixMilli(), now.Add(q.visibility).UnixMilli()).Slice()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(reply) != 3 {
+		return nil, fmt.Errorf("unexpected delivery queue reply %v", reply)
+	}
+	id, _ := reply[0].(string)
+	data, _ := reply[1].(string)
+	attempts, _ := reply[2].(int64)
+	// A notification acknowledged while it was popped is gone.
+	if data == "" {
+		return nil, q.Ack(ctx, id)
+	}
+	notification := new(Notification)
+	if err := json.Unmarshal([]byte(data), notification); err != nil {
+		// The notification could never be delivered, it is dropped.
+		if ackErr := q.Ack(ctx, id); ackErr != nil {
+			return nil, ackErr
+		}
+		return nil, fmt.Errorf("invalid notification %v of the delivery queue: %w", id, err)
+	}
+	return &QueuedNotification{ID: id, Notification: notification, Attempts: int(attempts)}, nil
+}
+
+func (q *redisDeliveryQueue) Ack(ctx context.Context, id string) error {
+	_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, q.inFlightKey, id)
+		pipe.HDel(ctx, q.itemsKey, id)
+		pipe.HDel(ctx, q.attemptsKey, id)
+		return nil
+	})
+	return err
+}
+
+func (q *redisDeliveryQueue) Depth(ctx context.Context) (int, error) {
+	depth, err := q.client.LLen(ctx, q.pendingKey).Result()
+	return int(depth), err
+}
@@ -0,0 +1,133 @@
+package notify
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// reportBuckets is the number of buckets the report window is split in.
+const reportBuckets = 24
+
+// ReportEntry sums up the deliveries of a template to a platform.
+type ReportEntry struct {
+	Template    string         `json:"template"`
+	Type        string         `json:"type"`
+	Delivered   int            `json:"delivered"`
+	Failed      int            `json:"failed"`
+	FailureRate float64        `json:"failure_rate"`
+	Reasons     map[string]int `json:"reasons,omitempty"`
+}
+
+// Report sums up the deliveries since a point in time.
+type Report struct {
+	Since   time.Time     `json:"since"`
+	Entries []ReportEntry `json:"entries"`
+}
+
+type reportKey struct {
+	template string
+	platform string
+}
+
+type reportBucket struct {
+	start   time.Time
+	entries map[reportKey]*ReportEntry
+}
+
+// deliveryReport aggregates the delivery outcomes over a rolling window. It is
+// kept in memory and starts over when the service restarts.
+type deliveryReport struct {
+	sync.Mutex
+	window     time.Duration
+	resolution time.Duration
+	buckets    []*reportBucket
+}
+
+func newDeliveryReport(window time.Duration) *deliveryReport {
+	return &deliveryReport{
+		window:     window,
+		resolution: window / reportBuckets,
+	}
+}
+
+func (r *deliveryReport) add(outcome Outcome) {
+	r.Lock()
+	defer r.Unlock()
+	start := outcome.Time.Truncate(r.resolution)
+	if len(r.buckets) == 0 || r.buckets[len(r.buckets)-1].start.Before(start) {
+		r.buckets = append(r.buckets, &reportBucket{start: start, entries: make(map[reportKey]*ReportEntry)})
+		r.prune(outcome.Time)
+	}
+	bucket := r.buckets[len(r.buckets)-1]
+
+	key := reportKey{template: outcome.Template, platform: outcome.Type}
+	entry, ok := bucket.entries[key]
+	if !ok {
+		entry = &ReportEntry{Template: outcome.Template, Type: outcome.Type}
+		bucket.entries[key] = entry
+	}
+	if outcome.Delivered {
+		entry.Delivered++
+		return
+	}
+	entry.Failed++
+	if entry.Reasons == nil {
+		entry.Reasons = make(map[string]int)
+	}
+	entry.Reasons[outcome.Reason]++
+}
+
+// prune drops the buckets that ended before the window.
+func (r *deliveryReport) prune(now time.Time) {
+	for len(r.buckets) > 0 && !r.buckets[0].start.Add(r.resolution).After(now.Add(-r.window)) {
+		r.buckets = r.buckets[1:]
+	}
+}
+
+func (r *deliveryReport) report(now time.Time) Report {
+	r.Lock()
+	defer r.Unlock()
+	r.prune(now)
+
+	summed := make(map[reportKey]*ReportEntry)
+	for _, bucket := range r.buckets {
+		for key, entry := range bucket.entries {
+			sum, ok := summed[key]
+			if !ok {
+				sum = &ReportEntry{Template: entry.Template, Type: entry.Type}
+				summed[key] = sum
+			}
+			sum.Delivered += entry.Delivered
+			sum.Failed += entry.Failed
+			for reason, count := range entry.Reasons {
+				if sum.Reasons == nil {
+					sum.Reasons = make(map[string]int)
+				}
+				sum.Reasons[reason] += count
+			}
+		}
+	}
+
+	report := Report{Since: now.Add(-r.window), Entries: make([]ReportEntry, 0, len(summed))}
+	for _, entry := range summed {
+		entry.FailureRate = float64(entry.Failed) / float64(entry.Delivered+entry.Failed)
+		report.Entries = append(report.Entries, *entry)
+	}
+	sort.Slice(report.Entries, func(i, j int) bool {
+		if report.Entries[i].Template != report.Entries[j].Template {
+			return report.Entries[i].Template < report.Entries[j].Template
+		}
+		return report.Entries[i].Type < report.Entries[j].Type
+	})
+	return report
+}
+
+// Report returns the delivery counts and failure rates per template and
+// platform over the report window, and false when the report is disabled.
+func (n *Notifier) Report() (Report, bool) {
+	if n.report == nil {
+		return Report{}, false
+	}
+	return n.report.report(time.Now()), true
+}
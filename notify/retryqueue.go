@@ -0,0 +1,279 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// RetryEntry is a notification waiting to be sent again after its delivery
+// failed.
+type RetryEntry struct {
+	ID           string        `json:"id"`
+	Notification *Notification `json:"notification"`
+	// Attempts is the number of failed deliveries of the notification.
+	Attempts int `json:"attempts"`
+	// FailedAt is the time of the first failed delivery, the entry is
+	// dropped once older than the max age of the retry queue.
+	FailedAt      time.Time `json:"failed_at"`
+	NextAttemptAt time.Time `json:"next_attempt_at"`
+}
+
+// RetryStore persists the notifications waiting to be retried, so they
+// survive restarts.
+type RetryStore interface {
+	Save(entry *RetryEntry) error
+	// Due returns the entries whose next attempt is due at the given time.
+	Due(now time.Time) ([]*RetryEntry, error)
+	Delete(id string) error
+}
+
+// retryFile is the database of the BoltRetryStore in its directory.
+const retryFile = "retry.db"
+
+var (
+	// retryEntriesBucket holds the entries by id.
+	retryEntriesBucket = []byte("entries")
+	// retryDueBucket indexes the entries by next attempt, its keys being the
+	// big endian unix nanoseconds of the attempt followed by the id.
+	retryDueBucket = []byte("due")
+)
+
+// BoltRetryStore is a RetryStore kept in a bbolt database, its entries
+// indexed by next attempt so only the due ones are read. Every change is
+// synced to the disk before it returns.
+type BoltRetryStore struct {
+	db *bolt.DB
+}
+
+// NewBoltRetryStore returns a RetryStore keeping the entries in a database of
+// the directory, which is created when missing. The entries of the json files
+// the directory held before are moved to the database.
+func NewBoltRetryStore(dir string) (*BoltRetryStore, error) {
+	files, err := newJSONFiles[RetryEntry](dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create retry queue directory %v", err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, retryFile), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open retry queue %v", err)
+	}
+	store := &BoltRetryStore{db: db}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(retryEntriesBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(retryDueBucket)
+		return err
+	})
+	if err == nil {
+		err = store.importFiles(files)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// importFiles moves the entries of the json files to the database.
+func (b *BoltRetryStore) importFiles(files *jsonFiles[RetryEntry]) error {
+	entries, err := files.all(func(*RetryEntry) bool { return true })
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := b.Save(entry); err != nil {
+			return err
+		}
+		if err := files.delete(entry.ID); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the database.
+func (b *BoltRetryStore) Close() error {
+	return b.db.Close()
+}
+
+func (b *BoltRetryStore) Save(entry *RetryEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		entries, due := tx.Bucket(retryEntriesBucket), tx.Bucket(retryDueBucket)
+		if err := unindexRetry(entries, due, entry.ID); err != nil {
+			return err
+		}
+		if err := entries.Put([]byte(entry.ID), data); err != nil {
+			return err
+		}
+		return due.Put(retryDueKey(entry.NextAttemptAt, entry.ID), nil)
+	})
+}
+
+func (b *BoltRetryStore) Due(now time.Time) ([]*RetryEntry, error) {
+	var dueEntries []*RetryEntry
+	err := b.db.View(func(tx *bolt.Tx) error {
+		entries, due := tx.Bucket(retryEntriesBucket), tx.Bucket(retryDueBucket)
+		end := retryDueKey(now, "")
+		cursor := due.Cursor()
+		for key, _ := cursor.First(); key != nil && bytes.Compare(key[:8], end[:8]) <= 0; key, _ = cursor.Next() {
+			id := string(key[8:])
+			entry := new(RetryEntry)
+			if err := json.Unmarshal(entries.Get([]byte(id)), entry); err != nil {
+				return fmt.Errorf("invalid retry entry %v: %w", id, err)
+			}
+			dueEntries = append(dueEntries, entry)
+		}
+		return nil
+	})
+	return dueEntries, err
+}
+
+func (b *BoltRetryStore) Delete(id string) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		entries := tx.Bucket(retryEntriesBucket)
+		if err := unindexRetry(entries, tx.Bucket(retryDueBucket), id); err != nil {
+			return err
+		}
+		return entries.Delete([]byte(id))
+	})
+}
+
+// unindexRetry removes the entry of the id, if any, from the due index.
+func unindexRetry(entries *bolt.Bucket, due *bolt.Bucket, id string) error {
+	data := entries.Get([]byte(id))
+	if data == nil {
+		return nil
+	}
+	var entry RetryEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return fmt.Errorf("invalid retry entry %v: %w", id, err)
+	}
+	return due.Delete(retryDueKey(entry.NextAttemptAt, id))
+}
+
+// retryDueKey returns the key of the due index of an entry, ordered by next
+// attempt.
+func retryDueKey(nextAttemptAt time.Time, id string) []byte {
+	key := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(key, uint64(nextAttemptAt.UnixNano()))
+	return append(key, id...)
+}
+
+// UseRetryQueue persists the notifications whose delivery failed with a
+// retryable reason in the store, to be sent again by RunRetryQueue. It must
+// be set before sending notifications.
+func (n *Notifier) UseRetryQueue(store RetryStore) {
+	n.retryQueue = store
+}
+
+// RunRetryQueue sends the notifications of the retry queue as they become
+// due, checking the queue at the given interval until ctx is done.
+func (n *Notifier) RunRetryQueue(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n.retryDue(ctx, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// persistRetry saves a notification that failed to be delivered in the retry
+// queue, returning whether it will be retried.
+func (n *Notifier) persistRetry(c context.Context, request *Notification, err error) bool {
+	if n.retryQueue == nil || errors.Is(err, ErrServiceNotFound) || errors.Is(err, ErrUnknownApp) || errors.Is(err, ErrSendDeadlineExceeded) {
+		return false
+	}
+	if !n.retryable(request, Reason(err)) || n.invalidTokens.has(request, time.Now()) {
+		return false
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return false
+	}
+	now := time.Now()
+	entry := &RetryEntry{
+		ID:            hex.EncodeToString(id),
+		Notification:  request,
+		Attempts:      1,
+		FailedAt:      now,
+		NextAttemptAt: now.Add(exponentialBackoff(n.retryQueueDelay, n.retryQueueMaxDelay, 1)),
+	}
+	if err := n.retryQueue.Save(entry); err != nil {
+		n.logFor(c, request).Error("failed to persist notification for retry", "error", err)
+		return false
+	}
+	n.logFor(c, request).Info("persisted notification for retry", "next_attempt_at", entry.NextAttemptAt)
+	n.setStatus(request, StatusRetrying, nil, err)
+	return true
+}
+
+// retryDue queues the due notifications of the retry queue, dropping those
+// older than the max age.
+func (n *Notifier) retryDue(ctx context.Context, now time.Time) {
+	entries, err := n.retryQueue.Due(now)
+	if err != nil {
+		n.logger.Error("failed to read the retry queue", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		logger := n.logFor(ctx, entry.Notification).With("retry_id", entry.ID, "attempts", entry.Attempts)
+		if n.retryQueueMaxAge > 0 && now.Sub(entry.FailedAt) > n.retryQueueMaxAge {
+			logger.Info("dropping notification, not sent within the retry max age")
+			if err := n.retryQueue.Delete(entry.ID); err != nil {
+				logger.Error("failed to delete retry entry", "error", err)
+			}
+			continue
+		}
+
+		// The next attempt is pushed back before sending, so the entry is
+		// neither picked again meanwhile nor lost if the process stops.
+		entry.Attempts++
+		entry.NextAttemptAt = now.Add(exponentialBackoff(n.retryQueueDelay, n.retryQueueMaxDelay, entry.Attempts))
+		if err := n.retryQueue.Save(entry); err != nil {
+			logger.Error("failed to update retry entry", "error", err)
+			continue
+		}
+		entry := entry
+		err := n.queue.QueueTask(func(context.Context) error {
+			// A retry under way when the queue stops running still completes,
+			// rather than failing as cancelled.
+			startedAt := time.Now()
+			result, err := n.deliver(context.Background(), entry.Notification, startedAt, true)
+			n.record(entry.Notification, result, err, startedAt)
+			if err == nil || !n.retryable(entry.Notification, Reason(err)) {
+				if err != nil {
+					logger.Info("dropping notification, failure is not retryable", "reason", Reason(err))
+				}
+				if err := n.retryQueue.Delete(entry.ID); err != nil {
+					logger.Error("failed to delete retry entry", "error", err)
+				}
+			} else {
+				n.setStatus(entry.Notification, StatusRetrying, nil, err)
+			}
+			return err
+		})
+		if err != nil {
+			logger.Error("failed to queue notification retry", "error", err)
+		}
+	}
+}
@@ -0,0 +1,310 @@
+package notify
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSchedulingDisabled   = errors.New("scheduling is disabled")
+	ErrScheduleTooFar       = errors.New("notification is scheduled too far in the future")
+	ErrScheduledNotFound    = errors.New("scheduled notification not found")
+	ErrUrgentNotSchedulable = errors.New("notifications awaited by a sender can't be scheduled")
+)
+
+// ScheduledEntry is a notification waiting to be sent at a given time,
+// either scheduled by its sender or held back by the notifier.
+type ScheduledEntry struct {
+	Notification *Notification `json:"notification"`
+	DeliverAt    time.Time     `json:"deliver_at"`
+	// Stage is the stage of the pipeline the notifications held back resume
+	// at, the notifications scheduled by their sender going through all of
+	// them.
+	Stage string `json:"stage,omitempty"`
+	// Key identifies the window of the collapsed, coalesced and summarized
+	// notifications.
+	Key string `json:"key,omitempty"`
+}
+
+// Stages of the notifications held back in the schedule. The collapsed and
+// coalesced notifications are dispatched once their window ends, the
+// summaries and the delayed notifications are queued once due.
+const (
+	stageCollapse = "collapse"
+	stageCoalesce = "coalesce"
+	stageSummary  = "summary"
+	stageDelayed  = "delayed"
+)
+
+// ScheduleStore persists the scheduled notifications, keyed by the id of
+// their notification, so they survive restarts.
+type ScheduleStore interface {
+	Save(entry *ScheduledEntry) error
+	// Due returns the entries to be sent at the given time.
+	Due(now time.Time) ([]*ScheduledEntry, error)
+	// Delete returns ErrScheduledNotFound when no notification of the id is
+	// scheduled.
+	Delete(id string) error
+}
+
+// memorySchedule is an in memory ScheduleStore.
+type memorySchedule struct {
+	sync.Mutex
+	entries map[string]*ScheduledEntry
+}
+
+func newMemorySchedule() *memorySchedule {
+	return &memorySchedule{entries: make(map[string]*ScheduledEntry)}
+}
+
+func (m *memorySchedule) Save(entry *ScheduledEntry) error {
+	m.Lock()
+	defer m.Unlock()
+	m.entries[entry.Notification.ID] = entry
+	return nil
+}
+
+func (m *memorySchedule) Due(now time.Time) ([]*ScheduledEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+	var due []*ScheduledEntry
+	for _, entry := range m.entries {
+		if !entry.DeliverAt.After(now) {
+			due = append(due, entry)
+		}
+	}
+	return due, nil
+}
+
+// all returns every entry of the schedule, due or not.
+func (m *memorySchedule) all() []*ScheduledEntry {
+	m.Lock()
+	defer m.Unlock()
+	entries := make([]*ScheduledEntry, 0, len(m.entries))
+	for _, entry := range m.entries {
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func (m *memorySchedule) Delete(id string) error {
+	m.Lock()
+	defer m.Unlock()
+	if _, ok := m.entries[id]; !ok {
+		return ErrScheduledNotFound
+	}
+	delete(m.entries, id)
+	return nil
+}
+
+// fileSchedule is a ScheduleStore keeping each entry in a json file of a
+// directory.
+type fileSchedule struct {
+	files *jsonFiles[ScheduledEntry]
+}
+
+// NewFileScheduleStore returns a ScheduleStore keeping the entries in the
+// directory, which is created when missing.
+func NewFileScheduleStore(dir string) (ScheduleStore, error) {
+	files, err := newJSONFiles[ScheduledEntry](dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schedule directory %v", err)
+	}
+	return &fileSchedule{files: files}, nil
+}
+
+func (f *fileSchedule) Save(entry *ScheduledEntry) error {
+	return f.files.save(entry.Notification.ID, entry)
+}
+
+func (f *fileSchedule) Due(now time.Time) ([]*ScheduledEntry, error) {
+	return f.files.all(func(entry *ScheduledEntry) bool {
+		return !entry.DeliverAt.After(now)
+	})
+}
+
+func (f *fileSchedule) Delete(id string) error {
+	err := f.files.delete(id)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrScheduledNotFound
+	}
+	return err
+}
+
+// UseScheduleStore replaces the store the scheduled and held back
+// notifications are kept in, in memory by default, for example with a
+// persistent one. It must be set before sending notifications.
+func (n *Notifier) UseScheduleStore(store ScheduleStore) {
+	n.schedule = store
+}
+
+// holder keeps the notifications held back by the windows in the schedule.
+type holder interface {
+	// hold saves the entry, replacing the entry of the replaced id if any.
+	hold(entry *ScheduledEntry, replaced string) error
+	// release deletes the entry of the id.
+	release(id string) error
+}
+
+// hold saves the notification held back in the schedule, replacing the entry
+// of the replaced id if any. The scheduler is woken up once a new entry is
+// due rather than at its next check.
+func (n *Notifier) hold(entry *ScheduledEntry, replaced string) error {
+	if err := n.schedule.Save(entry); err != nil {
+		return err
+	}
+	if replaced == "" {
+		time.AfterFunc(time.Until(entry.DeliverAt), func() {
+			n.sendScheduled(context.Background(), time.Now())
+		})
+		return nil
+	}
+	if replaced != entry.Notification.ID {
+		if err := n.schedule.Delete(replaced); err != nil && !errors.Is(err, ErrScheduledNotFound) {
+			n.logFor(context.Background(), entry.Notification).Error("failed to delete replaced notification", "replaced", replaced, "error", err)
+		}
+	}
+	return nil
+}
+
+func (n *Notifier) release(id string) error {
+	return n.schedule.Delete(id)
+}
+
+// Schedule keeps the notification to be sent at the given time by
+// RunScheduler, returning its id. The notifications awaited by a sender
+// can't be scheduled.
+func (n *Notifier) Schedule(c context.Context, request *Notification, deliverAt time.Time) (string, error) {
+	if !n.scheduling {
+		return "", ErrSchedulingDisabled
+	}
+	if n.stopping.Load() {
+		return "", ErrShuttingDown
+	}
+	if IsUrgent(request.Template) {
+		return "", ErrUrgentNotSchedulable
+	}
+	if n.scheduleMaxDelay > 0 && time.Until(deliverAt) > n.scheduleMaxDelay {
+		return "", ErrScheduleTooFar
+	}
+	if _, err := n.service(request, request.Type); err != nil {
+		return "", err
+	}
+	if _, err := n.versionBuilder(request); err != nil {
+		return "", err
+	}
+	if request.ID == "" {
+		if request.ID = newNotificationID(); request.ID == "" {
+			return "", errors.New("failed to generate the notification id")
+		}
+	}
+	if err := n.schedule.Save(&ScheduledEntry{Notification: request, DeliverAt: deliverAt}); err != nil {
+		return "", err
+	}
+	n.logFor(c, request).Info("scheduled notification", "deliver_at", deliverAt)
+	n.setStatus(request, StatusScheduled, nil, nil)
+	return request.ID, nil
+}
+
+// CancelScheduled drops the scheduled or held back notification of the id,
+// returning ErrScheduledNotFound when it is not scheduled, or no longer.
+func (n *Notifier) CancelScheduled(id string) error {
+	if err := n.schedule.Delete(id); err != nil {
+		return err
+	}
+	if n.statuses != nil {
+		if status, err := n.statuses.Status(id); err == nil && status.Notification != nil {
+			n.setStatus(status.Notification, StatusCancelled, nil, nil)
+		}
+	}
+	return nil
+}
+
+// RunScheduler sends the scheduled and held back notifications as they
+// become due, checking the schedule at the given interval until ctx is done.
+// The notifications held back are sent once due anyway, the scheduler
+// sending those kept in a persistent store after a restart.
+func (n *Notifier) RunScheduler(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n.sendScheduled(ctx, time.Now())
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// sendScheduled sends the due notifications of the schedule. An entry is
+// deleted before its notification is sent, so a notification cancelled
+// meanwhile is not sent, and saved again when the queue is full.
+func (n *Notifier) sendScheduled(ctx context.Context, now time.Time) {
+	// The entries are left in the schedule once the notifier stops.
+	if n.stopping.Load() {
+		return
+	}
+	entries, err := n.schedule.Due(now)
+	if err != nil {
+		n.logger.Error("failed to read the scheduled notifications", "error", err)
+		return
+	}
+	for _, entry := range entries {
+		logger := n.logFor(ctx, entry.Notification)
+		if err := n.take(entry); err != nil {
+			if !errors.Is(err, ErrScheduledNotFound) {
+				logger.Error("failed to delete scheduled notification", "error", err)
+			}
+			continue
+		}
+		err := n.resume(entry)
+		if errors.Is(err, ErrQueueFull) {
+			logger.Info("queue is full, sending scheduled notification later")
+			if err := n.schedule.Save(entry); err != nil {
+				logger.Error("failed to save scheduled notification", "error", err)
+			}
+			continue
+		}
+		if err != nil {
+			logger.Error("failed to send scheduled notification", "stage", entry.Stage, "error", err)
+			if entry.Stage != "" {
+				n.setStatus(entry.Notification, StatusFailed, nil, err)
+			}
+		}
+	}
+}
+
+// take deletes the due entry from the schedule, closing the window holding
+// it if any.
+func (n *Notifier) take(entry *ScheduledEntry) error {
+	switch {
+	case entry.Stage == stageCollapse && n.collapse != nil:
+		return n.collapse.take(entry)
+	case entry.Stage == stageCoalesce && n.coalesce != nil:
+		return n.coalesce.take(entry)
+	case entry.Stage == stageSummary && n.summary != nil:
+		return n.summary.take(entry)
+	}
+	return n.schedule.Delete(entry.Notification.ID)
+}
+
+// resume sends the due notification from the stage it was held back at.
+func (n *Notifier) resume(entry *ScheduledEntry) error {
+	// The request context is gone by the time the notification is sent.
+	ctx := context.Background()
+	switch entry.Stage {
+	case stageCollapse, stageCoalesce:
+		_, err := n.dispatch(ctx, entry.Notification, nil)
+		return err
+	case stageSummary, stageDelayed:
+		return n.enqueue(ctx, entry.Notification, nil)
+	}
+	// The notification is sent the way it would have been when received.
+	_, err := n.notify(ctx, entry.Notification, nil)
+	return err
+}
@@ -0,0 +1,312 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"firebase.google.com/go/messaging"
+	"github.com/breez/notify/notify"
+	"github.com/golang-jwt/jwt"
+)
+
+const (
+	APNSProductionEndpoint = "https://api.push.apple.com"
+	APNSSandboxEndpoint    = "https://api.sandbox.push.apple.com"
+	// apnsTokenRefresh is how long a provider token is used, APNS rejecting
+	// the tokens older than an hour and those refreshed more often than every
+	// 20 minutes.
+	apnsTokenRefresh = 45 * time.Minute
+)
+
+// APNSBundles selects the bundle id, the apns-topic, of the apps the
+// notifications are sent to, e.g. the mainnet and testnet builds of an app.
+type APNSBundles struct {
+	// Default is the bundle id of the notifications without an app id.
+	Default string
+	// Apps maps the app ids of the notifications to their bundle id.
+	Apps map[string]string
+}
+
+// bundle returns the bundle id of the app.
+func (b *APNSBundles) bundle(appID string) (string, error) {
+	if appID == "" {
+		if b.Default == "" {
+			return "", errors.New("app_id is required, no default apns bundle is configured")
+		}
+		return b.Default, nil
+	}
+	bundle, ok := b.Apps[appID]
+	if !ok {
+		return "", fmt.Errorf("unknown app_id %v", appID)
+	}
+	return bundle, nil
+}
+
+// any returns the default bundle id, or the first of those of the apps when
+// there is no default one.
+func (b *APNSBundles) any() string {
+	if b.Default != "" {
+		return b.Default
+	}
+	var bundles []string
+	for _, bundle := range b.Apps {
+		bundles = append(bundles, bundle)
+	}
+	sort.Strings(bundles)
+	if len(bundles) == 0 {
+		return ""
+	}
+	return bundles[0]
+}
+
+// APNS delivers notifications to iOS devices through APNS directly rather
+// than through FCM, authenticating either with a provider token signed with a
+// p8 key or with a certificate. The target identifier of the notifications is
+// the APNS device token. The payloads are those of the ios FCM messages.
+type APNS struct {
+	messageBuilder FCMMessageBuilder
+	endpoint       string
+	bundles        APNSBundles
+	// token is nil when authenticating with a certificate.
+	token      *apnsToken
+	httpClient *http.Client
+}
+
+// NewAPNSWithKey returns the APNS service authenticating with provider tokens
+// signed with the p8 key of keyID, of the team.
+func NewAPNSWithKey(messageBuilder FCMMessageBuilder, endpoint string, bundles APNSBundles, keyPEM []byte, keyID string, teamID string) (*APNS, error) {
+	key, err := jwt.ParseECPrivateKeyFromPEM(keyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid apns key: %w", err)
+	}
+	return &APNS{
+		messageBuilder: messageBuilder,
+		endpoint:       strings.TrimSuffix(endpoint, "/"),
+		bundles:        bundles,
+		token:          &apnsToken{key: key, keyID: keyID, teamID: teamID},
+		httpClient:     &http.Client{Timeout: 30 * time.Second},
+	}, nil
+}
+
+// NewAPNSWithCertificate returns the APNS service authenticating with the
+// certificate of the app.
+func NewAPNSWithCertificate(messageBuilder FCMMessageBuilder, endpoint string, bundles APNSBundles, cert tls.Certificate) *APNS {
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{Certificates: []tls.Certificate{cert}},
+		ForceAttemptHTTP2: true,
+	}
+	return &APNS{
+		messageBuilder: messageBuilder,
+		endpoint:       strings.TrimSuffix(endpoint, "/"),
+		bundles:        bundles,
+		httpClient:     &http.Client{Timeout: 30 * time.Second, Transport: transport},
+	}
+}
+
+func (a *APNS) Render(req *notify.Notification) (interface{}, error) {
+	message, err := a.buildMessage(req)
+	if err != nil {
+		return nil, err
+	}
+	return apnsPayload(message)
+}
+
+func (a *APNS) Send(ctx context.Context, req *notify.Notification) error {
+	_, err := a.SendMessage(ctx, req)
+	return err
+}
+
+// SendMessage sends the notification, returning the apns-id of the message.
+func (a *APNS) SendMessage(ctx context.Context, req *notify.Notification) (string, error) {
+	if req.TargetIdentifier == "" {
+		return "", notify.NewDeliveryError(notify.ReasonUnregistered, errors.New("empty apns device token"))
+	}
+	topic, err := a.bundles.bundle(req.AppID)
+	if err != nil {
+		return "", err
+	}
+	message, err := a.buildMessage(req)
+	if err != nil {
+		return "", err
+	}
+	reportPayloadSize(req, message)
+	payload, err := apnsPayload(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal apns payload %v", err)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/3/device/"+req.TargetIdentifier, bytes.NewReader(payload))
+	if err != nil {
+		return "", notify.NewDeliveryError(notify.ReasonUnregistered, err)
+	}
+	for header, value := range message.APNS.Headers {
+		request.Header.Set(header, value)
+	}
+	if request.Header.Get("apns-push-type") == "" {
+		request.Header.Set("apns-push-type", "alert")
+	}
+	request.Header.Set("apns-topic", topic)
+	if a.token != nil {
+		token, err := a.token.get(time.Now())
+		if err != nil {
+			return "", notify.NewDeliveryError(notify.ReasonAuth, err)
+		}
+		request.Header.Set("Authorization", "bearer "+token)
+	}
+
+	res, err := a.httpClient.Do(request)
+	if err != nil {
+		return "", notify.NewDeliveryError(notify.Reason(err), fmt.Errorf("failed to send apns message %w", err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		var body struct {
+			Reason string `json:"reason"`
+		}
+		_ = json.NewDecoder(io.LimitReader(res.Body, 512)).Decode(&body)
+		return "", notify.NewDeliveryError(apnsErrorReason(res.StatusCode, body.Reason),
+			fmt.Errorf("failed to send apns message, status: %v, reason: %v", res.StatusCode, body.Reason))
+	}
+	return res.Header.Get("apns-id"), nil
+}
+
+// Healthy reports whether the provider token can be signed.
+func (a *APNS) Healthy(ctx context.Context) error {
+	if a.token == nil {
+		return nil
+	}
+	_, err := a.token.get(time.Now())
+	return err
+}
+
+// CheckProvider verifies the credentials of the service and its connectivity
+// with a background push to an invalid device token, which APNS only rejects
+// as such once the provider token or the certificate is accepted.
+func (a *APNS) CheckProvider(ctx context.Context) error {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/3/device/"+healthCheckToken,
+		strings.NewReader(`{"aps":{"content-available":1}}`))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("apns-push-type", "background")
+	request.Header.Set("apns-priority", "5")
+	if topic := a.bundles.any(); topic != "" {
+		request.Header.Set("apns-topic", topic)
+	}
+	if a.token != nil {
+		token, err := a.token.get(time.Now())
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Authorization", "bearer "+token)
+	}
+
+	res, err := a.httpClient.Do(request)
+	if err != nil {
+		return fmt.Errorf("apns check failed %w", err)
+	}
+	defer res.Body.Close()
+	var body struct {
+		Reason string `json:"reason"`
+	}
+	_ = json.NewDecoder(io.LimitReader(res.Body, 512)).Decode(&body)
+	if res.StatusCode == http.StatusOK || apnsErrorReason(res.StatusCode, body.Reason) == notify.ReasonUnregistered {
+		return nil
+	}
+	return fmt.Errorf("apns check failed, status: %v, reason: %v", res.StatusCode, body.Reason)
+}
+
+func (a *APNS) buildMessage(req *notify.Notification) (*messaging.Message, error) {
+	message, err := a.messageBuilder(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message %v", err)
+	}
+	if message == nil || message.APNS == nil || message.APNS.Payload == nil {
+		return nil, ErrUnrecognizedTemplate
+	}
+	return message, nil
+}
+
+// apnsPayload returns the APNS payload of the message, its data being custom
+// keys next to aps like FCM delivers them.
+func apnsPayload(message *messaging.Message) ([]byte, error) {
+	payload, err := json.Marshal(message.APNS.Payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(message.Data) == 0 {
+		return payload, nil
+	}
+	var keys map[string]interface{}
+	if err := json.Unmarshal(payload, &keys); err != nil {
+		return nil, err
+	}
+	for key, value := range message.Data {
+		if _, ok := keys[key]; !ok {
+			keys[key] = value
+		}
+	}
+	return json.Marshal(keys)
+}
+
+// apnsErrorReason classifies the statuses and reasons returned by APNS.
+func apnsErrorReason(status int, reason string) notify.ErrorReason {
+	switch reason {
+	case "BadDeviceToken", "Unregistered", "DeviceTokenNotForTopic":
+		return notify.ReasonUnregistered
+	case "ExpiredProviderToken", "InvalidProviderToken", "MissingProviderToken", "BadCertificate", "BadCertificateEnvironment":
+		return notify.ReasonAuth
+	}
+	switch status {
+	case http.StatusGone:
+		return notify.ReasonUnregistered
+	case http.StatusRequestEntityTooLarge:
+		return notify.ReasonTooLarge
+	case http.StatusTooManyRequests:
+		return notify.ReasonThrottled
+	case http.StatusForbidden:
+		return notify.ReasonAuth
+	}
+	if status >= http.StatusInternalServerError {
+		return notify.ReasonUnavailable
+	}
+	return notify.ReasonUnknown
+}
+
+// apnsToken signs the provider tokens, reusing each of them until it is due
+// for a refresh.
+type apnsToken struct {
+	sync.Mutex
+	key      *ecdsa.PrivateKey
+	keyID    string
+	teamID   string
+	token    string
+	issuedAt time.Time
+}
+
+func (t *apnsToken) get(now time.Time) (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	if t.token != "" && now.Sub(t.issuedAt) < apnsTokenRefresh {
+		return t.token, nil
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{"iss": t.teamID, "iat": now.Unix()})
+	token.Header["kid"] = t.keyID
+	signed, err := token.SignedString(t.key)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign apns provider token: %w", err)
+	}
+	t.token, t.issuedAt = signed, now
+	return signed, nil
+}
@@ -0,0 +1,37 @@
+package services
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// EndpointTransport sends every request to the endpoint base url instead of
+// the host the request was built for, keeping the request path.
+type EndpointTransport struct {
+	endpoint *url.URL
+	next     http.RoundTripper
+}
+
+func NewEndpointTransport(endpoint string, next http.RoundTripper) (*EndpointTransport, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	return &EndpointTransport{endpoint: u, next: next}, nil
+}
+
+func (t *EndpointTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrip must not modify the caller's request.
+	r := req.Clone(req.Context())
+	r.URL.Scheme = t.endpoint.Scheme
+	r.URL.Host = t.endpoint.Host
+	r.URL.Path = strings.TrimSuffix(t.endpoint.Path, "/") + req.URL.Path
+	r.URL.RawPath = ""
+	r.Host = ""
+	return t.next.RoundTrip(r)
+}
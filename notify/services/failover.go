@@ -0,0 +1,189 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/breez/notify/notify"
+	"golang.org/x/exp/slog"
+)
+
+// Failover delivers notifications through a primary service and switches new
+// sends to a secondary service once the primary failed threshold times in a
+// row, or failed its health or provider check. Only the failures of the
+// provider count: those of the notifications or their tokens can't be
+// delivered by the secondary either. Once the recovery interval passed, the
+// primary is back as soon as it passes its checks, or once a single send
+// probing it succeeds.
+type Failover struct {
+	sync.Mutex
+	primary          notify.Service
+	secondary        notify.Service
+	threshold        int
+	recoveryInterval time.Duration
+	failures         int
+	failedAt         time.Time
+	// failedOver is set while the sends go to the secondary.
+	failedOver bool
+	// probing is set while a send probes the primary after the recovery
+	// interval.
+	probing bool
+}
+
+func NewFailover(primary, secondary notify.Service, threshold int, recoveryInterval time.Duration) *Failover {
+	return &Failover{
+		primary:          primary,
+		secondary:        secondary,
+		threshold:        threshold,
+		recoveryInterval: recoveryInterval,
+	}
+}
+
+func (f *Failover) Send(context context.Context, req *notify.Notification) error {
+	_, err := f.SendMessage(context, req)
+	return err
+}
+
+func (f *Failover) SendMessage(context context.Context, req *notify.Notification) (string, error) {
+	if !f.usePrimary() {
+		return notify.SendMessage(context, f.secondary, req)
+	}
+
+	messageID, err := notify.SendMessage(context, f.primary, req)
+	f.record(err)
+	return messageID, err
+}
+
+func (f *Failover) Render(req *notify.Notification) (interface{}, error) {
+	service := f.primary
+	if f.isFailedOver() {
+		service = f.secondary
+	}
+	renderer, ok := service.(notify.Renderer)
+	if !ok {
+		return nil, nil
+	}
+	return renderer.Render(req)
+}
+
+// Healthy reports whether the primary or the secondary service can deliver,
+// failing over when the primary can't.
+func (f *Failover) Healthy(ctx context.Context) error {
+	err := healthy(ctx, f.primary)
+	f.check(err)
+	if err == nil {
+		return nil
+	}
+	if secondaryErr := healthy(ctx, f.secondary); secondaryErr != nil {
+		return fmt.Errorf("primary: %v, secondary: %v", err, secondaryErr)
+	}
+	return nil
+}
+
+// CheckProvider reports whether the provider of the primary or the secondary
+// service is reachable, failing over when the primary is not.
+func (f *Failover) CheckProvider(ctx context.Context) error {
+	err := checkProvider(ctx, f.primary)
+	f.check(err)
+	if err == nil {
+		return nil
+	}
+	if secondaryErr := checkProvider(ctx, f.secondary); secondaryErr != nil {
+		return fmt.Errorf("primary: %v, secondary: %v", err, secondaryErr)
+	}
+	return nil
+}
+
+// checkProvider checks the provider of the service when it is a provider
+// checker.
+func checkProvider(ctx context.Context, service notify.Service) error {
+	if checker, ok := service.(notify.ProviderChecker); ok {
+		return checker.CheckProvider(ctx)
+	}
+	return nil
+}
+
+// healthy checks the service when it is a health checker.
+func healthy(ctx context.Context, service notify.Service) error {
+	if checker, ok := service.(notify.HealthChecker); ok {
+		return checker.Healthy(ctx)
+	}
+	return nil
+}
+
+// isFailedOver reports whether the sends go to the secondary.
+func (f *Failover) isFailedOver() bool {
+	f.Lock()
+	defer f.Unlock()
+	return f.failedOver
+}
+
+// usePrimary reports whether a send goes to the primary, letting a single
+// send probe it once the recovery interval passed.
+func (f *Failover) usePrimary() bool {
+	f.Lock()
+	defer f.Unlock()
+	if !f.failedOver {
+		return true
+	}
+	if f.probing || time.Since(f.failedAt) < f.recoveryInterval {
+		return false
+	}
+	slog.Info("probing primary service after failover")
+	f.probing = true
+	return true
+}
+
+// record counts the failures of the provider of the primary, failing over
+// once they reach the threshold or the probe of the primary failed. The
+// other failures, e.g. cancelled sends, tell nothing about the provider.
+func (f *Failover) record(err error) {
+	f.Lock()
+	defer f.Unlock()
+	probe := f.probing
+	f.probing = false
+	reason := notify.Reason(err)
+	switch {
+	case err == nil || reason == notify.ReasonUnregistered || reason == notify.ReasonTooLarge:
+		// The provider answered, even though it refused the notification.
+		if f.failedOver {
+			slog.Info("primary service recovered")
+		}
+		f.failures = 0
+		f.failedOver = false
+	case notify.ProviderFailure(reason):
+		f.failures++
+		if f.failures >= f.threshold || probe {
+			slog.Error("primary service failed repeatedly, failing over", "failures", f.failures, "error", err)
+			f.failOver()
+		}
+	}
+}
+
+// check fails over when the check of the primary failed, and recovers once
+// it passes after the recovery interval.
+func (f *Failover) check(err error) {
+	f.Lock()
+	defer f.Unlock()
+	if err != nil {
+		if !f.failedOver {
+			slog.Error("primary service failed its check, failing over", "error", err)
+		}
+		f.failOver()
+		return
+	}
+	if f.failedOver && time.Since(f.failedAt) >= f.recoveryInterval {
+		slog.Info("primary service passed its check, recovering")
+		f.failures = 0
+		f.failedOver = false
+	}
+}
+
+// failOver sends to the secondary until the recovery interval passed. It must
+// be called with the lock held.
+func (f *Failover) failOver() {
+	f.failedOver = true
+	f.failedAt = time.Now()
+}
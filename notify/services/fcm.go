@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"strings"
 
 	"firebase.google.com/go/messaging"
 	"github.com/breez/notify/notify"
@@ -13,6 +14,10 @@ var (
 	ErrUnrecognizedTemplate = errors.New("unrecognized template")
 )
 
+// healthCheckToken is the token the provider checks send to, which no device
+// is ever registered with.
+const healthCheckToken = "healthcheck"
+
 type FCMMessageBuilder func(req *notify.Notification) (*messaging.Message, error)
 type FCM struct {
 	messageBuilder FCMMessageBuilder
@@ -23,18 +28,82 @@ func NewFCM(messageBuilder FCMMessageBuilder, client *messaging.Client) *FCM {
 	return &FCM{messageBuilder: messageBuilder, client: client}
 }
 
-func (f *FCM) Send(context context.Context, req *notify.Notification) error {
-	pushNotification, err := f.messageBuilder(req)
+func (f *FCM) Render(req *notify.Notification) (interface{}, error) {
+	return f.buildMessage(req)
+}
+
+func (f *FCM) Send(ctx context.Context, req *notify.Notification) error {
+	_, err := f.SendMessage(ctx, req)
+	return err
+}
+
+// SendMessage sends the notification, returning the id of the fcm message.
+// Unlike the legacy api, the v1 api doesn't return canonical registration
+// ids: a replaced token fails as unregistered instead of being migrated with
+// notify.ReportTokenMigration.
+func (f *FCM) SendMessage(ctx context.Context, req *notify.Notification) (string, error) {
+	pushNotification, err := f.buildMessage(req)
 	if err != nil {
-		return fmt.Errorf("failed to create message %v", err)
+		return "", err
 	}
-	if pushNotification == nil {
-		return ErrUnrecognizedTemplate
-	}
-	_, err = f.client.Send(context, pushNotification)
+	reportPayloadSize(req, pushNotification)
+	messageID, err := f.client.Send(ctx, pushNotification)
 	if err != nil {
-		return fmt.Errorf("failed to send fcm message %v", err)
+		return "", notify.NewDeliveryError(fcmErrorReason(err), fmt.Errorf("failed to send fcm message %w", err))
 	}
 
+	return messageID, nil
+}
+
+// Healthy reports whether the fcm client was initialized with its
+// credentials.
+func (f *FCM) Healthy(ctx context.Context) error {
+	if f.client == nil {
+		return errors.New("fcm client is not initialized")
+	}
 	return nil
 }
+
+// CheckProvider verifies the credentials of the fcm client and its
+// connectivity with a dry run of a message to an invalid token, which FCM
+// only rejects as such once the client is authenticated.
+func (f *FCM) CheckProvider(ctx context.Context) error {
+	if f.client == nil {
+		return errors.New("fcm client is not initialized")
+	}
+	_, err := f.client.SendDryRun(ctx, &messaging.Message{Token: healthCheckToken})
+	if err == nil || messaging.IsInvalidArgument(err) || messaging.IsRegistrationTokenNotRegistered(err) {
+		return nil
+	}
+	return fmt.Errorf("fcm check failed %w", err)
+}
+
+// fcmErrorReason classifies the errors returned by the fcm client.
+func fcmErrorReason(err error) notify.ErrorReason {
+	switch {
+	case messaging.IsRegistrationTokenNotRegistered(err):
+		return notify.ReasonUnregistered
+	case messaging.IsMessageRateExceeded(err):
+		return notify.ReasonThrottled
+	case messaging.IsInvalidAPNSCredentials(err), messaging.IsMismatchedCredential(err):
+		return notify.ReasonAuth
+	case messaging.IsServerUnavailable(err), messaging.IsInternal(err):
+		return notify.ReasonUnavailable
+	case messaging.IsInvalidArgument(err) && strings.Contains(strings.ToLower(err.Error()), "too big"):
+		return notify.ReasonTooLarge
+	case errors.Is(err, context.DeadlineExceeded):
+		return notify.ReasonTimeout
+	}
+	return notify.ReasonUnknown
+}
+
+func (f *FCM) buildMessage(req *notify.Notification) (*messaging.Message, error) {
+	pushNotification, err := f.messageBuilder(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create message %v", err)
+	}
+	if pushNotification == nil {
+		return nil, ErrUnrecognizedTemplate
+	}
+	return pushNotification, nil
+}
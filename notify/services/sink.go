@@ -0,0 +1,91 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/breez/notify/notify"
+)
+
+type sinkRecord struct {
+	Notification *notify.Notification `json:"notification"`
+	Payload      interface{}          `json:"payload,omitempty"`
+}
+
+// Sink captures notifications instead of delivering them to devices. Each
+// notification, along with the payload built by the renderer, is appended as
+// a json line to a file or posted to an http endpoint.
+type Sink struct {
+	sync.Mutex
+	destination string
+	renderer    notify.Renderer
+	httpClient  *http.Client
+}
+
+func NewSink(destination string, renderer notify.Renderer) *Sink {
+	return &Sink{
+		destination: destination,
+		renderer:    renderer,
+		httpClient:  http.DefaultClient,
+	}
+}
+
+func (s *Sink) Render(req *notify.Notification) (interface{}, error) {
+	if s.renderer == nil {
+		return nil, nil
+	}
+	return s.renderer.Render(req)
+}
+
+func (s *Sink) Send(context context.Context, req *notify.Notification) error {
+	payload, err := s.Render(req)
+	if err != nil {
+		return err
+	}
+	record, err := json.Marshal(sinkRecord{Notification: req, Payload: payload})
+	if err != nil {
+		return fmt.Errorf("failed to marshal sink record %v", err)
+	}
+
+	if strings.HasPrefix(s.destination, "http://") || strings.HasPrefix(s.destination, "https://") {
+		return s.post(context, record)
+	}
+	return s.append(record)
+}
+
+func (s *Sink) post(context context.Context, record []byte) error {
+	req, err := http.NewRequestWithContext(context, http.MethodPost, s.destination, bytes.NewReader(record))
+	if err != nil {
+		return fmt.Errorf("failed to create sink request %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := s.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post to sink %v", err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		return fmt.Errorf("sink responded with status %v", res.StatusCode)
+	}
+	return nil
+}
+
+func (s *Sink) append(record []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	file, err := os.OpenFile(s.destination, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open sink file %v", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(append(record, '\n')); err != nil {
+		return fmt.Errorf("failed to write to sink file %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package services
+
+import (
+	"encoding/json"
+
+	"firebase.google.com/go/messaging"
+	"github.com/breez/notify/notify"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// fcmDataLimit is the maximum size in bytes of the data of an fcm message.
+	fcmDataLimit = 4096
+	// apnsPayloadLimit is the maximum size in bytes of an APNS payload.
+	apnsPayloadLimit = 4096
+	// payloadHeadroomRatio is the share of the limit above which payloads are
+	// reported, before they grow enough to be rejected.
+	payloadHeadroomRatio = 0.8
+)
+
+// payloadSize returns the size of the message payload as accounted by the
+// provider of the platform, along with the limit of that provider.
+func payloadSize(platform string, message *messaging.Message) (int, int) {
+	dataSize := 0
+	for key, value := range message.Data {
+		dataSize += len(key) + len(value)
+	}
+	if (platform != "ios" && platform != "apns") || message.APNS == nil || message.APNS.Payload == nil {
+		return dataSize, fcmDataLimit
+	}
+
+	// The data is delivered as custom keys of the APNS payload.
+	payload, err := json.Marshal(message.APNS.Payload)
+	if err != nil {
+		return dataSize, apnsPayloadLimit
+	}
+	data, _ := json.Marshal(message.Data)
+	return len(payload) + len(data), apnsPayloadLimit
+}
+
+// reportPayloadSize logs the payloads approaching the size limit of their
+// platform.
+func reportPayloadSize(req *notify.Notification, message *messaging.Message) {
+	size, limit := payloadSize(req.Type, message)
+	if float64(size) > float64(limit)*payloadHeadroomRatio {
+		slog.Info("payload close to the size limit", "request_id", req.RequestID, "template", req.Template, "platform", req.Type, "size", size, "limit", limit)
+	}
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/breez/notify/notify"
+)
+
+// UnifiedPush delivers notifications to the UnifiedPush distributors of
+// de-googled devices, ntfy included. The target identifier of the
+// notifications is the push endpoint of the app, or an ntfy topic on the
+// default server.
+type UnifiedPush struct {
+	// server is the default server the topics are published to.
+	server *url.URL
+	// token authenticates the requests to the default server only, the
+	// endpoints of other distributors are not sent the token.
+	token      string
+	httpClient *http.Client
+}
+
+func NewUnifiedPush(server string, token string) (*UnifiedPush, error) {
+	serverURL, err := url.Parse(strings.TrimSuffix(server, "/"))
+	if err != nil || serverURL.Host == "" {
+		return nil, fmt.Errorf("invalid unifiedpush server %q", server)
+	}
+	return &UnifiedPush{server: serverURL, token: token, httpClient: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (u *UnifiedPush) Render(req *notify.Notification) (interface{}, error) {
+	return &webPushMessage{
+		NotificationType:    req.Template,
+		DisplayMessage:      req.DisplayMessage,
+		Body:                req.Body,
+		AppData:             req.AppData,
+		NotificationPayload: req.Data,
+	}, nil
+}
+
+func (u *UnifiedPush) Send(ctx context.Context, req *notify.Notification) error {
+	_, err := u.SendMessage(ctx, req)
+	return err
+}
+
+// SendMessage posts the notification to the endpoint of the target,
+// returning the url of the message at the distributor as its id when known.
+func (u *UnifiedPush) SendMessage(ctx context.Context, req *notify.Notification) (string, error) {
+	endpoint, err := u.endpoint(req.TargetIdentifier)
+	if err != nil {
+		return "", notify.NewDeliveryError(notify.ReasonUnregistered, err)
+	}
+
+	message, _ := u.Render(req)
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal unifiedpush message %v", err)
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint.String(), bytes.NewReader(payload))
+	if err != nil {
+		return "", notify.NewDeliveryError(notify.ReasonUnregistered, err)
+	}
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = webPushDefaultTTL
+	}
+	request.Header.Set("TTL", strconv.Itoa(int(ttl.Seconds())))
+	if notify.IsUrgent(req.Template) {
+		request.Header.Set("Urgency", "high")
+	}
+	if u.token != "" && endpoint.Host == u.server.Host {
+		request.Header.Set("Authorization", "Bearer "+u.token)
+	}
+
+	res, err := u.httpClient.Do(request)
+	if err != nil {
+		return "", notify.NewDeliveryError(notify.Reason(err), fmt.Errorf("failed to send unifiedpush %w", err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return "", notify.NewDeliveryError(webPushErrorReason(res.StatusCode),
+			fmt.Errorf("failed to send unifiedpush, status: %v, body: %s", res.StatusCode, body))
+	}
+	io.Copy(io.Discard, res.Body)
+	return res.Header.Get("Location"), nil
+}
+
+// endpoint returns the push endpoint of the target, either an https url or a
+// topic of the default server.
+func (u *UnifiedPush) endpoint(target string) (*url.URL, error) {
+	if !strings.Contains(target, "/") {
+		if target == "" {
+			return nil, fmt.Errorf("empty unifiedpush target")
+		}
+		return u.server.JoinPath(target), nil
+	}
+	endpoint, err := url.Parse(target)
+	if err != nil || endpoint.Host == "" {
+		return nil, fmt.Errorf("invalid unifiedpush endpoint")
+	}
+	// Only the default server may be reached over plain http.
+	if endpoint.Scheme != "https" && !(endpoint.Scheme == u.server.Scheme && endpoint.Host == u.server.Host) {
+		return nil, fmt.Errorf("unifiedpush endpoint must use https")
+	}
+	return endpoint, nil
+}
@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	webpush "github.com/SherClockHolmes/webpush-go"
+	"github.com/breez/notify/notify"
+)
+
+// webPushDefaultTTL is how long the push service keeps notifications without
+// a TTL for offline browsers.
+const webPushDefaultTTL = 24 * time.Hour
+
+// webPushMessage is the payload delivered to the service worker, using the
+// same keys as the data of the mobile pushes.
+type webPushMessage struct {
+	NotificationType    string                 `json:"notification_type"`
+	DisplayMessage      string                 `json:"display_message"`
+	Body                string                 `json:"body,omitempty"`
+	AppData             *string                `json:"app_data,omitempty"`
+	NotificationPayload map[string]interface{} `json:"notification_payload"`
+}
+
+// WebPush delivers notifications to browsers using the Web Push protocol with
+// VAPID authentication. The target identifier of the notifications is the
+// json PushSubscription of the browser.
+type WebPush struct {
+	subscriber string
+	publicKey  string
+	privateKey string
+	httpClient *http.Client
+}
+
+func NewWebPush(subscriber string, publicKey string, privateKey string) *WebPush {
+	return &WebPush{
+		subscriber: subscriber,
+		publicKey:  publicKey,
+		privateKey: privateKey,
+		httpClient: http.DefaultClient,
+	}
+}
+
+func (w *WebPush) Render(req *notify.Notification) (interface{}, error) {
+	return &webPushMessage{
+		NotificationType:    req.Template,
+		DisplayMessage:      req.DisplayMessage,
+		Body:                req.Body,
+		AppData:             req.AppData,
+		NotificationPayload: req.Data,
+	}, nil
+}
+
+func (w *WebPush) Send(ctx context.Context, req *notify.Notification) error {
+	_, err := w.SendMessage(ctx, req)
+	return err
+}
+
+// SendMessage sends the notification, returning the url of the message at
+// the push service as its id.
+func (w *WebPush) SendMessage(ctx context.Context, req *notify.Notification) (string, error) {
+	var subscription webpush.Subscription
+	if err := json.Unmarshal([]byte(req.TargetIdentifier), &subscription); err != nil || subscription.Endpoint == "" {
+		return "", notify.NewDeliveryError(notify.ReasonUnregistered, fmt.Errorf("invalid push subscription"))
+	}
+
+	message, _ := w.Render(req)
+	payload, err := json.Marshal(message)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal web push message %v", err)
+	}
+
+	ttl := req.TTL
+	if ttl <= 0 {
+		ttl = webPushDefaultTTL
+	}
+	urgency := webpush.UrgencyNormal
+	if notify.IsUrgent(req.Template) {
+		urgency = webpush.UrgencyHigh
+	}
+	res, err := webpush.SendNotificationWithContext(ctx, payload, &subscription, &webpush.Options{
+		HTTPClient:      w.httpClient,
+		Subscriber:      w.subscriber,
+		TTL:             int(ttl.Seconds()),
+		Urgency:         urgency,
+		VAPIDPublicKey:  w.publicKey,
+		VAPIDPrivateKey: w.privateKey,
+	})
+	if err != nil {
+		return "", notify.NewDeliveryError(notify.Reason(err), fmt.Errorf("failed to send web push %w", err))
+	}
+	defer res.Body.Close()
+	if res.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return "", notify.NewDeliveryError(webPushErrorReason(res.StatusCode),
+			fmt.Errorf("failed to send web push, status: %v, body: %s", res.StatusCode, body))
+	}
+	return res.Header.Get("Location"), nil
+}
+
+// Healthy reports whether the VAPID keys are configured.
+func (w *WebPush) Healthy(ctx context.Context) error {
+	if w.publicKey == "" || w.privateKey == "" {
+		return fmt.Errorf("vapid keys are not configured")
+	}
+	return nil
+}
+
+// webPushErrorReason classifies the statuses returned by the push services.
+func webPushErrorReason(status int) notify.ErrorReason {
+	switch status {
+	case http.StatusNotFound, http.StatusGone:
+		return notify.ReasonUnregistered
+	case http.StatusRequestEntityTooLarge:
+		return notify.ReasonTooLarge
+	case http.StatusTooManyRequests:
+		return notify.ReasonThrottled
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return notify.ReasonAuth
+	}
+	if status >= http.StatusInternalServerError {
+		return notify.ReasonUnavailable
+	}
+	return notify.ReasonUnknown
+}
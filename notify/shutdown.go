@@ -0,0 +1,56 @@
+package notify
+
+import (
+	"context"
+	"time"
+)
+
+// Shutdown stops accepting notifications, refused with ErrShuttingDown, and
+// waits for the queued ones to be delivered, or for ctx to be done. The
+// notifications held back in a collapse or coalesce window of the memory
+// schedule are queued right away rather than lost, those of a persistent
+// schedule being sent after a restart.
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	n.stopping.Store(true)
+	if memory, ok := n.schedule.(*memorySchedule); ok {
+		n.flushHeld(memory)
+	}
+	released := make(chan struct{})
+	go func() {
+		n.queue.Release()
+		close(released)
+	}()
+
+	select {
+	case <-released:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flushHeld queues the notifications held back in the collapse and coalesce
+// windows of the memory schedule, cutting the windows short. The others are
+// not sent before their time, e.g. in the quiet hours of their target, and
+// are dropped unless due.
+func (n *Notifier) flushHeld(memory *memorySchedule) {
+	now := time.Now()
+	for _, entry := range memory.all() {
+		logger := n.logFor(context.Background(), entry.Notification)
+		cut := entry.Stage == stageCollapse || entry.Stage == stageCoalesce
+		if !cut && entry.DeliverAt.After(now) {
+			logger.Warn("dropping held back notification on shutdown", "stage", entry.Stage, "deliver_at", entry.DeliverAt)
+			if err := n.take(entry); err == nil {
+				n.setStatus(entry.Notification, StatusFailed, nil, ErrShuttingDown)
+			}
+			continue
+		}
+		if err := n.take(entry); err != nil {
+			continue
+		}
+		if err := n.enqueue(context.Background(), entry.Notification, nil); err != nil {
+			logger.Error("failed to queue held back notification on shutdown", "stage", entry.Stage, "error", err)
+			n.setStatus(entry.Notification, StatusFailed, nil, err)
+		}
+	}
+}
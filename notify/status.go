@@ -0,0 +1,233 @@
+package notify
+
+import (
+	"container/list"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrStatusDisabled = errors.New("delivery status tracking is disabled")
+	ErrStatusNotFound = errors.New("notification status not found")
+	ErrNotResendable  = errors.New("only failed notifications can be sent again")
+)
+
+// DeliveryStatus is the state of the delivery of a notification.
+type DeliveryStatus string
+
+const (
+	StatusQueued   DeliveryStatus = "queued"
+	StatusSent     DeliveryStatus = "sent"
+	StatusFailed   DeliveryStatus = "failed"
+	StatusRetrying DeliveryStatus = "retrying"
+	// StatusScheduled notifications are queued once due, unless cancelled.
+	StatusScheduled DeliveryStatus = "scheduled"
+	StatusCancelled DeliveryStatus = "cancelled"
+	// The notifications held back and never sent on their own end up
+	// dropped, replaced by a later notification of their collapse key,
+	// folded in a coalesced notification or counted in the daily summary.
+	StatusDropped    DeliveryStatus = "dropped"
+	StatusCollapsed  DeliveryStatus = "collapsed"
+	StatusCoalesced  DeliveryStatus = "coalesced"
+	StatusSummarized DeliveryStatus = "summarized"
+)
+
+// NotificationStatus is the latest known state of the delivery of a
+// notification. The target is masked.
+type NotificationStatus struct {
+	ID        string         `json:"id"`
+	RequestID string         `json:"request_id,omitempty"`
+	Template  string         `json:"template"`
+	Platform  string         `json:"platform"`
+	Target    string         `json:"target"`
+	Status    DeliveryStatus `json:"status"`
+	MessageID string         `json:"message_id,omitempty"`
+	// ErrorReason and Error describe the last failure of the delivery.
+	ErrorReason string    `json:"error_reason,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Notification is the notification as queued, kept to send it again. Its
+	// target is not masked.
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+// StatusFilter selects the statuses listed, its empty fields matching all the
+// notifications.
+type StatusFilter struct {
+	Template    string
+	Platform    string
+	Status      DeliveryStatus
+	TokenPrefix string
+	// Limit bounds the number of statuses listed, zero listing them all.
+	Limit int
+}
+
+// Matches reports whether the status is selected by the filter.
+func (f *StatusFilter) Matches(status *NotificationStatus) bool {
+	if f.Template != "" && status.Template != f.Template {
+		return false
+	}
+	if f.Platform != "" && status.Platform != f.Platform {
+		return false
+	}
+	if f.Status != "" && status.Status != f.Status {
+		return false
+	}
+	if f.TokenPrefix != "" && (status.Notification == nil || !strings.HasPrefix(status.Notification.TargetIdentifier, f.TokenPrefix)) {
+		return false
+	}
+	return true
+}
+
+// StatusStore keeps the delivery status of the notifications, for senders to
+// look into the deliveries reported missing by the users.
+type StatusStore interface {
+	SetStatus(status *NotificationStatus) error
+	// Status returns ErrStatusNotFound when the notification is unknown.
+	Status(id string) (*NotificationStatus, error)
+	// Statuses lists the statuses matching the filter, from the most to the
+	// least recently updated.
+	Statuses(filter StatusFilter) ([]*NotificationStatus, error)
+}
+
+// memoryStatuses is an in memory StatusStore keeping the statuses of the most
+// recently updated notifications when bounded.
+type memoryStatuses struct {
+	sync.Mutex
+	// order lists the statuses from the most to the least recently updated.
+	order    *list.List
+	statuses map[string]*list.Element
+	// maxEntries is zero when the statuses are not bounded.
+	maxEntries int
+}
+
+func newMemoryStatuses(maxEntries int) *memoryStatuses {
+	return &memoryStatuses{order: list.New(), statuses: make(map[string]*list.Element), maxEntries: maxEntries}
+}
+
+func (m *memoryStatuses) SetStatus(status *NotificationStatus) error {
+	m.Lock()
+	defer m.Unlock()
+	if element, ok := m.statuses[status.ID]; ok {
+		element.Value = status
+		m.order.MoveToFront(element)
+		return nil
+	}
+	if m.maxEntries > 0 && m.order.Len() >= m.maxEntries {
+		oldest := m.order.Back()
+		m.order.Remove(oldest)
+		delete(m.statuses, oldest.Value.(*NotificationStatus).ID)
+	}
+	m.statuses[status.ID] = m.order.PushFront(status)
+	return nil
+}
+
+func (m *memoryStatuses) Status(id string) (*NotificationStatus, error) {
+	m.Lock()
+	defer m.Unlock()
+	element, ok := m.statuses[id]
+	if !ok {
+		return nil, ErrStatusNotFound
+	}
+	status := *element.Value.(*NotificationStatus)
+	return &status, nil
+}
+
+func (m *memoryStatuses) Statuses(filter StatusFilter) ([]*NotificationStatus, error) {
+	m.Lock()
+	defer m.Unlock()
+	var statuses []*NotificationStatus
+	for element := m.order.Front(); element != nil; element = element.Next() {
+		if filter.Limit > 0 && len(statuses) >= filter.Limit {
+			break
+		}
+		if status := element.Value.(*NotificationStatus); filter.Matches(status) {
+			copied := *status
+			statuses = append(statuses, &copied)
+		}
+	}
+	return statuses, nil
+}
+
+// newNotificationID returns a random notification id.
+func newNotificationID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// UseStatusStore replaces the store the delivery status of the notifications
+// is kept in, for example with one shared by the instances.
+func (n *Notifier) UseStatusStore(store StatusStore) {
+	n.statuses = store
+}
+
+// Status returns the delivery status of the notification with the given id.
+func (n *Notifier) Status(id string) (*NotificationStatus, error) {
+	if n.statuses == nil {
+		return nil, ErrStatusDisabled
+	}
+	return n.statuses.Status(id)
+}
+
+// Statuses lists the delivery statuses of the recent notifications matching
+// the filter, the most recently updated first.
+func (n *Notifier) Statuses(filter StatusFilter) ([]*NotificationStatus, error) {
+	if n.statuses == nil {
+		return nil, ErrStatusDisabled
+	}
+	return n.statuses.Statuses(filter)
+}
+
+// Resend sends a failed notification again under the same id, waiting for its
+// delivery.
+func (n *Notifier) Resend(c context.Context, id string) (*Result, error) {
+	status, err := n.Status(id)
+	if err != nil {
+		return nil, err
+	}
+	if status.Status != StatusFailed || status.Notification == nil {
+		return nil, ErrNotResendable
+	}
+	request := *status.Notification
+	return n.NotifyAndWait(c, &request)
+}
+
+// setStatus records the delivery status of the notification, along with the
+// message id of the result or the failure when not nil.
+func (n *Notifier) setStatus(request *Notification, status DeliveryStatus, result *Result, err error) {
+	if n.statuses == nil || request.ID == "" {
+		return
+	}
+	record := &NotificationStatus{
+		ID:        request.ID,
+		RequestID: request.RequestID,
+		Template:  request.Template,
+		Platform:  request.Type,
+		Target:    MaskToken(request.TargetIdentifier),
+		Status:    status,
+		UpdatedAt: time.Now(),
+	}
+	queued := *request
+	record.Notification = &queued
+	if result != nil {
+		record.MessageID = result.MessageID
+		if result.Platform != "" {
+			record.Platform = result.Platform
+		}
+	}
+	if err != nil {
+		record.ErrorReason = string(Reason(err))
+		record.Error = err.Error()
+	}
+	if err := n.statuses.SetStatus(record); err != nil {
+		n.logFor(context.Background(), request).Error("failed to record the delivery status", "status", status, "error", err)
+	}
+}
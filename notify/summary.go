@@ -0,0 +1,127 @@
+package notify
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// targetSummary holds the counts of the notifications of a target awaiting
+// its summary, and the entry of the summary.
+type targetSummary struct {
+	entry  *ScheduledEntry
+	counts map[string]int
+	total  int
+}
+
+// summaryBuffer aggregates the non urgent notifications of targets opted in
+// the daily summary, and sends a single summary notification per target at the
+// summary hour of the device timezone, or UTC when unknown. The summary is
+// kept in the schedule until then.
+type summaryBuffer struct {
+	sync.Mutex
+	templates map[string]bool
+	hour      int
+	holder    holder
+	logFor    func(context.Context, *Notification) *slog.Logger
+	targets   map[string]*targetSummary
+}
+
+func newSummaryBuffer(templates []string, hour int, holder holder, logFor func(context.Context, *Notification) *slog.Logger) *summaryBuffer {
+	summary := &summaryBuffer{
+		templates: make(map[string]bool, len(templates)),
+		hour:      hour,
+		holder:    holder,
+		logFor:    logFor,
+		targets:   make(map[string]*targetSummary),
+	}
+	for _, template := range templates {
+		summary.templates[template] = true
+	}
+	return summary
+}
+
+// add counts the notification in the summary of its target if it belongs to
+// it, returning false when it should be sent right away.
+func (s *summaryBuffer) add(request *Notification, now time.Time) (bool, error) {
+	if !request.Summary || IsUrgent(request.Template) || !s.templates[request.Template] {
+		return false, nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	// A summary past its hour is being sent, the notification opens a new one.
+	target, ok := s.targets[request.TargetIdentifier]
+	replaced := ""
+	if ok && target.entry.DeliverAt.After(now) {
+		replaced = target.entry.Notification.ID
+	} else {
+		location, err := deviceLocation(request)
+		if err != nil {
+			s.logFor(context.Background(), request).Debug("invalid device timezone", "error", err)
+		}
+		if location == nil {
+			location = time.UTC
+		}
+		delay := untilLocalHour(now, location, s.hour)
+		s.logFor(context.Background(), request).Info("scheduling daily summary", "delay", delay)
+		target = &targetSummary{
+			entry:  &ScheduledEntry{Notification: &Notification{ID: newNotificationID()}, DeliverAt: now.Add(delay), Stage: stageSummary, Key: request.TargetIdentifier},
+			counts: make(map[string]int),
+		}
+	}
+
+	counts := make(map[string]int, len(target.counts)+1)
+	for template, count := range target.counts {
+		counts[template] = count
+	}
+	counts[request.Template]++
+	entry := &ScheduledEntry{
+		Notification: summarize(target.entry.Notification.ID, request, counts, target.total+1),
+		DeliverAt:    target.entry.DeliverAt,
+		Stage:        stageSummary,
+		Key:          request.TargetIdentifier,
+	}
+	if err := s.holder.hold(entry, replaced); err != nil {
+		return false, err
+	}
+	target.entry, target.counts = entry, counts
+	target.total++
+	s.targets[request.TargetIdentifier] = target
+	return true, nil
+}
+
+// take deletes the due entry from the schedule, closing the summary of its
+// target unless a new one was opened meanwhile.
+func (s *summaryBuffer) take(entry *ScheduledEntry) error {
+	s.Lock()
+	defer s.Unlock()
+	if target, ok := s.targets[entry.Key]; ok && target.entry.Notification.ID == entry.Notification.ID {
+		delete(s.targets, entry.Key)
+	}
+	return s.holder.release(entry.Notification.ID)
+}
+
+// summarize returns the summary notification of the id, counting the
+// notifications of each template, sent to the target of the last one.
+func summarize(id string, last *Notification, counts map[string]int, total int) *Notification {
+	data := make(map[string]interface{}, len(counts))
+	for template, count := range counts {
+		data[template] = count
+	}
+	return &Notification{
+		ID:               id,
+		Template:         NOTIFICATION_DAILY_SUMMARY,
+		DisplayMessage:   fmt.Sprintf("%v new events today", total),
+		Type:             last.Type,
+		TargetIdentifier: last.TargetIdentifier,
+		App:              last.App,
+		AppID:            last.AppID,
+		AppData:          last.AppData,
+		Timezone:         last.Timezone,
+		Data:             map[string]interface{}{"counts": data, "total": total},
+	}
+}
@@ -0,0 +1,68 @@
+package notify
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// tokenBucket paces the sends of a platform to a steady rate, letting bursts
+// of up to burst sends through right away. Sends beyond the rate wait for
+// their turn, up to queueSize waiting sends.
+type tokenBucket struct {
+	sync.Mutex
+	interval  time.Duration
+	burst     time.Duration
+	queueSize int
+	waiting   int
+	next      time.Time
+}
+
+func newTokenBucket(ratePerSecond int, burst int, queueSize int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	interval := time.Second / time.Duration(ratePerSecond)
+	return &tokenBucket{
+		interval:  interval,
+		burst:     time.Duration(burst-1) * interval,
+		queueSize: queueSize,
+	}
+}
+
+// wait blocks until the send can proceed at the bucket rate. It returns
+// ErrThrottled when too many sends are already waiting.
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.Lock()
+	now := time.Now()
+	// The unused sends of an idle bucket accumulate up to the burst.
+	if earliest := now.Add(-b.burst); b.next.Before(earliest) {
+		b.next = earliest
+	}
+	delay := b.next.Sub(now)
+	if delay > 0 && b.waiting >= b.queueSize {
+		b.Unlock()
+		return ErrThrottled
+	}
+	b.next = b.next.Add(b.interval)
+	if delay <= 0 {
+		b.Unlock()
+		return nil
+	}
+	b.waiting++
+	b.Unlock()
+
+	defer func() {
+		b.Lock()
+		b.waiting--
+		b.Unlock()
+	}()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
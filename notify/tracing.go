@@ -0,0 +1,18 @@
+package notify
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/breez/notify/notify")
+
+// endSpan ends the span, recording the failure reason of err if any.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, string(Reason(err)))
+	}
+	span.End()
+}
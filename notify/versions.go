@@ -0,0 +1,37 @@
+package notify
+
+import "errors"
+
+var (
+	ErrUnsupportedTemplateVersion = errors.New("unsupported template version")
+)
+
+// DataBuilder builds the data of a former version of a template from the data
+// of its current version.
+type DataBuilder func(data map[string]interface{}) map[string]interface{}
+
+// RegisterTemplateVersion registers the builder of the data of a former
+// version of the template, sent to the clients requesting that version. It
+// must be called before sending notifications.
+func (n *Notifier) RegisterTemplateVersion(template string, version int, builder DataBuilder) {
+	if n.templateVersions == nil {
+		n.templateVersions = make(map[string]map[int]DataBuilder)
+	}
+	if n.templateVersions[template] == nil {
+		n.templateVersions[template] = make(map[int]DataBuilder)
+	}
+	n.templateVersions[template][version] = builder
+}
+
+// versionBuilder returns the builder of the version of the notification, nil
+// for the current version.
+func (n *Notifier) versionBuilder(request *Notification) (DataBuilder, error) {
+	if request.TemplateVersion == 0 {
+		return nil, nil
+	}
+	builder, ok := n.templateVersions[request.Template][request.TemplateVersion]
+	if !ok {
+		return nil, ErrUnsupportedTemplateVersion
+	}
+	return builder, nil
+}